@@ -2,46 +2,97 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
-	"sync"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/artorias742/DTP/config"
+	"github.com/artorias742/DTP/consensus"
 	"github.com/artorias742/DTP/monitoring"
 	"github.com/artorias742/DTP/network"
+	"github.com/artorias742/DTP/security"
+	"github.com/artorias742/DTP/storage"
 	"github.com/artorias742/DTP/trading"
 	"github.com/google/uuid"
 )
 
 type Server struct {
-	peer   *network.Peer
-	mutex  sync.Mutex
-	orders chan *trading.Order // Channel to queue orders for processing
+	peer       *network.Peer
+	clusterKey string // admin requests carry it as a bearer token
 }
 
-func NewServer(peer *network.Peer) *Server {
+func NewServer(peer *network.Peer, clusterKey string) *Server {
 	return &Server{
-		peer:   peer,
-		orders: make(chan *trading.Order, 100), // Buffered channel for up to 100 orders
+		peer:       peer,
+		clusterKey: clusterKey,
 	}
 }
 
-// Start begins the HTTP server and order processing goroutine.
+// Start begins the HTTP server and the DAY order expiry goroutine.
 func (s *Server) Start() {
 	logger := monitoring.GetLogger()
 
-	// Start order processing in the background
-	go s.processOrders()
+	// Expire DAY orders in the background
+	go s.expireDayOrders()
 
-	// Define HTTP endpoints
-	http.HandleFunc("/order", s.handleOrder)
-	http.HandleFunc("/health", s.handleHealth)
+	if !s.adminEnabled() {
+		logger.Warn("No cluster key set, membership changes and leadership transfers are disabled")
+	}
 
 	// Start server on port :8083
 	logger.Info("Starting API server", "addr", ":8083")
-	if err := http.ListenAndServe(":8083", nil); err != nil {
+	if err := http.ListenAndServe(":8083", s.routes()); err != nil {
 		logger.Error("API server failed", "error", err)
 	}
 }
 
+// routes defines the HTTP endpoints.
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/order", s.handleOrder)
+	mux.HandleFunc("DELETE /order/{id}", s.handleCancel)
+	mux.HandleFunc("PATCH /order/{id}", s.handleAmend)
+	mux.HandleFunc("GET /book/{symbol}", s.handleBook)
+	mux.HandleFunc("GET /order/{id}", s.handleGetOrder)
+	mux.HandleFunc("GET /orders", s.handleListOrders)
+	mux.HandleFunc("GET /account/{owner}", s.handleGetAccount)
+	mux.HandleFunc("GET /trades", s.handleListTrades)
+	mux.HandleFunc("GET /cluster", s.handleCluster)
+	if s.adminEnabled() {
+		mux.HandleFunc("POST /cluster/members", s.admin(s.handleAddMember))
+		mux.HandleFunc("DELETE /cluster/members/{id}", s.admin(s.handleRemoveMember))
+		mux.HandleFunc("POST /cluster/leader", s.admin(s.handleTransferLeadership))
+	}
+	mux.HandleFunc("/health", s.handleHealth)
+	return mux
+}
+
+// adminEnabled reports whether the admin endpoints are served. The default
+// cluster key is public, so without a key of its own a node has none that
+// could keep them to the operators.
+func (s *Server) adminEnabled() bool {
+	return s.clusterKey != "" && s.clusterKey != config.DefaultClusterKey
+}
+
+// admin passes on only requests that carry the cluster key, the secret the
+// peers share, as a bearer token: changing the membership or the leader is
+// for the operators of the cluster, not for anyone who can place orders.
+func (s *Server) admin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !security.CheckKey(token, s.clusterKey) {
+			monitoring.GetLogger().Warn("Unauthorized admin request", "path", r.URL.Path, "remote", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
 // handleOrder handles POST requests to place a new order.
 func (s *Server) handleOrder(w http.ResponseWriter, r *http.Request) {
 	logger := monitoring.GetLogger()
@@ -52,9 +103,17 @@ func (s *Server) handleOrder(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Type     string  `json:"type"`
-		Price    float64 `json:"price"`
-		Quantity float64 `json:"quantity"`
+		Symbol      string          `json:"symbol"`
+		Type        string          `json:"type"`
+		Kind        string          `json:"kind"`          // LIMIT (default), MARKET, STOP or STOP_LIMIT
+		TimeInForce string          `json:"time_in_force"` // GTC (default), IOC, FOK or DAY; market and stop orders default to IOC
+		Price       trading.Decimal `json:"price"`
+		StopPrice   trading.Decimal `json:"stop_price"` // trigger for STOP and STOP_LIMIT orders
+		Quantity    trading.Decimal `json:"quantity"`
+		Display     trading.Decimal `json:"display_quantity"` // iceberg slice size; 0 shows the full quantity
+		Owner       string          `json:"owner"`            // account placing the order
+		SelfTrade   string          `json:"self_trade"`       // CANCEL_NEWEST (default), CANCEL_OLDEST, CANCEL_BOTH or DECREMENT
+		PostOnly    string          `json:"post_only"`        // REJECT or REPRICE; empty allows taking liquidity
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -69,18 +128,298 @@ func (s *Server) handleOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create and queue order
-	order := trading.NewOrder(uuid.New().String(), orderType, req.Price, req.Quantity)
-	s.orders <- order // Send to processing channel
+	// Validate symbol up front so unknown instruments are rejected before
+	// logging; the book itself is created when the order is applied
+	instrument, err := s.peer.Books.Instrument(req.Symbol)
+	if err != nil {
+		http.Error(w, "Invalid symbol", http.StatusBadRequest)
+		return
+	}
+
+	// Create and validate order
+	order := trading.NewOrder(uuid.New().String(), req.Symbol, orderType, req.Price, req.Quantity)
+	order.Kind = trading.OrderKind(req.Kind)
+	order.TimeInForce = trading.TimeInForce(req.TimeInForce)
+	order.StopPrice = req.StopPrice
+	order.DisplayQuantity = req.Display
+	order.Owner = req.Owner
+	order.SelfTrade = trading.SelfTradePrevention(req.SelfTrade)
+	order.PostOnly = trading.PostOnlyMode(req.PostOnly)
+	if err := order.Validate(); err != nil {
+		http.Error(w, "Invalid order: check kind, time_in_force, price, stop_price, quantity, display_quantity, self_trade and post_only", http.StatusBadRequest)
+		return
+	}
+	if err := instrument.Check(order); err != nil {
+		http.Error(w, "Invalid order: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Acknowledge only once the order is committed and has been matched
+	result, trades, err := s.peer.SubmitOrder(order)
+	if err != nil {
+		http.Error(w, "Failed to record order: "+err.Error(), proposalStatus(err))
+		logger.Error("Failed to submit order", "id", order.ID, "error", err)
+		return
+	}
 
 	logger.Info("Order received from user",
 		"id", order.ID,
+		"symbol", order.Symbol,
 		"type", order.Type,
+		"kind", order.Kind,
+		"timeInForce", order.TimeInForce,
 		"price", order.Price,
-		"quantity", order.Quantity)
+		"stopPrice", order.StopPrice,
+		"quantity", order.Quantity,
+		"displayQuantity", order.DisplayQuantity,
+		"owner", order.Owner,
+		"postOnly", order.PostOnly)
+	network.LogTrades(trades)
 
+	// Say where the order ended up: filled, resting, killed or rejected
 	w.WriteHeader(http.StatusAccepted)
-	json.NewEncoder(w).Encode(map[string]string{"order_id": order.ID})
+	json.NewEncoder(w).Encode(map[string]any{
+		"order_id":     order.ID,
+		"status":       result.Status,
+		"cum_quantity": result.CumQuantity,
+		"avg_price":    result.AvgPrice,
+	})
+}
+
+// handleCancel handles DELETE requests to pull a resting order from its book.
+func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request) {
+	logger := monitoring.GetLogger()
+
+	id := r.PathValue("id")
+	result, err := s.peer.CancelOrder(id)
+	if err != nil {
+		http.Error(w, "Failed to record cancel: "+err.Error(), proposalStatus(err))
+		logger.Error("Failed to cancel order", "id", id, "error", err)
+		return
+	}
+	logger.Info("Order cancel requested", "id", id, "result", result)
+
+	// Only a cancel that pulled the order succeeded; one that found it
+	// already closed conflicts with that
+	status := http.StatusConflict
+	switch result {
+	case trading.Canceled:
+		status = http.StatusOK
+	case trading.UnknownOrder:
+		status = http.StatusNotFound
+	}
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"order_id": id, "result": string(result)})
+}
+
+// handleAmend handles PATCH requests to change the price and/or remaining
+// quantity of a resting order. Omitted fields are left unchanged.
+func (s *Server) handleAmend(w http.ResponseWriter, r *http.Request) {
+	logger := monitoring.GetLogger()
+
+	var req struct {
+		Price    trading.Decimal `json:"price"`
+		Quantity trading.Decimal `json:"quantity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		logger.Error("Failed to decode amend request", "error", err)
+		return
+	}
+
+	id := r.PathValue("id")
+	result, trades, err := s.peer.AmendOrder(id, trading.Amendment{Price: req.Price, Quantity: req.Quantity})
+	if err != nil {
+		http.Error(w, "Failed to record amend: "+err.Error(), proposalStatus(err))
+		logger.Error("Failed to amend order", "id", id, "error", err)
+		return
+	}
+	logger.Info("Order amend requested",
+		"id", id,
+		"price", req.Price,
+		"quantity", req.Quantity,
+		"result", result)
+	network.LogTrades(trades)
+
+	status := http.StatusOK
+	switch result {
+	case trading.AmendRejected:
+		status = http.StatusBadRequest
+	case trading.AmendFilled, trading.AmendCanceled:
+		status = http.StatusConflict
+	case trading.AmendUnknown:
+		status = http.StatusNotFound
+	}
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"order_id": id, "result": string(result)})
+}
+
+// Reads take a consistency parameter: linearizable (the default), lease or
+// stale; see network.Consistency.
+
+// handleBook returns a market-data snapshot of a symbol's book. Iceberg orders
+// only contribute their displayed size.
+func (s *Server) handleBook(w http.ResponseWriter, r *http.Request) {
+	levels := 10
+	if v := r.URL.Query().Get("depth"); v != "" {
+		var err error
+		if levels, err = strconv.Atoi(v); err != nil || levels <= 0 {
+			http.Error(w, "Invalid depth", http.StatusBadRequest)
+			return
+		}
+	}
+	if !s.syncRead(w, r) {
+		return
+	}
+
+	// Only a committed order opens a book, never a read
+	book, err := s.peer.Books.Lookup(r.PathValue("symbol"))
+	if err != nil {
+		http.Error(w, "Unknown symbol", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(book.Depth(levels))
+}
+
+// handleGetOrder returns the stored state of an order: status, filled and
+// remaining quantity and average fill price.
+func (s *Server) handleGetOrder(w http.ResponseWriter, r *http.Request) {
+	if !s.syncRead(w, r) {
+		return
+	}
+	order, err := s.peer.Store.GetOrder(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Failed to read order", http.StatusInternalServerError)
+		return
+	}
+	if order == nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(order)
+}
+
+// handleListOrders lists stored orders filtered by status, symbol and side,
+// a page at a time. Pages are selected with offset and limit (default 50,
+// at most 500); next_offset is returned while more orders match.
+func (s *Server) handleListOrders(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := storage.OrderFilter{
+		Status: trading.OrderStatus(query.Get("status")),
+		Symbol: query.Get("symbol"),
+		Side:   trading.OrderType(query.Get("side")),
+	}
+
+	offset, limit := 0, 50
+	var err error
+	if v := query.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > 500 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	if !s.syncRead(w, r) {
+		return
+	}
+
+	orders, next, err := s.peer.Store.ListOrders(filter, offset, limit)
+	if err != nil {
+		http.Error(w, "Failed to list orders", http.StatusInternalServerError)
+		return
+	}
+	resp := map[string]any{"orders": orders}
+	if next >= 0 {
+		resp["next_offset"] = next
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleListTrades lists stored trades filtered by symbol, order ID and a
+// [from, to) time range given in RFC 3339, a page at a time. A page holds at
+// most limit trades (default 50, at most 500); next_cursor is returned while
+// more trades match and is passed back as cursor, with the same filters, to
+// get the following page. Cursors are opaque.
+func (s *Server) handleListTrades(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := storage.TradeFilter{
+		Symbol:  query.Get("symbol"),
+		OrderID: query.Get("order_id"),
+	}
+
+	var err error
+	if v := query.Get("from"); v != "" {
+		if filter.From, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Invalid from", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		if filter.To, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Invalid to", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 50
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > 500 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	if !s.syncRead(w, r) {
+		return
+	}
+
+	trades, next, err := s.peer.Store.ListTrades(filter, query.Get("cursor"), limit)
+	if errors.Is(err, storage.ErrBadCursor) {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to list trades", http.StatusInternalServerError)
+		return
+	}
+	resp := map[string]any{"trades": trades}
+	if next != "" {
+		resp["next_cursor"] = next
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleGetAccount returns the net position per symbol an owner holds as a
+// result of its fills.
+func (s *Server) handleGetAccount(w http.ResponseWriter, r *http.Request) {
+	if !s.syncRead(w, r) {
+		return
+	}
+	account, err := s.peer.Store.GetAccount(r.PathValue("owner"))
+	if err != nil {
+		http.Error(w, "Failed to read account", http.StatusInternalServerError)
+		return
+	}
+	if account == nil {
+		http.Error(w, "Account not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(account)
 }
 
 // handleHealth provides a simple health check endpoint.
@@ -89,38 +428,164 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
 }
 
-// processOrders processes orders from the channel and adds them to the order book.
-func (s *Server) processOrders() {
+// handleCluster reports this node's Raft state, which node leads and the
+// other members. Any node accepts orders; followers pass them to the leader.
+func (s *Server) handleCluster(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(s.peer.ClusterStatus())
+}
+
+// handleAddMember adds a node to the cluster, as a voter once it has caught
+// up with the log unless it is to stay a learner. Membership changes go to
+// the leader, which /cluster names.
+func (s *Server) handleAddMember(w http.ResponseWriter, r *http.Request) {
 	logger := monitoring.GetLogger()
-	for order := range s.orders {
-		// Add order to the order book
-		s.addOrder(order)
-
-		// Match orders after adding
-		trades := s.peer.OrderBook.MatchOrders()
-
-		logger.Info("Order processed", "id", order.ID)
-		for _, trade := range trades {
-			logger.Info("Trade executed",
-				"buyOrder", trade.BuyOrderID,
-				"sellOrder", trade.SellOrderID,
-				"price", trade.Price,
-				"quantity", trade.Quantity)
-		}
+
+	var req struct {
+		ID      string `json:"id"`
+		Addr    string `json:"addr"`    // where the other members reach it
+		Learner bool   `json:"learner"` // leave it a non-voting learner
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" || req.Addr == "" {
+		http.Error(w, "Invalid request body: id and addr are required", http.StatusBadRequest)
+		return
 	}
+
+	if err := s.peer.AddMember(req.ID, req.Addr, req.Learner); err != nil {
+		http.Error(w, "Failed to add member: "+err.Error(), membershipStatus(err))
+		logger.Error("Failed to add member", "id", req.ID, "addr", req.Addr, "error", err)
+		return
+	}
+	logger.Info("Member added", "id", req.ID, "addr", req.Addr, "learner", req.Learner)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(s.peer.ClusterStatus())
 }
 
-// addOrder adds an order to the peer's order book with proper synchronization.
-func (s *Server) addOrder(order *trading.Order) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+// handleRemoveMember removes a voter or learner from the cluster.
+func (s *Server) handleRemoveMember(w http.ResponseWriter, r *http.Request) {
+	logger := monitoring.GetLogger()
+
+	id := r.PathValue("id")
+	if err := s.peer.RemoveMember(id); err != nil {
+		http.Error(w, "Failed to remove member: "+err.Error(), membershipStatus(err))
+		logger.Error("Failed to remove member", "id", id, "error", err)
+		return
+	}
+	logger.Info("Member removed", "id", id)
 
-	// Directly call AddOrder from trading/book.go
-	s.peer.OrderBook.AddOrder(order)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(s.peer.ClusterStatus())
+}
+
+// handleTransferLeadership hands leadership to another voter, the one named
+// or else the most caught up, and answers once it leads; say before taking
+// the leader down for maintenance. Transfers go to the leader.
+func (s *Server) handleTransferLeadership(w http.ResponseWriter, r *http.Request) {
 	logger := monitoring.GetLogger()
-	logger.Debug("Order added to book",
-		"id", order.ID,
-		"type", order.Type,
-		"price", order.Price,
-		"quantity", order.Quantity)
+
+	var req struct {
+		ID string `json:"id"` // optional
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	leader, err := s.peer.TransferLeadership(req.ID)
+	if err != nil {
+		http.Error(w, "Failed to transfer leadership: "+err.Error(), transferStatus(err))
+		logger.Error("Failed to transfer leadership", "to", req.ID, "error", err)
+		return
+	}
+	logger.Info("Leadership transferred", "to", leader)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(s.peer.ClusterStatus())
+}
+
+// syncRead waits until the node can answer a read at the consistency the
+// request asks for, and writes the error response if it cannot.
+func (s *Server) syncRead(w http.ResponseWriter, r *http.Request) bool {
+	consistency, err := network.ParseConsistency(r.URL.Query().Get("consistency"))
+	if err != nil {
+		http.Error(w, "Invalid consistency: use linearizable, lease or stale", http.StatusBadRequest)
+		return false
+	}
+	if err := s.peer.SyncRead(r.Context(), consistency); err != nil {
+		http.Error(w, "Failed to confirm read: "+err.Error(), proposalStatus(err))
+		return false
+	}
+	return true
+}
+
+// expireRetry is how long expireDayOrders waits before trying again.
+const expireRetry = time.Second
+
+// expireDayOrders expires resting DAY orders at every UTC midnight. Every node
+// tries until the expiry is applied, so it happens even if there was no
+// leader at midnight or the leader's proposal did not commit in time.
+func (s *Server) expireDayOrders() {
+	logger := monitoring.GetLogger()
+	for {
+		now := time.Now().UTC()
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		time.Sleep(time.Until(midnight))
+
+		for !s.peer.DayOrdersExpired(midnight) {
+			expired, err := s.peer.ExpireDayOrders(midnight)
+			switch {
+			case err == nil:
+				logger.Info("DAY orders expired", "count", len(expired))
+			case errors.Is(err, consensus.ErrNotLeader):
+				// The leader expires them on every node; wait for it
+			default:
+				logger.Warn("Failed to expire DAY orders, retrying", "error", err)
+			}
+			if !s.peer.DayOrdersExpired(midnight) {
+				time.Sleep(expireRetry)
+			}
+		}
+	}
+}
+
+// proposalStatus is the HTTP status for a request that could not be
+// committed, or a read that could not be confirmed: without a leader, or
+// while the leader hands over leadership, no node can take it, and one that
+// timed out cannot say whether it will still commit.
+func proposalStatus(err error) int {
+	switch {
+	case errors.Is(err, consensus.ErrNotLeader), errors.Is(err, network.ErrNoLeader),
+		errors.Is(err, consensus.ErrTransferInProgress):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, network.ErrProposalTimeout), errors.Is(err, network.ErrReadTimeout):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// membershipStatus is the HTTP status for a membership change that failed:
+// one that conflicts with the membership or with a change in progress, or
+// one that could not be committed.
+func membershipStatus(err error) int {
+	switch {
+	case errors.Is(err, consensus.ErrInvalidConfChange), errors.Is(err, consensus.ErrConfChangePending):
+		return http.StatusConflict
+	case errors.Is(err, network.ErrCatchUpTimeout):
+		return http.StatusGatewayTimeout
+	}
+	return proposalStatus(err)
+}
+
+// transferStatus is the HTTP status for a leadership transfer that failed: one
+// to a node that cannot lead or made during another transfer, or one that did
+// not go through.
+func transferStatus(err error) int {
+	switch {
+	case errors.Is(err, consensus.ErrInvalidTransfer), errors.Is(err, consensus.ErrTransferInProgress):
+		return http.StatusConflict
+	case errors.Is(err, network.ErrTransferFailed):
+		return http.StatusGatewayTimeout
+	}
+	return proposalStatus(err)
 }
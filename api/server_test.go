@@ -0,0 +1,181 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artorias742/DTP/config"
+	"github.com/artorias742/DTP/consensus"
+	"github.com/artorias742/DTP/monitoring"
+	"github.com/artorias742/DTP/network"
+	"github.com/artorias742/DTP/trading"
+)
+
+func TestMain(m *testing.M) {
+	monitoring.InitLogging()
+	os.Exit(m.Run())
+}
+
+// newTestServer starts a single-node peer, stopped when the test ends, and
+// returns the API's handler for it once the peer leads.
+func newTestServer(t *testing.T) (*network.Peer, http.Handler) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	peer, err := network.NewPeer(&config.Config{
+		PeerID: "n1", ListenAddr: addr, DataDir: t.TempDir(), Storage: "memory", RaftSync: "never", ClusterKey: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := peer.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for peer.ClusterStatus().State != consensus.Leader {
+		if time.Now().After(deadline) {
+			t.Fatal("no leader elected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return peer, NewServer(peer, "test").routes()
+}
+
+// serve sends a request to the handler and decodes the JSON answer into resp.
+func serve(t *testing.T, h http.Handler, method, path, body string, resp any) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if resp != nil {
+		if err := json.NewDecoder(rec.Body).Decode(resp); err != nil {
+			t.Fatalf("%s %s answered %d: %v", method, path, rec.Code, err)
+		}
+	}
+	return rec.Code
+}
+
+type orderResponse struct {
+	OrderID     string              `json:"order_id"`
+	Status      trading.OrderStatus `json:"status"`
+	CumQuantity trading.Decimal     `json:"cum_quantity"`
+	AvgPrice    trading.Decimal     `json:"avg_price"`
+}
+
+// submit places an order and returns the answer.
+func submit(t *testing.T, h http.Handler, body string) orderResponse {
+	t.Helper()
+	var resp orderResponse
+	if code := serve(t, h, http.MethodPost, "/order", body, &resp); code != http.StatusAccepted {
+		t.Fatalf("order %s answered %d", body, code)
+	}
+	return resp
+}
+
+func TestHandleOrderReportsOutcome(t *testing.T) {
+	_, h := newTestServer(t)
+
+	sell := submit(t, h, `{"symbol":"BTC","type":"SELL","price":100,"quantity":5}`)
+	if sell.Status != trading.StatusNew || sell.CumQuantity != 0 {
+		t.Fatalf("resting order answered %+v", sell)
+	}
+	buy := submit(t, h, `{"symbol":"BTC","type":"BUY","price":100,"quantity":2}`)
+	if buy.Status != trading.StatusFilled || buy.CumQuantity != trading.DecimalFromInt(2) || buy.AvgPrice != trading.DecimalFromInt(100) {
+		t.Fatalf("filled order answered %+v", buy)
+	}
+	kill := submit(t, h, `{"symbol":"BTC","type":"BUY","price":100,"quantity":4,"time_in_force":"FOK"}`)
+	if kill.Status != trading.StatusCanceled || kill.CumQuantity != 0 {
+		t.Fatalf("killed fill-or-kill order answered %+v", kill)
+	}
+	ioc := submit(t, h, `{"symbol":"BTC","type":"BUY","price":100,"quantity":4,"time_in_force":"IOC"}`)
+	if ioc.Status != trading.StatusCanceled || ioc.CumQuantity != trading.DecimalFromInt(3) {
+		t.Fatalf("partly filled immediate-or-cancel order answered %+v", ioc)
+	}
+}
+
+func TestHandleCancelStatuses(t *testing.T) {
+	peer, h := newTestServer(t)
+
+	resting := submit(t, h, `{"symbol":"BTC","type":"BUY","price":90,"quantity":1}`)
+	filled := submit(t, h, `{"symbol":"BTC","type":"SELL","price":100,"quantity":1}`)
+	submit(t, h, `{"symbol":"BTC","type":"BUY","price":100,"quantity":1}`)
+	submit(t, h, `{"symbol":"BTC","type":"SELL","price":110,"quantity":1}`)
+	rejected := submit(t, h, `{"symbol":"BTC","type":"BUY","price":110,"quantity":1,"post_only":"REJECT"}`)
+	if rejected.Status != trading.StatusRejected {
+		t.Fatalf("crossing post-only order answered %+v", rejected)
+	}
+	day := submit(t, h, `{"symbol":"BTC","type":"BUY","price":80,"quantity":1,"time_in_force":"DAY"}`)
+	if _, err := peer.ExpireDayOrders(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		id     string
+		code   int
+		result trading.CancelResult
+	}{
+		{resting.OrderID, http.StatusOK, trading.Canceled},
+		{resting.OrderID, http.StatusConflict, trading.AlreadyCanceled},
+		{filled.OrderID, http.StatusConflict, trading.AlreadyFilled},
+		{rejected.OrderID, http.StatusConflict, trading.Rejected},
+		{day.OrderID, http.StatusConflict, trading.Expired},
+		{"missing", http.StatusNotFound, trading.UnknownOrder},
+	} {
+		var resp struct {
+			Result trading.CancelResult `json:"result"`
+		}
+		if code := serve(t, h, http.MethodDelete, "/order/"+tc.id, "", &resp); code != tc.code || resp.Result != tc.result {
+			t.Errorf("cancel of %s answered %d %s, want %d %s", tc.id, code, resp.Result, tc.code, tc.result)
+		}
+	}
+}
+
+func TestAdminRoutesNeedClusterKey(t *testing.T) {
+	_, h := newTestServer(t)
+
+	for _, auth := range []string{"", "test", "Bearer wrong", "Bearer test"} {
+		for _, route := range []struct{ method, path, body string }{
+			{http.MethodPost, "/cluster/members", `{"id":"n2","addr":"127.0.0.1:1","learner":true}`},
+			{http.MethodDelete, "/cluster/members/n2", ""},
+			{http.MethodPost, "/cluster/leader", `{"id":"n2"}`},
+		} {
+			req := httptest.NewRequest(route.method, route.path, strings.NewReader(route.body))
+			if auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if unauthorized := rec.Code == http.StatusUnauthorized; unauthorized != (auth != "Bearer test") {
+				t.Errorf("%s %s with authorization %q answered %d", route.method, route.path, auth, rec.Code)
+			}
+		}
+	}
+}
+
+func TestAdminRoutesOffWithoutClusterKey(t *testing.T) {
+	for _, key := range []string{"", config.DefaultClusterKey} {
+		h := NewServer(nil, key).routes()
+		req := httptest.NewRequest(http.MethodPost, "/cluster/members", strings.NewReader(`{"id":"n2","addr":"127.0.0.1:1"}`))
+		req.Header.Set("Authorization", "Bearer "+key)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("membership change with cluster key %q answered %d", key, rec.Code)
+		}
+	}
+}
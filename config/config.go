@@ -1,14 +1,36 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// DefaultClusterKey is the cluster key of nodes started without CLUSTER_KEY.
+// It is public, so it only suits a trial cluster on one machine.
+const DefaultClusterKey = "32-byte-secret-key-here!!"
+
 type Config struct {
 	PeerID     string
 	ListenAddr string
 	SeedNodes  []string
+	Symbols    []string // instrument specs SYMBOL[:TICK[:LOT]] to open books for; empty means create on demand
+	DataDir    string   // directory holding the write-ahead log, snapshots and the disk store
+	Storage    string   // order store backend: "memory" or "disk"
+
+	SnapshotInterval time.Duration // how often to snapshot the books; 0 disables timed snapshots
+	SnapshotEvery    int           // snapshot after this many logged requests; 0 disables
+
+	RaftPeers      map[string]string // the other Raft members, peer ID to address; empty runs a single-node cluster
+	RaftJoin       bool              // join the cluster in RaftPeers as a learner instead of founding it
+	ClusterKey     string            // shared secret peer messages are encrypted with
+	RaftLogEntries int               // applied Raft entries kept for lagging followers before compaction; behind that they get a snapshot
+
+	RaftSync         string        // when the Raft log is synced to disk: "always", "periodic" or "never"
+	RaftSyncInterval time.Duration // how often the "periodic" policy syncs
 }
 
 func LoadConfig() (*Config, error) {
@@ -30,9 +52,106 @@ func LoadConfig() (*Config, error) {
 		seedNodes = strings.Split(seeds, ",")
 	}
 
+	raftPeers := map[string]string{}
+
+	if list := os.Getenv("RAFT_PEERS"); list != "" {
+		for _, spec := range strings.Split(list, ",") {
+			id, addr, ok := strings.Cut(spec, "=")
+			if !ok || id == "" || addr == "" {
+				return nil, fmt.Errorf("invalid RAFT_PEERS entry %q, want ID=ADDR", spec)
+			}
+			raftPeers[id] = addr
+		}
+	}
+
+	raftJoin := false
+	if v := os.Getenv("RAFT_JOIN"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, err
+		}
+		raftJoin = b
+	}
+
+	clusterKey := os.Getenv("CLUSTER_KEY")
+	if clusterKey == "" {
+		clusterKey = DefaultClusterKey
+	}
+
+	symbols := []string{}
+
+	if list := os.Getenv("SYMBOLS"); list != "" {
+		symbols = strings.Split(list, ",")
+	}
+
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = filepath.Join("data", peerID)
+	}
+
+	snapshotInterval := 5 * time.Minute
+	if v := os.Getenv("SNAPSHOT_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		snapshotInterval = d
+	}
+
+	snapshotEvery := 10000
+	if v := os.Getenv("SNAPSHOT_EVERY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		snapshotEvery = n
+	}
+
+	raftLogEntries := 10000
+	if v := os.Getenv("RAFT_LOG_ENTRIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		raftLogEntries = n
+	}
+
+	raftSync := os.Getenv("RAFT_SYNC")
+	if raftSync == "" {
+		raftSync = "always"
+	}
+
+	raftSyncInterval := 10 * time.Millisecond
+	if v := os.Getenv("RAFT_SYNC_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		raftSyncInterval = d
+	}
+
+	storage := os.Getenv("STORAGE_BACKEND")
+	if storage == "" {
+		storage = "memory"
+	}
+
 	return &Config{
 		PeerID:     peerID,
 		ListenAddr: listenAddr,
 		SeedNodes:  seedNodes,
+		Symbols:    symbols,
+		DataDir:    dataDir,
+		Storage:    storage,
+
+		SnapshotInterval: snapshotInterval,
+		SnapshotEvery:    snapshotEvery,
+
+		RaftPeers:      raftPeers,
+		RaftJoin:       raftJoin,
+		ClusterKey:     clusterKey,
+		RaftLogEntries: raftLogEntries,
+
+		RaftSync:         raftSync,
+		RaftSyncInterval: raftSyncInterval,
 	}, nil
 }
@@ -0,0 +1,218 @@
+package consensus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/artorias742/DTP/monitoring"
+)
+
+var (
+	// ErrConfChangePending is returned for a membership change proposed
+	// while an earlier one is uncommitted, or before the leader has
+	// committed an entry of its own term.
+	ErrConfChangePending = errors.New("a membership change is in progress")
+
+	// ErrInvalidConfChange is returned for a change that does not fit the
+	// current membership, such as promoting a node that is not a learner.
+	ErrInvalidConfChange = errors.New("invalid membership change")
+)
+
+// ConfState is the membership of a cluster. Voters elect the leader and make
+// up the quorums that commit entries; learners are sent the log like
+// everyone else but count for neither.
+type ConfState struct {
+	Voters   []string `json:"voters"`
+	Learners []string `json:"learners,omitempty"`
+}
+
+// ConfChangeType is the kind of a membership change.
+type ConfChangeType int
+
+const (
+	ConfAddLearner ConfChangeType = iota // add a node that is sent the log but does not vote
+	ConfPromote                          // make a learner a voter
+	ConfRemove                           // remove a voter or learner
+)
+
+func (t ConfChangeType) String() string {
+	switch t {
+	case ConfAddLearner:
+		return "AddLearner"
+	case ConfPromote:
+		return "Promote"
+	case ConfRemove:
+		return "Remove"
+	}
+	return "Unknown"
+}
+
+// ConfChange is the data of an EntryConfChange entry. Changes go one node at
+// a time, so any majority of the old voters overlaps any majority of the new
+// ones and no two leaders can be elected in the same term.
+type ConfChange struct {
+	Type    ConfChangeType `json:"type"`
+	Node    string         `json:"node"`
+	Context []byte         `json:"context,omitempty"` // handed to the state machine as is, e.g. the node's address
+	Conf    ConfState      `json:"conf"`              // the membership the change results in; filled in by ProposeConfChange
+}
+
+// apply returns the membership after a change, or ErrInvalidConfChange if the
+// change does not fit.
+func (c ConfState) apply(cc ConfChange) (ConfState, error) {
+	isVoter, isLearner := contains(c.Voters, cc.Node), contains(c.Learners, cc.Node)
+	next := ConfState{Voters: append([]string(nil), c.Voters...), Learners: append([]string(nil), c.Learners...)}
+	switch cc.Type {
+	case ConfAddLearner:
+		if isVoter || isLearner {
+			return ConfState{}, fmt.Errorf("%w: %s is already a member", ErrInvalidConfChange, cc.Node)
+		}
+		next.Learners = append(next.Learners, cc.Node)
+	case ConfPromote:
+		if !isLearner {
+			return ConfState{}, fmt.Errorf("%w: %s is not a learner", ErrInvalidConfChange, cc.Node)
+		}
+		next.Learners = without(next.Learners, cc.Node)
+		next.Voters = append(next.Voters, cc.Node)
+	case ConfRemove:
+		if !isVoter && !isLearner {
+			return ConfState{}, fmt.Errorf("%w: %s is not a member", ErrInvalidConfChange, cc.Node)
+		}
+		if isVoter && len(c.Voters) == 1 {
+			return ConfState{}, fmt.Errorf("%w: %s is the last voter", ErrInvalidConfChange, cc.Node)
+		}
+		next.Voters = without(next.Voters, cc.Node)
+		next.Learners = without(next.Learners, cc.Node)
+	default:
+		return ConfState{}, fmt.Errorf("%w: unknown type %d", ErrInvalidConfChange, cc.Type)
+	}
+	sort.Strings(next.Voters)
+	sort.Strings(next.Learners)
+	return next, nil
+}
+
+func contains(ids []string, id string) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
+
+func without(ids []string, id string) []string {
+	kept := ids[:0]
+	for _, other := range ids {
+		if other != id {
+			kept = append(kept, other)
+		}
+	}
+	return kept
+}
+
+// ProposeConfChange appends a membership change to the log if the node
+// leads. The change takes effect on each node as soon as it is in its log,
+// not when it commits, and only one may be uncommitted at a time. Like
+// Propose, it returns before the change commits; the state machine is handed
+// the entry once it does.
+func (r *Raft) ProposeConfChange(cc ConfChange) error {
+	r.mutex.Lock()
+	if r.state != Leader {
+		r.mutex.Unlock()
+		return ErrNotLeader
+	}
+	if r.transferee != "" {
+		r.mutex.Unlock()
+		return ErrTransferInProgress
+	}
+	// Until the leader commits an entry of its term, it may not know of a
+	// change an earlier leader left uncommitted
+	if r.pendingConf > r.commitIndex || r.termAt(r.commitIndex) != r.term {
+		r.mutex.Unlock()
+		return ErrConfChangePending
+	}
+	conf, err := r.conf.apply(cc)
+	if err != nil {
+		r.mutex.Unlock()
+		return err
+	}
+	cc.Conf = conf
+	data, err := json.Marshal(cc)
+	if err != nil {
+		r.mutex.Unlock()
+		return err
+	}
+
+	index := r.lastIndex() + 1
+	r.log = append(r.log, Entry{Index: index, Term: r.term, Type: EntryConfChange, Data: data})
+	r.pendingConf = index
+	r.setConf(conf)
+	monitoring.GetLogger().Info("Membership change proposed", "id", r.id, "change", cc.Type, "node", cc.Node, "index", index)
+
+	r.maybeCommit()
+	r.broadcastAppend()
+	r.flush()
+	r.applyCommitted()
+	return nil
+}
+
+// setConf makes conf the node's membership. A leader starts replicating to
+// nodes that joined and forgets the ones that left.
+func (r *Raft) setConf(conf ConfState) {
+	r.conf = conf
+	r.voters = make(map[string]bool, len(conf.Voters))
+	r.peers = r.peers[:0]
+	for _, id := range conf.Voters {
+		r.voters[id] = true
+		if id != r.id {
+			r.peers = append(r.peers, id)
+		}
+	}
+	for _, id := range conf.Learners {
+		if id != r.id {
+			r.peers = append(r.peers, id)
+		}
+	}
+	sort.Strings(r.peers)
+
+	if r.state != Leader {
+		return
+	}
+	members := make(map[string]bool, len(r.peers))
+	for _, peer := range r.peers {
+		members[peer] = true
+		if _, ok := r.nextIndex[peer]; !ok {
+			r.nextIndex[peer] = r.lastIndex() + 1
+			r.matchIndex[peer] = 0
+		}
+	}
+	for peer := range r.nextIndex {
+		if !members[peer] {
+			delete(r.nextIndex, peer)
+			delete(r.matchIndex, peer)
+			delete(r.sending, peer)
+		}
+	}
+}
+
+// confAt returns the membership as of the entry at index, which must be in
+// the log, and the index of the change that set it, or 0 if that change was
+// compacted away.
+func (r *Raft) confAt(index uint64) (ConfState, uint64) {
+	first := r.log[0].Index
+	for i := index; i > first; i-- {
+		entry := r.log[i-first]
+		if entry.Type != EntryConfChange {
+			continue
+		}
+		var cc ConfChange
+		if err := json.Unmarshal(entry.Data, &cc); err != nil {
+			monitoring.GetLogger().Error("Failed to decode membership change", "id", r.id, "index", i, "error", err)
+			continue
+		}
+		return cc.Conf, i
+	}
+	return r.confBase, 0
+}
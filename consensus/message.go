@@ -0,0 +1,124 @@
+package consensus
+
+// MessageType identifies a Raft RPC. Requests and their responses are sent as
+// separate one-way messages, so a transport only has to deliver messages, not
+// match replies to calls.
+type MessageType int
+
+const (
+	MsgVote              MessageType = iota // RequestVote
+	MsgVoteResponse                         // reply to RequestVote
+	MsgAppend                               // AppendEntries, also sent empty as a heartbeat
+	MsgAppendResponse                       // reply to AppendEntries
+	MsgSnapshot                             // InstallSnapshot, one chunk at a time
+	MsgSnapshotResponse                     // acknowledges a snapshot chunk
+	MsgReadIndex                            // a follower asks the leader for a read index
+	MsgReadIndexResponse                    // reply to MsgReadIndex
+	MsgPreVote                              // asks whether the node would get a vote, without an election
+	MsgPreVoteResponse                      // reply to MsgPreVote
+	MsgTimeoutNow                           // the leader tells a follower to start an election now
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MsgVote:
+		return "RequestVote"
+	case MsgVoteResponse:
+		return "RequestVoteResponse"
+	case MsgAppend:
+		return "AppendEntries"
+	case MsgAppendResponse:
+		return "AppendEntriesResponse"
+	case MsgSnapshot:
+		return "InstallSnapshot"
+	case MsgSnapshotResponse:
+		return "InstallSnapshotResponse"
+	case MsgReadIndex:
+		return "ReadIndex"
+	case MsgReadIndexResponse:
+		return "ReadIndexResponse"
+	case MsgPreVote:
+		return "PreVote"
+	case MsgPreVoteResponse:
+		return "PreVoteResponse"
+	case MsgTimeoutNow:
+		return "TimeoutNow"
+	}
+	return "Unknown"
+}
+
+// Message is a Raft RPC between two nodes. Which fields are set depends on
+// the type:
+//
+//	MsgVote              Index and LogTerm are the candidate's last log entry;
+//	                     Transfer marks a campaign the leader asked for
+//	MsgVoteResponse      Reject is set if the vote was refused
+//	MsgPreVote           like MsgVote, but Term is the term the candidate would
+//	                     campaign in and granting it records nothing
+//	MsgPreVoteResponse   Term is the pre-vote's if granted; on Reject it is the
+//	                     voter's own
+//	MsgAppend            Index and LogTerm are the entry before Entries, Commit
+//	                     is the leader's commit index and Read its latest
+//	                     heartbeat round
+//	MsgAppendResponse    Index is the last entry now matching the leader's log;
+//	                     on Reject it is the Index that did not match and Hint
+//	                     is the follower's last index. Read echoes the round
+//	MsgSnapshot          Index and LogTerm are the last entry the snapshot
+//	                     covers, Data is the chunk at Offset and Done marks the
+//	                     last chunk, which also carries the membership in Conf
+//	MsgSnapshotResponse  Index is the snapshot's and Hint is the offset of the
+//	                     next chunk wanted; Reject means a chunk was out of order
+//	MsgReadIndex         Read is the follower's ID for the read
+//	MsgReadIndexResponse Index is the read index for the read with ID Read;
+//	                     Reject means the node asked does not lead
+//	MsgTimeoutNow        sent to a follower whose log matches the leader's to
+//	                     hand it leadership
+//
+// A follower that installed a whole snapshot answers with a MsgAppendResponse
+// for the snapshot's last entry.
+type Message struct {
+	Type    MessageType `json:"type"`
+	From    string      `json:"from"`
+	To      string      `json:"to"`
+	Term    uint64      `json:"term"`
+	Index   uint64      `json:"index"`
+	LogTerm uint64      `json:"log_term"`
+	Entries []Entry     `json:"entries,omitempty"`
+	Commit  uint64      `json:"commit"`
+	Reject  bool        `json:"reject"`
+	Hint    uint64      `json:"hint"`
+	Offset  uint64      `json:"offset,omitempty"`
+	Data    []byte      `json:"data,omitempty"`
+	Done    bool        `json:"done,omitempty"`
+	Conf    *ConfState  `json:"conf,omitempty"`
+	Read    uint64      `json:"read,omitempty"`
+
+	Transfer bool `json:"transfer,omitempty"`
+}
+
+// EntryType tells entries for the state machine from those Raft acts on too.
+type EntryType int
+
+const (
+	EntryNormal     EntryType = iota // data for the state machine
+	EntryConfChange                  // a ConfChange encoded as JSON
+)
+
+// Entry is a record in the replicated log. An entry without data is the
+// no-op a new leader appends to commit the entries of earlier terms.
+type Entry struct {
+	Index uint64    `json:"index"`
+	Term  uint64    `json:"term"`
+	Type  EntryType `json:"type,omitempty"`
+	Data  []byte    `json:"data,omitempty"`
+}
+
+// Snapshot is the state machine's state as of the entry at Index, which has
+// term Term. It stands in for every entry up to Index once the log is
+// compacted.
+type Snapshot struct {
+	Index uint64
+	Term  uint64
+	Conf  ConfState // membership as of Index
+	Data  []byte
+}
@@ -1,172 +1,1020 @@
 package consensus
 
 import (
+	"errors"
+	"hash/fnv"
 	"math/rand"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/artorias742/DTP/monitoring"
 )
 
+// ErrNotLeader is returned for proposals made to a node that does not lead.
+var ErrNotLeader = errors.New("not the leader")
+
+// StateMachine is what the replicated log drives. Apply is called once for
+// every committed entry, in log order, on every node; entries without data
+// are the no-ops leaders append and can be skipped, and EntryConfChange
+// entries are membership changes Raft has already acted on. The log is compacted
+// behind applied entries, so Apply must make an entry durable before it
+// returns.
+//
+// Snapshot encodes the state as of the last entry applied, for followers too
+// far behind to catch up from the log, and Restore replaces the state with
+// such a snapshot. Neither runs concurrently with Apply.
+type StateMachine interface {
+	Apply(entry Entry)
+	Snapshot() ([]byte, error)
+	Restore(snap Snapshot) error
+}
+
+type State string
+
+const (
+	Follower     State = "follower"
+	PreCandidate State = "pre-candidate"
+	Candidate    State = "candidate"
+	Leader       State = "leader"
+)
+
+// Config holds the settings of a Raft node. Timeouts are counted in ticks of
+// TickInterval; zero values take the defaults below.
+type Config struct {
+	ID        string
+	Storage   Storage
+	Transport Transport
+
+	StateMachine StateMachine
+	Applied      uint64 // last entry the state machine already has, from its own snapshot
+	AppliedTerm  uint64 // term of that entry
+
+	// The membership as of Applied: the cluster's first members, or the
+	// latest membership change the state machine was handed. A node joining
+	// a cluster lists itself as a learner.
+	Voters   []string
+	Learners []string
+
+	TickInterval   time.Duration // default 10ms
+	ElectionTicks  int           // minimum election timeout, randomized up to twice this; default 15
+	HeartbeatTicks int           // default 5
+	Seed           int64         // seeds the election timeouts; 0 derives a seed from the clock and ID
+
+	LogEntries        int // applied entries kept for followers that lag; the log is compacted at twice this; default 10000
+	SnapshotChunkSize int // bytes of snapshot per InstallSnapshot message; default 1MB
+}
+
+// Raft is a node of a Raft cluster. It is driven by Tick, which advances its
+// timers, and Step, which hands it a message from another node; both run to
+// completion under the mutex and send the messages they produce after
+// releasing it.
 type Raft struct {
 	mutex     sync.Mutex
-	state     string // "follower", "candidate", " leader"
-	term      int
-	peers     []string
-	lastHeart time.Time
-	peerID    string
-	votes     int
+	id        string
+	storage   Storage
+	transport Transport
+
+	state    State
+	term     uint64
+	votedFor string
+	leader   string
+	saved    HardState // hard state last written to storage
+
+	conf        ConfState       // membership as of the last entry in the log
+	confBase    ConfState       // membership as of log[0]
+	voters      map[string]bool // the voters in conf
+	peers       []string        // the other voters and learners, whom a leader replicates to
+	pendingConf uint64          // index of the last membership change in the log, 0 if compacted
+
+	log          []Entry // log[0] holds the index and term of the entry before the first one
+	stable       uint64  // last entry written to storage
+	resetLog     bool    // a snapshot replaced the log, which storage has yet to drop
+	commitIndex  uint64
+	applied      uint64 // last entry handed to the state machine
+	stateMachine StateMachine
+	applyMutex   sync.Mutex // serializes applyCommitted
+
+	votes      map[string]bool   // votes received while a candidate
+	nextIndex  map[string]uint64 // leader only: next entry to send to each peer
+	matchIndex map[string]uint64 // leader only: highest entry known to match on each peer
+	active     map[string]bool   // leader only: peers heard from this election timeout
+
+	transferee      string // leader only: voter leadership is being handed to
+	transferElapsed int    // leader only: ticks since the transfer started
+
+	round           uint64                    // leader only: heartbeat rounds sent
+	roundTicks      map[uint64]int            // leader only: when each round not yet answered by a quorum was sent
+	acked           map[string]uint64         // leader only: latest round each peer answered
+	leaseUntil      int                       // leader only: tick at which the lease runs out
+	leaseFrom       int                       // leader only: rounds sent before this tick do not extend the lease
+	pendingReads    []*readRequest            // leader only: reads waiting for a round to be answered
+	readID          uint64                    // last ID given to a read sent to the leader
+	reads           map[uint64]chan readState // reads sent to the leader, by ID
+	appliedAdvanced chan struct{}             // closed when applied advances
+
+	snapshot     *Snapshot            // leader only: latest snapshot for followers behind the log
+	wantSnapshot bool                 // leader only: a follower needs a newer snapshot than that
+	sending      map[string]*transfer // leader only: snapshots being sent, by peer
+	receiving    *Snapshot            // a snapshot arriving in chunks
+	restore      *Snapshot            // a received snapshot the state machine has yet to restore
+	restoreFrom  string               // the leader that sent it, which is told once it is restored
+	logEntries   int
+	chunkSize    int
+
+	tickInterval     time.Duration
+	electionTicks    int
+	heartbeatTicks   int
+	electionTimeout  int // randomized in [electionTicks, 2*electionTicks)
+	electionElapsed  int
+	heartbeatElapsed int
+	ticks            int // ticks since the node started
+	rand             *rand.Rand
+
+	outbox []Message
+	stop   chan struct{}
 }
 
-func NewRaft(peerID string, peers []string) *Raft {
-	return &Raft{
-		state:     "follower",
-		term:      0,
-		peers:     peers,
-		lastHeart: time.Now(),
-		peerID:    peerID,
-		votes:     0,
-	}
+// transfer tracks a snapshot on its way to a follower.
+type transfer struct {
+	index  uint64 // last entry of the snapshot
+	offset uint64 // next chunk to send
 }
 
-func (r *Raft) Start() {
-	go r.run()
+func NewRaft(cfg Config) (*Raft, error) {
+	if cfg.LogEntries <= 0 {
+		cfg.LogEntries = 10000
+	}
+	if cfg.SnapshotChunkSize <= 0 {
+		cfg.SnapshotChunkSize = 1 << 20
+	}
+	if cfg.TickInterval <= 0 {
+		cfg.TickInterval = 10 * time.Millisecond
+	}
+	if cfg.ElectionTicks <= 0 {
+		cfg.ElectionTicks = 15
+	}
+	if cfg.HeartbeatTicks <= 0 {
+		cfg.HeartbeatTicks = 5
+	}
+	if cfg.Seed == 0 {
+		h := fnv.New64a()
+		h.Write([]byte(cfg.ID))
+		cfg.Seed = time.Now().UnixNano() ^ int64(h.Sum64())
+	}
+
+	hs, err := cfg.Storage.HardState()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := cfg.Storage.Entries(cfg.Applied)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Raft{
+		id:             cfg.ID,
+		storage:        cfg.Storage,
+		transport:      cfg.Transport,
+		state:          Follower,
+		term:           hs.Term,
+		votedFor:       hs.VotedFor,
+		saved:          hs,
+		log:            []Entry{{Index: cfg.Applied, Term: cfg.AppliedTerm}},
+		commitIndex:    cfg.Applied,
+		applied:        cfg.Applied,
+		stateMachine:   cfg.StateMachine,
+		tickInterval:   cfg.TickInterval,
+		electionTicks:  cfg.ElectionTicks,
+		heartbeatTicks: cfg.HeartbeatTicks,
+		rand:           rand.New(rand.NewSource(cfg.Seed)),
+		logEntries:     cfg.LogEntries,
+		chunkSize:      cfg.SnapshotChunkSize,
+
+		reads:           make(map[uint64]chan readState),
+		appliedAdvanced: make(chan struct{}),
+	}
+	r.confBase = ConfState{Voters: append([]string(nil), cfg.Voters...), Learners: append([]string(nil), cfg.Learners...)}
+	sort.Strings(r.confBase.Voters)
+	sort.Strings(r.confBase.Learners)
+
+	// Entries stored past the state machine were acknowledged before a
+	// restart, and with them any membership change they made
+	r.log = append(r.log, entries...)
+	r.stable = r.lastIndex()
+	var conf ConfState
+	conf, r.pendingConf = r.confAt(r.lastIndex())
+	r.setConf(conf)
+	if len(entries) > 0 {
+		monitoring.GetLogger().Info("Raft log loaded", "id", cfg.ID, "applied", cfg.Applied, "last", r.lastIndex())
+	}
+	r.resetElectionTimer()
+	return r, nil
 }
 
-func (r *Raft) run() {
-	logger := monitoring.GetLogger()
-	rand.Seed(time.Now().UnixNano())
+// Start drives the node from a ticker until Stop is called.
+func (r *Raft) Start() {
+	r.mutex.Lock()
+	r.stop = make(chan struct{})
+	stop := r.stop
+	r.mutex.Unlock()
 
-	for {
-		r.mutex.Lock()
-		currentState := r.state
-		r.mutex.Unlock()
+	go r.run(stop)
+}
 
-		switch currentState {
-		case "follower":
-			r.handleFollower()
+func (r *Raft) Stop() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
-		case "candidate":
-			r.handleCandidate()
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+}
 
-		case "leader":
-			r.handleLeader()
+func (r *Raft) run(stop chan struct{}) {
+	ticker := time.NewTicker(r.tickInterval)
+	defer ticker.Stop()
 
-		default:
-			logger.Error("Unknown state", "state", currentState)
-			time.Sleep(1 * time.Second)
+	for {
+		select {
+		case <-ticker.C:
+			r.Tick()
+		case <-stop:
+			return
 		}
 	}
 }
 
-// // handleFollower manages the follower state, waiting for heartbeats or triggering an election.
-func (r *Raft) handleFollower() {
-	logger := monitoring.GetLogger()
+// Tick advances the node's clock by one tick: a voter that has not heard from
+// a leader for its election timeout starts a pre-vote, and a leader sends
+// heartbeats. Learners wait to be sent the log. A leader that has not heard
+// from a quorum for an election timeout steps down, so that clients go
+// looking for the leader elsewhere, and one whose leadership transfer has
+// not gone through in that time gives up on it.
+func (r *Raft) Tick() {
+	r.mutex.Lock()
+	r.ticks++
+	switch r.state {
+	case Leader:
+		r.heartbeatElapsed++
+		if r.heartbeatElapsed >= r.heartbeatTicks {
+			r.heartbeatElapsed = 0
+			r.broadcastAppend()
+		}
+		r.electionElapsed++
+		if r.electionElapsed >= r.electionTimeout {
+			r.electionElapsed = 0
+			if !r.quorumActive() {
+				monitoring.GetLogger().Warn("Lost touch with a quorum, stepping down", "id", r.id, "term", r.term)
+				r.becomeFollower(r.term, "")
+			}
+			r.active = make(map[string]bool)
+		}
+		if r.transferee != "" {
+			r.transferElapsed++
+			if r.transferElapsed >= r.electionTimeout {
+				monitoring.GetLogger().Warn("Leadership transfer timed out", "id", r.id, "term", r.term, "to", r.transferee)
+				r.abortTransfer()
+			}
+		}
+	default:
+		r.electionElapsed++
+		if r.electionElapsed >= r.electionTimeout && r.voters[r.id] {
+			r.preCampaign()
+		}
+	}
+	r.flush()
+	r.applyCommitted()
+}
 
-	// Random electionn timeout between 150-300ms
-	timeout := time.Duration(150+rand.Intn(150)) * time.Millisecond
-	time.Sleep(timeout)
+// Step hands the node a message from another node.
+func (r *Raft) Step(msg Message) {
+	r.mutex.Lock()
+	r.step(msg)
+	r.flush()
+	r.applyCommitted()
+}
 
+// Propose appends data to the log if the node leads. It returns once the
+// entry is on its way to the followers; the state machine sees it when it
+// commits, which a change of leader can prevent, so callers that need the
+// outcome must watch for the entry being applied. A leader handing over
+// leadership takes no proposals.
+func (r *Raft) Propose(data []byte) error {
 	r.mutex.Lock()
-	if time.Since(r.lastHeart) > timeout {
-		logger.Info("No heartbeat received, becoming candidate", "peerID", r.peerID)
-		r.state = "candidate"
-		r.term++
-		r.votes = 1
-		r.lastHeart = time.Now()
+	if r.state != Leader {
+		r.mutex.Unlock()
+		return ErrNotLeader
 	}
-	r.mutex.Unlock()
+	if r.transferee != "" {
+		r.mutex.Unlock()
+		return ErrTransferInProgress
+	}
+	r.log = append(r.log, Entry{Index: r.lastIndex() + 1, Term: r.term, Data: data})
+	r.maybeCommit()
+	r.broadcastAppend()
+	r.flush()
+	r.applyCommitted()
+	return nil
 }
 
-func (r *Raft) handleCandidate() {
+// applyCommitted hands the entries committed since the last call to the
+// state machine, outside the mutex so the node keeps answering RPCs while
+// they are applied. It also restores snapshots received from the leader,
+// takes the snapshots followers need and compacts the log.
+func (r *Raft) applyCommitted() {
+	if r.stateMachine == nil {
+		return
+	}
 	logger := monitoring.GetLogger()
-	logger.Info("Starting election", "peerID", r.peerID, "term", r.term)
+	r.applyMutex.Lock()
+	defer r.applyMutex.Unlock()
 
-	majority := (len(r.peers)+1)/2 + 1 // +1 for self
-	voteChan := make(chan bool, len(r.peers))
+	for {
+		r.mutex.Lock()
+		if snap := r.restore; snap != nil {
+			r.restore = nil
+			r.mutex.Unlock()
 
-	// Simulate sending vote requests to peers
-	for _, peer := range r.peers {
-		go func(peer string) {
-			// In a real system, send RPC to peer and wait for response
-			// Here, simulate with 50% chance of vote
-			vote := rand.Intn(2) == 1
-			voteChan <- vote
-		}(peer)
-	}
+			// Entries after a failed restore would be applied to the wrong
+			// state, so there is no carrying on
+			if err := r.stateMachine.Restore(*snap); err != nil {
+				logger.Fatal("Failed to restore snapshot", "id", r.id, "index", snap.Index, "error", err)
+			}
+			logger.Info("Snapshot restored", "id", r.id, "index", snap.Index, "term", snap.Term)
 
-	// Collect votes
-	timeout := time.After(200 * time.Millisecond)
-	for i := 0; i < len(r.peers); i++ {
-		select {
-		case vote := <-voteChan:
+			// Only now may the leader count on the snapshot being here
 			r.mutex.Lock()
-			if vote {
-				r.votes++
-			}
-			if r.votes >= majority && r.state == "candidate" {
-				logger.Info("Won election, becoming leader", "peerID", r.peerID, "term", r.term)
-				r.state = "leader"
-			}
+			r.setApplied(snap.Index)
+			r.send(Message{Type: MsgAppendResponse, To: r.restoreFrom, Index: snap.Index})
+			r.flush()
+			continue
+		}
+
+		if r.wantSnapshot {
+			r.wantSnapshot = false
+			index := r.applied
+			term := r.termAt(index)
+			conf, _ := r.confAt(index)
 			r.mutex.Unlock()
-		case <-timeout:
-			logger.Info("Election timeout, reverting to follower", "peerID", r.peerID)
+
+			data, err := r.stateMachine.Snapshot()
+			if err != nil {
+				logger.Error("Failed to take snapshot", "id", r.id, "error", err)
+				return
+			}
+			logger.Info("Snapshot taken for lagging followers", "id", r.id, "index", index, "bytes", len(data))
+
 			r.mutex.Lock()
-			r.state = "follower"
-			r.votes = 0
+			r.snapshot = &Snapshot{Index: index, Term: term, Conf: conf, Data: data}
 			r.mutex.Unlock()
+			continue
+		}
+
+		// Entries are applied once they are in storage too, which for a
+		// leader may lag behind its commit index
+		first := r.log[0].Index
+		entries := append([]Entry(nil), r.log[r.applied+1-first:min(r.commitIndex, r.stable)+1-first]...)
+		r.mutex.Unlock()
+		if len(entries) == 0 {
 			return
 		}
+
+		for _, entry := range entries {
+			r.stateMachine.Apply(entry)
+		}
+
+		r.mutex.Lock()
+		r.setApplied(entries[len(entries)-1].Index)
+		if r.applied-r.log[0].Index > uint64(2*r.logEntries) {
+			r.compact(r.applied - uint64(r.logEntries))
+		}
+		r.mutex.Unlock()
 	}
+}
 
-	// If no majority, revert to follower
-	r.mutex.Lock()
-	if r.state == "candidate" {
-		logger.Info("No majority, reverting to follower", "peerID", r.peerID)
-		r.state = "follower"
-		r.votes = 0
+// compact drops the entries up to index, which must be applied, keeping its
+// index and term in log[0] and the membership as of it in confBase, and
+// lets storage drop them too.
+func (r *Raft) compact(index uint64) {
+	r.confBase, _ = r.confAt(index)
+	first := r.log[0].Index
+	log := make([]Entry, 0, len(r.log)-int(index-first))
+	log = append(log, Entry{Index: index, Term: r.termAt(index)})
+	r.log = append(log, r.log[index+1-first:]...)
+	if err := r.storage.Compact(index); err != nil {
+		monitoring.GetLogger().Error("Failed to compact stored Raft log", "id", r.id, "error", err)
+	}
+}
+
+// flush saves the hard state if it changed and the entries not yet stored,
+// then releases the mutex and sends the queued messages. Nothing is sent
+// unless the state it depends on is in storage, so a vote is never granted,
+// nor an entry acknowledged, by a node that could forget it.
+func (r *Raft) flush() {
+	if err := r.persist(); err != nil {
+		monitoring.GetLogger().Error("Failed to save Raft state", "id", r.id, "error", err)
+		r.outbox = nil
 	}
+	msgs := r.outbox
+	r.outbox = nil
 	r.mutex.Unlock()
+
+	for _, msg := range msgs {
+		r.transport.Send(msg)
+	}
 }
 
-func (r *Raft) handleLeader() {
-	logger := monitoring.GetLogger()
-	logger.Info("Acting as leader", "peerID", r.peerID, "term", r.term)
+// persist writes what changed since the last call to storage.
+func (r *Raft) persist() error {
+	hs := HardState{Term: r.term, VotedFor: r.votedFor}
+	if hs != r.saved {
+		if err := r.storage.SetHardState(hs); err != nil {
+			return err
+		}
+		r.saved = hs
+	}
+	if r.resetLog {
+		if err := r.storage.Reset(r.log[0].Index); err != nil {
+			return err
+		}
+		r.resetLog = false
+	}
+	if r.stable < r.lastIndex() {
+		if err := r.storage.Append(r.log[r.stable+1-r.log[0].Index:]); err != nil {
+			return err
+		}
+		r.stable = r.lastIndex()
+	}
+	return nil
+}
 
-	// Send heartbeats every 50ms
-	ticker := time.NewTicker(50 * time.Millisecond)
-	defer ticker.Stop()
+// send queues a message stamped with the node's ID and current term. Pre-votes
+// and their responses carry the term the election would be for instead, which
+// the caller sets.
+func (r *Raft) send(msg Message) {
+	msg.From = r.id
+	if msg.Type != MsgPreVote && msg.Type != MsgPreVoteResponse {
+		msg.Term = r.term
+	}
+	r.outbox = append(r.outbox, msg)
+}
 
-	for range ticker.C {
-		r.mutex.Lock()
-		if r.state != "leader" {
-			r.mutex.Unlock()
+func (r *Raft) step(msg Message) {
+	switch {
+	case msg.Term > r.term && (msg.Type == MsgVote || msg.Type == MsgPreVote) &&
+		(!r.voters[msg.From] || r.inLease() && !msg.Transfer):
+		// Either a node removed from the cluster that has not heard yet, which
+		// cannot win, or a candidate that timed out while the leader is still
+		// heard from. Taking up its term would only depose the leader, and
+		// leases rely on no votes being granted that soon. The leader itself
+		// asks for a transfer campaign, so that one goes ahead.
+		return
+
+	case msg.Term > r.term && (msg.Type == MsgPreVote || msg.Type == MsgPreVoteResponse && !msg.Reject):
+		// A pre-vote, or a pre-vote granted, is for a term neither side has
+		// moved to yet
+
+	case msg.Term > r.term:
+		logger := monitoring.GetLogger()
+		logger.Info("Newer term seen", "id", r.id, "term", msg.Term, "from", msg.From, "type", msg.Type)
+		leader := ""
+		if msg.Type == MsgAppend || msg.Type == MsgSnapshot {
+			leader = msg.From
+		}
+		r.becomeFollower(msg.Term, leader)
+
+	case msg.Term < r.term:
+		// A stale node: answer its requests so it learns the current term
+		switch msg.Type {
+		case MsgVote:
+			r.send(Message{Type: MsgVoteResponse, To: msg.From, Reject: true})
+		case MsgPreVote:
+			r.send(Message{Type: MsgPreVoteResponse, To: msg.From, Term: r.term, Reject: true})
+		case MsgAppend, MsgSnapshot:
+			r.send(Message{Type: MsgAppendResponse, To: msg.From, Index: msg.Index, Reject: true, Hint: r.lastIndex()})
+		case MsgReadIndex:
+			r.send(Message{Type: MsgReadIndexResponse, To: msg.From, Read: msg.Read, Reject: true})
+		}
+		return
+	}
+
+	switch msg.Type {
+	case MsgVote, MsgPreVote:
+		r.handleVote(msg)
+	case MsgVoteResponse, MsgPreVoteResponse:
+		r.handleVoteResponse(msg)
+	case MsgAppend:
+		if r.state == Leader {
+			return // cannot happen: a term has one leader
+		}
+		if r.state == Candidate || r.state == PreCandidate {
+			// Someone else won this term
+			r.becomeFollower(r.term, msg.From)
+		}
+		r.handleAppend(msg)
+	case MsgAppendResponse:
+		r.handleAppendResponse(msg)
+	case MsgSnapshot:
+		if r.state == Leader {
 			return
 		}
-		r.mutex.Unlock()
+		if r.state == Candidate || r.state == PreCandidate {
+			r.becomeFollower(r.term, msg.From)
+		}
+		r.handleSnapshot(msg)
+	case MsgSnapshotResponse:
+		r.handleSnapshotResponse(msg)
+	case MsgReadIndex:
+		r.handleReadIndex(msg)
+	case MsgReadIndexResponse:
+		r.handleReadIndexResponse(msg)
+	case MsgTimeoutNow:
+		r.handleTimeoutNow(msg)
+	}
+}
 
-		// Simulate sending heartbeats to peers
-		for _, peer := range r.peers {
-			go func(peer string) {
-				// In a real system, send heartbeat RPC
-				// Here, just log it
-				logger.Debug("Sent heartbeat", "to", peer, "term", r.term)
-				r.mutex.Lock()
-				r.lastHeart = time.Now() // Update own heartbeat time
-				r.mutex.Unlock()
-			}(peer)
-		}
-
-		// Check if we should step down (simplified)
-		// In a real system, this would be based on receiving higher term from peers
-		if rand.Intn(100) < 5 { // 5% chance to simulate term conflict
-			r.mutex.Lock()
-			logger.Info("Stepping down due to simulated term conflict", "peerID", r.peerID)
-			r.state = "follower"
-			r.votes = 0
-			r.term++
-			r.mutex.Unlock()
+// inLease reports whether the node leads, or has heard from a leader within
+// the minimum election timeout.
+func (r *Raft) inLease() bool {
+	return r.state == Leader || (r.leader != "" && r.electionElapsed < r.electionTicks)
+}
+
+// handleVote grants a vote if the node has not voted for anyone else this
+// term and the candidate's log is at least as up to date as its own. A
+// pre-vote is granted on the log alone, for a later term than the node's,
+// and binds it to nothing.
+func (r *Raft) handleVote(msg Message) {
+	if msg.Type == MsgPreVote {
+		if msg.Term > r.term && r.upToDate(msg.LogTerm, msg.Index) {
+			r.send(Message{Type: MsgPreVoteResponse, To: msg.From, Term: msg.Term})
+		} else {
+			r.send(Message{Type: MsgPreVoteResponse, To: msg.From, Term: r.term, Reject: true})
+		}
+		return
+	}
+	canVote := r.votedFor == "" || r.votedFor == msg.From
+	if !canVote || !r.upToDate(msg.LogTerm, msg.Index) {
+		r.send(Message{Type: MsgVoteResponse, To: msg.From, Reject: true})
+		return
+	}
+	r.votedFor = msg.From
+	r.electionElapsed = 0
+	r.send(Message{Type: MsgVoteResponse, To: msg.From})
+}
+
+// upToDate reports whether a log ending at index with an entry of term is at
+// least as up to date as the node's own: a later last term wins, and with
+// the same last term the longer log does.
+func (r *Raft) upToDate(term, index uint64) bool {
+	last := r.lastTerm()
+	return term > last || (term == last && index >= r.lastIndex())
+}
+
+// handleVoteResponse counts a vote, or pre-vote, and moves on to the election,
+// or leadership, once a quorum granted theirs.
+func (r *Raft) handleVoteResponse(msg Message) {
+	if msg.Type == MsgPreVoteResponse {
+		if r.state != PreCandidate || !msg.Reject && msg.Term != r.term+1 {
+			return // not pre-campaigning, or granted in an earlier pre-vote
+		}
+	} else if r.state != Candidate {
+		return
+	}
+	r.votes[msg.From] = !msg.Reject
+	granted := 0
+	for id, vote := range r.votes {
+		if vote && r.voters[id] {
+			granted++
+		}
+	}
+	if granted < r.quorum() {
+		return
+	}
+	if r.state == PreCandidate {
+		r.campaign(false)
+	} else {
+		r.becomeLeader()
+	}
+}
+
+// handleAppend checks that the leader's log matches the node's own at the
+// entry before the new ones, drops any conflicting entries, appends the new
+// ones and advances the commit index.
+func (r *Raft) handleAppend(msg Message) {
+	r.leader = msg.From
+	r.electionElapsed = 0
+
+	if first := r.log[0].Index; msg.Index < first {
+		// Entries up to the first one here are committed and already match
+		skip := first - msg.Index
+		if uint64(len(msg.Entries)) <= skip {
+			r.send(Message{Type: MsgAppendResponse, To: msg.From, Index: first, Read: msg.Read})
 			return
 		}
+		msg.Entries = msg.Entries[skip:]
+		msg.Index, msg.LogTerm = first, r.log[0].Term
+	}
+
+	if msg.Index > r.lastIndex() || r.termAt(msg.Index) != msg.LogTerm {
+		r.send(Message{Type: MsgAppendResponse, To: msg.From, Index: msg.Index, Reject: true, Hint: min(msg.Index-1, r.lastIndex()), Read: msg.Read})
+		return
+	}
+
+	confChanged := false
+	for i, entry := range msg.Entries {
+		if entry.Index <= r.lastIndex() {
+			if r.termAt(entry.Index) == entry.Term {
+				continue
+			}
+			// Entries after a conflict were never committed, so they can go,
+			// and with them any membership change they made
+			r.log = r.log[:entry.Index-r.log[0].Index]
+			r.stable = min(r.stable, r.lastIndex())
+			confChanged = true
+		}
+		r.log = append(r.log, msg.Entries[i:]...)
+		for _, added := range msg.Entries[i:] {
+			confChanged = confChanged || added.Type == EntryConfChange
+		}
+		break
+	}
+	if confChanged {
+		var conf ConfState
+		conf, r.pendingConf = r.confAt(r.lastIndex())
+		r.setConf(conf)
+	}
+
+	// A delayed append matches less than the log holds, and must not take
+	// back what a later one committed
+	match := msg.Index + uint64(len(msg.Entries))
+	if commit := min(msg.Commit, match); commit > r.commitIndex {
+		r.commitIndex = commit
+	}
+	r.send(Message{Type: MsgAppendResponse, To: msg.From, Index: match, Read: msg.Read})
+}
+
+func (r *Raft) handleAppendResponse(msg Message) {
+	if _, ok := r.nextIndex[msg.From]; !ok || r.state != Leader {
+		return // not a leader, or a node that is no longer a member
+	}
+	r.active[msg.From] = true
+	if msg.Read > r.acked[msg.From] {
+		r.acked[msg.From] = msg.Read
+		r.advanceReads()
+	}
+	match := r.matchIndex[msg.From]
+	if msg.Reject {
+		// Back up to just past the follower's log, unless the rejection is an
+		// old one for an index it has matched since
+		if msg.Index > match {
+			r.nextIndex[msg.From] = max(match+1, min(msg.Index, msg.Hint+1))
+			r.sendAppend(msg.From)
+		}
+		return
+	}
+	if msg.Index > match {
+		r.matchIndex[msg.From] = msg.Index
+		r.maybeCommit()
+		if r.state != Leader {
+			return // committed its own removal
+		}
+	}
+	if msg.From == r.transferee && r.matchIndex[msg.From] == r.lastIndex() {
+		r.send(Message{Type: MsgTimeoutNow, To: msg.From})
+	}
+	if t := r.sending[msg.From]; t != nil && msg.Index >= t.index {
+		delete(r.sending, msg.From)
+	}
+	if msg.Index+1 > r.nextIndex[msg.From] {
+		r.nextIndex[msg.From] = msg.Index + 1
+	}
+	if r.nextIndex[msg.From] <= r.lastIndex() {
+		r.sendAppend(msg.From) // more than one message's worth was missing
+	}
+}
+
+// handleSnapshot collects a snapshot chunk by chunk. Once the last chunk is
+// in, the snapshot replaces the whole log and is handed to the state machine
+// by applyCommitted, which acknowledges it once restored.
+func (r *Raft) handleSnapshot(msg Message) {
+	r.leader = msg.From
+	r.electionElapsed = 0
+
+	if msg.Index <= r.commitIndex {
+		// Already here: committed entries match the leader's
+		r.receiving = nil
+		r.send(Message{Type: MsgAppendResponse, To: msg.From, Index: r.commitIndex})
+		return
+	}
+
+	if msg.Offset == 0 && (r.receiving == nil || r.receiving.Index != msg.Index) {
+		r.receiving = &Snapshot{Index: msg.Index, Term: msg.LogTerm}
+	}
+	snap := r.receiving
+	if snap == nil || snap.Index != msg.Index || msg.Offset != uint64(len(snap.Data)) {
+		var want uint64
+		if snap != nil && snap.Index == msg.Index {
+			want = uint64(len(snap.Data))
+		}
+		r.send(Message{Type: MsgSnapshotResponse, To: msg.From, Index: msg.Index, Reject: true, Hint: want})
+		return
+	}
+	snap.Data = append(snap.Data, msg.Data...)
+	if !msg.Done {
+		r.send(Message{Type: MsgSnapshotResponse, To: msg.From, Index: msg.Index, Hint: uint64(len(snap.Data))})
+		return
+	}
+
+	r.receiving = nil
+	if msg.Conf != nil {
+		snap.Conf = *msg.Conf
+	}
+	r.log = []Entry{{Index: snap.Index, Term: snap.Term}}
+	r.stable, r.resetLog = snap.Index, true
+	r.confBase, r.pendingConf = snap.Conf, 0
+	r.setConf(snap.Conf)
+	r.commitIndex = snap.Index
+	r.restore, r.restoreFrom = snap, msg.From
+}
+
+// handleSnapshotResponse sends a follower the chunk it asked for next.
+func (r *Raft) handleSnapshotResponse(msg Message) {
+	if r.state != Leader {
+		return
+	}
+	r.active[msg.From] = true
+	t := r.sending[msg.From]
+	if t == nil || t.index != msg.Index {
+		return
+	}
+	if msg.Reject || msg.Hint > t.offset {
+		t.offset = msg.Hint
+		r.sendSnapshot(msg.From)
+	}
+}
+
+// maybeCommit advances the commit index to the highest entry stored on a
+// quorum of voters. Only entries of the current term are counted; earlier
+// ones are committed along with them. A leader that is no longer a voter
+// steps down once its removal commits.
+func (r *Raft) maybeCommit() {
+	matched := make([]uint64, 0, len(r.conf.Voters))
+	for _, id := range r.conf.Voters {
+		if id == r.id {
+			matched = append(matched, r.lastIndex())
+		} else {
+			matched = append(matched, r.matchIndex[id])
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i] > matched[j] })
+	index := matched[r.quorum()-1]
+	if index > r.commitIndex && r.termAt(index) == r.term {
+		r.commitIndex = index
+	}
+
+	if !r.voters[r.id] && r.commitIndex >= r.pendingConf {
+		monitoring.GetLogger().Info("Removed from the voters, stepping down", "id", r.id, "term", r.term)
+		r.broadcastAppend() // so the followers learn the removal committed
+		r.becomeFollower(r.term, "")
+	}
+}
+
+// preCampaign asks the voters whether they would vote for the node in the next
+// term, without moving to it. Only once a quorum would does it campaign, so a
+// node cut off from the others, or removed from the cluster, cannot depose a
+// leader the rest still hear from by driving up the term.
+func (r *Raft) preCampaign() {
+	r.state = PreCandidate
+	r.leader = ""
+	r.votes = map[string]bool{r.id: true}
+	r.failReads()
+	r.resetElectionTimer()
+	monitoring.GetLogger().Info("Starting pre-vote", "id", r.id, "term", r.term+1)
+
+	if r.quorum() == 1 {
+		r.campaign(false)
+		return
+	}
+	for _, peer := range r.peers {
+		if r.voters[peer] {
+			r.send(Message{Type: MsgPreVote, To: peer, Term: r.term + 1, Index: r.lastIndex(), LogTerm: r.lastTerm()})
+		}
+	}
+}
+
+// campaign starts an election in the next term. A campaign the leader asked
+// for with MsgTimeoutNow is marked as a transfer, which voters do not ignore
+// while they still hear from the leader.
+func (r *Raft) campaign(transfer bool) {
+	logger := monitoring.GetLogger()
+
+	r.state = Candidate
+	r.term++
+	r.votedFor = r.id
+	r.leader = ""
+	r.votes = map[string]bool{r.id: true}
+	r.failReads()
+	r.resetElectionTimer()
+	logger.Info("Starting election", "id", r.id, "term", r.term)
+
+	if r.quorum() == 1 {
+		r.becomeLeader()
+		return
+	}
+	for _, peer := range r.peers {
+		if r.voters[peer] {
+			r.send(Message{Type: MsgVote, To: peer, Index: r.lastIndex(), LogTerm: r.lastTerm(), Transfer: transfer})
+		}
+	}
+}
+
+func (r *Raft) becomeFollower(term uint64, leader string) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+	}
+	r.failReads()
+	r.state = Follower
+	r.leader = leader
+	r.votes = nil
+	r.nextIndex, r.matchIndex, r.active = nil, nil, nil
+	r.snapshot, r.sending = nil, nil
+	r.roundTicks, r.acked = nil, nil
+	r.transferee = ""
+	r.resetElectionTimer()
+}
+
+// becomeLeader takes over the cluster: it appends a no-op entry of the new
+// term, which commits everything before it once replicated, and sends it out
+// right away so the other candidates stand down.
+func (r *Raft) becomeLeader() {
+	logger := monitoring.GetLogger()
+	logger.Info("Won election, becoming leader", "id", r.id, "term", r.term)
+
+	r.state = Leader
+	r.leader = r.id
+	r.votes = nil
+	r.heartbeatElapsed = 0
+	r.electionElapsed = 0
+	r.nextIndex = make(map[string]uint64, len(r.peers))
+	r.matchIndex = make(map[string]uint64, len(r.peers))
+	r.active = make(map[string]bool)
+	r.sending = make(map[string]*transfer)
+	r.roundTicks = make(map[uint64]int)
+	r.acked = make(map[string]uint64)
+	r.leaseUntil, r.leaseFrom = 0, 0
+	r.transferee = ""
+	for _, peer := range r.peers {
+		r.nextIndex[peer] = r.lastIndex() + 1
+	}
+	r.log = append(r.log, Entry{Index: r.lastIndex() + 1, Term: r.term})
+	r.maybeCommit()
+	r.broadcastAppend()
+}
+
+// broadcastAppend sends every peer its entries or a heartbeat, as a new
+// heartbeat round.
+func (r *Raft) broadcastAppend() {
+	r.round++
+	r.roundTicks[r.round] = r.ticks
+	for _, peer := range r.peers {
+		r.sendAppend(peer)
+	}
+}
+
+// maxAppendEntries caps the entries carried by one AppendEntries message.
+const maxAppendEntries = 256
+
+// sendAppend sends a peer the entries from its next index on, or an empty
+// heartbeat if it has them all. The next index moves past the entries sent
+// without waiting for the reply, so entries proposed meanwhile follow right
+// behind; a lost message shows up as a rejection and is sent again. A peer
+// whose next entry was compacted away is sent a snapshot instead.
+func (r *Raft) sendAppend(to string) {
+	if r.nextIndex[to] <= r.log[0].Index || r.sending[to] != nil {
+		r.sendSnapshot(to)
+		return
+	}
+	prev := r.nextIndex[to] - 1
+	entries := r.log[prev+1-r.log[0].Index:]
+	if len(entries) > maxAppendEntries {
+		entries = entries[:maxAppendEntries]
+	}
+	r.nextIndex[to] = prev + uint64(len(entries)) + 1
+	r.send(Message{
+		Type:    MsgAppend,
+		To:      to,
+		Index:   prev,
+		LogTerm: r.termAt(prev),
+		Entries: append([]Entry(nil), entries...),
+		Commit:  r.commitIndex,
+		Read:    r.round,
+	})
+}
+
+// sendSnapshot sends a peer the next chunk of the latest snapshot. Without a
+// snapshot covering the compacted entries it asks applyCommitted for one, and
+// the next heartbeat sends it.
+func (r *Raft) sendSnapshot(to string) {
+	snap := r.snapshot
+	if snap == nil || snap.Index < r.log[0].Index {
+		r.wantSnapshot = true
+		return
+	}
+	t := r.sending[to]
+	if t == nil || t.index != snap.Index {
+		t = &transfer{index: snap.Index}
+		r.sending[to] = t
+	}
+	end := min(t.offset+uint64(r.chunkSize), uint64(len(snap.Data)))
+	msg := Message{
+		Type:    MsgSnapshot,
+		To:      to,
+		Index:   snap.Index,
+		LogTerm: snap.Term,
+		Offset:  t.offset,
+		Data:    snap.Data[t.offset:end],
+		Done:    end == uint64(len(snap.Data)),
+	}
+	if msg.Done {
+		msg.Conf = &snap.Conf
+	}
+	r.send(msg)
+}
+
+func (r *Raft) resetElectionTimer() {
+	r.electionElapsed = 0
+	r.electionTimeout = r.electionTicks + r.rand.Intn(r.electionTicks)
+}
+
+// quorumActive reports whether a quorum of voters, the leader included, was
+// heard from this election timeout.
+func (r *Raft) quorumActive() bool {
+	active := 0
+	for _, id := range r.conf.Voters {
+		if id == r.id || r.active[id] {
+			active++
+		}
+	}
+	return active >= r.quorum()
+}
+
+// quorum is the number of voters that make a majority.
+func (r *Raft) quorum() int {
+	return len(r.conf.Voters)/2 + 1
+}
+
+func (r *Raft) lastIndex() uint64 {
+	return r.log[len(r.log)-1].Index
+}
+
+func (r *Raft) lastTerm() uint64 {
+	return r.log[len(r.log)-1].Term
+}
+
+// termAt returns the term of the entry at index, which must be in the log.
+func (r *Raft) termAt(index uint64) uint64 {
+	return r.log[index-r.log[0].Index].Term
+}
+
+// Status is a point-in-time view of a node.
+type Status struct {
+	ID          string `json:"id"`
+	State       State  `json:"state"`
+	Term        uint64 `json:"term"`
+	Leader      string `json:"leader"` // empty while no leader is known
+	CommitIndex uint64 `json:"commit_index"`
+	LastIndex   uint64 `json:"last_index"`
+
+	Voters   []string          `json:"voters"`
+	Learners []string          `json:"learners,omitempty"`
+	Match    map[string]uint64 `json:"match,omitempty"` // leader only: last entry known to be on each other member
+
+	Transferee string `json:"transferee,omitempty"` // leader only: voter leadership is being handed to
+}
+
+func (r *Raft) Status() Status {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	status := Status{
+		ID:          r.id,
+		State:       r.state,
+		Term:        r.term,
+		Leader:      r.leader,
+		CommitIndex: r.commitIndex,
+		LastIndex:   r.lastIndex(),
+		Voters:      append([]string(nil), r.conf.Voters...),
+		Learners:    append([]string(nil), r.conf.Learners...),
+		Transferee:  r.transferee,
+	}
+	if r.state == Leader {
+		status.Match = make(map[string]uint64, len(r.matchIndex))
+		for id, match := range r.matchIndex {
+			status.Match[id] = match
+		}
 	}
+	return status
 }
@@ -0,0 +1,1021 @@
+package consensus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/artorias742/DTP/monitoring"
+)
+
+func TestMain(m *testing.M) {
+	monitoring.InitLogging()
+	os.Exit(m.Run())
+}
+
+// cluster runs Raft nodes over a MemoryNetwork in one goroutine, so that a
+// test plays out the same way every time. After every tick it checks that no
+// two nodes led in the same term, and it checks every vote sent that no node
+// voted for two candidates in one term.
+type cluster struct {
+	t        *testing.T
+	ids      []string
+	nodes    map[string]*Raft
+	storages map[string]Storage
+	machines map[string]*appliedLog
+	base     Config
+	net      *MemoryNetwork
+	leaderOf map[uint64]string // the leader seen in each term
+	votes    map[vote]string   // the candidate each node voted for in each term
+
+	dir          string // where nodes keep their storage, or empty to keep it in memory
+	killOnAppend string // a node to kill as it appends the next entries sent to it
+}
+
+type vote struct {
+	voter string
+	term  uint64
+}
+
+// appliedLog is a state machine that records the entries it is given.
+type appliedLog struct {
+	entries []Entry   // entries with data, membership changes aside
+	last    Entry     // the last entry with data, where a restart picks up
+	conf    ConfState // membership as of last
+}
+
+func (l *appliedLog) Apply(entry Entry) {
+	if entry.Data == nil {
+		return
+	}
+	l.last = Entry{Index: entry.Index, Term: entry.Term}
+	if entry.Type == EntryConfChange {
+		var cc ConfChange
+		if err := json.Unmarshal(entry.Data, &cc); err != nil {
+			panic(err)
+		}
+		l.conf = cc.Conf
+		return
+	}
+	l.entries = append(l.entries, entry)
+}
+
+func (l *appliedLog) Snapshot() ([]byte, error) {
+	return json.Marshal(l.entries)
+}
+
+func (l *appliedLog) Restore(snap Snapshot) error {
+	l.entries = nil
+	l.last = Entry{Index: snap.Index, Term: snap.Term}
+	l.conf = snap.Conf
+	return json.Unmarshal(snap.Data, &l.entries)
+}
+
+// data returns the data of the applied entries.
+func (l *appliedLog) data() []string {
+	data := make([]string, len(l.entries))
+	for i, entry := range l.entries {
+		data[i] = string(entry.Data)
+	}
+	return data
+}
+
+func newCluster(t *testing.T, n int) *cluster {
+	return newClusterConfig(t, n, Config{})
+}
+
+// newClusterConfig starts n nodes with the settings in base.
+func newClusterConfig(t *testing.T, n int, base Config) *cluster {
+	return newClusterIn(t, n, base, "")
+}
+
+// newClusterIn starts n nodes with the settings in base that keep their
+// storage in directories under dir, or in memory if dir is empty.
+func newClusterIn(t *testing.T, n int, base Config, dir string) *cluster {
+	c := &cluster{
+		t:        t,
+		dir:      dir,
+		nodes:    make(map[string]*Raft),
+		base:     base,
+		storages: make(map[string]Storage),
+		machines: make(map[string]*appliedLog),
+		net:      NewMemoryNetwork(1),
+		leaderOf: make(map[uint64]string),
+		votes:    make(map[vote]string),
+	}
+	for i := 1; i <= n; i++ {
+		c.ids = append(c.ids, fmt.Sprintf("n%d", i))
+	}
+	for _, id := range c.ids {
+		c.storages[id] = c.openStorage(id)
+		c.machines[id] = &appliedLog{conf: ConfState{Voters: c.ids}}
+		c.start(id)
+	}
+	return c
+}
+
+// join starts a new node that knows the current voters and lists itself as
+// a learner, for the leader to add.
+func (c *cluster) join(id string, voters []string) {
+	c.ids = append(c.ids, id)
+	c.storages[id] = c.openStorage(id)
+	c.machines[id] = &appliedLog{conf: ConfState{Voters: voters, Learners: []string{id}}}
+	c.start(id)
+}
+
+// openStorage opens a node's storage, which on disk finds what the node
+// stored before it was killed.
+func (c *cluster) openStorage(id string) Storage {
+	if c.dir == "" {
+		return NewMemoryStorage()
+	}
+	storage, err := OpenFileStorage(filepath.Join(c.dir, id), FileStorageOptions{SegmentSize: 1024})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return storage
+}
+
+// start creates the node from its storage and state machine, replacing any
+// earlier instance as a restart would. The new node's log starts after the
+// last entry the state machine applied, with the membership as of that entry.
+func (c *cluster) start(id string) {
+	var seed int64
+	for i, other := range c.ids {
+		if other == id {
+			seed = int64(i + 1)
+		}
+	}
+	machine := c.machines[id]
+	cfg := c.base
+	cfg.ID, cfg.Seed = id, seed
+	cfg.Voters, cfg.Learners = machine.conf.Voters, machine.conf.Learners
+	cfg.Storage, cfg.Transport = c.storages[id], c
+	cfg.StateMachine, cfg.Applied, cfg.AppliedTerm = machine, machine.last.Index, machine.last.Term
+	node, err := NewRaft(cfg)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.nodes[id] = node
+	c.net.Add(node)
+}
+
+// Send checks the votes among the messages the nodes send, then hands them to
+// the network, except for the entries that kill the node they are for.
+func (c *cluster) Send(msg Message) {
+	if msg.Type == MsgVoteResponse && !msg.Reject {
+		key := vote{voter: msg.From, term: msg.Term}
+		if other, ok := c.votes[key]; ok && other != msg.To {
+			c.t.Errorf("%s voted for %s and %s in term %d", msg.From, other, msg.To, msg.Term)
+		}
+		c.votes[key] = msg.To
+	}
+	if msg.To == c.killOnAppend && msg.Type == MsgAppend && len(msg.Entries) > 0 && !c.net.IsDown(msg.To) {
+		c.killOnAppend = ""
+		c.killMidAppend(msg)
+		return
+	}
+	c.net.Send(msg)
+}
+
+func (c *cluster) tick(n int) {
+	for ; n > 0; n-- {
+		c.net.Tick()
+		c.checkLeaders()
+	}
+}
+
+func (c *cluster) deliver() {
+	c.net.Deliver()
+	c.checkLeaders()
+}
+
+// checkLeaders fails the test if two nodes lead in the same term.
+func (c *cluster) checkLeaders() {
+	c.t.Helper()
+	for _, id := range c.ids {
+		status := c.nodes[id].Status()
+		if status.State != Leader {
+			continue
+		}
+		if other, ok := c.leaderOf[status.Term]; ok && other != id {
+			c.t.Fatalf("%s and %s both led in term %d", other, id, status.Term)
+		}
+		c.leaderOf[status.Term] = id
+	}
+}
+
+// leaders returns the nodes that are up and believe they lead.
+func (c *cluster) leaders() []string {
+	var leaders []string
+	for _, id := range c.ids {
+		if !c.net.IsDown(id) && c.nodes[id].Status().State == Leader {
+			leaders = append(leaders, id)
+		}
+	}
+	return leaders
+}
+
+// waitLeader ticks until exactly one node that is up leads.
+func (c *cluster) waitLeader() string {
+	for i := 0; i < 1000; i++ {
+		if leaders := c.leaders(); len(leaders) == 1 {
+			return leaders[0]
+		}
+		c.tick(1)
+	}
+	c.t.Fatalf("no single leader after 1000 ticks: %v", c.leaders())
+	return ""
+}
+
+func TestElectsOneStableLeader(t *testing.T) {
+	for _, n := range []int{1, 3, 5} {
+		t.Run(fmt.Sprintf("%d nodes", n), func(t *testing.T) {
+			c := newCluster(t, n)
+			leader := c.waitLeader()
+			term := c.nodes[leader].Status().Term
+
+			// Heartbeats keep everyone following the same leader
+			c.tick(500)
+			if leaders := c.leaders(); len(leaders) != 1 || leaders[0] != leader {
+				t.Fatalf("leaders = %v, want [%s]", leaders, leader)
+			}
+			for _, id := range c.ids {
+				status := c.nodes[id].Status()
+				if status.Term != term || status.Leader != leader {
+					t.Errorf("%s: term %d leader %q, want term %d leader %q", id, status.Term, status.Leader, term, leader)
+				}
+				// The leader's no-op is committed everywhere
+				if status.CommitIndex != 1 || status.LastIndex != 1 {
+					t.Errorf("%s: commit %d last %d, want 1 and 1", id, status.CommitIndex, status.LastIndex)
+				}
+			}
+		})
+	}
+}
+
+func TestReelectsWhenLeaderFails(t *testing.T) {
+	c := newCluster(t, 3)
+	old := c.waitLeader()
+	oldTerm := c.nodes[old].Status().Term
+
+	c.net.Down(old)
+	leader := c.waitLeader()
+	if leader == old {
+		t.Fatalf("isolated node %s still leads", old)
+	}
+	term := c.nodes[leader].Status().Term
+	if term <= oldTerm {
+		t.Fatalf("new leader's term %d, want above %d", term, oldTerm)
+	}
+
+	// The old leader still thinks it leads until it hears of the newer term
+	if c.nodes[old].Status().State != Leader {
+		t.Fatalf("isolated leader stepped down without hearing from anyone")
+	}
+	c.net.Up(old)
+	c.tick(50)
+	status := c.nodes[old].Status()
+	if status.State != Follower || status.Leader != leader || status.Term != term {
+		t.Fatalf("old leader: %+v, want a follower of %s in term %d", status, leader, term)
+	}
+	if leaders := c.leaders(); len(leaders) != 1 || leaders[0] != leader {
+		t.Fatalf("leaders = %v, want [%s]", leaders, leader)
+	}
+}
+
+func TestNoLeaderWithoutQuorum(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.waitLeader()
+
+	// Leave one follower on its own
+	c.net.Down(leader)
+	for _, id := range c.ids {
+		if id != leader {
+			c.net.Down(id)
+			break
+		}
+	}
+	c.tick(500)
+	if leaders := c.leaders(); len(leaders) != 0 {
+		t.Fatalf("a lone follower elected %v", leaders)
+	}
+}
+
+func TestReplicatesInLogOrder(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.waitLeader()
+	var want []string
+	propose := func(n int) {
+		for i := 0; i < n; i++ {
+			data := fmt.Sprintf("entry %d", len(want))
+			if err := c.nodes[leader].Propose([]byte(data)); err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, data)
+		}
+		c.deliver()
+	}
+	check := func() {
+		t.Helper()
+		for _, id := range c.ids {
+			if got := c.machines[id].data(); !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s applied %d entries, want %d in proposal order", id, len(got), len(want))
+			}
+		}
+	}
+
+	propose(10)
+	c.tick(10) // followers learn the commit index from the next heartbeat
+	check()
+
+	for _, id := range c.ids {
+		if id != leader {
+			if err := c.nodes[id].Propose([]byte("x")); err != ErrNotLeader {
+				t.Fatalf("follower %s: Propose error = %v, want ErrNotLeader", id, err)
+			}
+		}
+	}
+
+	// A follower that misses more than one message's worth catches up
+	var lagging string
+	for _, id := range c.ids {
+		if id != leader {
+			lagging = id
+			break
+		}
+	}
+	c.net.Down(lagging)
+	propose(3 * maxAppendEntries)
+	c.tick(10)
+	c.net.Up(lagging)
+	c.tick(50)
+	check()
+
+	// A restarted follower picks up after what it already applied
+	c.start(lagging)
+	propose(5)
+	c.tick(50)
+	check()
+}
+
+func TestInstallSnapshot(t *testing.T) {
+	c := newClusterConfig(t, 3, Config{LogEntries: 10, SnapshotChunkSize: 100})
+	leader := c.waitLeader()
+	var lagging string
+	for _, id := range c.ids {
+		if id != leader {
+			lagging = id
+			break
+		}
+	}
+
+	c.net.Down(lagging)
+	var want []string
+	for i := 0; i < 100; i++ {
+		data := fmt.Sprintf("entry %d", i)
+		if err := c.nodes[leader].Propose([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, data)
+		c.deliver()
+	}
+	c.tick(10)
+
+	// The leader kept no more than twice LogEntries of what it applied
+	if n := len(c.nodes[leader].log) - 1; n > 20 {
+		t.Fatalf("leader holds %d entries after compaction, want at most 20", n)
+	}
+
+	// The lagging follower is past the log and gets a snapshot, in chunks
+	c.net.Up(lagging)
+	for i := 0; i < 200 && !reflect.DeepEqual(c.machines[lagging].data(), want); i++ {
+		c.tick(1)
+	}
+	if got := c.machines[lagging].data(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("lagging follower has %d entries, want %d", len(got), len(want))
+	}
+	if chunks := c.net.Delivered(MsgSnapshot); chunks < 2 {
+		t.Fatalf("snapshot sent in %d chunks, want several", chunks)
+	}
+
+	// It carries on from the snapshot with new entries
+	if err := c.nodes[leader].Propose([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, "after")
+	c.tick(10)
+	for _, id := range c.ids {
+		if got := c.machines[id].data(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s has %d entries, want %d", id, len(got), len(want))
+		}
+	}
+}
+
+// leaderAmong ticks until one of ids leads and returns it.
+func (c *cluster) leaderAmong(ids []string) string {
+	c.t.Helper()
+	for i := 0; i < 1000; i++ {
+		for _, id := range ids {
+			if c.nodes[id].Status().State == Leader {
+				return id
+			}
+		}
+		c.tick(1)
+	}
+	c.t.Fatalf("none of %v leads after 1000 ticks", ids)
+	return ""
+}
+
+func TestPartitionedLeaderCannotCommit(t *testing.T) {
+	c := newCluster(t, 5)
+	old := c.waitLeader()
+	minority := []string{old}
+	var majority []string
+	for _, id := range c.ids {
+		if id == old {
+			continue
+		}
+		if len(minority) < 2 {
+			minority = append(minority, id)
+		} else {
+			majority = append(majority, id)
+		}
+	}
+
+	c.net.Partition(minority, majority)
+	if err := c.nodes[old].Propose([]byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+	leader := c.leaderAmong(majority)
+	if err := c.nodes[leader].Propose([]byte("kept")); err != nil {
+		t.Fatal(err)
+	}
+	c.tick(100)
+	if status := c.nodes[old].Status(); status.State == Leader {
+		t.Fatalf("leader cut off from the quorum still leads: %+v", status)
+	}
+	for _, id := range minority {
+		if got := c.machines[id].data(); len(got) != 0 {
+			t.Fatalf("%s applied %v without a quorum", id, got)
+		}
+	}
+
+	// Once healed, the minority drops its uncommitted entry for the majority's
+	c.net.Heal()
+	c.tick(100)
+	for _, id := range c.ids {
+		if got := c.machines[id].data(); !reflect.DeepEqual(got, []string{"kept"}) {
+			t.Fatalf("%s applied %v, want [kept]", id, got)
+		}
+	}
+}
+
+// lossyRun proposes an entry on every tick to whichever node leads, over a
+// network that delays, drops and reorders messages, then lets the nodes
+// converge over a reliable one. It returns what every node applied and how
+// many AppendEntries messages arrived.
+func lossyRun(t *testing.T) ([]string, int) {
+	c := newCluster(t, 3)
+	c.net.SetLatency(0, 3)
+	c.net.SetDropRate(0.2)
+	c.net.SetReorder(true)
+	for i := 0; i < 300; i++ {
+		for _, id := range c.ids {
+			if c.nodes[id].Status().State == Leader {
+				if err := c.nodes[id].Propose([]byte(fmt.Sprintf("entry %d", i))); err != nil {
+					t.Fatal(err)
+				}
+				break
+			}
+		}
+		c.tick(1)
+	}
+
+	c.net.SetDropRate(0)
+	c.tick(200)
+	applied := c.machines[c.ids[0]].data()
+	for _, id := range c.ids[1:] {
+		if got := c.machines[id].data(); !reflect.DeepEqual(got, applied) {
+			t.Fatalf("%s applied %d entries, %s %d, or in another order", id, len(got), c.ids[0], len(applied))
+		}
+	}
+	return applied, c.net.Delivered(MsgAppend)
+}
+
+func TestLossyNetwork(t *testing.T) {
+	applied, delivered := lossyRun(t)
+	if len(applied) < 100 {
+		t.Fatalf("only %d of 300 entries committed", len(applied))
+	}
+
+	// The same seeds play out the same way
+	again, deliveredAgain := lossyRun(t)
+	if !reflect.DeepEqual(again, applied) || deliveredAgain != delivered {
+		t.Fatalf("second run applied %d entries from %d messages, first %d from %d",
+			len(again), deliveredAgain, len(applied), delivered)
+	}
+}
+
+// changeConf proposes a membership change to the leader and ticks until it
+// is applied everywhere that is up.
+func (c *cluster) changeConf(leader string, cc ConfChange) {
+	c.t.Helper()
+	if err := c.nodes[leader].ProposeConfChange(cc); err != nil {
+		c.t.Fatalf("%s %s: %v", cc.Type, cc.Node, err)
+	}
+	c.tick(20)
+}
+
+func TestAddLearnerThenPromote(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.waitLeader()
+	var want []string
+	for i := 0; i < 50; i++ {
+		data := fmt.Sprintf("entry %d", i)
+		if err := c.nodes[leader].Propose([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, data)
+	}
+	c.tick(10)
+
+	// The learner is sent the whole log but is not part of the quorum
+	c.join("n4", []string{"n1", "n2", "n3"})
+	c.changeConf(leader, ConfChange{Type: ConfAddLearner, Node: "n4"})
+	if got := c.machines["n4"].data(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("learner has %d entries, want %d", len(got), len(want))
+	}
+	status := c.nodes[leader].Status()
+	if !reflect.DeepEqual(status.Voters, []string{"n1", "n2", "n3"}) || !reflect.DeepEqual(status.Learners, []string{"n4"}) {
+		t.Fatalf("voters %v learners %v, want n1-n3 and n4", status.Voters, status.Learners)
+	}
+	if status.Match["n4"] != status.LastIndex {
+		t.Fatalf("learner matches up to %d, want %d", status.Match["n4"], status.LastIndex)
+	}
+
+	// Only one change may be in flight
+	if err := c.nodes[leader].ProposeConfChange(ConfChange{Type: ConfPromote, Node: "n4"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.nodes[leader].ProposeConfChange(ConfChange{Type: ConfRemove, Node: "n4"}); err != ErrConfChangePending {
+		t.Fatalf("second change error = %v, want ErrConfChangePending", err)
+	}
+	c.tick(20)
+	for _, id := range c.ids {
+		if voters := c.nodes[id].Status().Voters; len(voters) != 4 {
+			t.Fatalf("%s: voters %v, want 4 after the promotion", id, voters)
+		}
+	}
+	if err := c.nodes[leader].ProposeConfChange(ConfChange{Type: ConfPromote, Node: "n4"}); !errors.Is(err, ErrInvalidConfChange) {
+		t.Fatalf("promoting a voter: error = %v, want ErrInvalidConfChange", err)
+	}
+
+	// With four voters, two are not a quorum
+	c.net.Down(leader)
+	for _, id := range c.ids {
+		if id != leader && id != "n4" {
+			c.net.Down(id)
+			break
+		}
+	}
+	c.tick(500)
+	if leaders := c.leaders(); len(leaders) != 0 {
+		t.Fatalf("two of four voters elected %v", leaders)
+	}
+}
+
+func TestRemoveVoter(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.waitLeader()
+
+	// The removed leader commits its removal, steps down and stays out
+	c.changeConf(leader, ConfChange{Type: ConfRemove, Node: leader})
+	c.tick(500)
+	next := c.waitLeader()
+	if next == leader {
+		t.Fatalf("removed node %s still leads", leader)
+	}
+	if status := c.nodes[leader].Status(); status.State != Follower || len(status.Voters) != 2 {
+		t.Fatalf("removed node: %+v, want a follower that knows of two voters", status)
+	}
+	if err := c.nodes[next].Propose([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	c.tick(20)
+	for _, id := range c.ids {
+		if id == leader {
+			continue
+		}
+		if got := c.machines[id].data(); !reflect.DeepEqual(got, []string{"after"}) {
+			t.Fatalf("%s applied %v, want [after]", id, got)
+		}
+	}
+
+	// The last voter cannot go
+	var other string
+	for _, id := range c.ids {
+		if id != leader && id != next {
+			other = id
+		}
+	}
+	c.changeConf(next, ConfChange{Type: ConfRemove, Node: other})
+	if err := c.nodes[next].ProposeConfChange(ConfChange{Type: ConfRemove, Node: next}); !errors.Is(err, ErrInvalidConfChange) {
+		t.Fatalf("removing the last voter: error = %v, want ErrInvalidConfChange", err)
+	}
+	c.net.Down(other)
+	if err := c.nodes[next].Propose([]byte("alone")); err != nil {
+		t.Fatal(err)
+	}
+	c.tick(1)
+	if got := c.machines[next].data(); !reflect.DeepEqual(got, []string{"after", "alone"}) {
+		t.Fatalf("single voter applied %v, want [after alone]", got)
+	}
+}
+
+// received returns what came on a read's channel, failing the test if
+// nothing did.
+func received(t *testing.T, done chan readState) readState {
+	t.Helper()
+	select {
+	case state := <-done:
+		return state
+	default:
+		t.Fatal("read not answered")
+		return readState{}
+	}
+}
+
+func TestReadIndex(t *testing.T) {
+	single := newCluster(t, 1)
+	single.waitLeader()
+	if err := single.nodes["n1"].ReadIndex(context.Background(), false); err != nil {
+		t.Fatalf("single node read: %v", err)
+	}
+
+	c := newCluster(t, 3)
+	leader := c.waitLeader()
+	for i := 0; i < 5; i++ {
+		if err := c.nodes[leader].Propose([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.tick(10)
+	commit := c.nodes[leader].Status().CommitIndex
+
+	// The leader confirms it still leads before handing out a read index
+	done, _ := c.nodes[leader].startRead(false)
+	select {
+	case <-done:
+		t.Fatal("read confirmed before any follower answered")
+	default:
+	}
+	c.deliver()
+	if state := received(t, done); state.err != nil || state.index != commit {
+		t.Fatalf("leader read = %+v, want index %d", state, commit)
+	}
+
+	// A follower asks the leader
+	var follower string
+	for _, id := range c.ids {
+		if id != leader {
+			follower = id
+			break
+		}
+	}
+	done, _ = c.nodes[follower].startRead(false)
+	c.deliver()
+	if state := received(t, done); state.err != nil || state.index != commit {
+		t.Fatalf("follower read = %+v, want index %d", state, commit)
+	}
+
+	// A deposed leader cannot confirm a read, and fails it once it hears of
+	// the new term
+	c.net.Down(leader)
+	done, _ = c.nodes[leader].startRead(false)
+	c.waitLeader()
+	c.net.Up(leader)
+	c.tick(20)
+	if state := received(t, done); state.err != ErrNotLeader {
+		t.Fatalf("deposed leader read = %+v, want ErrNotLeader", state)
+	}
+}
+
+func TestLeaseRead(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.waitLeader()
+	c.tick(10)
+	node := c.nodes[leader]
+
+	// Within its lease the leader answers without a heartbeat round
+	sent := c.net.Delivered(MsgAppend)
+	done, _ := node.startRead(true)
+	if state := received(t, done); state.err != nil || state.index != node.Status().CommitIndex {
+		t.Fatalf("lease read = %+v, want the commit index", state)
+	}
+	c.deliver()
+	if c.net.Delivered(MsgAppend) != sent {
+		t.Fatalf("lease read sent %d heartbeats", c.net.Delivered(MsgAppend)-sent)
+	}
+
+	// Cut off, its lease runs out before anyone else could be elected and
+	// the read needs a round that cannot complete
+	c.net.Down(leader)
+	for i := 0; i < node.electionTicks; i++ {
+		node.Tick()
+	}
+	done, _ = node.startRead(true)
+	select {
+	case <-done:
+		t.Fatal("lease read answered after the lease ran out")
+	default:
+	}
+
+	// Without a quorum for an election timeout it steps down, failing the read
+	for i := 0; i < 4*node.electionTicks && node.Status().State == Leader; i++ {
+		node.Tick()
+	}
+	if status := node.Status(); status.State != Follower {
+		t.Fatalf("cut off leader is %s, want follower", status.State)
+	}
+	if state := received(t, done); state.err != ErrNotLeader {
+		t.Fatalf("read = %+v, want ErrNotLeader", state)
+	}
+}
+
+func TestPreVoteKeepsPartitionedNodeTerm(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.waitLeader()
+	term := c.nodes[leader].Status().Term
+	var cutOff string
+	for _, id := range c.ids {
+		if id != leader {
+			cutOff = id
+			break
+		}
+	}
+
+	// Cut off, the node keeps failing its pre-vote rather than running up
+	// the term
+	c.net.Partition([]string{cutOff})
+	c.tick(300)
+	if status := c.nodes[cutOff].Status(); status.State != PreCandidate || status.Term != term {
+		t.Fatalf("cut off node = %+v, want a pre-candidate still in term %d", status, term)
+	}
+
+	// So it rejoins without deposing the leader
+	c.net.Heal()
+	c.tick(100)
+	for _, id := range c.ids {
+		status := c.nodes[id].Status()
+		if status.Term != term || status.Leader != leader {
+			t.Fatalf("%s = %+v, want %s still leading term %d", id, status, leader, term)
+		}
+	}
+}
+
+func TestTransferLeadership(t *testing.T) {
+	c := newCluster(t, 3)
+	old := c.waitLeader()
+	term := c.nodes[old].Status().Term
+	var to string
+	for _, id := range c.ids {
+		if id != old {
+			to = id
+			break
+		}
+	}
+	if err := c.nodes[old].TransferLeadership(old); !errors.Is(err, ErrInvalidTransfer) {
+		t.Fatalf("transfer to the leader itself: err = %v, want ErrInvalidTransfer", err)
+	}
+
+	// The transferee missed entries, which it is sent before it campaigns
+	c.net.Down(to)
+	for i := 0; i < 5; i++ {
+		if err := c.nodes[old].Propose([]byte(fmt.Sprintf("entry %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.tick(10)
+	c.net.Up(to)
+	if err := c.nodes[old].TransferLeadership(to); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.nodes[old].Propose([]byte("during")); err != ErrTransferInProgress {
+		t.Fatalf("proposal during the transfer: err = %v, want ErrTransferInProgress", err)
+	}
+
+	// Well before anyone would time out
+	for i := 0; i < c.nodes[to].electionTicks/2 && c.nodes[to].Status().State != Leader; i++ {
+		c.tick(1)
+	}
+	status := c.nodes[to].Status()
+	if status.State != Leader || status.Term != term+1 {
+		t.Fatalf("transferee = %+v, want leader of term %d", status, term+1)
+	}
+	if err := c.nodes[to].Propose([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	c.tick(20)
+	want := []string{"entry 0", "entry 1", "entry 2", "entry 3", "entry 4", "after"}
+	for _, id := range c.ids {
+		if got := c.machines[id].data(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s applied %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestTransferLeadershipGivesUp(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.waitLeader()
+	var to string
+	for _, id := range c.ids {
+		if id != leader {
+			to = id
+			break
+		}
+	}
+
+	c.net.Down(to)
+	if err := c.nodes[leader].TransferLeadership(to); err != nil {
+		t.Fatal(err)
+	}
+	c.tick(2 * c.nodes[leader].electionTicks)
+	status := c.nodes[leader].Status()
+	if status.State != Leader || status.Transferee != "" {
+		t.Fatalf("leader = %+v, want it leading with the transfer given up", status)
+	}
+	if err := c.nodes[leader].Propose([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recorder is a transport that keeps what it is asked to send.
+type recorder struct {
+	sent []Message
+}
+
+func (r *recorder) Send(msg Message) {
+	r.sent = append(r.sent, msg)
+}
+
+// last returns the last message sent and forgets the rest.
+func (r *recorder) last() Message {
+	msg := r.sent[len(r.sent)-1]
+	r.sent = nil
+	return msg
+}
+
+func newNode(t *testing.T, storage Storage, transport Transport) *Raft {
+	r, err := NewRaft(Config{ID: "a", Voters: []string{"a", "b", "c"}, Storage: storage, Transport: transport, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestVotePersistsAcrossRestart(t *testing.T) {
+	storage := NewMemoryStorage()
+	out := &recorder{}
+	r := newNode(t, storage, out)
+
+	r.Step(Message{Type: MsgVote, From: "b", To: "a", Term: 5})
+	if reply := out.last(); reply.Type != MsgVoteResponse || reply.Reject || reply.Term != 5 {
+		t.Fatalf("reply to b = %+v, want a granted vote in term 5", reply)
+	}
+	if hs, _ := storage.HardState(); hs != (HardState{Term: 5, VotedFor: "b"}) {
+		t.Fatalf("hard state = %+v, want term 5 voted for b", hs)
+	}
+
+	// A restarted node remembers its vote and refuses anyone else this term
+	r = newNode(t, storage, out)
+	r.Step(Message{Type: MsgVote, From: "c", To: "a", Term: 5})
+	if reply := out.last(); !reply.Reject {
+		t.Fatalf("restarted node voted for c in term 5 after voting for b")
+	}
+	r.Step(Message{Type: MsgVote, From: "b", To: "a", Term: 5})
+	if reply := out.last(); reply.Reject {
+		t.Fatalf("restarted node refused b the vote it already gave it")
+	}
+
+	// A new term frees the vote
+	r.Step(Message{Type: MsgVote, From: "c", To: "a", Term: 6})
+	if reply := out.last(); reply.Reject || reply.Term != 6 {
+		t.Fatalf("reply to c = %+v, want a granted vote in term 6", reply)
+	}
+}
+
+func TestVoteRequiresUpToDateLog(t *testing.T) {
+	tests := []struct {
+		lastIndex, lastTerm uint64
+		granted             bool
+	}{
+		{lastIndex: 5, lastTerm: 1, granted: false}, // longer but older
+		{lastIndex: 1, lastTerm: 2, granted: false}, // same term, shorter
+		{lastIndex: 2, lastTerm: 2, granted: true},  // identical
+		{lastIndex: 3, lastTerm: 2, granted: true},  // same term, longer
+		{lastIndex: 1, lastTerm: 3, granted: true},  // shorter but newer
+	}
+	for i, tt := range tests {
+		out := &recorder{}
+		r := newNode(t, NewMemoryStorage(), out)
+		r.log = append(r.log, Entry{Index: 1, Term: 1}, Entry{Index: 2, Term: 2})
+
+		r.Step(Message{Type: MsgVote, From: "b", To: "a", Term: 4, Index: tt.lastIndex, LogTerm: tt.lastTerm})
+		if reply := out.last(); reply.Reject == tt.granted {
+			t.Errorf("%d: candidate log ending at %d/%d granted = %v, want %v", i, tt.lastIndex, tt.lastTerm, !reply.Reject, tt.granted)
+		}
+	}
+}
+
+func TestLeaderStepsDownOnHigherTerm(t *testing.T) {
+	out := &recorder{}
+	r := newNode(t, NewMemoryStorage(), out)
+	r.Step(Message{Type: MsgVote, From: "b", To: "a", Term: 1}) // skip to term 1
+
+	// Win the pre-vote, then term 2
+	for r.Status().State != PreCandidate {
+		r.Tick()
+	}
+	if msg := out.last(); msg.Type != MsgPreVote || msg.Term != 2 || r.Status().Term != 1 {
+		t.Fatalf("sent %+v in term %d, want a pre-vote for term 2 from term 1", msg, r.Status().Term)
+	}
+	r.Step(Message{Type: MsgPreVoteResponse, From: "b", To: "a", Term: 2})
+	r.Step(Message{Type: MsgVoteResponse, From: "b", To: "a", Term: 2})
+	if status := r.Status(); status.State != Leader || status.Term != 2 {
+		t.Fatalf("status = %+v, want leader in term 2", status)
+	}
+
+	// A follower answers from a later term
+	r.Step(Message{Type: MsgAppendResponse, From: "c", To: "a", Term: 3, Reject: true})
+	if status := r.Status(); status.State != Follower || status.Term != 3 || status.Leader != "" {
+		t.Fatalf("status = %+v, want a leaderless follower in term 3", status)
+	}
+}
+
+func TestAppendRepairsDivergentLog(t *testing.T) {
+	out := &recorder{}
+	r := newNode(t, NewMemoryStorage(), out)
+	// Entries 3 and 4 came from a leader of term 2 that never committed them
+	r.log = append(r.log, Entry{Index: 1, Term: 1}, Entry{Index: 2, Term: 1}, Entry{Index: 3, Term: 2}, Entry{Index: 4, Term: 2})
+
+	// The term 3 leader's entry 4 is of term 3, not 2
+	r.Step(Message{Type: MsgAppend, From: "b", To: "a", Term: 3, Index: 4, LogTerm: 3})
+	if reply := out.last(); !reply.Reject || reply.Hint != 3 {
+		t.Fatalf("reply = %+v, want a rejection hinting index 3", reply)
+	}
+
+	r.Step(Message{Type: MsgAppend, From: "b", To: "a", Term: 3, Index: 2, LogTerm: 1, Commit: 3,
+		Entries: []Entry{{Index: 3, Term: 3}}})
+	if reply := out.last(); reply.Reject || reply.Index != 3 {
+		t.Fatalf("reply = %+v, want a match up to index 3", reply)
+	}
+	status := r.Status()
+	if status.LastIndex != 3 || r.termAt(3) != 3 || status.CommitIndex != 3 || status.Leader != "b" {
+		t.Fatalf("status = %+v with term %d at 3, want the log cut to 3 of term 3, committed, led by b", status, r.termAt(3))
+	}
+}
+
+func TestStaleAppendKeepsCommitIndex(t *testing.T) {
+	out := &recorder{}
+	r := newNode(t, NewMemoryStorage(), out)
+	entries := []Entry{{Index: 1, Term: 1, Data: []byte("a")}, {Index: 2, Term: 1, Data: []byte("b")}, {Index: 3, Term: 1, Data: []byte("c")}}
+	r.Step(Message{Type: MsgAppend, From: "b", To: "a", Term: 1, Commit: 5, Entries: entries})
+	if status := r.Status(); status.CommitIndex != 3 {
+		t.Fatalf("commit index = %d, want 3", status.CommitIndex)
+	}
+
+	// A delayed append from before carries fewer entries but a later commit
+	r.Step(Message{Type: MsgAppend, From: "b", To: "a", Term: 1, Commit: 6, Entries: entries[:1]})
+	if reply := out.last(); reply.Reject || reply.Index != 1 {
+		t.Fatalf("reply = %+v, want a match up to index 1", reply)
+	}
+	if status := r.Status(); status.CommitIndex != 3 || status.LastIndex != 3 {
+		t.Fatalf("status = %+v, want entries up to 3 kept and committed", status)
+	}
+}
+
+func TestVoteIgnoredWhileLeaderHeard(t *testing.T) {
+	out := &recorder{}
+	r := newNode(t, NewMemoryStorage(), out)
+	r.Step(Message{Type: MsgAppend, From: "b", To: "a", Term: 2})
+	out.sent = nil
+
+	// c timed out, but b is still heard from
+	r.Step(Message{Type: MsgVote, From: "c", To: "a", Term: 3})
+	if status := r.Status(); len(out.sent) != 0 || status.Term != 2 || status.Leader != "b" {
+		t.Fatalf("status %+v after sending %v, want the vote ignored", status, out.sent)
+	}
+
+	// After the minimum election timeout without b, c can have the vote
+	r.electionElapsed = r.electionTicks
+	r.Step(Message{Type: MsgVote, From: "c", To: "a", Term: 3})
+	if reply := out.last(); reply.Reject || reply.Term != 3 {
+		t.Fatalf("reply to c = %+v, want a granted vote in term 3", reply)
+	}
+}
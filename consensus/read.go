@@ -0,0 +1,209 @@
+package consensus
+
+import (
+	"context"
+	"sort"
+)
+
+// Reads do not go through the log. Instead a read waits until the state
+// machine has applied every entry committed before the read started, its
+// read index, which the leader only hands out once it knows it still leads:
+// either a quorum answered a heartbeat sent after the read arrived, or the
+// leader's lease, the time in which no other leader can be elected, has not
+// run out. Followers ask the leader for the read index.
+
+// readRequest is a read waiting for the leader to confirm it still leads.
+type readRequest struct {
+	index uint64         // read index
+	round uint64         // heartbeat round a quorum must answer
+	from  string         // follower that asked, or empty for a read on this node
+	id    uint64         // the follower's ID for the read
+	done  chan readState // reads on this node only
+}
+
+// readState is the outcome of asking for a read index.
+type readState struct {
+	index uint64
+	err   error
+}
+
+// ReadIndex returns once the state machine reflects every entry committed
+// before it was called, so that reading from it then is linearizable. With
+// lease set, a leader whose lease has not run out skips the heartbeat round
+// that confirms it leads; the lease relies on the nodes' clocks ticking at
+// about the same rate. A follower always asks the leader for a confirmed
+// read index. ErrNotLeader is returned when no leader is known or leadership
+// changes before the read is confirmed.
+func (r *Raft) ReadIndex(ctx context.Context, lease bool) error {
+	done, id := r.startRead(lease)
+	select {
+	case state := <-done:
+		if state.err != nil {
+			return state.err
+		}
+		return r.waitApplied(ctx, state.index)
+	case <-ctx.Done():
+		if id != 0 {
+			r.mutex.Lock()
+			delete(r.reads, id)
+			r.mutex.Unlock()
+		}
+		return ctx.Err()
+	}
+}
+
+// startRead asks for a read index. The index comes on the channel returned;
+// a read sent to the leader also returns its ID.
+func (r *Raft) startRead(lease bool) (chan readState, uint64) {
+	done := make(chan readState, 1)
+	var id uint64
+
+	r.mutex.Lock()
+	switch {
+	case r.state == Leader && lease && r.leaseValid():
+		done <- readState{index: r.readIndex()}
+	case r.state == Leader:
+		r.pendingReads = append(r.pendingReads, &readRequest{index: r.readIndex(), round: r.round + 1, done: done})
+		r.broadcastAppend()
+		r.advanceReads()
+	case r.leader == "":
+		done <- readState{err: ErrNotLeader}
+	default:
+		r.readID++
+		id = r.readID
+		r.reads[id] = done
+		r.send(Message{Type: MsgReadIndex, To: r.leader, Read: id})
+	}
+	r.flush()
+	return done, id
+}
+
+// waitApplied waits until the state machine has applied the entry at index.
+func (r *Raft) waitApplied(ctx context.Context, index uint64) error {
+	for {
+		r.mutex.Lock()
+		applied, advanced := r.applied, r.appliedAdvanced
+		r.mutex.Unlock()
+		if applied >= index {
+			return nil
+		}
+		select {
+		case <-advanced:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// setApplied records that the state machine has applied up to index and
+// wakes the reads waiting for it.
+func (r *Raft) setApplied(index uint64) {
+	r.applied = index
+	close(r.appliedAdvanced)
+	r.appliedAdvanced = make(chan struct{})
+}
+
+// readIndex is the index a read that arrives now must wait for: the commit
+// index, or if the leader has yet to commit an entry of its term, and so may
+// not know the latest commit index, its last entry.
+func (r *Raft) readIndex() uint64 {
+	if r.termAt(r.commitIndex) != r.term {
+		return r.lastIndex()
+	}
+	return r.commitIndex
+}
+
+// leaseValid reports whether no other leader can have been elected since a
+// quorum last answered the leader: they ignore candidates for the minimum
+// election timeout after hearing from it. That does not hold for the campaign
+// of a leadership transfer, so a leader handing over leadership has no lease.
+func (r *Raft) leaseValid() bool {
+	if r.transferee != "" {
+		return false
+	}
+	if len(r.conf.Voters) == 1 && r.voters[r.id] {
+		return true
+	}
+	return r.ticks < r.leaseUntil
+}
+
+// handleReadIndex confirms a follower's read like one made on the leader.
+func (r *Raft) handleReadIndex(msg Message) {
+	if r.state != Leader {
+		r.send(Message{Type: MsgReadIndexResponse, To: msg.From, Read: msg.Read, Reject: true})
+		return
+	}
+	r.pendingReads = append(r.pendingReads, &readRequest{index: r.readIndex(), round: r.round + 1, from: msg.From, id: msg.Read})
+	r.broadcastAppend()
+	r.advanceReads()
+}
+
+func (r *Raft) handleReadIndexResponse(msg Message) {
+	done, ok := r.reads[msg.Read]
+	if !ok {
+		return
+	}
+	delete(r.reads, msg.Read)
+	if msg.Reject {
+		done <- readState{err: ErrNotLeader}
+		return
+	}
+	done <- readState{index: msg.Index}
+}
+
+// advanceReads finds the latest heartbeat round a quorum of voters has
+// answered, extends the lease from when that round was sent and confirms
+// the reads waiting on it.
+func (r *Raft) advanceReads() {
+	answered := make([]uint64, 0, len(r.conf.Voters))
+	for _, id := range r.conf.Voters {
+		if id == r.id {
+			answered = append(answered, r.round)
+		} else {
+			answered = append(answered, r.acked[id])
+		}
+	}
+	sort.Slice(answered, func(i, j int) bool { return answered[i] > answered[j] })
+	round := answered[r.quorum()-1]
+
+	if tick, ok := r.roundTicks[round]; ok && tick >= r.leaseFrom && r.transferee == "" {
+		// A tick short of the election timeout, for the ticks not lining up
+		r.leaseUntil = max(r.leaseUntil, tick+r.electionTicks-1)
+	}
+	for sent := range r.roundTicks {
+		if sent <= round {
+			delete(r.roundTicks, sent)
+		}
+	}
+
+	waiting := r.pendingReads[:0]
+	for _, read := range r.pendingReads {
+		if read.round > round {
+			waiting = append(waiting, read)
+			continue
+		}
+		if read.done != nil {
+			read.done <- readState{index: read.index}
+		} else {
+			r.send(Message{Type: MsgReadIndexResponse, To: read.from, Index: read.index, Read: read.id})
+		}
+	}
+	r.pendingReads = waiting
+}
+
+// failReads tells every read waiting on this node's leadership, or on a
+// leader it no longer follows, that it failed.
+func (r *Raft) failReads() {
+	for _, read := range r.pendingReads {
+		if read.done != nil {
+			read.done <- readState{err: ErrNotLeader}
+		} else {
+			r.send(Message{Type: MsgReadIndexResponse, To: read.from, Read: read.id, Reject: true})
+		}
+	}
+	r.pendingReads = nil
+	for id, done := range r.reads {
+		done <- readState{err: ErrNotLeader}
+		delete(r.reads, id)
+	}
+}
@@ -0,0 +1,425 @@
+package consensus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/artorias742/DTP/monitoring"
+)
+
+// ErrCorruptLog is returned when the log on disk is damaged anywhere but at
+// the end of its last segment, the only place a crash mid-append can tear.
+var ErrCorruptLog = errors.New("raft log is corrupt")
+
+// entryHeaderSize is the length and CRC-32C of an encoded entry, both big
+// endian, which precede it in a segment file.
+const entryHeaderSize = 8
+
+// entryFixedSize is the index, term and type that start an encoded entry;
+// the data makes up the rest.
+const entryFixedSize = 17
+
+// maxEntrySize bounds a single entry so a garbage length in a torn header is
+// not mistaken for a huge entry.
+const maxEntrySize = 64 << 20
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errTorn marks an entry that is cut short, fails its checksum or does not
+// follow the one before it.
+var errTorn = errors.New("torn entry")
+
+// errFound stops a scan of a segment once it reaches the entry looked for.
+var errFound = errors.New("entry found")
+
+// logSegment is one file of the log, named after the index of its first
+// entry. Segments hold consecutive entries and each one picks up where the
+// one before it ends.
+type logSegment struct {
+	first uint64
+	path  string
+}
+
+// openLog reads the segments in the directory, checks that their entries
+// follow on from one another and cuts a torn entry off the end of the last
+// one, which it opens for appending.
+func (f *FileStorage) openLog() error {
+	segments, err := listLogSegments(f.dir)
+	if err != nil {
+		return err
+	}
+	for i, seg := range segments {
+		if i > 0 && seg.first != f.next {
+			return fmt.Errorf("%w: segment %s starts at %d, expected %d", ErrCorruptLog, seg.path, seg.first, f.next)
+		}
+		f.next = seg.first
+		valid, err := readEntries(seg.path, func(entry Entry, _ int64) error {
+			if entry.Index != f.next {
+				return errTorn
+			}
+			f.next++
+			return nil
+		})
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, errTorn) || i != len(segments)-1 {
+			return fmt.Errorf("%w: %s: %v", ErrCorruptLog, seg.path, err)
+		}
+		monitoring.GetLogger().Warn("Dropping torn entry at the end of the Raft log", "segment", seg.path, "index", f.next)
+		if err := os.Truncate(seg.path, valid); err != nil {
+			return err
+		}
+	}
+	f.segments = segments
+	if len(segments) == 0 {
+		return nil
+	}
+
+	last := segments[len(segments)-1]
+	if f.file, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return err
+	}
+	info, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	f.size = info.Size()
+	return nil
+}
+
+func (f *FileStorage) Entries(after uint64) ([]Entry, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if len(f.segments) == 0 || f.segments[0].first > after+1 || f.next <= after+1 {
+		return nil, nil
+	}
+	var entries []Entry
+	for i, seg := range f.segments {
+		if i+1 < len(f.segments) && f.segments[i+1].first <= after+1 {
+			continue
+		}
+		_, err := readEntries(seg.path, func(entry Entry, _ int64) error {
+			if entry.Index > after {
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// Append writes the entries in as few writes as the segment size allows and,
+// under SyncAlways, syncs them.
+func (f *FileStorage) Append(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	first := entries[0].Index
+	if len(f.segments) > 0 && first > f.next {
+		return fmt.Errorf("%w: entry %d does not follow entry %d", ErrLogGap, first, f.next-1)
+	}
+	if len(f.segments) > 0 && first < f.next {
+		if err := f.truncate(first); err != nil {
+			return err
+		}
+	}
+	if len(f.segments) == 0 {
+		// An empty log starts wherever the entries do
+		if err := f.rotate(first); err != nil {
+			return err
+		}
+	}
+
+	var buf []byte
+	for _, entry := range entries {
+		frame := frameEntry(entry)
+		if f.size+int64(len(buf)) > 0 && f.size+int64(len(buf)+len(frame)) > f.options.SegmentSize {
+			if err := f.write(buf, entry.Index); err != nil {
+				return err
+			}
+			buf = nil
+			if err := f.rotate(entry.Index); err != nil {
+				return err
+			}
+		}
+		buf = append(buf, frame...)
+	}
+	if err := f.write(buf, entries[len(entries)-1].Index+1); err != nil {
+		return err
+	}
+
+	if f.options.Sync == SyncAlways {
+		return f.file.Sync()
+	}
+	f.dirty = true
+	return nil
+}
+
+// write appends encoded entries to the last segment, after which next is
+// the index that follows them. A failed write is cut off again so the
+// entries can be retried.
+func (f *FileStorage) write(buf []byte, next uint64) error {
+	if len(buf) == 0 {
+		return nil
+	}
+	if _, err := f.file.Write(buf); err != nil {
+		f.file.Truncate(f.size)
+		return err
+	}
+	f.size += int64(len(buf))
+	f.next = next
+	return nil
+}
+
+func (f *FileStorage) Compact(index uint64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	removed := 0
+	for removed+1 < len(f.segments) && f.segments[removed+1].first <= index+1 {
+		if err := os.Remove(f.segments[removed].path); err != nil {
+			return err
+		}
+		removed++
+	}
+	if removed == 0 {
+		return nil
+	}
+	f.segments = append([]logSegment(nil), f.segments[removed:]...)
+	return syncDir(f.dir)
+}
+
+func (f *FileStorage) Reset(index uint64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.truncate(0); err != nil {
+		return err
+	}
+	return f.rotate(index + 1)
+}
+
+// Close stops the periodic sync, if any, then syncs and closes the log.
+func (f *FileStorage) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.stop != nil {
+		close(f.stop)
+		f.stop = nil
+	}
+	if f.file == nil {
+		return nil
+	}
+	if err := f.file.Sync(); err != nil {
+		return err
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// truncate drops the entries from index on and leaves the segment holding
+// the one before open for appending, or no segments at all. Segments go from
+// the last one back, so a crash part way leaves a shorter log rather than one
+// with a hole. The caller must hold the mutex.
+func (f *FileStorage) truncate(index uint64) error {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	for len(f.segments) > 0 && f.segments[len(f.segments)-1].first >= index {
+		if err := os.Remove(f.segments[len(f.segments)-1].path); err != nil {
+			return err
+		}
+		f.segments = f.segments[:len(f.segments)-1]
+	}
+	if err := syncDir(f.dir); err != nil {
+		return err
+	}
+	if len(f.segments) == 0 {
+		f.next, f.size = 0, 0
+		return nil
+	}
+
+	seg := f.segments[len(f.segments)-1]
+	offset, err := readEntries(seg.path, func(entry Entry, _ int64) error {
+		if entry.Index == index {
+			return errFound
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errFound) {
+		return err
+	}
+	if err := os.Truncate(seg.path, offset); err != nil {
+		return err
+	}
+	if f.file, err = os.OpenFile(seg.path, os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return err
+	}
+	f.size = offset
+	f.next = index
+	return nil
+}
+
+// rotate syncs and closes the last segment and starts a new one whose first
+// entry is first. The caller must hold the mutex.
+func (f *FileStorage) rotate(first uint64) error {
+	if f.file != nil {
+		if err := f.file.Sync(); err != nil {
+			return err
+		}
+		if err := f.file.Close(); err != nil {
+			return err
+		}
+		f.file = nil
+	}
+
+	seg := logSegment{first: first, path: filepath.Join(f.dir, fmt.Sprintf("log-%020d.log", first))}
+	file, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(f.dir); err != nil {
+		file.Close()
+		return err
+	}
+	f.segments = append(f.segments, seg)
+	f.file = file
+	f.size = 0
+	f.next = first
+	return nil
+}
+
+// syncLoop syncs appended entries every SyncInterval until stop is closed.
+func (f *FileStorage) syncLoop(stop chan struct{}) {
+	ticker := time.NewTicker(f.options.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			f.mutex.Lock()
+			if f.dirty && f.file != nil {
+				if err := f.file.Sync(); err != nil {
+					monitoring.GetLogger().Error("Failed to sync Raft log", "error", err)
+				} else {
+					f.dirty = false
+				}
+			}
+			f.mutex.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// readEntries calls fn with each entry in a segment file and its offset,
+// and returns the offset just past the last entry it accepted, or of the
+// entry fn stopped at. It stops with errTorn at the first entry that is
+// incomplete or fails its checksum.
+func readEntries(path string, fn func(entry Entry, offset int64) error) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	header := make([]byte, entryHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			return offset, errTorn
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		if length < entryFixedSize || length > maxEntrySize {
+			return offset, errTorn
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return offset, errTorn
+		}
+		if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+			return offset, errTorn
+		}
+		entry := Entry{
+			Index: binary.BigEndian.Uint64(payload[0:8]),
+			Term:  binary.BigEndian.Uint64(payload[8:16]),
+			Type:  EntryType(payload[16]),
+		}
+		if len(payload) > entryFixedSize {
+			entry.Data = payload[entryFixedSize:]
+		}
+		if err := fn(entry, offset); err != nil {
+			return offset, err
+		}
+		offset += int64(entryHeaderSize) + int64(length)
+	}
+}
+
+// frameEntry encodes an entry and prefixes it with its length and checksum.
+func frameEntry(entry Entry) []byte {
+	length := entryFixedSize + len(entry.Data)
+	buf := make([]byte, entryHeaderSize+length)
+	payload := buf[entryHeaderSize:]
+	binary.BigEndian.PutUint64(payload[0:8], entry.Index)
+	binary.BigEndian.PutUint64(payload[8:16], entry.Term)
+	payload[16] = byte(entry.Type)
+	copy(payload[entryFixedSize:], entry.Data)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(length))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	return buf
+}
+
+// listLogSegments returns the segment files in dir ordered by first index.
+func listLogSegments(dir string) ([]logSegment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []logSegment
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "log-") || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		var first uint64
+		if _, err := fmt.Sscanf(name, "log-%d.log", &first); err != nil {
+			continue
+		}
+		segments = append(segments, logSegment{first: first, path: filepath.Join(dir, name)})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].first < segments[j].first })
+	return segments, nil
+}
+
+// syncDir makes file creations and removals in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
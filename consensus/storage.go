@@ -0,0 +1,241 @@
+package consensus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrLogGap is returned for entries appended past the end of the log.
+var ErrLogGap = errors.New("entries do not follow the log")
+
+// HardState is the part of a node's state that must survive a restart before
+// it answers any RPC: a node that forgot its term or its vote could vote twice
+// in the same term.
+type HardState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+// Storage keeps a node's hard state and its log. Raft writes both before it
+// sends any message that depends on them, so an entry a follower
+// acknowledged, or a vote it granted, is not forgotten in a crash.
+// SetHardState must not return until the state is durable; whether Append
+// does depends on the storage's sync policy.
+type Storage interface {
+	HardState() (HardState, error)
+	SetHardState(state HardState) error
+
+	// Entries returns the entries after index, the last one the state
+	// machine applied, or none if the log does not continue from there.
+	Entries(after uint64) ([]Entry, error)
+
+	// Append writes entries to the log, first dropping any it holds from
+	// the index of the first one on, which conflict with them.
+	Append(entries []Entry) error
+
+	// Compact may drop the entries up to index, which are applied.
+	Compact(index uint64) error
+
+	// Reset drops every entry, for a log that now starts after index, as
+	// when a snapshot replaces it.
+	Reset(index uint64) error
+}
+
+// MemoryStorage keeps the hard state and the log in memory. It survives a
+// Raft instance being replaced, which is enough for tests, but not a process
+// restart.
+type MemoryStorage struct {
+	state   HardState
+	entries []Entry
+	mutex   sync.Mutex
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+func (m *MemoryStorage) HardState() (HardState, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.state, nil
+}
+
+func (m *MemoryStorage) SetHardState(state HardState) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.state = state
+	return nil
+}
+
+func (m *MemoryStorage) Entries(after uint64) ([]Entry, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i, entry := range m.entries {
+		if entry.Index == after+1 {
+			return append([]Entry(nil), m.entries[i:]...), nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemoryStorage) Append(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	first := entries[0].Index
+	if n := len(m.entries); n > 0 && first > m.entries[n-1].Index+1 {
+		return fmt.Errorf("%w: entry %d does not follow entry %d", ErrLogGap, first, m.entries[n-1].Index)
+	}
+	kept := m.entries[:0]
+	for _, entry := range m.entries {
+		if entry.Index < first {
+			kept = append(kept, entry)
+		}
+	}
+	m.entries = append(kept, entries...)
+	return nil
+}
+
+func (m *MemoryStorage) Compact(index uint64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for len(m.entries) > 0 && m.entries[0].Index <= index {
+		m.entries = m.entries[1:]
+	}
+	return nil
+}
+
+func (m *MemoryStorage) Reset(index uint64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.entries = nil
+	return nil
+}
+
+// SyncPolicy says when FileStorage forces appended entries to disk. Hard
+// state is synced on every change whatever the policy.
+type SyncPolicy int
+
+const (
+	// SyncAlways syncs before Append returns, so nothing is acknowledged
+	// that a crash could lose.
+	SyncAlways SyncPolicy = iota
+
+	// SyncPeriodic syncs every SyncInterval. Entries appended since the
+	// last sync are lost if the machine crashes, so entries acknowledged by
+	// a quorum can be lost if a quorum crashes together; a process crash
+	// alone loses nothing.
+	SyncPeriodic
+
+	// SyncNever leaves syncing to the operating system, with the same risk
+	// for however long it waits.
+	SyncNever
+)
+
+// FileStorageOptions tunes FileStorage; zero values take the defaults.
+type FileStorageOptions struct {
+	SegmentSize  int64         // size at which the log starts a new segment file; default 64MB
+	Sync         SyncPolicy    // default SyncAlways
+	SyncInterval time.Duration // for SyncPeriodic; default 10ms
+}
+
+// FileStorage keeps the hard state in a file in a directory, and the log in
+// segment files next to it. Each hard state update is written to a new file
+// that replaces the old one, so a crash leaves either the old state or the
+// new one; the log is appended to and a crash at worst tears its last entry,
+// which is dropped when it is opened again.
+type FileStorage struct {
+	dir     string
+	options FileStorageOptions
+
+	mutex    sync.Mutex
+	segments []logSegment // ordered by first index; the last is open for appending
+	file     *os.File
+	size     int64  // bytes in the last segment
+	next     uint64 // index the next entry must have, 0 while the log is empty and can start anywhere
+	dirty    bool   // appended to since the last sync
+	stop     chan struct{}
+}
+
+// OpenFileStorage creates dir if needed and returns a storage keeping its
+// state there, with the log as it was before the last crash less any entry
+// torn by it.
+func OpenFileStorage(dir string, options FileStorageOptions) (*FileStorage, error) {
+	if options.SegmentSize <= 0 {
+		options.SegmentSize = 64 << 20
+	}
+	if options.SyncInterval <= 0 {
+		options.SyncInterval = 10 * time.Millisecond
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	f := &FileStorage{dir: dir, options: options}
+	if err := f.openLog(); err != nil {
+		return nil, err
+	}
+	if options.Sync == SyncPeriodic {
+		f.stop = make(chan struct{})
+		go f.syncLoop(f.stop)
+	}
+	return f, nil
+}
+
+func (f *FileStorage) path() string {
+	return filepath.Join(f.dir, "hardstate.json")
+}
+
+func (f *FileStorage) HardState() (HardState, error) {
+	var state HardState
+	data, err := os.ReadFile(f.path())
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func (f *FileStorage) SetHardState(state HardState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := f.path() + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, f.path()); err != nil {
+		return err
+	}
+
+	// Sync the directory so the rename itself survives a crash
+	return syncDir(f.dir)
+}
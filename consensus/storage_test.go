@@ -0,0 +1,275 @@
+package consensus
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// kill stops a node as if its process died: it is cut off and its storage
+// closed. What it wrote stays on disk for restart.
+func (c *cluster) kill(id string) {
+	c.net.Down(id)
+	if storage, ok := c.storages[id].(*FileStorage); ok {
+		if err := storage.Close(); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+// killMidAppend kills the node msg is for while it appends msg's entries,
+// which follow its log: all but the end of the last one reached the disk,
+// and it acknowledged none of them.
+func (c *cluster) killMidAppend(msg Message) {
+	storage := c.storages[msg.To].(*FileStorage)
+	next := storage.next
+	c.kill(msg.To)
+	if msg.Index+1 != next {
+		return // it died before writing anything
+	}
+
+	var buf []byte
+	for _, entry := range msg.Entries {
+		buf = append(buf, frameEntry(entry)...)
+	}
+	buf = buf[:len(buf)-len(frameEntry(msg.Entries[len(msg.Entries)-1]))/2]
+	segment := storage.segments[len(storage.segments)-1]
+	file, err := os.OpenFile(segment.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write(buf); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// restart brings a killed node back from what it stored.
+func (c *cluster) restart(id string) {
+	c.storages[id] = c.openStorage(id)
+	c.start(id)
+	c.net.Up(id)
+}
+
+// checkPrefixes fails the test unless what each node applied is where the
+// node that applied the most started.
+func (c *cluster) checkPrefixes() {
+	c.t.Helper()
+	var longest []string
+	for _, id := range c.ids {
+		if data := c.machines[id].data(); len(data) > len(longest) {
+			longest = data
+		}
+	}
+	for _, id := range c.ids {
+		for i, data := range c.machines[id].data() {
+			if data != longest[i] {
+				c.t.Fatalf("%s applied %q at %d where another node applied %q", id, data, i, longest[i])
+			}
+		}
+	}
+}
+
+func TestFileStorageDropsTornEntry(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := OpenFileStorage(dir, FileStorageOptions{SegmentSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []Entry
+	for i := uint64(1); i <= 10; i++ {
+		entries = append(entries, Entry{Index: i, Term: 1, Data: []byte(fmt.Sprintf("entry %d", i))})
+	}
+	if err := storage.Append(entries); err != nil {
+		t.Fatal(err)
+	}
+	// A new leader's entries replace 8 to 10, across segments
+	if err := storage.Append([]Entry{{Index: 8, Term: 2, Data: []byte("new 8")}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(storage.segments) < 2 {
+		t.Fatalf("%d segments, want the entries split across several", len(storage.segments))
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Killed while appending entry 9
+	last := storage.segments[len(storage.segments)-1].path
+	frame := frameEntry(Entry{Index: 9, Term: 2, Data: []byte("new 9")})
+	file, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(frame[:len(frame)-3])
+	file.Close()
+
+	storage, err = OpenFileStorage(dir, FileStorageOptions{SegmentSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := storage.Entries(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]Entry(nil), entries[4:7]...), Entry{Index: 8, Term: 2, Data: []byte("new 8")})
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("entries after 4 = %v, want %v", got, want)
+	}
+	// Appending carries on where the torn entry was cut off
+	if err := storage.Append([]Entry{{Index: 9, Term: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Append([]Entry{{Index: 11, Term: 2}}); err == nil {
+		t.Fatal("appended entry 11 after entry 9")
+	}
+	storage.Close()
+}
+
+func TestNoDoubleVoteAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := OpenFileStorage(dir, FileStorageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &recorder{}
+	r := newNode(t, storage, out)
+	r.Step(Message{Type: MsgVote, From: "b", To: "a", Term: 5})
+	if reply := out.last(); reply.Reject {
+		t.Fatalf("reply to b = %+v, want a granted vote", reply)
+	}
+
+	// b wins and sends entries; the node dies appending them, and also
+	// leaves behind half a hard state update
+	r.Step(Message{Type: MsgAppend, From: "b", To: "a", Term: 5, Entries: []Entry{{Index: 1, Term: 5}}})
+	storage.Close()
+	frame := frameEntry(Entry{Index: 2, Term: 5, Data: []byte("torn")})
+	file, err := os.OpenFile(storage.segments[0].path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(frame[:entryHeaderSize+4])
+	file.Close()
+	if err := os.WriteFile(filepath.Join(dir, "hardstate.json.tmp"), []byte(`{"term":5,"vo`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err = OpenFileStorage(dir, FileStorageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	r = newNode(t, storage, out)
+	if status := r.Status(); status.Term != 5 || status.LastIndex != 1 {
+		t.Fatalf("restarted node = %+v, want term 5 with entry 1 and no torn entry", status)
+	}
+	r.Step(Message{Type: MsgVote, From: "c", To: "a", Term: 5, Index: 1, LogTerm: 5})
+	if reply := out.last(); !reply.Reject {
+		t.Fatal("restarted node voted for c in term 5 after voting for b")
+	}
+}
+
+func TestCommittedEntriesSurviveCrash(t *testing.T) {
+	c := newClusterIn(t, 3, Config{}, t.TempDir())
+	leader := c.waitLeader()
+	var followers []string
+	for _, id := range c.ids {
+		if id != leader {
+			followers = append(followers, id)
+		}
+	}
+
+	// One follower dies appending, the other keeps the quorum
+	c.killOnAppend = followers[0]
+	for i := 0; i < 20; i++ {
+		if err := c.nodes[leader].Propose([]byte(fmt.Sprintf("entry %d", i))); err != nil {
+			t.Fatal(err)
+		}
+		c.tick(1)
+	}
+	if !c.net.IsDown(followers[0]) {
+		t.Fatalf("%s was not killed", followers[0])
+	}
+	c.restart(followers[0])
+	c.tick(20)
+
+	// The last entry commits on the leader, which applies it, but the
+	// followers have yet to hear it committed when the whole cluster dies
+	if err := c.nodes[leader].Propose([]byte("last")); err != nil {
+		t.Fatal(err)
+	}
+	c.deliver()
+	committed := c.machines[leader].data()
+	if committed[len(committed)-1] != "last" {
+		t.Fatalf("leader applied %v, want it to end with last", committed)
+	}
+	for _, id := range c.ids {
+		c.kill(id)
+	}
+
+	// The followers come back without the old leader and still have it
+	for _, id := range followers {
+		c.restart(id)
+	}
+	c.leaderAmong(followers)
+	c.tick(20)
+	for _, id := range followers {
+		if got := c.machines[id].data(); !reflect.DeepEqual(got, committed) {
+			t.Fatalf("%s applied %v, want %v", id, got, committed)
+		}
+	}
+}
+
+func TestRandomCrashesKeepCommittedEntries(t *testing.T) {
+	c := newClusterIn(t, 5, Config{LogEntries: 20}, t.TempDir())
+	rng := rand.New(rand.NewSource(1))
+	proposed := 0
+	for i := 0; i < 3000; i++ {
+		if leaders := c.leaders(); len(leaders) == 1 && c.nodes[leaders[0]].Propose([]byte(fmt.Sprintf("entry %d", proposed))) == nil {
+			proposed++
+		}
+
+		var up, down []string
+		for _, id := range c.ids {
+			if c.net.IsDown(id) {
+				down = append(down, id)
+			} else {
+				up = append(up, id)
+			}
+		}
+		switch n := rng.Intn(100); {
+		case n < 2 && len(down) < 2:
+			c.kill(up[rng.Intn(len(up))])
+		case n < 4 && len(down) < 2:
+			c.killOnAppend = up[rng.Intn(len(up))]
+		case n < 8 && len(down) > 0:
+			c.restart(down[rng.Intn(len(down))])
+		}
+		c.tick(1)
+		if i%10 == 0 {
+			c.checkPrefixes()
+		}
+	}
+
+	for _, id := range c.ids {
+		if c.net.IsDown(id) {
+			c.restart(id)
+		}
+	}
+	c.killOnAppend = ""
+	c.tick(200)
+	c.checkPrefixes()
+	want := c.machines[c.ids[0]].data()
+	for _, id := range c.ids {
+		if got := c.machines[id].data(); len(got) != len(want) {
+			t.Fatalf("%s applied %d entries, %s %d", id, len(got), c.ids[0], len(want))
+		}
+	}
+	if len(want) < proposed/2 {
+		t.Fatalf("only %d of %d entries committed", len(want), proposed)
+	}
+	t.Logf("%d of %d entries committed through %d terms", len(want), proposed, len(c.leaderOf))
+}
@@ -0,0 +1,70 @@
+package consensus
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/artorias742/DTP/monitoring"
+)
+
+var (
+	// ErrTransferInProgress is returned for proposals and leadership
+	// transfers made to a leader that is handing over leadership.
+	ErrTransferInProgress = errors.New("leadership transfer in progress")
+
+	// ErrInvalidTransfer is returned for a leadership transfer to a node that
+	// is not one of the other voters.
+	ErrInvalidTransfer = errors.New("invalid leadership transfer")
+)
+
+// TransferLeadership hands leadership to another voter, say to take the
+// leader down for maintenance. The leader stops taking proposals, brings the
+// voter's log up to date and then tells it to campaign with MsgTimeoutNow,
+// which it can win at once, well before the followers would time out. It
+// returns once the transfer is under way; Status names the new leader once
+// it is done. A transfer that has not gone through within an election
+// timeout is given up, and the leader takes proposals again.
+func (r *Raft) TransferLeadership(to string) error {
+	r.mutex.Lock()
+	if r.state != Leader {
+		r.mutex.Unlock()
+		return ErrNotLeader
+	}
+	if r.transferee != "" {
+		r.mutex.Unlock()
+		return ErrTransferInProgress
+	}
+	if to == r.id || !r.voters[to] {
+		r.mutex.Unlock()
+		return fmt.Errorf("%w: %q is not another voter", ErrInvalidTransfer, to)
+	}
+
+	r.transferee = to
+	r.transferElapsed = 0
+	r.leaseUntil = 0
+	monitoring.GetLogger().Info("Transferring leadership", "id", r.id, "term", r.term, "to", to)
+	if r.matchIndex[to] == r.lastIndex() {
+		r.send(Message{Type: MsgTimeoutNow, To: to})
+	} else {
+		r.sendAppend(to)
+	}
+	r.flush()
+	return nil
+}
+
+// abortTransfer gives up on a leadership transfer. The transferee may yet get
+// a MsgTimeoutNow that was delayed, so rounds sent within an election timeout
+// of giving up do not extend the lease.
+func (r *Raft) abortTransfer() {
+	r.transferee = ""
+	r.leaseFrom = r.ticks + r.electionTicks
+}
+
+// handleTimeoutNow starts the election the leader asked for.
+func (r *Raft) handleTimeoutNow(msg Message) {
+	if r.state == Leader || !r.voters[r.id] {
+		return
+	}
+	monitoring.GetLogger().Info("Leadership handed over, starting election", "id", r.id, "term", r.term, "from", msg.From)
+	r.campaign(true)
+}
@@ -0,0 +1,225 @@
+package consensus
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// Transport delivers messages to other nodes. Send must not block; Raft
+// copes with messages that are lost, duplicated or delivered out of order, so
+// a transport may drop a message it cannot deliver. Messages from other nodes
+// are handed to Raft.Step.
+//
+// network.Peer carries messages over its peer connections. MemoryNetwork
+// connects nodes in one process, for tests.
+type Transport interface {
+	Send(msg Message)
+}
+
+// MemoryNetwork is a Transport connecting nodes in one process, with a
+// clock of its own so that a run is the same every time for the same seed.
+// Tick advances the clock, ticks every node and delivers the messages due;
+// nodes must not also be started. Faults are injected on demand: latency,
+// dropped messages, messages delivered out of order, partitions and nodes
+// that are down.
+type MemoryNetwork struct {
+	mutex sync.Mutex
+	rand  *rand.Rand
+	now   int // ticks since the network was created
+
+	nodes     map[string]*Raft
+	ids       []string // node IDs, sorted, so nodes tick in the same order every run
+	down      map[string]bool
+	partition map[string]int // group of each node in a partition; nodes left out make up group 0
+
+	minLatency, maxLatency int     // ticks a message takes
+	dropRate               float64 // chance a message is lost
+	reorder                bool    // deliver the messages due in random order
+
+	queue     []inflight
+	delivered map[MessageType]int
+}
+
+// inflight is a message on its way.
+type inflight struct {
+	msg Message
+	due int // tick it arrives at
+}
+
+func NewMemoryNetwork(seed int64) *MemoryNetwork {
+	return &MemoryNetwork{
+		rand:      rand.New(rand.NewSource(seed)),
+		nodes:     make(map[string]*Raft),
+		down:      make(map[string]bool),
+		delivered: make(map[MessageType]int),
+	}
+}
+
+// Add connects a node, replacing any earlier node with its ID as a restart
+// would.
+func (n *MemoryNetwork) Add(r *Raft) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if _, ok := n.nodes[r.id]; !ok {
+		n.ids = append(n.ids, r.id)
+		sort.Strings(n.ids)
+	}
+	n.nodes[r.id] = r
+}
+
+// Send queues a message, or drops it at the configured rate.
+func (n *MemoryNetwork) Send(msg Message) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.dropRate > 0 && n.rand.Float64() < n.dropRate {
+		return
+	}
+	latency := n.minLatency
+	if n.maxLatency > n.minLatency {
+		latency += n.rand.Intn(n.maxLatency - n.minLatency + 1)
+	}
+	n.queue = append(n.queue, inflight{msg: msg, due: n.now + latency})
+}
+
+// Tick advances the clock by one tick, ticks every node that is up and
+// delivers the messages due.
+func (n *MemoryNetwork) Tick() {
+	n.mutex.Lock()
+	n.now++
+	var nodes []*Raft
+	for _, id := range n.ids {
+		if !n.down[id] {
+			nodes = append(nodes, n.nodes[id])
+		}
+	}
+	n.mutex.Unlock()
+
+	for _, node := range nodes {
+		if !n.IsDown(node.id) { // brought down by a node ticked before it
+			node.Tick()
+		}
+	}
+	n.Deliver()
+}
+
+// Deliver hands the nodes every message due, including those sent in reply
+// that are due at once, until none are left. Messages to or from a node
+// that is down, or across a partition, are lost.
+func (n *MemoryNetwork) Deliver() {
+	for {
+		n.mutex.Lock()
+		msg, to, ok := n.next()
+		n.mutex.Unlock()
+		if !ok {
+			return
+		}
+		if to != nil {
+			to.Step(msg)
+		}
+	}
+}
+
+// next takes the next message due off the queue and returns it with the
+// node to deliver it to, or no node if it is lost. The caller must hold the
+// mutex.
+func (n *MemoryNetwork) next() (Message, *Raft, bool) {
+	var due []int
+	for i, f := range n.queue {
+		if f.due <= n.now {
+			due = append(due, i)
+			if !n.reorder {
+				break
+			}
+		}
+	}
+	if len(due) == 0 {
+		return Message{}, nil, false
+	}
+	i := due[0]
+	if n.reorder {
+		i = due[n.rand.Intn(len(due))]
+	}
+	msg := n.queue[i].msg
+	n.queue = append(n.queue[:i], n.queue[i+1:]...)
+
+	to := n.nodes[msg.To]
+	if to == nil || n.down[msg.From] || n.down[msg.To] || n.partition[msg.From] != n.partition[msg.To] {
+		return msg, nil, true
+	}
+	n.delivered[msg.Type]++
+	return msg, to, true
+}
+
+// SetLatency makes every message take between min and max ticks, picked at
+// random, so that messages overtake one another when they differ.
+func (n *MemoryNetwork) SetLatency(min, max int) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.minLatency, n.maxLatency = min, max
+}
+
+// SetDropRate makes every message lost with probability rate.
+func (n *MemoryNetwork) SetDropRate(rate float64) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.dropRate = rate
+}
+
+// SetReorder delivers the messages due at a tick in random order rather
+// than the order they were sent in.
+func (n *MemoryNetwork) SetReorder(reorder bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.reorder = reorder
+}
+
+// Partition splits the nodes into groups that only talk among themselves.
+// Nodes in no group form one more.
+func (n *MemoryNetwork) Partition(groups ...[]string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.partition = make(map[string]int)
+	for i, group := range groups {
+		for _, id := range group {
+			n.partition[id] = i + 1
+		}
+	}
+}
+
+// Heal undoes Partition.
+func (n *MemoryNetwork) Heal() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.partition = nil
+}
+
+// Down stops a node: it is no longer ticked, and messages to and from it are
+// lost, until Up is called.
+func (n *MemoryNetwork) Down(id string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.down[id] = true
+}
+
+func (n *MemoryNetwork) Up(id string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	delete(n.down, id)
+}
+
+// IsDown reports whether Down stopped a node.
+func (n *MemoryNetwork) IsDown(id string) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.down[id]
+}
+
+// Delivered returns how many messages of a type reached their node.
+func (n *MemoryNetwork) Delivered(t MessageType) int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.delivered[t]
+}
@@ -42,10 +42,13 @@ func main() {
 	}()
 
 	// Initialize peer node
-	peer := network.NewPeer(cfg)
+	peer, err := network.NewPeer(cfg)
+	if err != nil {
+		logger.Fatal("Failed to initialize peer", "error", err)
+	}
 
 	// Start API server for user interaction
-	apiServer := api.NewServer(peer)
+	apiServer := api.NewServer(peer, cfg.ClusterKey)
 	go apiServer.Start()
 
 	// Start peer with recovery mechanism
@@ -3,14 +3,38 @@ package monitoring
 import "github.com/prometheus/client_golang/prometheus"
 
 var (
-    OrderLatency = prometheus.NewHistogram(
-        prometheus.HistogramOpts{
-            Name:    "order_processing_latency_seconds",
-            Buckets: prometheus.LinearBuckets(0.01, 0.05, 20),
-        },
-    )
+	OrderLatency = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "order_processing_latency_seconds",
+			Buckets: prometheus.LinearBuckets(0.01, 0.05, 20),
+		},
+	)
+
+	OrdersReceived = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "orders_received_total",
+			Help: "Orders accepted into an order book, by symbol.",
+		},
+		[]string{"symbol"},
+	)
+
+	TradesExecuted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "trades_executed_total",
+			Help: "Trades produced by matching, by symbol.",
+		},
+		[]string{"symbol"},
+	)
+
+	TradedVolume = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "traded_volume_total",
+			Help: "Quantity traded, by symbol.",
+		},
+		[]string{"symbol"},
+	)
 )
 
 func InitMetrics() {
-    prometheus.MustRegister(OrderLatency)
-}
\ No newline at end of file
+	prometheus.MustRegister(OrderLatency, OrdersReceived, TradesExecuted, TradedVolume)
+}
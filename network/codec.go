@@ -0,0 +1,614 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/artorias742/DTP/consensus"
+	"github.com/artorias742/DTP/storage"
+	"github.com/artorias742/DTP/trading"
+)
+
+// ProtocolVersion is the version of the wire format, sent in the header of
+// every message. A peer drops the connection on a message of another version
+// rather than guess at its layout; any change to the layouts below bumps it.
+const ProtocolVersion = 3
+
+var (
+	// ErrUnsupportedVersion is returned for a message of another protocol
+	// version.
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+	// ErrMalformedMessage is returned for a payload that does not decode to
+	// its message type, is cut short or has bytes left over.
+	ErrMalformedMessage = errors.New("malformed message")
+)
+
+// Payloads are a fixed sequence of fields per message type, with no field
+// tags or delimiters:
+//
+//	integers  varints, unsigned or zig-zag signed
+//	decimals  signed varints of their units
+//	bools     one byte, 0 or 1
+//	strings   uvarint length followed by the bytes, so they may hold anything
+//	times     a bool, set unless the time is zero, then Unix seconds as a
+//	          signed varint and nanoseconds as a uvarint
+//	optional  a bool, then the value if set
+//	lists     uvarint count followed by the elements
+//
+// The layout of each type is given by its encode function.
+
+// encoder appends fields to a payload.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *encoder) int(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.buf = append(e.buf, 1)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) string(s string) {
+	e.uint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) strings(ss []string) {
+	e.uint(uint64(len(ss)))
+	for _, s := range ss {
+		e.string(s)
+	}
+}
+
+func (e *encoder) decimal(d trading.Decimal) {
+	e.int(int64(d))
+}
+
+func (e *encoder) time(t time.Time) {
+	e.bool(!t.IsZero())
+	if !t.IsZero() {
+		e.int(t.Unix())
+		e.uint(uint64(t.Nanosecond()))
+	}
+}
+
+// decoder reads fields off a payload. The first field that does not decode
+// sets err, and every field after it decodes to its zero value, so a decode
+// function only has to check err once at the end, with done.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) fail() {
+	d.err = ErrMalformedMessage
+	d.buf = nil
+}
+
+func (d *decoder) uint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) int() int64 {
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) bool() bool {
+	if len(d.buf) == 0 || d.buf[0] > 1 {
+		d.fail()
+		return false
+	}
+	v := d.buf[0] == 1
+	d.buf = d.buf[1:]
+	return v
+}
+
+// bytes returns nil for an empty field, and otherwise a slice of the payload.
+func (d *decoder) bytes() []byte {
+	n := d.uint()
+	if n > uint64(len(d.buf)) {
+		d.fail()
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	b := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+// count reads the length of a list. Every element takes at least a byte, so
+// a count larger than what is left is malformed, which keeps a bad count from
+// allocating more than the payload is worth.
+func (d *decoder) count() int {
+	n := d.uint()
+	if n > uint64(len(d.buf)) {
+		d.fail()
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) strings() []string {
+	n := d.count()
+	if n == 0 {
+		return nil
+	}
+	ss := make([]string, n)
+	for i := range ss {
+		ss[i] = d.string()
+	}
+	return ss
+}
+
+func (d *decoder) decimal() trading.Decimal {
+	return trading.Decimal(d.int())
+}
+
+func (d *decoder) time() time.Time {
+	if !d.bool() {
+		return time.Time{}
+	}
+	sec := d.int()
+	nsec := d.uint()
+	if nsec >= uint64(time.Second) {
+		d.fail()
+		return time.Time{}
+	}
+	return time.Unix(sec, int64(nsec)).UTC()
+}
+
+// done returns the error that stopped decoding, if any, or else whether the
+// whole payload was read.
+func (d *decoder) done() error {
+	if d.err == nil && len(d.buf) > 0 {
+		d.fail()
+	}
+	return d.err
+}
+
+// NewOrderRequest returns a message submitting an order. Only the fields a
+// client chooses are sent; the receiving peer stamps the order's time.
+func NewOrderRequest(order *trading.Order) *Message {
+	var e encoder
+	e.string(order.ID)
+	e.string(order.Symbol)
+	e.string(string(order.Type))
+	e.string(string(order.Kind))
+	e.string(string(order.TimeInForce))
+	e.decimal(order.Price)
+	e.decimal(order.StopPrice)
+	e.decimal(order.Quantity)
+	e.decimal(order.DisplayQuantity)
+	e.string(order.Owner)
+	e.string(string(order.SelfTrade))
+	e.string(string(order.PostOnly))
+	return &Message{Type: OrderRequest, Payload: e.buf}
+}
+
+// NewOrderCancel returns a message canceling the order with the given ID.
+func NewOrderCancel(id string) *Message {
+	var e encoder
+	e.string(id)
+	return &Message{Type: OrderCancel, Payload: e.buf}
+}
+
+// NewOrderAmend returns a message amending the order with the given ID. A
+// zero price or quantity leaves it unchanged.
+func NewOrderAmend(id string, amend trading.Amendment) *Message {
+	var e encoder
+	e.string(id)
+	e.decimal(amend.Price)
+	e.decimal(amend.Quantity)
+	return &Message{Type: OrderAmend, Payload: e.buf}
+}
+
+// NewOrderConfirm returns a message confirming an order, with text for the
+// log.
+func NewOrderConfirm(text string) *Message {
+	var e encoder
+	e.string(text)
+	return &Message{Type: OrderConfirm, Payload: e.buf}
+}
+
+// decodeOrderRequest reads the order NewOrderRequest encoded. Its timestamp
+// is left zero.
+func decodeOrderRequest(payload []byte) (*trading.Order, error) {
+	d := decoder{buf: payload}
+	order := &trading.Order{
+		ID:              d.string(),
+		Symbol:          d.string(),
+		Type:            trading.OrderType(d.string()),
+		Kind:            trading.OrderKind(d.string()),
+		TimeInForce:     trading.TimeInForce(d.string()),
+		Price:           d.decimal(),
+		StopPrice:       d.decimal(),
+		Quantity:        d.decimal(),
+		DisplayQuantity: d.decimal(),
+		Owner:           d.string(),
+		SelfTrade:       trading.SelfTradePrevention(d.string()),
+		PostOnly:        trading.PostOnlyMode(d.string()),
+	}
+	if err := d.done(); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// decodeString reads the payload of an OrderCancel or OrderConfirm.
+func decodeString(payload []byte) (string, error) {
+	d := decoder{buf: payload}
+	s := d.string()
+	return s, d.done()
+}
+
+// decodeOrderAmend reads the payload NewOrderAmend encoded.
+func decodeOrderAmend(payload []byte) (string, trading.Amendment, error) {
+	d := decoder{buf: payload}
+	id := d.string()
+	amend := trading.Amendment{Price: d.decimal(), Quantity: d.decimal()}
+	return id, amend, d.done()
+}
+
+func encodeRaftMessage(msg consensus.Message) []byte {
+	var e encoder
+	e.int(int64(msg.Type))
+	e.string(msg.From)
+	e.string(msg.To)
+	e.uint(msg.Term)
+	e.uint(msg.Index)
+	e.uint(msg.LogTerm)
+	e.uint(uint64(len(msg.Entries)))
+	for _, entry := range msg.Entries {
+		e.uint(entry.Index)
+		e.uint(entry.Term)
+		e.int(int64(entry.Type))
+		e.bytes(entry.Data)
+	}
+	e.uint(msg.Commit)
+	e.bool(msg.Reject)
+	e.uint(msg.Hint)
+	e.uint(msg.Offset)
+	e.bytes(msg.Data)
+	e.bool(msg.Done)
+	e.bool(msg.Conf != nil)
+	if msg.Conf != nil {
+		e.strings(msg.Conf.Voters)
+		e.strings(msg.Conf.Learners)
+	}
+	e.uint(msg.Read)
+	e.bool(msg.Transfer)
+	return e.buf
+}
+
+func decodeRaftMessage(payload []byte) (consensus.Message, error) {
+	d := decoder{buf: payload}
+	msg := consensus.Message{
+		Type:    consensus.MessageType(d.int()),
+		From:    d.string(),
+		To:      d.string(),
+		Term:    d.uint(),
+		Index:   d.uint(),
+		LogTerm: d.uint(),
+	}
+	if n := d.count(); n > 0 {
+		msg.Entries = make([]consensus.Entry, n)
+		for i := range msg.Entries {
+			msg.Entries[i] = consensus.Entry{
+				Index: d.uint(),
+				Term:  d.uint(),
+				Type:  consensus.EntryType(d.int()),
+				Data:  d.bytes(),
+			}
+		}
+	}
+	msg.Commit = d.uint()
+	msg.Reject = d.bool()
+	msg.Hint = d.uint()
+	msg.Offset = d.uint()
+	msg.Data = d.bytes()
+	msg.Done = d.bool()
+	if d.bool() {
+		msg.Conf = &consensus.ConfState{Voters: d.strings(), Learners: d.strings()}
+	}
+	msg.Read = d.uint()
+	msg.Transfer = d.bool()
+	if err := d.done(); err != nil {
+		return consensus.Message{}, err
+	}
+	return msg, nil
+}
+
+func encodeForwardRequest(req forwardRequest) []byte {
+	var e encoder
+	e.string(req.ID)
+	e.string(req.From)
+	e.bool(req.Record != nil)
+	if req.Record != nil {
+		e.record(req.Record)
+	}
+	return e.buf
+}
+
+func decodeForwardRequest(payload []byte) (forwardRequest, error) {
+	d := decoder{buf: payload}
+	req := forwardRequest{ID: d.string(), From: d.string()}
+	if d.bool() {
+		req.Record = d.record()
+	}
+	if err := d.done(); err != nil {
+		return forwardRequest{}, err
+	}
+	return req, nil
+}
+
+func encodeForwardResponse(resp forwardResponse) []byte {
+	var e encoder
+	e.string(resp.ID)
+	e.bool(resp.Order != nil)
+	if resp.Order != nil {
+		e.order(resp.Order)
+	}
+	e.uint(uint64(len(resp.Trades)))
+	for _, trade := range resp.Trades {
+		e.trade(trade)
+	}
+	e.string(string(resp.Cancel))
+	e.string(string(resp.Amend))
+	e.strings(resp.Expired)
+	e.string(resp.Error)
+	return e.buf
+}
+
+func decodeForwardResponse(payload []byte) (forwardResponse, error) {
+	d := decoder{buf: payload}
+	resp := forwardResponse{ID: d.string()}
+	if d.bool() {
+		resp.Order = d.order()
+	}
+	if n := d.count(); n > 0 {
+		resp.Trades = make([]trading.Trade, n)
+		for i := range resp.Trades {
+			resp.Trades[i] = d.trade()
+		}
+	}
+	resp.Cancel = trading.CancelResult(d.string())
+	resp.Amend = trading.AmendResult(d.string())
+	resp.Expired = d.strings()
+	resp.Error = d.string()
+	if err := d.done(); err != nil {
+		return forwardResponse{}, err
+	}
+	return resp, nil
+}
+
+func encodeHistoryRequest(req historyRequest) []byte {
+	var e encoder
+	e.string(req.ID)
+	e.string(req.From)
+	e.bool(req.Trades)
+	e.int(int64(req.Offset))
+	e.string(req.Cursor)
+	return e.buf
+}
+
+func decodeHistoryRequest(payload []byte) (historyRequest, error) {
+	d := decoder{buf: payload}
+	req := historyRequest{ID: d.string(), From: d.string(), Trades: d.bool(), Offset: int(d.int()), Cursor: d.string()}
+	if err := d.done(); err != nil {
+		return historyRequest{}, err
+	}
+	return req, nil
+}
+
+func encodeHistoryResponse(resp historyResponse) []byte {
+	var e encoder
+	e.string(resp.ID)
+	e.uint(uint64(len(resp.Orders)))
+	for _, order := range resp.Orders {
+		e.order(order)
+	}
+	e.uint(uint64(len(resp.Trades)))
+	for _, trade := range resp.Trades {
+		e.trade(trade)
+	}
+	e.int(int64(resp.Next))
+	e.string(resp.Cursor)
+	e.string(resp.Error)
+	return e.buf
+}
+
+func decodeHistoryResponse(payload []byte) (historyResponse, error) {
+	d := decoder{buf: payload}
+	resp := historyResponse{ID: d.string()}
+	if n := d.count(); n > 0 {
+		resp.Orders = make([]*trading.Order, n)
+		for i := range resp.Orders {
+			resp.Orders[i] = d.order()
+		}
+	}
+	if n := d.count(); n > 0 {
+		resp.Trades = make([]trading.Trade, n)
+		for i := range resp.Trades {
+			resp.Trades[i] = d.trade()
+		}
+	}
+	resp.Next = int(d.int())
+	resp.Cursor = d.string()
+	resp.Error = d.string()
+	if err := d.done(); err != nil {
+		return historyResponse{}, err
+	}
+	return resp, nil
+}
+
+func (e *encoder) record(r *storage.Record) {
+	e.uint(r.LSN)
+	e.string(string(r.Type))
+	e.bool(r.Order != nil)
+	if r.Order != nil {
+		e.order(r.Order)
+	}
+	e.string(r.OrderID)
+	e.bool(r.Amendment != nil)
+	if r.Amendment != nil {
+		e.decimal(r.Amendment.Price)
+		e.decimal(r.Amendment.Quantity)
+		e.time(r.Amendment.Timestamp)
+	}
+	e.bool(r.Cutoff != nil)
+	if r.Cutoff != nil {
+		e.time(*r.Cutoff)
+	}
+	e.bool(r.Timestamp != nil)
+	if r.Timestamp != nil {
+		e.time(*r.Timestamp)
+	}
+	e.bool(r.Trade != nil)
+	if r.Trade != nil {
+		e.trade(*r.Trade)
+	}
+	e.uint(uint64(len(r.Members)))
+	for _, member := range r.Members {
+		e.string(member.ID)
+		e.string(member.Addr)
+		e.bool(member.Learner)
+	}
+	e.string(r.Request)
+	e.uint(r.RaftIndex)
+	e.uint(r.RaftTerm)
+}
+
+func (d *decoder) record() *storage.Record {
+	r := &storage.Record{LSN: d.uint(), Type: storage.RecordType(d.string())}
+	if d.bool() {
+		r.Order = d.order()
+	}
+	r.OrderID = d.string()
+	if d.bool() {
+		r.Amendment = &trading.Amendment{Price: d.decimal(), Quantity: d.decimal(), Timestamp: d.time()}
+	}
+	if d.bool() {
+		cutoff := d.time()
+		r.Cutoff = &cutoff
+	}
+	if d.bool() {
+		timestamp := d.time()
+		r.Timestamp = &timestamp
+	}
+	if d.bool() {
+		trade := d.trade()
+		r.Trade = &trade
+	}
+	if n := d.count(); n > 0 {
+		r.Members = make([]storage.Member, n)
+		for i := range r.Members {
+			r.Members[i] = storage.Member{ID: d.string(), Addr: d.string(), Learner: d.bool()}
+		}
+	}
+	r.Request = d.string()
+	r.RaftIndex = d.uint()
+	r.RaftTerm = d.uint()
+	return r
+}
+
+// order encodes an order as a record carries it, with its fill state.
+func (e *encoder) order(o *trading.Order) {
+	e.string(o.ID)
+	e.string(o.Symbol)
+	e.string(string(o.Type))
+	e.string(string(o.Kind))
+	e.string(string(o.TimeInForce))
+	e.decimal(o.Price)
+	e.decimal(o.StopPrice)
+	e.decimal(o.Quantity)
+	e.decimal(o.OrigQuantity)
+	e.decimal(o.CumQuantity)
+	e.decimal(o.AvgPrice)
+	e.string(string(o.Status))
+	e.decimal(o.DisplayQuantity)
+	e.string(o.Owner)
+	e.string(string(o.SelfTrade))
+	e.string(string(o.PostOnly))
+	e.time(o.Timestamp)
+}
+
+func (d *decoder) order() *trading.Order {
+	return &trading.Order{
+		ID:              d.string(),
+		Symbol:          d.string(),
+		Type:            trading.OrderType(d.string()),
+		Kind:            trading.OrderKind(d.string()),
+		TimeInForce:     trading.TimeInForce(d.string()),
+		Price:           d.decimal(),
+		StopPrice:       d.decimal(),
+		Quantity:        d.decimal(),
+		OrigQuantity:    d.decimal(),
+		CumQuantity:     d.decimal(),
+		AvgPrice:        d.decimal(),
+		Status:          trading.OrderStatus(d.string()),
+		DisplayQuantity: d.decimal(),
+		Owner:           d.string(),
+		SelfTrade:       trading.SelfTradePrevention(d.string()),
+		PostOnly:        trading.PostOnlyMode(d.string()),
+		Timestamp:       d.time(),
+	}
+}
+
+func (e *encoder) trade(t trading.Trade) {
+	e.string(t.ID)
+	e.string(t.Symbol)
+	e.string(t.BuyOrderID)
+	e.string(t.SellOrderID)
+	e.string(string(t.AggressorSide))
+	e.decimal(t.Price)
+	e.decimal(t.Quantity)
+	e.time(t.Timestamp)
+}
+
+func (d *decoder) trade() trading.Trade {
+	return trading.Trade{
+		ID:            d.string(),
+		Symbol:        d.string(),
+		BuyOrderID:    d.string(),
+		SellOrderID:   d.string(),
+		AggressorSide: trading.OrderType(d.string()),
+		Price:         d.decimal(),
+		Quantity:      d.decimal(),
+		Timestamp:     d.time(),
+	}
+}
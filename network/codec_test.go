@@ -0,0 +1,197 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/artorias742/DTP/consensus"
+	"github.com/artorias742/DTP/security"
+	"github.com/artorias742/DTP/storage"
+	"github.com/artorias742/DTP/trading"
+)
+
+// checkReencode decodes data and, if it decodes, checks that encoding the
+// result and decoding that again gives the same value.
+func checkReencode[T any](t *testing.T, data []byte, decode func([]byte) (T, error), encode func(T) []byte) {
+	t.Helper()
+	v, err := decode(data)
+	if err != nil {
+		if !errors.Is(err, ErrMalformedMessage) {
+			t.Fatalf("decode failed with %v, want ErrMalformedMessage", err)
+		}
+		return
+	}
+	again, err := decode(encode(v))
+	if err != nil {
+		t.Fatalf("re-encoded %+v does not decode: %v", v, err)
+	}
+	if !reflect.DeepEqual(again, v) {
+		t.Fatalf("re-encoded %+v decodes to %+v", v, again)
+	}
+}
+
+func FuzzDecodeRaftMessage(f *testing.F) {
+	f.Add(encodeRaftMessage(consensus.Message{Type: consensus.MsgVote, From: "a", To: "b", Term: 3, Index: 7, LogTerm: 2}))
+	f.Add(encodeRaftMessage(consensus.Message{
+		Type: consensus.MsgAppend, From: "a", To: "b", Term: 3, Index: 7, LogTerm: 2, Commit: 6, Read: 4,
+		Entries: []consensus.Entry{{Index: 8, Term: 3, Data: []byte("order")}, {Index: 9, Term: 3, Type: consensus.EntryConfChange}},
+	}))
+	f.Add(encodeRaftMessage(consensus.Message{
+		Type: consensus.MsgSnapshot, Index: 100, Offset: 4096, Data: []byte{0, 1, 2}, Done: true,
+		Conf: &consensus.ConfState{Voters: []string{"a", "b"}, Learners: []string{"c"}},
+	}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkReencode(t, data, decodeRaftMessage, encodeRaftMessage)
+	})
+}
+
+func FuzzDecodeForwardRequest(f *testing.F) {
+	now := time.Unix(1700000000, 123).UTC()
+	order := trading.NewOrder("o|1", "BTC", trading.Buy, trading.DecimalFromInt(10), trading.DecimalFromInt(2))
+	order.Owner = "alice|bob"
+	order.Timestamp = now
+	f.Add(encodeForwardRequest(forwardRequest{ID: "r", From: "a", Record: &storage.Record{Type: storage.RecordOrder, Order: order}}))
+	f.Add(encodeForwardRequest(forwardRequest{ID: "r", From: "a", Record: &storage.Record{
+		Type: storage.RecordAmend, OrderID: "o1", Amendment: &trading.Amendment{Price: 5, Timestamp: now},
+	}}))
+	f.Add(encodeForwardRequest(forwardRequest{ID: "r", From: "a", Record: &storage.Record{
+		Type: storage.RecordMembers, Members: []storage.Member{{ID: "b", Addr: "localhost:9001", Learner: true}}, Cutoff: &now, Timestamp: &time.Time{},
+	}}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkReencode(t, data, decodeForwardRequest, encodeForwardRequest)
+	})
+}
+
+func FuzzDecodeForwardResponse(f *testing.F) {
+	f.Add(encodeForwardResponse(forwardResponse{ID: "r", Order: &trading.Order{
+		ID: "b", Symbol: "BTC", Type: trading.Buy, Status: trading.StatusPartiallyFilled, CumQuantity: 1, Timestamp: time.Unix(7, 0).UTC(),
+	}, Trades: []trading.Trade{{
+		ID: "t", Symbol: "BTC", BuyOrderID: "b", SellOrderID: "s", AggressorSide: trading.Sell,
+		Price: 10, Quantity: -1, Timestamp: time.Unix(-5, 999999999).UTC(),
+	}}}))
+	f.Add(encodeForwardResponse(forwardResponse{ID: "r", Cancel: trading.Canceled, Expired: []string{"a", ""}, Error: "no leader elected"}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkReencode(t, data, decodeForwardResponse, encodeForwardResponse)
+	})
+}
+
+func FuzzDecodeHistoryRequest(f *testing.F) {
+	f.Add(encodeHistoryRequest(historyRequest{ID: "r", From: "a", Offset: 500}))
+	f.Add(encodeHistoryRequest(historyRequest{ID: "r", From: "a", Trades: true, Cursor: "1000"}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkReencode(t, data, decodeHistoryRequest, encodeHistoryRequest)
+	})
+}
+
+func FuzzDecodeHistoryResponse(f *testing.F) {
+	order := trading.NewOrder("o|1", "BTC", trading.Sell, trading.DecimalFromInt(10), trading.DecimalFromInt(2))
+	order.Timestamp = time.Unix(1700000000, 123).UTC()
+	f.Add(encodeHistoryResponse(historyResponse{ID: "r", Orders: []*trading.Order{order}, Next: 500}))
+	f.Add(encodeHistoryResponse(historyResponse{ID: "r", Trades: []trading.Trade{{
+		ID: "t", Symbol: "BTC", BuyOrderID: "b", SellOrderID: "s", Price: 10, Quantity: 1, Timestamp: order.Timestamp,
+	}}, Next: -1, Cursor: "500"}))
+	f.Add(encodeHistoryResponse(historyResponse{ID: "r", Next: -1, Error: "bad cursor"}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkReencode(t, data, decodeHistoryResponse, encodeHistoryResponse)
+	})
+}
+
+func FuzzOrderRequest(f *testing.F) {
+	f.Add("o1", "BTC|USD", "BUY", "LIMIT", "GTC", int64(100), int64(0), int64(5), int64(0), "owner", "", "")
+	f.Add("", "", "", "", "", int64(-1), int64(1<<62), int64(0), int64(-1<<63), "|||", "CANCEL_NEWEST", "REJECT")
+	f.Fuzz(func(t *testing.T, id, symbol, side, kind, tif string, price, stop, quantity, display int64, owner, selfTrade, postOnly string) {
+		order := &trading.Order{
+			ID:              id,
+			Symbol:          symbol,
+			Type:            trading.OrderType(side),
+			Kind:            trading.OrderKind(kind),
+			TimeInForce:     trading.TimeInForce(tif),
+			Price:           trading.Decimal(price),
+			StopPrice:       trading.Decimal(stop),
+			Quantity:        trading.Decimal(quantity),
+			DisplayQuantity: trading.Decimal(display),
+			Owner:           owner,
+			SelfTrade:       trading.SelfTradePrevention(selfTrade),
+			PostOnly:        trading.PostOnlyMode(postOnly),
+		}
+		msg := NewOrderRequest(order)
+		got, err := decodeOrderRequest(msg.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, order) {
+			t.Fatalf("order decoded to %+v, want %+v", got, order)
+		}
+		checkReencode(t, msg.Payload[:len(msg.Payload)/2], decodeOrderRequest, func(o *trading.Order) []byte {
+			return NewOrderRequest(o).Payload
+		})
+
+		msg = NewOrderAmend(id, trading.Amendment{Price: trading.Decimal(price), Quantity: trading.Decimal(quantity)})
+		gotID, amend, err := decodeOrderAmend(msg.Payload)
+		if err != nil || gotID != id || amend.Price != trading.Decimal(price) || amend.Quantity != trading.Decimal(quantity) {
+			t.Fatalf("amend decoded to %q %+v %v", gotID, amend, err)
+		}
+	})
+}
+
+func FuzzReadMessage(f *testing.F) {
+	key := make([]byte, 32)
+	p := &Peer{auth: security.NewAuthManager(key)}
+	var frames bytes.Buffer
+	for _, msg := range []*Message{NewOrderCancel("o1"), NewOrderConfirm("ok"), {Type: RaftMessage, Payload: encodeRaftMessage(consensus.Message{Term: 1})}} {
+		if err := p.writeMessage(&frames, msg); err != nil {
+			f.Fatal(err)
+		}
+	}
+	f.Add(frames.Bytes())
+	f.Add([]byte{0, 0, 0, 2, 2, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := bufio.NewReader(bytes.NewReader(data))
+		for {
+			msg, err := p.readMessage(reader)
+			if err != nil {
+				return
+			}
+			// Whatever gets through decryption must not crash the decoders
+			decodeOrderRequest(msg.Payload)
+			decodeOrderAmend(msg.Payload)
+			decodeString(msg.Payload)
+			decodeRaftMessage(msg.Payload)
+			decodeForwardRequest(msg.Payload)
+			decodeForwardResponse(msg.Payload)
+			decodeHistoryRequest(msg.Payload)
+			decodeHistoryResponse(msg.Payload)
+		}
+	})
+}
+
+func TestReadMessageChecksVersion(t *testing.T) {
+	p := &Peer{auth: security.NewAuthManager(make([]byte, 32))}
+	var buf bytes.Buffer
+	want := NewOrderAmend("id|with|pipes", trading.Amendment{Price: trading.DecimalFromInt(3)})
+	if err := p.writeMessage(&buf, want); err != nil {
+		t.Fatal(err)
+	}
+	frame := append([]byte(nil), buf.Bytes()...)
+
+	got, err := p.readMessage(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("read %+v, want %+v", got, want)
+	}
+	id, _, err := decodeOrderAmend(got.Payload)
+	if err != nil || id != "id|with|pipes" {
+		t.Fatalf("amend for %q, %v", id, err)
+	}
+
+	frame[4] = ProtocolVersion + 1
+	if _, err := p.readMessage(bufio.NewReader(bytes.NewReader(frame))); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("reading a version %d message gave %v, want ErrUnsupportedVersion", frame[4], err)
+	}
+}
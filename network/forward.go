@@ -0,0 +1,140 @@
+package network
+
+import (
+	"errors"
+	"time"
+
+	"github.com/artorias742/DTP/consensus"
+	"github.com/artorias742/DTP/monitoring"
+	"github.com/artorias742/DTP/storage"
+	"github.com/artorias742/DTP/trading"
+	"github.com/google/uuid"
+)
+
+// ErrNoLeader is returned for a request made while no leader is known.
+var ErrNoLeader = errors.New("no leader elected")
+
+// forwardRequest carries a request from a follower to the leader.
+type forwardRequest struct {
+	ID     string          `json:"id"`   // matches the response to the request
+	From   string          `json:"from"` // peer ID to send the response to
+	Record *storage.Record `json:"record"`
+}
+
+// forwardResponse carries the outcome of a forwarded request back.
+type forwardResponse struct {
+	ID      string               `json:"id"`
+	Order   *trading.Order       `json:"order,omitempty"`
+	Trades  []trading.Trade      `json:"trades,omitempty"`
+	Cancel  trading.CancelResult `json:"cancel,omitempty"`
+	Amend   trading.AmendResult  `json:"amend,omitempty"`
+	Expired []string             `json:"expired,omitempty"`
+	Error   string               `json:"error,omitempty"`
+}
+
+// request proposes a request if this node leads, and otherwise forwards it
+// to the leader. Either way it returns once the request is applied, or
+// failed to be.
+func (p *Peer) request(r *storage.Record) (result, error) {
+	res, err := p.propose(r)
+	if errors.Is(err, consensus.ErrNotLeader) {
+		return p.forward(r)
+	}
+	return res, err
+}
+
+// forward sends a request to the leader and waits for its outcome.
+func (p *Peer) forward(r *storage.Record) (result, error) {
+	leader := p.raft.Status().Leader
+	addr, ok := p.transport.addr(leader)
+	if leader == "" || !ok {
+		return result{}, ErrNoLeader
+	}
+
+	req := forwardRequest{ID: uuid.New().String(), From: p.config.PeerID, Record: r}
+	done := make(chan forwardResponse, 1)
+	p.waitMutex.Lock()
+	p.forwards[req.ID] = done
+	p.waitMutex.Unlock()
+	defer func() {
+		p.waitMutex.Lock()
+		delete(p.forwards, req.ID)
+		p.waitMutex.Unlock()
+	}()
+
+	if err := p.sendTo(addr, &Message{Type: ForwardRequest, Payload: encodeForwardRequest(req)}); err != nil {
+		return result{}, err
+	}
+	select {
+	case resp := <-done:
+		res := result{
+			order:   resp.Order,
+			trades:  resp.Trades,
+			cancel:  resp.Cancel,
+			amend:   resp.Amend,
+			expired: resp.Expired,
+			err:     decodeError(resp.Error),
+		}
+		// Failures to commit are the caller's error, like they are on the leader
+		if errors.Is(res.err, consensus.ErrNotLeader) || errors.Is(res.err, ErrProposalTimeout) {
+			return result{}, res.err
+		}
+		return res, nil
+	case <-time.After(proposalTimeout + dialTimeout):
+		return result{}, ErrProposalTimeout
+	}
+}
+
+// serveForward proposes a request forwarded by a follower and sends back the
+// outcome. It does not forward again: if this node no longer leads, the
+// follower is told so.
+func (p *Peer) serveForward(req forwardRequest) {
+	logger := monitoring.GetLogger()
+
+	resp := forwardResponse{ID: req.ID}
+	res, err := p.propose(req.Record)
+	if err == nil {
+		err = res.err
+	}
+	resp.Order, resp.Trades, resp.Cancel, resp.Amend, resp.Expired = res.order, res.trades, res.cancel, res.amend, res.expired
+	if err != nil {
+		resp.Error = err.Error()
+	}
+
+	addr, ok := p.transport.addr(req.From)
+	if !ok {
+		logger.Warn("Forwarded request from unknown peer", "from", req.From)
+		return
+	}
+	if err := p.sendTo(addr, &Message{Type: ForwardResponse, Payload: encodeForwardResponse(resp)}); err != nil {
+		logger.Warn("Failed to answer forwarded request", "to", req.From, "error", err)
+	}
+}
+
+// deliverForward hands a response to the request waiting for it, if it has
+// not given up yet.
+func (p *Peer) deliverForward(resp forwardResponse) {
+	p.waitMutex.Lock()
+	done, ok := p.forwards[resp.ID]
+	p.waitMutex.Unlock()
+	if ok {
+		select {
+		case done <- resp:
+		default: // a duplicate
+		}
+	}
+}
+
+// decodeError turns an error sent by the leader back into the error value
+// callers check for, where there is one.
+func decodeError(msg string) error {
+	if msg == "" {
+		return nil
+	}
+	for _, err := range []error{consensus.ErrNotLeader, ErrProposalTimeout, trading.ErrUnknownSymbol, trading.ErrDuplicateOrder} {
+		if msg == err.Error() {
+			return err
+		}
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,212 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/artorias742/DTP/monitoring"
+	"github.com/artorias742/DTP/storage"
+	"github.com/artorias742/DTP/trading"
+	"github.com/google/uuid"
+)
+
+// A Raft snapshot carries the books, the accounts and the orders still live,
+// but none of the order and trade history, which grows without bound. A
+// follower that restores one copies the history from the leader's store a
+// page at a time first, so it lists the same orders and trades as every other
+// node, in the same order.
+
+// historyPageSize is how many orders or trades a history response holds.
+const historyPageSize = 500
+
+// historyRetry is how long a follower waits before fetching the history
+// again after a failed attempt.
+const historyRetry = time.Second
+
+// historyAttempts is how many times a follower tries to fetch the history
+// before giving up on the snapshot.
+const historyAttempts = 10
+
+// ErrHistoryTimeout is returned for a history request that got no answer.
+var ErrHistoryTimeout = errors.New("no answer to history request")
+
+// historyRequest asks a peer for a page of its stored orders or trades.
+type historyRequest struct {
+	ID     string `json:"id"`     // matches the response to the request
+	From   string `json:"from"`   // peer ID to send the response to
+	Trades bool   `json:"trades"` // a page of trades rather than of orders
+	Offset int    `json:"offset"` // where a page of orders starts
+	Cursor string `json:"cursor"` // where a page of trades starts
+}
+
+// historyResponse carries a page of stored orders or trades back.
+type historyResponse struct {
+	ID     string           `json:"id"`
+	Orders []*trading.Order `json:"orders,omitempty"`
+	Trades []trading.Trade  `json:"trades,omitempty"`
+	Next   int              `json:"next"`             // offset of the next page of orders, or -1
+	Cursor string           `json:"cursor,omitempty"` // cursor of the next page of trades, or ""
+	Error  string           `json:"error,omitempty"`
+}
+
+// fetchHistory copies the orders and trades counted by a snapshot from the
+// leader's store into this one, retrying until it has them all or it has
+// tried historyAttempts times. Orders the snapshot carries are stored as it
+// has them rather than as the leader has them now, since the log entries
+// after the snapshot still have to be applied to them.
+func (p *Peer) fetchHistory(snap *storage.Snapshot) error {
+	if snap.OrderCount == 0 && snap.TradeCount == 0 {
+		return nil
+	}
+	logger := monitoring.GetLogger()
+	var err error
+	for attempt := 1; attempt <= historyAttempts; attempt++ {
+		err = ErrNoLeader
+		if leader := p.raft.Status().Leader; leader != "" && leader != p.config.PeerID {
+			err = p.copyHistory(snap, func(req historyRequest) (historyResponse, error) {
+				return p.requestHistory(leader, req)
+			})
+		}
+		if err == nil {
+			logger.Info("History fetched", "orders", snap.OrderCount, "trades", snap.TradeCount)
+			return nil
+		}
+		logger.Warn("Fetching history failed", "attempt", attempt, "error", err)
+		if attempt < historyAttempts {
+			time.Sleep(historyRetry)
+		}
+	}
+	return fmt.Errorf("fetching history: %w", err)
+}
+
+// copyHistory makes one attempt at copying the history from one peer, whose
+// pages fetch returns, from the start: cursors only mean something to the
+// store that handed them out.
+func (p *Peer) copyHistory(snap *storage.Snapshot, fetch func(historyRequest) (historyResponse, error)) error {
+	live := make(map[string]*trading.Order, len(snap.Orders))
+	for _, order := range snap.Orders {
+		live[order.ID] = order
+	}
+
+	copied := 0
+	for offset := 0; copied < snap.OrderCount; {
+		resp, err := fetch(historyRequest{Offset: offset})
+		if err != nil {
+			return err
+		}
+		for _, order := range resp.Orders {
+			if copied == snap.OrderCount {
+				break
+			}
+			if snapped, ok := live[order.ID]; ok {
+				order = snapped
+			}
+			if err := p.Store.SaveOrder(order); err != nil {
+				return err
+			}
+			copied++
+		}
+		if resp.Next < 0 && copied < snap.OrderCount {
+			return fmt.Errorf("peer holds %d of the %d orders in the snapshot", copied, snap.OrderCount)
+		}
+		offset = resp.Next
+	}
+
+	copied = 0
+	for cursor := ""; copied < snap.TradeCount; {
+		resp, err := fetch(historyRequest{Trades: true, Cursor: cursor})
+		if err != nil {
+			return err
+		}
+		trades := resp.Trades[:min(len(resp.Trades), snap.TradeCount-copied)]
+		if err := p.Store.SaveTrades(trades); err != nil {
+			return err
+		}
+		copied += len(trades)
+		if resp.Cursor == "" && copied < snap.TradeCount {
+			return fmt.Errorf("peer holds %d of the %d trades in the snapshot", copied, snap.TradeCount)
+		}
+		cursor = resp.Cursor
+	}
+	return nil
+}
+
+// requestHistory sends a history request to a peer and waits for the page.
+func (p *Peer) requestHistory(to string, req historyRequest) (historyResponse, error) {
+	addr, ok := p.transport.addr(to)
+	if !ok {
+		return historyResponse{}, fmt.Errorf("no address for %s", to)
+	}
+
+	req.ID, req.From = uuid.New().String(), p.config.PeerID
+	done := make(chan historyResponse, 1)
+	p.waitMutex.Lock()
+	p.histories[req.ID] = done
+	p.waitMutex.Unlock()
+	defer func() {
+		p.waitMutex.Lock()
+		delete(p.histories, req.ID)
+		p.waitMutex.Unlock()
+	}()
+
+	if err := p.sendTo(addr, &Message{Type: HistoryRequest, Payload: encodeHistoryRequest(req)}); err != nil {
+		return historyResponse{}, err
+	}
+	select {
+	case resp := <-done:
+		if resp.Error != "" {
+			return historyResponse{}, errors.New(resp.Error)
+		}
+		return resp, nil
+	case <-time.After(proposalTimeout + dialTimeout):
+		return historyResponse{}, ErrHistoryTimeout
+	}
+}
+
+// serveHistory answers a history request with a page from the store.
+func (p *Peer) serveHistory(req historyRequest) {
+	logger := monitoring.GetLogger()
+	addr, ok := p.transport.addr(req.From)
+	if !ok {
+		logger.Warn("History request from unknown peer", "from", req.From)
+		return
+	}
+	resp := p.historyPage(req)
+	if err := p.sendTo(addr, &Message{Type: HistoryResponse, Payload: encodeHistoryResponse(resp)}); err != nil {
+		logger.Warn("Failed to answer history request", "to", req.From, "error", err)
+	}
+}
+
+// historyPage reads the page of orders or trades a history request asks for.
+func (p *Peer) historyPage(req historyRequest) historyResponse {
+	resp := historyResponse{ID: req.ID, Next: -1}
+	var err error
+	if req.Trades {
+		var trades []*trading.Trade
+		trades, resp.Cursor, err = p.Store.ListTrades(storage.TradeFilter{}, req.Cursor, historyPageSize)
+		for _, trade := range trades {
+			resp.Trades = append(resp.Trades, *trade)
+		}
+	} else {
+		resp.Orders, resp.Next, err = p.Store.ListOrders(storage.OrderFilter{}, req.Offset, historyPageSize)
+	}
+	if err != nil {
+		return historyResponse{ID: req.ID, Next: -1, Error: err.Error()}
+	}
+	return resp
+}
+
+// deliverHistory hands a page to the request waiting for it, if it has not
+// given up yet.
+func (p *Peer) deliverHistory(resp historyResponse) {
+	p.waitMutex.Lock()
+	done, ok := p.histories[resp.ID]
+	p.waitMutex.Unlock()
+	if ok {
+		select {
+		case done <- resp:
+		default: // a duplicate
+		}
+	}
+}
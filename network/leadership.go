@@ -0,0 +1,57 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/artorias742/DTP/consensus"
+)
+
+// transferTimeout bounds how long TransferLeadership waits for the new
+// leader to be elected.
+const transferTimeout = 10 * time.Second
+
+// transferPoll is how often TransferLeadership checks on the transfer.
+const transferPoll = 10 * time.Millisecond
+
+// ErrTransferFailed is returned when a leadership transfer was given up, or
+// another node than the one asked for took over.
+var ErrTransferFailed = errors.New("leadership transfer did not complete")
+
+// TransferLeadership hands leadership to another voter, or with to empty to
+// the voter with the most of the log, and returns once it leads. Only the
+// leader takes transfers. It returns the new leader's ID.
+func (p *Peer) TransferLeadership(to string) (string, error) {
+	status := p.raft.Status()
+	if status.State != consensus.Leader {
+		return "", consensus.ErrNotLeader
+	}
+	if to == "" {
+		for _, id := range status.Voters {
+			if id != p.config.PeerID && (to == "" || status.Match[id] > status.Match[to]) {
+				to = id
+			}
+		}
+		if to == "" {
+			return "", fmt.Errorf("%w: no other voter", consensus.ErrInvalidTransfer)
+		}
+	}
+	if err := p.raft.TransferLeadership(to); err != nil {
+		return "", err
+	}
+
+	deadline := time.Now().Add(transferTimeout)
+	for time.Now().Before(deadline) {
+		status := p.raft.Status()
+		switch {
+		case status.Leader == to:
+			return to, nil
+		case status.State == consensus.Leader && status.Transferee == "",
+			status.Leader != "" && status.Leader != p.config.PeerID:
+			return "", ErrTransferFailed
+		}
+		time.Sleep(transferPoll)
+	}
+	return "", ErrTransferFailed
+}
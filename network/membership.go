@@ -0,0 +1,148 @@
+package network
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/artorias742/DTP/consensus"
+	"github.com/artorias742/DTP/storage"
+)
+
+// catchUpTimeout bounds how long a learner has to catch up with the log
+// before AddMember gives up promoting it.
+const catchUpTimeout = 30 * time.Second
+
+// catchUpPoll is how often AddMember checks on a learner.
+const catchUpPoll = 100 * time.Millisecond
+
+// ErrCatchUpTimeout is returned when a learner was added but did not catch up
+// in time to be promoted. It stays a learner; adding it again retries.
+var ErrCatchUpTimeout = errors.New("learner did not catch up in time")
+
+// AddMember adds a node to the Raft cluster. It joins as a learner, which is
+// sent the log but does not vote, and unless learner is set it is promoted
+// to a voter once it has caught up, so it never holds up commits while it
+// copies the log. Only the leader takes membership changes.
+func (p *Peer) AddMember(id, addr string, learner bool) error {
+	status := p.raft.Status()
+	if !contains(status.Learners, id) {
+		cc := consensus.ConfChange{Type: consensus.ConfAddLearner, Node: id}
+		r := &storage.Record{Members: []storage.Member{{ID: id, Addr: addr, Learner: true}}}
+		if _, err := p.proposeConfChange(cc, r); err != nil {
+			return err
+		}
+	}
+	if learner {
+		return nil
+	}
+	if err := p.awaitCatchUp(id); err != nil {
+		return err
+	}
+	_, err := p.proposeConfChange(consensus.ConfChange{Type: consensus.ConfPromote, Node: id}, &storage.Record{})
+	return err
+}
+
+// RemoveMember removes a voter or learner from the Raft cluster. A leader
+// that removes itself steps down once the change commits.
+func (p *Peer) RemoveMember(id string) error {
+	_, err := p.proposeConfChange(consensus.ConfChange{Type: consensus.ConfRemove, Node: id}, &storage.Record{})
+	return err
+}
+
+// awaitCatchUp waits until a learner has every committed entry.
+func (p *Peer) awaitCatchUp(id string) error {
+	deadline := time.Now().Add(catchUpTimeout)
+	for time.Now().Before(deadline) {
+		status := p.raft.Status()
+		if status.State != consensus.Leader {
+			return consensus.ErrNotLeader
+		}
+		if status.Match[id] >= status.CommitIndex {
+			return nil
+		}
+		time.Sleep(catchUpPoll)
+	}
+	return ErrCatchUpTimeout
+}
+
+// initialMembers is the cluster this node founds, or joins as a learner,
+// when it has no membership of its own yet: itself and the configured peers.
+// Their addresses stay configured rather than recorded.
+func (p *Peer) initialMembers() []storage.Member {
+	members := []storage.Member{{ID: p.config.PeerID, Learner: p.config.RaftJoin}}
+	for id := range p.config.RaftPeers {
+		members = append(members, storage.Member{ID: id})
+	}
+	sortMembers(members)
+	return members
+}
+
+// membersAfter returns the members once a change results in conf. Members
+// keep their addresses unless joining gives them one.
+func (p *Peer) membersAfter(conf consensus.ConfState, joining []storage.Member) []storage.Member {
+	addrs := make(map[string]string)
+	for _, m := range p.members {
+		addrs[m.ID] = m.Addr
+	}
+	for _, m := range joining {
+		if m.Addr != "" {
+			addrs[m.ID] = m.Addr
+		}
+	}
+	var members []storage.Member
+	for _, id := range conf.Voters {
+		members = append(members, storage.Member{ID: id, Addr: addrs[id]})
+	}
+	for _, id := range conf.Learners {
+		members = append(members, storage.Member{ID: id, Addr: addrs[id], Learner: true})
+	}
+	sortMembers(members)
+	return members
+}
+
+// setMembers makes members the cluster's membership and points the transport
+// at the other members. The caller must hold the mutex.
+func (p *Peer) setMembers(members []storage.Member) {
+	p.members = members
+	addrs := make(map[string]string, len(members))
+	for _, m := range members {
+		if m.ID == p.config.PeerID {
+			continue
+		}
+		addr := m.Addr
+		if addr == "" {
+			addr = p.config.RaftPeers[m.ID]
+		}
+		if addr != "" {
+			addrs[m.ID] = addr
+		}
+	}
+	p.transport.setMembers(addrs)
+}
+
+// confState returns the membership in the form Raft takes it.
+func confState(members []storage.Member) consensus.ConfState {
+	var conf consensus.ConfState
+	for _, m := range members {
+		if m.Learner {
+			conf.Learners = append(conf.Learners, m.ID)
+		} else {
+			conf.Voters = append(conf.Voters, m.ID)
+		}
+	}
+	return conf
+}
+
+func sortMembers(members []storage.Member) {
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+}
+
+func contains(ids []string, id string) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
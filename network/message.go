@@ -2,12 +2,21 @@ package network
 
 type MessageType int
 
+// Message types. Each has its own payload layout, see codec.go.
 const (
-	OrderRequest MessageType = iota
-	OrderConfirm
-	OrderCancel
+	OrderRequest    MessageType = iota // an order to submit, see NewOrderRequest
+	OrderConfirm                       // text for the log
+	OrderCancel                        // the ID of the order to cancel
+	OrderAmend                         // an order ID with its new price and quantity
+	RaftMessage                        // a consensus.Message
+	ForwardRequest                     // a request a follower passes to the leader
+	ForwardResponse                    // the leader's answer to a ForwardRequest
+	HistoryRequest                     // a request for a page of stored orders or trades
+	HistoryResponse                    // the answer to a HistoryRequest
 )
 
+// Message is what peers exchange. Payload is encoded by the codec for Type
+// and sent encrypted, after a header with the protocol version.
 type Message struct {
 	Type    MessageType
 	Payload []byte
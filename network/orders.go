@@ -0,0 +1,330 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/artorias742/DTP/consensus"
+	"github.com/artorias742/DTP/monitoring"
+	"github.com/artorias742/DTP/storage"
+	"github.com/artorias742/DTP/trading"
+	"github.com/google/uuid"
+)
+
+// The methods in this file are the only way order state changes. Requests
+// are proposed to Raft, by way of the leader when this node does not lead,
+// and acknowledged once applied; Apply runs every committed request, on every
+// node in the same log order. It writes the request to the write-ahead log,
+// applies it to the books and logs the trades it produced, all under the
+// peer's mutex so the log order is the order the books saw, and returns once
+// the log is synced.
+
+// proposalTimeout bounds how long a request waits to be committed and applied.
+const proposalTimeout = 5 * time.Second
+
+// ErrProposalTimeout is returned for a request that was proposed but not
+// applied in time. It may still commit later.
+var ErrProposalTimeout = errors.New("request not committed in time")
+
+// result is the outcome of applying a request.
+type result struct {
+	order   *trading.Order // an order submitted, as matching left it
+	trades  []trading.Trade
+	cancel  trading.CancelResult
+	amend   trading.AmendResult
+	expired []string
+	err     error
+}
+
+// SubmitOrder runs an order through its book and returns the order as its
+// last execution report left it, filled, resting, killed or rejected, with
+// the trades it took part in. An order that fails validation is reported as
+// rejected by its book on every node and its reason returned.
+func (p *Peer) SubmitOrder(order *trading.Order) (*trading.Order, []trading.Trade, error) {
+	if _, err := p.Books.Instrument(order.Symbol); err != nil {
+		return nil, nil, err
+	}
+	res, err := p.request(&storage.Record{Type: storage.RecordOrder, Order: order})
+	if err != nil {
+		return nil, nil, err
+	}
+	return res.order, res.trades, res.err
+}
+
+// CancelOrder stamps a cancel request with the time it was accepted and
+// applies it.
+func (p *Peer) CancelOrder(id string) (trading.CancelResult, error) {
+	now := time.Now()
+	res, err := p.request(&storage.Record{Type: storage.RecordCancel, OrderID: id, Timestamp: &now})
+	if err != nil {
+		return "", err
+	}
+	return res.cancel, res.err
+}
+
+// AmendOrder stamps an amend request with the time it was accepted and
+// applies it.
+func (p *Peer) AmendOrder(id string, amend trading.Amendment) (trading.AmendResult, []trading.Trade, error) {
+	if amend.Timestamp.IsZero() {
+		amend.Timestamp = time.Now()
+	}
+	res, err := p.request(&storage.Record{Type: storage.RecordAmend, OrderID: id, Amendment: &amend})
+	if err != nil {
+		return "", nil, err
+	}
+	return res.amend, res.trades, res.err
+}
+
+// ExpireDayOrders applies a DAY order expiry. Every node runs the same
+// schedule, so only the leader's expiry is proposed and followers get
+// consensus.ErrNotLeader.
+func (p *Peer) ExpireDayOrders(cutoff time.Time) ([]string, error) {
+	res, err := p.propose(&storage.Record{Type: storage.RecordExpire, Cutoff: &cutoff})
+	if err != nil {
+		return nil, err
+	}
+	return res.expired, res.err
+}
+
+// DayOrdersExpired reports whether DAY orders were expired at cutoff, or a
+// later one, by a request this node applied.
+func (p *Peer) DayOrdersExpired(cutoff time.Time) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return !p.expiredAt.Before(cutoff)
+}
+
+// propose proposes a request and waits until Apply runs it on this node. Only
+// the leader accepts proposals.
+func (p *Peer) propose(r *storage.Record) (result, error) {
+	return p.await(r, p.raft.Propose)
+}
+
+// proposeConfChange proposes a membership change, carrying r in its context,
+// and waits until Apply runs it on this node.
+func (p *Peer) proposeConfChange(cc consensus.ConfChange, r *storage.Record) (result, error) {
+	r.Type = storage.RecordMembers
+	return p.await(r, func(data []byte) error {
+		cc.Context = data
+		return p.raft.ProposeConfChange(cc)
+	})
+}
+
+// await tags a request with a fresh ID, hands it to submit and waits until
+// Apply runs it on this node.
+func (p *Peer) await(r *storage.Record, submit func(data []byte) error) (result, error) {
+	r.Request = uuid.New().String()
+	data, err := json.Marshal(r)
+	if err != nil {
+		return result{}, err
+	}
+
+	done := make(chan result, 1)
+	p.waitMutex.Lock()
+	p.waiters[r.Request] = done
+	p.waitMutex.Unlock()
+	defer func() {
+		p.waitMutex.Lock()
+		delete(p.waiters, r.Request)
+		p.waitMutex.Unlock()
+	}()
+
+	if err := submit(data); err != nil {
+		return result{}, err
+	}
+	select {
+	case res := <-done:
+		return res, nil
+	case <-time.After(proposalTimeout):
+		return result{}, ErrProposalTimeout
+	}
+}
+
+// Apply runs a committed request and hands the outcome to its proposer if it
+// is waiting on this node. Raft calls it for every committed entry in log
+// order; entries already in the write-ahead log, which Raft hands over again
+// after a restart, are skipped. A membership change is logged with the
+// membership it results in. A request that cannot be made durable stops the
+// node, as a failed restore does: Raft counts the entry as applied either
+// way, and this replica would go on from a state the others do not have.
+func (p *Peer) Apply(entry consensus.Entry) {
+	if entry.Data == nil {
+		return
+	}
+	var r storage.Record
+	var cc consensus.ConfChange
+	err := json.Unmarshal(entry.Data, &r)
+	if entry.Type == consensus.EntryConfChange {
+		r = storage.Record{}
+		if err = json.Unmarshal(entry.Data, &cc); err == nil && cc.Context != nil {
+			err = json.Unmarshal(cc.Context, &r)
+		}
+		r.Type = storage.RecordMembers
+	}
+	if err != nil {
+		monitoring.GetLogger().Error("Failed to decode log entry", "index", entry.Index, "error", err)
+		return
+	}
+	r.RaftIndex, r.RaftTerm = entry.Index, entry.Term
+
+	p.mutex.Lock()
+	if entry.Index <= p.applied || p.isStopped() {
+		p.mutex.Unlock()
+		return
+	}
+	if r.Type == storage.RecordMembers {
+		r.Members = p.membersAfter(cc.Conf, r.Members)
+	}
+	res, err := p.execute(&r)
+	p.mutex.Unlock()
+	if err != nil {
+		monitoring.GetLogger().Fatal("Failed to apply committed request", "index", entry.Index, "error", err)
+	}
+
+	p.waitMutex.Lock()
+	done, ok := p.waiters[r.Request]
+	p.waitMutex.Unlock()
+	if ok {
+		done <- res
+	}
+}
+
+// execute logs a committed request, applies it and commits its trades. The
+// error is a failure to make the request durable; the request's own outcome
+// is in the result. The caller must hold the mutex.
+func (p *Peer) execute(r *storage.Record) (result, error) {
+	if err := p.wal.Append(r); err != nil {
+		return result{}, err
+	}
+	p.applied, p.appliedTerm = r.RaftIndex, r.RaftTerm
+	res := p.apply(r)
+	return res, p.commit(res.trades)
+}
+
+// apply applies a request to the books. The caller must hold the mutex.
+func (p *Peer) apply(r *storage.Record) result {
+	var res result
+	switch r.Type {
+	case storage.RecordOrder:
+		res.trades, res.err = applyOrder(p.Books, r.Order)
+		if res.err == nil {
+			// A copy, since the book goes on changing a resting order
+			order := *r.Order
+			res.order = &order
+		}
+	case storage.RecordCancel:
+		var at time.Time
+		if r.Timestamp != nil {
+			at = *r.Timestamp
+		}
+		res.cancel = p.Books.CancelOrder(r.OrderID, at)
+	case storage.RecordAmend:
+		res.amend, res.trades = p.Books.AmendOrder(r.OrderID, *r.Amendment)
+	case storage.RecordExpire:
+		res.expired = p.Books.ExpireDayOrders(*r.Cutoff)
+		if r.Cutoff.After(p.expiredAt) {
+			p.expiredAt = *r.Cutoff
+		}
+	case storage.RecordMembers:
+		p.setMembers(r.Members)
+	}
+	return res
+}
+
+// commit logs the trades of the request just applied and syncs the log, then
+// takes a snapshot if enough requests were logged since the last one. The
+// caller must hold the mutex.
+func (p *Peer) commit(trades []trading.Trade) error {
+	if err := p.Store.Err(); err != nil {
+		return err
+	}
+	for i := range trades {
+		if err := p.wal.Append(&storage.Record{Type: storage.RecordTrade, Trade: &trades[i]}); err != nil {
+			return err
+		}
+	}
+	if err := p.Store.SaveTrades(trades); err != nil {
+		return err
+	}
+	if err := p.wal.Sync(); err != nil {
+		return err
+	}
+
+	p.unsnapshotted++
+	if p.config.SnapshotEvery > 0 && p.unsnapshotted >= p.config.SnapshotEvery {
+		// The request is already durable, so a failed snapshot is not its failure.
+		if err := p.snapshot(); err != nil {
+			monitoring.GetLogger().Error("Snapshot failed", "error", err)
+		}
+	}
+	return nil
+}
+
+// replay applies the write-ahead log records from the given LSN on to the
+// books and notes the last Raft entry among them. Trades are not applied,
+// since the books produce them again; they are checked against the logged
+// ones so a replay that diverges from the original run is noticed.
+func (p *Peer) replay(from uint64) error {
+	logger := monitoring.GetLogger()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var expected []trading.Trade
+	requests, mismatched := 0, 0
+	err := p.wal.Replay(from, func(r storage.Record) error {
+		if r.Type == storage.RecordTrade {
+			if len(expected) == 0 || !sameTrade(expected[0], *r.Trade) {
+				mismatched++
+			}
+			if len(expected) > 0 {
+				expected = expected[1:]
+			}
+			return nil
+		}
+		if r.RaftIndex > 0 {
+			p.applied, p.appliedTerm = r.RaftIndex, r.RaftTerm
+		}
+		trades := p.apply(&r).trades
+		if err := p.Store.SaveTrades(trades); err != nil {
+			return err
+		}
+		mismatched += len(expected)
+		expected = trades
+		requests++
+		p.unsnapshotted++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Trades still expected from the last request are not counted: a crash
+	// can cut the log between a request and its trades.
+
+	if mismatched > 0 {
+		logger.Warn("Replayed trades differ from the write-ahead log", "mismatches", mismatched)
+	}
+	logger.Info("Write-ahead log replayed", "requests", requests, "nextLSN", p.wal.NextLSN())
+	return nil
+}
+
+// sameTrade compares trades field by field; timestamps read back from the
+// log lose their monotonic clock reading, so they are compared with Equal.
+func sameTrade(a, b trading.Trade) bool {
+	return a.Timestamp.Equal(b.Timestamp) && a.Symbol == b.Symbol &&
+		a.ID == b.ID && a.BuyOrderID == b.BuyOrderID && a.SellOrderID == b.SellOrderID &&
+		a.AggressorSide == b.AggressorSide && a.Price == b.Price && a.Quantity == b.Quantity
+}
+
+// applyOrder adds an order to its book and matches it.
+func applyOrder(books *trading.BookRegistry, order *trading.Order) ([]trading.Trade, error) {
+	book, err := books.Book(order.Symbol)
+	if err != nil {
+		return nil, err
+	}
+	if err := books.AddOrder(order); err != nil {
+		return nil, err
+	}
+	return book.MatchOrders(), nil
+}
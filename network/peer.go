@@ -3,36 +3,179 @@ package network
 import (
 	"bufio"
 	"crypto/rand"
-	"fmt"
-
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/artorias742/DTP/config"
 	"github.com/artorias742/DTP/consensus"
 	"github.com/artorias742/DTP/monitoring"
 	"github.com/artorias742/DTP/security"
+	"github.com/artorias742/DTP/storage"
 	"github.com/artorias742/DTP/trading"
 )
 
 type Peer struct {
 	config    *config.Config
-	OrderBook *trading.OrderBook
+	Books     *trading.BookRegistry
+	Store     *storage.Store
+	wal       *storage.WAL
 	auth      *security.AuthManager
+	keys      *security.KeyManager
 	raft      *consensus.Raft
+	raftLog   *consensus.FileStorage
+	transport *raftTransport
 	listener  net.Listener
-	peers     map[string]net.Conn
+	peers     map[string]net.Conn // outgoing connections by address
+	connMutex sync.Mutex          // guards peers
+	mutex     sync.Mutex          // orders changes to the books and the log
+	stopped   chan struct{}       // closed by Stop
+
+	unsnapshotted int    // requests logged since the last snapshot
+	applied       uint64 // last Raft entry applied to the books
+	appliedTerm   uint64
+	members       []storage.Member // the Raft cluster as of applied
+	expiredAt     time.Time        // latest cutoff DAY orders were expired at
+
+	waiters   map[string]chan result          // proposals waiting to be applied, by request ID
+	forwards  map[string]chan forwardResponse // requests waiting for the leader, by forward ID
+	histories map[string]chan historyResponse // history requests waiting for a page, by request ID
+	waitMutex sync.Mutex                      // guards waiters, forwards and histories
 }
 
-func NewPeer(cfg *config.Config) *Peer {
-	return &Peer{
+func NewPeer(cfg *config.Config) (*Peer, error) {
+	instruments := make([]trading.Instrument, 0, len(cfg.Symbols))
+	for _, spec := range cfg.Symbols {
+		instrument, err := trading.ParseInstrument(spec)
+		if err != nil {
+			return nil, err
+		}
+		instruments = append(instruments, instrument)
+	}
+
+	var backend storage.Backend
+	switch cfg.Storage {
+	case "memory":
+		backend = storage.NewMemoryBackend()
+	case "disk":
+		disk, err := storage.OpenDiskBackend(filepath.Join(cfg.DataDir, "store"))
+		if err != nil {
+			return nil, err
+		}
+		backend = disk
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Storage)
+	}
+
+	wal, err := storage.OpenWAL(filepath.Join(cfg.DataDir, "wal"), storage.DefaultSegmentSize)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := security.NewKeyManager()
+	if err != nil {
+		return nil, err
+	}
+	var raftSync consensus.SyncPolicy
+	switch cfg.RaftSync {
+	case "always":
+		raftSync = consensus.SyncAlways
+	case "periodic":
+		raftSync = consensus.SyncPeriodic
+	case "never":
+		raftSync = consensus.SyncNever
+	default:
+		return nil, fmt.Errorf("unknown Raft sync policy %q", cfg.RaftSync)
+	}
+	raftStorage, err := consensus.OpenFileStorage(filepath.Join(cfg.DataDir, "raft"), consensus.FileStorageOptions{
+		Sync:         raftSync,
+		SyncInterval: cfg.RaftSyncInterval,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// AES-256 needs a 32-byte key, whatever the length of the shared secret
+	key := sha256.Sum256([]byte(cfg.ClusterKey))
+
+	p := &Peer{
 		config:    cfg,
-		OrderBook: trading.NewOrderBook(),
-		auth:      security.NewAuthManager([]byte("32-byte-secret-key-here!!")), // Must be 32 bytes for AES-256
-		raft:      consensus.NewRaft(cfg.PeerID, cfg.SeedNodes),
+		Books:     trading.NewBookRegistry(instruments),
+		Store:     storage.NewStore(backend),
+		wal:       wal,
+		raftLog:   raftStorage,
+		auth:      security.NewAuthManager(key[:]),
+		keys:      keys,
 		peers:     make(map[string]net.Conn),
+		stopped:   make(chan struct{}),
+		waiters:   make(map[string]chan result),
+		forwards:  make(map[string]chan forwardResponse),
+		histories: make(map[string]chan historyResponse),
+	}
+	p.Books.OnReport(p.logReport)
+	p.Books.OnReport(p.Store.ApplyReport)
+	p.transport = newRaftTransport(p)
+
+	// Rebuild the books from the latest snapshot and the log before anything
+	// else can touch them; Raft picks up after the last entry they contain,
+	// with the membership as of that entry
+	if err := p.recover(); err != nil {
+		return nil, err
+	}
+	if p.members == nil {
+		p.setMembers(p.initialMembers())
+	}
+
+	conf := confState(p.members)
+	p.raft, err = consensus.NewRaft(consensus.Config{
+		ID:        cfg.PeerID,
+		Storage:   raftStorage,
+		Transport: p.transport,
+
+		StateMachine: p,
+		Applied:      p.applied,
+		AppliedTerm:  p.appliedTerm,
+		Voters:       conf.Voters,
+		Learners:     conf.Learners,
+		LogEntries:   cfg.RaftLogEntries,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// logReport logs every order lifecycle transition produced by the books.
+func (p *Peer) logReport(r trading.ExecutionReport) {
+	logger := monitoring.GetLogger()
+	logger.Info("Execution report",
+		"seq", r.Seq,
+		"symbol", r.Symbol,
+		"id", r.OrderID,
+		"execType", r.ExecType,
+		"status", r.Status,
+		"cumQuantity", r.CumQuantity,
+		"leavesQuantity", r.LeavesQuantity,
+		"avgPrice", r.AvgPrice,
+		"reason", r.Reason)
+}
+
+// ClusterStatus is this node's view of the Raft cluster.
+type ClusterStatus struct {
+	consensus.Status
+	Peers map[string]string `json:"peers"` // the other members, peer ID to address
+}
+
+func (p *Peer) ClusterStatus() ClusterStatus {
+	return ClusterStatus{
+		Status: p.raft.Status(),
+		Peers:  p.transport.members(),
 	}
 }
 
@@ -49,6 +192,9 @@ func (p *Peer) Start() error {
 	// Start Raft consensus
 	p.raft.Start()
 
+	// Snapshot the books periodically
+	go p.snapshotLoop()
+
 	// Start accepting connections
 	go p.acceptConnections()
 
@@ -59,10 +205,44 @@ func (p *Peer) Start() error {
 	return nil
 }
 
+// Stop stops Raft and the peer's loops, closes its connections and then the
+// logs. Entries Raft commits meanwhile are left to be applied on restart.
+func (p *Peer) Stop() error {
+	close(p.stopped)
+	p.raft.Stop()
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	p.transport.setMembers(nil)
+	p.connMutex.Lock()
+	for addr, conn := range p.peers {
+		conn.Close()
+		delete(p.peers, addr)
+	}
+	p.connMutex.Unlock()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return errors.Join(p.wal.Close(), p.raftLog.Close())
+}
+
+// isStopped reports whether Stop was called.
+func (p *Peer) isStopped() bool {
+	select {
+	case <-p.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
 func (p *Peer) acceptConnections() {
 	logger := monitoring.GetLogger()
 	for {
 		conn, err := p.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			logger.Error("Error accepting connection", "error", err)
 			continue
@@ -75,19 +255,29 @@ func (p *Peer) handleConnection(conn net.Conn) {
 	logger := monitoring.GetLogger()
 	defer conn.Close()
 
-	if !p.authenticate(conn) {
+	// One reader for the whole connection, so bytes it buffers past one
+	// message are not lost to the next
+	reader := bufio.NewReader(conn)
+	if !p.authenticate(conn, reader) {
 		logger.Warn("Authentication failed", "remote", conn.RemoteAddr())
 		return
 	}
 
+	// Raft messages are stepped in the order they arrive but off the read
+	// loop: restoring a snapshot holds up Step while the history is fetched,
+	// and its pages come back on this very connection
+	steps := make(chan consensus.Message, raftQueueSize)
+	defer close(steps)
+	go p.stepRaft(steps)
+
 	logger.Info("Connection authenticated", "remote", conn.RemoteAddr())
 	for {
-		msg, err := p.readMessage(conn)
+		msg, err := p.readMessage(reader)
 		if err != nil {
 			logger.Error("Message handling failed", "error", err)
 			return
 		}
-		if err := p.processMessage(msg); err != nil {
+		if err := p.processMessage(msg, steps); err != nil {
 			logger.Warn("Message processing failed", "error", err)
 		}
 	}
@@ -96,19 +286,88 @@ func (p *Peer) handleConnection(conn net.Conn) {
 func (p *Peer) connectToSeeds() {
 	logger := monitoring.GetLogger()
 	for _, addr := range p.config.SeedNodes {
-		conn, err := net.Dial("tcp", addr)
+		conn, err := p.dial(addr)
 		if err != nil {
 			logger.Warn("Failed to connect to seed", "addr", addr, "error", err)
 			continue
 		}
+		p.connMutex.Lock()
 		p.peers[addr] = conn
+		p.connMutex.Unlock()
 		logger.Info("Connected to seed", "addr", addr)
 	}
 }
 
+// dialTimeout bounds connecting to a peer and answering its challenge.
+const dialTimeout = time.Second
+
+// dial connects to a peer and answers its authentication challenge by signing
+// it, the other half of authenticate.
+func (p *Peer) dial(addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+
+	challenge := make([]byte, 32)
+	if _, err := io.ReadFull(conn, challenge); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	signature, err := p.keys.Sign(challenge)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := conn.Write(append(signature, p.keys.PublicKey()...)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// sendTo writes a message to the peer at addr, connecting first if there is
+// no connection yet. A connection that fails is dropped so the next message
+// reconnects. Each message is written with a single Write, so goroutines can
+// share a connection.
+func (p *Peer) sendTo(addr string, msg *Message) error {
+	p.connMutex.Lock()
+	conn := p.peers[addr]
+	p.connMutex.Unlock()
+
+	if conn == nil {
+		dialed, err := p.dial(addr)
+		if err != nil {
+			return err
+		}
+		p.connMutex.Lock()
+		if conn = p.peers[addr]; conn == nil {
+			conn = dialed
+			p.peers[addr] = conn
+		} else {
+			dialed.Close() // another goroutine connected first
+		}
+		p.connMutex.Unlock()
+	}
+
+	if err := p.writeMessage(conn, msg); err != nil {
+		conn.Close()
+		p.connMutex.Lock()
+		if p.peers[addr] == conn {
+			delete(p.peers, addr)
+		}
+		p.connMutex.Unlock()
+		return err
+	}
+	return nil
+}
+
 // authenticate performs a handshake with the connecting peer using ECDSA signatures.
 // It sends a challenge, receives a signed response, and verifies it.
-func (p *Peer) authenticate(conn net.Conn) bool {
+func (p *Peer) authenticate(conn net.Conn, reader *bufio.Reader) bool {
 	logger := monitoring.GetLogger()
 
 	// Generate a random challenge
@@ -125,7 +384,6 @@ func (p *Peer) authenticate(conn net.Conn) bool {
 	}
 
 	// Read signature (64 bytes for P-256 ECDSA) and public key (64 bytes raw X||Y)
-	reader := bufio.NewReader(conn)
 	signature := make([]byte, 64)
 	if _, err := io.ReadFull(reader, signature); err != nil {
 		logger.Error("Failed to read signature", "error", err)
@@ -147,11 +405,16 @@ func (p *Peer) authenticate(conn net.Conn) bool {
 	return true
 }
 
+// maxMessageSize caps the length a message may claim.
+const maxMessageSize = 16 << 20
+
+// headerSize is the protocol version and message type that follow the length.
+const headerSize = 2
+
 // readMessage reads a message from the connection.
-// Format: [4-byte length][1-byte type][payload]
-func (p *Peer) readMessage(conn net.Conn) (*Message, error) {
+// Format: [4-byte length][1-byte version][1-byte type][payload]
+func (p *Peer) readMessage(reader *bufio.Reader) (*Message, error) {
 	logger := monitoring.GetLogger()
-	reader := bufio.NewReader(conn)
 
 	// Read message length (4 bytes)
 	lengthBytes := make([]byte, 4)
@@ -159,16 +422,22 @@ func (p *Peer) readMessage(conn net.Conn) (*Message, error) {
 		return nil, err
 	}
 	length := binary.BigEndian.Uint32(lengthBytes)
+	if length < headerSize || length > maxMessageSize {
+		return nil, fmt.Errorf("invalid message length %d", length)
+	}
 
-	// Read message type (1 byte)
-	typeByte, err := reader.ReadByte()
-	if err != nil {
+	// Read protocol version and message type (1 byte each)
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
 		return nil, err
 	}
-	msgType := MessageType(typeByte)
+	if header[0] != ProtocolVersion {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedVersion, header[0])
+	}
+	msgType := MessageType(header[1])
 
 	// Read payload
-	payload := make([]byte, length-1) // Subtract 1 for type byte
+	payload := make([]byte, length-headerSize)
 	if _, err := io.ReadFull(reader, payload); err != nil {
 		return nil, err
 	}
@@ -186,52 +455,118 @@ func (p *Peer) readMessage(conn net.Conn) (*Message, error) {
 	}, nil
 }
 
-// processMessage handles the received message based on its type.
-func (p *Peer) processMessage(msg *Message) error {
+// writeMessage writes a message to the connection in the format readMessage
+// reads, encrypting the payload.
+func (p *Peer) writeMessage(w io.Writer, msg *Message) error {
+	encrypted, err := p.auth.Encrypt(msg.Payload)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4+headerSize+len(encrypted))
+	binary.BigEndian.PutUint32(buf[:4], uint32(headerSize+len(encrypted)))
+	buf[4] = ProtocolVersion
+	buf[5] = byte(msg.Type)
+	copy(buf[4+headerSize:], encrypted)
+	_, err = w.Write(buf)
+	return err
+}
+
+// stepRaft hands the Raft messages read from a connection to Raft in order.
+func (p *Peer) stepRaft(steps <-chan consensus.Message) {
+	for msg := range steps {
+		p.raft.Step(msg)
+	}
+}
+
+// processMessage handles the received message based on its type. Requests
+// that wait for a commit are served in their own goroutines, and Raft
+// messages queued for stepRaft, so the connection keeps reading while they
+// wait.
+func (p *Peer) processMessage(msg *Message, steps chan<- consensus.Message) error {
 	logger := monitoring.GetLogger()
 
 	switch msg.Type {
 	case OrderRequest:
-		// Parse order from payload (assuming format: ID|Type|Price|Quantity)
-		parts := splitPayload(msg.Payload) // Custom function to split payload
-		if len(parts) != 4 {
-			return errors.New("invalid order request format")
+		order, err := decodeOrderRequest(msg.Payload)
+		if err != nil {
+			return err
 		}
+		order.Timestamp = time.Now()
+		// Like a forwarded request, an order waits for its commit, which
+		// needs the Raft messages queued behind it on this connection
+		go p.serveOrder(order)
 
-		orderType := trading.OrderType(parts[1])
-		if orderType != trading.Buy && orderType != trading.Sell {
-			return errors.New("invalid order type")
+	case OrderConfirm:
+		text, err := decodeString(msg.Payload)
+		if err != nil {
+			return err
 		}
+		logger.Info("Order confirmation received", "payload", text)
 
-		price, err := parseFloat(parts[2])
+	case OrderCancel:
+		id, err := decodeString(msg.Payload)
 		if err != nil {
 			return err
 		}
-		quantity, err := parseFloat(parts[3])
+		if id == "" {
+			return errors.New("invalid order cancel format")
+		}
+		go p.serveCancel(id)
+
+	case OrderAmend:
+		id, amend, err := decodeOrderAmend(msg.Payload)
 		if err != nil {
 			return err
 		}
+		if id == "" {
+			return errors.New("invalid order amend format")
+		}
+		go p.serveAmend(id, amend)
 
-		order := trading.NewOrder(parts[0], orderType, price, quantity)
-		p.OrderBook.AddOrder(order)
-		logger.Info("Order added", "id", order.ID, "type", order.Type)
-
-		// Match orders and log trades
-		trades := p.OrderBook.MatchOrders()
-		for _, trade := range trades {
-			logger.Info("Trade executed",
-				"buyOrder", trade.BuyOrderID,
-				"sellOrder", trade.SellOrderID,
-				"price", trade.Price,
-				"quantity", trade.Quantity)
+	case ForwardRequest:
+		req, err := decodeForwardRequest(msg.Payload)
+		if err != nil {
+			return err
 		}
+		if req.Record == nil {
+			return errors.New("invalid forward request")
+		}
+		// Waiting for the commit here would hold up the connection's Raft
+		// messages, the very ones the commit needs
+		go p.serveForward(req)
 
-	case OrderConfirm:
-		logger.Info("Order confirmation received", "payload", string(msg.Payload))
+	case ForwardResponse:
+		resp, err := decodeForwardResponse(msg.Payload)
+		if err != nil {
+			return err
+		}
+		p.deliverForward(resp)
 
-	case OrderCancel:
-		logger.Info("Order cancellation received", "payload", string(msg.Payload))
-		// Implement cancellation logic if needed
+	case HistoryRequest:
+		req, err := decodeHistoryRequest(msg.Payload)
+		if err != nil {
+			return err
+		}
+		go p.serveHistory(req)
+
+	case HistoryResponse:
+		resp, err := decodeHistoryResponse(msg.Payload)
+		if err != nil {
+			return err
+		}
+		p.deliverHistory(resp)
+
+	case RaftMessage:
+		raftMsg, err := decodeRaftMessage(msg.Payload)
+		if err != nil {
+			return err
+		}
+		// Dropped if Raft is that far behind; it sends again what matters
+		select {
+		case steps <- raftMsg:
+		default:
+		}
 
 	default:
 		return errors.New("unknown message type")
@@ -239,23 +574,60 @@ func (p *Peer) processMessage(msg *Message) error {
 	return nil
 }
 
-// Helper functions (not part of the original interface but needed)
-func splitPayload(payload []byte) []string {
-	// Simple split by '|' - in production, use a proper serialization format
-	var parts []string
-	start := 0
-	for i, b := range payload {
-		if b == '|' {
-			parts = append(parts, string(payload[start:i]))
-			start = i + 1
-		}
+// serveOrder submits an order received from a peer and logs the outcome.
+func (p *Peer) serveOrder(order *trading.Order) {
+	logger := monitoring.GetLogger()
+
+	_, trades, err := p.SubmitOrder(order)
+	if err != nil {
+		logger.Warn("Message processing failed", "error", err)
+		return
+	}
+	logger.Info("Order added",
+		"id", order.ID,
+		"symbol", order.Symbol,
+		"type", order.Type,
+		"kind", order.Kind,
+		"timeInForce", order.TimeInForce)
+	LogTrades(trades)
+}
+
+// serveCancel cancels an order on behalf of a peer and logs the outcome.
+func (p *Peer) serveCancel(id string) {
+	logger := monitoring.GetLogger()
+
+	result, err := p.CancelOrder(id)
+	if err != nil {
+		logger.Warn("Message processing failed", "error", err)
+		return
 	}
-	parts = append(parts, string(payload[start:]))
-	return parts
+	logger.Info("Order cancellation received", "id", id, "result", result)
 }
 
-func parseFloat(s string) (float64, error) {
-	var f float64
-	_, err := fmt.Sscanf(s, "%f", &f)
-	return f, err
+// serveAmend amends an order on behalf of a peer and logs the outcome.
+func (p *Peer) serveAmend(id string, amend trading.Amendment) {
+	logger := monitoring.GetLogger()
+
+	result, trades, err := p.AmendOrder(id, amend)
+	if err != nil {
+		logger.Warn("Message processing failed", "error", err)
+		return
+	}
+	logger.Info("Order amendment received", "id", id, "result", result)
+	LogTrades(trades)
+}
+
+// LogTrades logs the trades a request produced.
+func LogTrades(trades []trading.Trade) {
+	logger := monitoring.GetLogger()
+	for _, trade := range trades {
+		logger.Info("Trade executed",
+			"id", trade.ID,
+			"symbol", trade.Symbol,
+			"aggressor", trade.AggressorSide,
+			"buyOrder", trade.BuyOrderID,
+			"sellOrder", trade.SellOrderID,
+			"price", trade.Price,
+			"quantity", trade.Quantity)
+	}
 }
@@ -0,0 +1,52 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Consistency is how up to date a read of the books and the store must be.
+type Consistency string
+
+const (
+	// Linearizable reads reflect every request acknowledged before them; the
+	// leader confirms with a quorum that it still leads.
+	Linearizable Consistency = "linearizable"
+	// Lease reads are linearizable too while the nodes' clocks agree, and
+	// skip the quorum round while the leader's lease lasts.
+	Lease Consistency = "lease"
+	// Stale reads return what this node has applied, which may be behind
+	// the leader, or from a leader that has been deposed.
+	Stale Consistency = "stale"
+)
+
+// ErrReadTimeout is returned for a read that could not be confirmed in time.
+var ErrReadTimeout = errors.New("read not confirmed in time")
+
+// ParseConsistency parses a consistency level; empty means Linearizable.
+func ParseConsistency(s string) (Consistency, error) {
+	switch c := Consistency(s); c {
+	case "":
+		return Linearizable, nil
+	case Linearizable, Lease, Stale:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown consistency %q", s)
+}
+
+// SyncRead returns once reading the books and the store is as up to date as
+// c asks, waiting for this node to apply what the leader has committed if
+// need be. It gives up after proposalTimeout.
+func (p *Peer) SyncRead(ctx context.Context, c Consistency) error {
+	if c == Stale {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, proposalTimeout)
+	defer cancel()
+	err := p.raft.ReadIndex(ctx, c == Lease)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrReadTimeout
+	}
+	return err
+}
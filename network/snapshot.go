@@ -0,0 +1,188 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/artorias742/DTP/consensus"
+	"github.com/artorias742/DTP/monitoring"
+	"github.com/artorias742/DTP/storage"
+)
+
+// snapshotDir is where the peer keeps its book snapshots.
+func (p *Peer) snapshotDir() string {
+	return filepath.Join(p.config.DataDir, "snapshots")
+}
+
+// recover loads the latest snapshot, if any, and replays the write-ahead log
+// records written after it.
+func (p *Peer) recover() error {
+	logger := monitoring.GetLogger()
+
+	snap, err := storage.LoadSnapshot(p.snapshotDir())
+	if err != nil {
+		return err
+	}
+	from := p.wal.FirstLSN()
+	if snap == nil && from > 1 {
+		return fmt.Errorf("write-ahead log starts at LSN %d but there is no snapshot", from)
+	}
+	if snap != nil {
+		if snap.LSN+1 < from || snap.LSN >= p.wal.NextLSN() {
+			return fmt.Errorf("snapshot at LSN %d does not line up with the write-ahead log (LSN %d to %d)",
+				snap.LSN, from, p.wal.NextLSN()-1)
+		}
+		if err := p.Books.Restore(snap.Books); err != nil {
+			return err
+		}
+		if err := p.Store.Restore(snap.Orders, snap.Trades, snap.Accounts); err != nil {
+			return err
+		}
+		from = snap.LSN + 1
+		p.applied, p.appliedTerm = snap.RaftIndex, snap.RaftTerm
+		p.expiredAt = snap.ExpiredAt
+		if snap.Members != nil {
+			p.setMembers(snap.Members)
+		}
+		logger.Info("Snapshot loaded", "lsn", snap.LSN, "books", len(snap.Books))
+	}
+	return p.replay(from)
+}
+
+// snapshotLoop takes a snapshot on every tick of the configured interval if
+// anything was logged since the last one.
+func (p *Peer) snapshotLoop() {
+	if p.config.SnapshotInterval <= 0 {
+		return
+	}
+	logger := monitoring.GetLogger()
+	ticker := time.NewTicker(p.config.SnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.stopped:
+			return
+		}
+		p.mutex.Lock()
+		if p.unsnapshotted > 0 && !p.isStopped() {
+			if err := p.snapshot(); err != nil {
+				logger.Error("Snapshot failed", "error", err)
+			}
+		}
+		p.mutex.Unlock()
+	}
+}
+
+// snapshot saves the state of every book, and of the store unless its
+// backend keeps it, then drops the write-ahead log segments the snapshot makes
+// redundant. It runs under the mutex so the state matches the log position
+// exactly. The caller must hold the mutex.
+func (p *Peer) snapshot() error {
+	snap := &storage.Snapshot{
+		LSN:   p.wal.NextLSN() - 1,
+		Books: p.Books.State(),
+
+		RaftIndex: p.applied,
+		RaftTerm:  p.appliedTerm,
+		Members:   p.members,
+		ExpiredAt: p.expiredAt,
+	}
+	if p.Store.Durable() {
+		// Replaying the tail over a newer store is harmless, an older one
+		// would miss updates, so the store must be durable first.
+		if err := p.Store.Sync(); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if snap.Orders, err = p.Store.Orders(); err != nil {
+			return err
+		}
+		if snap.Trades, err = p.Store.Trades(); err != nil {
+			return err
+		}
+		if snap.Accounts, err = p.Store.Accounts(); err != nil {
+			return err
+		}
+	}
+	if err := storage.SaveSnapshot(p.snapshotDir(), snap); err != nil {
+		return err
+	}
+	p.unsnapshotted = 0
+
+	// Start a fresh segment so everything up to the snapshot can go.
+	if err := p.wal.Rotate(); err != nil {
+		return err
+	}
+	if err := p.wal.TruncateBefore(snap.LSN + 1); err != nil {
+		return err
+	}
+	monitoring.GetLogger().Info("Snapshot saved", "lsn", snap.LSN, "books", len(snap.Books))
+	return nil
+}
+
+// Snapshot encodes the books, the live orders and the accounts for a follower
+// too far behind the leader's log to catch up from it, with the size of the
+// order and trade history it fetches separately. Raft calls it between
+// applies, so the state is as of the last entry applied.
+func (p *Peer) Snapshot() ([]byte, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	snap := storage.Snapshot{
+		Books: p.Books.State(),
+
+		RaftIndex: p.applied,
+		RaftTerm:  p.appliedTerm,
+		Members:   p.members,
+		ExpiredAt: p.expiredAt,
+	}
+	var err error
+	if snap.Orders, err = p.Store.LiveOrders(); err != nil {
+		return nil, err
+	}
+	if snap.Accounts, err = p.Store.Accounts(); err != nil {
+		return nil, err
+	}
+	if snap.OrderCount, snap.TradeCount, err = p.Store.Counts(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(snap)
+}
+
+// Restore fetches the order and trade history a snapshot from the leader
+// counts, then installs the snapshot.
+func (p *Peer) Restore(s consensus.Snapshot) error {
+	var snap storage.Snapshot
+	if err := json.Unmarshal(s.Data, &snap); err != nil {
+		return err
+	}
+	// Raft applies nothing until Restore returns, so the store gets the
+	// history before any entry that follows the snapshot
+	if err := p.fetchHistory(&snap); err != nil {
+		return err
+	}
+	return p.install(&snap, s)
+}
+
+// install replaces the books with a snapshot and loads its orders and
+// accounts into the store, then snapshots locally so a restart starts from
+// it rather than from the log records it replaced.
+func (p *Peer) install(snap *storage.Snapshot, s consensus.Snapshot) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err := p.Books.Restore(snap.Books); err != nil {
+		return err
+	}
+	if err := p.Store.Restore(snap.Orders, nil, snap.Accounts); err != nil {
+		return err
+	}
+	p.applied, p.appliedTerm = s.Index, s.Term
+	p.expiredAt = snap.ExpiredAt
+	p.setMembers(p.membersAfter(s.Conf, snap.Members))
+	return p.snapshot()
+}
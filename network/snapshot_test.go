@@ -0,0 +1,241 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/artorias742/DTP/config"
+	"github.com/artorias742/DTP/consensus"
+	"github.com/artorias742/DTP/monitoring"
+	"github.com/artorias742/DTP/storage"
+	"github.com/artorias742/DTP/trading"
+)
+
+func TestMain(m *testing.M) {
+	monitoring.InitLogging()
+	os.Exit(m.Run())
+}
+
+// newTestPeer opens a single-node peer on dir without starting it.
+func newTestPeer(t *testing.T, dir string) *Peer {
+	t.Helper()
+	p, err := NewPeer(&config.Config{PeerID: "n1", DataDir: dir, Storage: "memory", RaftSync: "never", ClusterKey: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// commitRecords applies requests as if Raft had committed them in order.
+func commitRecords(t *testing.T, p *Peer, records ...*storage.Record) {
+	t.Helper()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, r := range records {
+		r.RaftIndex, r.RaftTerm = p.applied+1, 1
+		res, err := p.execute(r)
+		if err == nil {
+			err = res.err
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+var testTime = time.Unix(1000, 0).UTC()
+
+func orderRecord(id string, side trading.OrderType, price, quantity int64) *storage.Record {
+	order := trading.NewOrder(id, "BTC", side, trading.DecimalFromInt(price), trading.DecimalFromInt(quantity))
+	testTime = testTime.Add(time.Second)
+	order.Timestamp = testTime
+	return &storage.Record{Type: storage.RecordOrder, Order: order}
+}
+
+func cancelRecord(id string) *storage.Record {
+	testTime = testTime.Add(time.Second)
+	at := testTime
+	return &storage.Record{Type: storage.RecordCancel, OrderID: id, Timestamp: &at}
+}
+
+// peerState encodes what a peer must get back after a restart.
+func peerState(t *testing.T, p *Peer) string {
+	t.Helper()
+	orders, err := p.Store.Orders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trades, err := p.Store.Trades()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(map[string]any{
+		"books": p.Books.State(), "orders": orders, "trades": trades, "applied": p.applied,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSnapshotCompactsWAL(t *testing.T) {
+	dir := t.TempDir()
+	p := newTestPeer(t, dir)
+	commitRecords(t, p,
+		orderRecord("s1", trading.Sell, 100, 5),
+		orderRecord("s2", trading.Sell, 101, 5),
+		orderRecord("b1", trading.Buy, 101, 7),
+	)
+
+	p.mutex.Lock()
+	lsn := p.wal.NextLSN() - 1
+	err := p.snapshot()
+	p.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first := p.wal.FirstLSN(); first != lsn+1 {
+		t.Fatalf("log starts at LSN %d after a snapshot at %d", first, lsn)
+	}
+	snap, err := storage.LoadSnapshot(p.snapshotDir())
+	if err != nil || snap == nil || snap.LSN != lsn {
+		t.Fatalf("loaded snapshot %v, %v; want one at LSN %d", snap, err, lsn)
+	}
+
+	commitRecords(t, p, cancelRecord("s2"), orderRecord("b2", trading.Buy, 99, 4))
+	want := peerState(t, p)
+	if err := p.wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	p = newTestPeer(t, dir)
+	if got := peerState(t, p); got != want {
+		t.Fatalf("restarted peer holds\n%s\nwant\n%s", got, want)
+	}
+	p.wal.Close()
+
+	// Without the snapshot the truncated log cannot rebuild the books
+	if err := os.RemoveAll(p.snapshotDir()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPeer(p.config); err == nil {
+		t.Fatal("peer started from a truncated log without a snapshot")
+	}
+}
+
+func TestRecoverSkipsInvalidSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	p := newTestPeer(t, dir)
+	commitRecords(t, p,
+		orderRecord("s1", trading.Sell, 100, 5),
+		orderRecord("b1", trading.Buy, 100, 2),
+		cancelRecord("s1"),
+	)
+	want := peerState(t, p)
+	if err := p.wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A damaged snapshot is passed over and the whole log replayed
+	if err := os.MkdirAll(p.snapshotDir(), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(p.snapshotDir(), fmt.Sprintf("snapshot-%020d.snap", 2))
+	if err := os.WriteFile(path, []byte("DTPS\x01garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p = newTestPeer(t, dir)
+	defer p.wal.Close()
+	if got := peerState(t, p); got != want {
+		t.Fatalf("restarted peer holds\n%s\nwant\n%s", got, want)
+	}
+}
+
+// freeAddr returns a loopback address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startTestPeer starts a peer listening on addr.
+func startTestPeer(t *testing.T, cfg *config.Config) *Peer {
+	t.Helper()
+	cfg.DataDir, cfg.Storage, cfg.RaftSync, cfg.ClusterKey = t.TempDir(), "memory", "never", "test"
+	p, err := NewPeer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := p.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+	return p
+}
+
+func TestRestoreFetchesHistory(t *testing.T) {
+	addr1, addr2 := freeAddr(t), freeAddr(t)
+	leader := startTestPeer(t, &config.Config{PeerID: "n1", ListenAddr: addr1, RaftLogEntries: 1})
+	deadline := time.Now().Add(5 * time.Second)
+	for leader.raft.Status().State != consensus.Leader {
+		if time.Now().After(deadline) {
+			t.Fatal("no leader elected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Enough requests that the log is compacted past them, so the follower
+	// can only catch up from a snapshot
+	orders := []*trading.Order{
+		trading.NewOrder("s1", "BTC", trading.Sell, trading.DecimalFromInt(100), trading.DecimalFromInt(5)),
+		trading.NewOrder("s2", "BTC", trading.Sell, trading.DecimalFromInt(101), trading.DecimalFromInt(5)),
+		trading.NewOrder("b1", "BTC", trading.Buy, trading.DecimalFromInt(101), trading.DecimalFromInt(7)),
+		trading.NewOrder("s3", "BTC", trading.Sell, trading.DecimalFromInt(105), trading.DecimalFromInt(3)),
+		trading.NewOrder("b2", "BTC", trading.Buy, trading.DecimalFromInt(99), trading.DecimalFromInt(4)),
+	}
+	for _, order := range orders {
+		order.Timestamp = time.Now()
+		if _, _, err := leader.SubmitOrder(order); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := leader.CancelOrder("s3"); err != nil {
+		t.Fatal(err)
+	}
+	follower := startTestPeer(t, &config.Config{
+		PeerID: "n2", ListenAddr: addr2, RaftJoin: true, RaftPeers: map[string]string{"n1": addr1},
+	})
+	if err := leader.AddMember("n2", addr2, true); err != nil {
+		t.Fatal(err)
+	}
+
+	leader.mutex.Lock()
+	want := peerState(t, leader)
+	leader.mutex.Unlock()
+	var got string
+	for deadline := time.Now().Add(10 * time.Second); got != want; time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("follower holds\n%s\nwant\n%s", got, want)
+		}
+		follower.mutex.Lock()
+		got = peerState(t, follower)
+		follower.mutex.Unlock()
+	}
+	// Installing the leader's snapshot is the only way the follower snapshots
+	if snap, err := storage.LoadSnapshot(follower.snapshotDir()); err != nil || snap == nil {
+		t.Fatalf("follower caught up without a snapshot: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package network
+
+import (
+	"sync"
+
+	"github.com/artorias742/DTP/consensus"
+	"github.com/artorias742/DTP/monitoring"
+)
+
+// raftQueueSize is how many messages may wait for each peer before new ones
+// are dropped.
+const raftQueueSize = 1024
+
+// raftTransport carries Raft messages to the other members over peer
+// connections. Each member has a queue drained by its own goroutine, so Send
+// never waits on the network, and a member that is down only loses its own
+// messages.
+type raftTransport struct {
+	peer   *Peer
+	mutex  sync.Mutex
+	addrs  map[string]string // member ID to address
+	queues map[string]chan consensus.Message
+}
+
+func newRaftTransport(p *Peer) *raftTransport {
+	return &raftTransport{
+		peer:   p,
+		addrs:  make(map[string]string),
+		queues: make(map[string]chan consensus.Message),
+	}
+}
+
+// setMembers replaces the members messages go to, starting a sender for
+// every new one and stopping those of members that left.
+func (t *raftTransport) setMembers(addrs map[string]string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for id, queue := range t.queues {
+		if addr, ok := addrs[id]; !ok || addr != t.addrs[id] {
+			close(queue)
+			delete(t.queues, id)
+		}
+	}
+	for id, addr := range addrs {
+		if _, ok := t.queues[id]; !ok {
+			queue := make(chan consensus.Message, raftQueueSize)
+			t.queues[id] = queue
+			go t.deliver(addr, queue)
+		}
+	}
+	t.addrs = addrs
+}
+
+// addr returns the address of a member.
+func (t *raftTransport) addr(id string) (string, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	addr, ok := t.addrs[id]
+	return addr, ok
+}
+
+// members returns the other members' addresses by ID.
+func (t *raftTransport) members() map[string]string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	addrs := make(map[string]string, len(t.addrs))
+	for id, addr := range t.addrs {
+		addrs[id] = addr
+	}
+	return addrs
+}
+
+// Send queues a message for its member, dropping it if the queue is full or
+// the member is unknown; Raft sends again what matters.
+func (t *raftTransport) Send(msg consensus.Message) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	queue, ok := t.queues[msg.To]
+	if !ok {
+		return
+	}
+	select {
+	case queue <- msg:
+	default:
+	}
+}
+
+func (t *raftTransport) deliver(addr string, queue chan consensus.Message) {
+	logger := monitoring.GetLogger()
+	for msg := range queue {
+		if err := t.peer.sendTo(addr, &Message{Type: RaftMessage, Payload: encodeRaftMessage(msg)}); err != nil {
+			logger.Debug("Failed to send Raft message", "to", msg.To, "addr", addr, "error", err)
+		}
+	}
+}
@@ -1,13 +1,53 @@
 package security
 
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+)
+
+// KeyManager holds the P-256 key pair a peer answers handshake challenges
+// with.
 type KeyManager struct {
-	privateKey []byte
-	publicKey  []byte
+	privateKey *ecdsa.PrivateKey
+}
+
+// NewKeyManager generates a fresh key pair.
+func NewKeyManager() (*KeyManager, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyManager{privateKey: key}, nil
 }
 
-func NewKeyManager() *KeyManager {
-	return &KeyManager{
-		privateKey: []byte("placeholder-private-key"),
-		publicKey:  []byte("placeholder-public-key"),
+// PublicKey returns the public key as raw X and Y coordinates (64 bytes), the
+// format ParseECDSAPublicKey reads.
+func (km *KeyManager) PublicKey() []byte {
+	pub := make([]byte, 64)
+	km.privateKey.X.FillBytes(pub[:32])
+	km.privateKey.Y.FillBytes(pub[32:])
+	return pub
+}
+
+// Sign signs the SHA-256 hash of data and returns the signature as [R || S],
+// the format VerifySignature expects.
+func (km *KeyManager) Sign(data []byte) ([]byte, error) {
+	hash := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, km.privateKey, hash[:])
+	if err != nil {
+		return nil, err
 	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signature, nil
+}
+
+// CheckKey reports whether given is the shared cluster key. The comparison
+// takes the same time however much of the key matches.
+func CheckKey(given, key string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(key)) == 1
 }
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/artorias742/DTP/trading"
+)
+
+// Backend is where a Store keeps its records: orders, trades and accounts,
+// along with whatever indexes it needs to list them by filter. Getters return
+// nil when there is no such record. List methods return up to limit matches
+// (all of them for a negative limit), oldest first.
+//
+// ListOrders starts at offset among the matches and returns the offset of the
+// following page, or -1 when there are no more. ListTrades starts at a cursor
+// it handed out earlier ("" for the first page) and returns the cursor of the
+// following page, or "" when there are no more. Cursors are opaque: callers
+// only pass them back with the same filter, and each backend encodes them its
+// own way. Putting a trade whose ID is already stored changes nothing.
+type Backend interface {
+	GetOrder(id string) (*trading.Order, error)
+	PutOrder(order *trading.Order) error
+	ListOrders(filter OrderFilter, offset, limit int) (orders []*trading.Order, next int, err error)
+
+	PutTrade(trade *trading.Trade) error
+	ListTrades(filter TradeFilter, cursor string, limit int) (trades []*trading.Trade, next string, err error)
+
+	GetAccount(owner string) (*Account, error)
+	PutAccount(account *Account) error
+	ListAccounts() ([]*Account, error)
+
+	// Counts returns how many orders and trades are stored.
+	Counts() (orders, trades int, err error)
+
+	// Durable reports whether records outlive the process once Sync returns.
+	Durable() bool
+	Sync() error
+	Close() error
+}
+
+// OrderFilter selects orders in ListOrders. Empty fields match everything.
+type OrderFilter struct {
+	Status trading.OrderStatus
+	Symbol string
+	Side   trading.OrderType
+}
+
+func (f OrderFilter) matches(order *trading.Order) bool {
+	return (f.Status == "" || order.Status == f.Status) &&
+		(f.Symbol == "" || order.Symbol == f.Symbol) &&
+		(f.Side == "" || order.Type == f.Side)
+}
+
+// TradeFilter selects trades in ListTrades. Empty fields match everything.
+type TradeFilter struct {
+	Symbol  string
+	OrderID string    // either side of the trade
+	From    time.Time // trades at or after From
+	To      time.Time // trades before To
+}
+
+func (f TradeFilter) matches(trade *trading.Trade) bool {
+	return (f.Symbol == "" || trade.Symbol == f.Symbol) &&
+		(f.OrderID == "" || trade.BuyOrderID == f.OrderID || trade.SellOrderID == f.OrderID) &&
+		(f.From.IsZero() || !trade.Timestamp.Before(f.From)) &&
+		(f.To.IsZero() || trade.Timestamp.Before(f.To))
+}
+
+// ErrBadCursor is returned by ListTrades for a cursor it did not hand out.
+var ErrBadCursor = errors.New("invalid cursor")
+
+// parseCursor turns a trade cursor back into the count of stored trades that
+// come before its page; "" points before the first trade.
+func parseCursor(cursor string) (uint64, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(cursor, 10, 64)
+	if err != nil {
+		return 0, ErrBadCursor
+	}
+	return n, nil
+}
+
+// Account is what an owner holds as a result of its fills.
+type Account struct {
+	Owner     string                     `json:"owner"`
+	Positions map[string]trading.Decimal `json:"positions"` // net filled quantity per symbol, negative when short
+}
@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/artorias742/DTP/trading"
+)
+
+// eachBackend runs a test against every Backend, each starting empty.
+func eachBackend(t *testing.T, test func(t *testing.T, b Backend)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryBackend())
+	})
+	t.Run("disk", func(t *testing.T) {
+		d := openDisk(t, t.TempDir())
+		defer d.Close()
+		test(t, d)
+	})
+}
+
+func TestListOrders(t *testing.T) {
+	eachBackend(t, func(t *testing.T, b Backend) {
+		putOrder(t, b, "o1", "BTC", trading.Buy, trading.StatusNew)
+		putOrder(t, b, "o2", "ETH", trading.Sell, trading.StatusNew)
+		putOrder(t, b, "o3", "BTC", trading.Sell, trading.StatusPartiallyFilled)
+		putOrder(t, b, "o4", "ETH", trading.Buy, trading.StatusNew)
+		putOrder(t, b, "o5", "BTC", trading.Buy, trading.StatusNew)
+		// Updates keep an order's place
+		putOrder(t, b, "o1", "BTC", trading.Buy, trading.StatusCanceled)
+		putOrder(t, b, "o3", "BTC", trading.Sell, trading.StatusNew)
+
+		for _, c := range []struct {
+			filter OrderFilter
+			want   []string
+		}{
+			{OrderFilter{}, []string{"o1", "o2", "o3", "o4", "o5"}},
+			{OrderFilter{Status: trading.StatusNew}, []string{"o2", "o3", "o4", "o5"}},
+			{OrderFilter{Status: trading.StatusCanceled}, []string{"o1"}},
+			{OrderFilter{Status: trading.StatusPartiallyFilled}, []string{}},
+			{OrderFilter{Symbol: "BTC"}, []string{"o1", "o3", "o5"}},
+			{OrderFilter{Symbol: "SOL"}, []string{}},
+			{OrderFilter{Side: trading.Buy}, []string{"o1", "o4", "o5"}},
+			{OrderFilter{Symbol: "ETH", Side: trading.Buy}, []string{"o4"}},
+			{OrderFilter{Status: trading.StatusNew, Symbol: "BTC"}, []string{"o3", "o5"}},
+			{OrderFilter{Status: trading.StatusNew, Symbol: "BTC", Side: trading.Sell}, []string{"o3"}},
+		} {
+			if got, next := orderIDs(t, b, c.filter, 0, -1); !reflect.DeepEqual(got, c.want) || next != -1 {
+				t.Errorf("orders matching %+v: %v next %d, want %v", c.filter, got, next, c.want)
+			}
+		}
+	})
+}
+
+func TestListOrdersPagination(t *testing.T) {
+	eachBackend(t, func(t *testing.T, b Backend) {
+		for _, id := range []string{"o1", "o2", "o3", "o4", "o5"} {
+			putOrder(t, b, id, "BTC", trading.Buy, trading.StatusNew)
+		}
+		putOrder(t, b, "x", "ETH", trading.Buy, trading.StatusNew)
+
+		for _, c := range []struct {
+			offset, limit int
+			want          []string
+			next          int
+		}{
+			{0, 2, []string{"o1", "o2"}, 2},
+			{2, 2, []string{"o3", "o4"}, 4},
+			{4, 2, []string{"o5"}, -1},
+			{3, 2, []string{"o4", "o5"}, -1},
+			{5, 2, []string{}, -1},
+			{9, 2, []string{}, -1},
+			{1, -1, []string{"o2", "o3", "o4", "o5"}, -1},
+		} {
+			got, next := orderIDs(t, b, OrderFilter{Symbol: "BTC"}, c.offset, c.limit)
+			if !reflect.DeepEqual(got, c.want) || next != c.next {
+				t.Errorf("BTC orders at %d limit %d: %v next %d, want %v next %d", c.offset, c.limit, got, next, c.want, c.next)
+			}
+		}
+	})
+}
+
+// putTrades stores t1 to t6, a minute apart from start.
+func putTrades(t *testing.T, b Backend, start time.Time) {
+	t.Helper()
+	minute := func(n int) time.Time { return start.Add(time.Duration(n) * time.Minute) }
+	putTrade(t, b, "t1", "BTC", "o1", "o2", minute(0))
+	putTrade(t, b, "t2", "ETH", "o3", "o4", minute(1))
+	putTrade(t, b, "t3", "BTC", "o1", "o5", minute(2))
+	putTrade(t, b, "t4", "BTC", "o6", "o2", minute(3))
+	putTrade(t, b, "t5", "ETH", "o3", "o7", minute(4))
+	putTrade(t, b, "t6", "BTC", "o8", "o1", minute(5))
+}
+
+func TestListTrades(t *testing.T) {
+	start := time.Unix(1000, 0).UTC()
+	eachBackend(t, func(t *testing.T, b Backend) {
+		putTrades(t, b, start)
+		putTrade(t, b, "t1", "BTC", "o1", "o2", start) // replayed, already stored
+
+		for _, c := range []struct {
+			filter TradeFilter
+			want   []string
+		}{
+			{TradeFilter{}, []string{"t1", "t2", "t3", "t4", "t5", "t6"}},
+			{TradeFilter{Symbol: "ETH"}, []string{"t2", "t5"}},
+			{TradeFilter{OrderID: "o1"}, []string{"t1", "t3", "t6"}},
+			{TradeFilter{OrderID: "o2", Symbol: "BTC"}, []string{"t1", "t4"}},
+			{TradeFilter{OrderID: "o3", Symbol: "BTC"}, []string{}},
+			{TradeFilter{From: start.Add(2 * time.Minute)}, []string{"t3", "t4", "t5", "t6"}},
+			{TradeFilter{To: start.Add(2 * time.Minute)}, []string{"t1", "t2"}},
+			{TradeFilter{Symbol: "BTC", From: start.Add(time.Minute), To: start.Add(5 * time.Minute)}, []string{"t3", "t4"}},
+		} {
+			if got, next := tradeIDs(t, b, c.filter, "", -1); !reflect.DeepEqual(got, c.want) || next != "" {
+				t.Errorf("trades matching %+v: %v next %q, want %v", c.filter, got, next, c.want)
+			}
+		}
+	})
+}
+
+func TestListTradesCursors(t *testing.T) {
+	start := time.Unix(1000, 0).UTC()
+	eachBackend(t, func(t *testing.T, b Backend) {
+		putTrades(t, b, start)
+
+		for _, filter := range []TradeFilter{{}, {Symbol: "BTC"}, {OrderID: "o3"}, {OrderID: "o1", From: start.Add(time.Minute)}} {
+			all, _ := tradeIDs(t, b, filter, "", -1)
+			for limit := 1; limit <= len(all)+1; limit++ {
+				got := []string{}
+				for cursor, pages := "", 0; ; pages++ {
+					if pages > len(all) {
+						t.Fatalf("paging through %+v by %d does not end", filter, limit)
+					}
+					page, next := tradeIDs(t, b, filter, cursor, limit)
+					if len(page) > limit || (next != "" && len(page) < limit) {
+						t.Fatalf("page of %+v by %d at %q holds %v, next %q", filter, limit, cursor, page, next)
+					}
+					got = append(got, page...)
+					if next == "" {
+						break
+					}
+					cursor = next
+				}
+				if !reflect.DeepEqual(got, all) {
+					t.Errorf("paging through %+v by %d gave %v, want %v", filter, limit, got, all)
+				}
+			}
+		}
+
+		// A cursor still points at the same place after more trades arrive
+		page, next := tradeIDs(t, b, TradeFilter{Symbol: "ETH"}, "", 1)
+		if !reflect.DeepEqual(page, []string{"t2"}) || next == "" {
+			t.Fatalf("first ETH page %v next %q", page, next)
+		}
+		putTrade(t, b, "t7", "ETH", "o9", "o3", start.Add(6*time.Minute))
+		if page, next := tradeIDs(t, b, TradeFilter{Symbol: "ETH"}, next, -1); !reflect.DeepEqual(page, []string{"t5", "t7"}) || next != "" {
+			t.Fatalf("rest of the ETH trades %v next %q", page, next)
+		}
+
+		for _, cursor := range []string{"x", "-1", "1.5"} {
+			if _, _, err := b.ListTrades(TradeFilter{}, cursor, 10); !errors.Is(err, ErrBadCursor) {
+				t.Errorf("listing from cursor %q gave %v, want ErrBadCursor", cursor, err)
+			}
+		}
+	})
+}
+
+func TestLiveOrdersAndCounts(t *testing.T) {
+	eachBackend(t, func(t *testing.T, b Backend) {
+		s := NewStore(b)
+		putOrder(t, b, "o1", "BTC", trading.Buy, trading.StatusPartiallyFilled)
+		putOrder(t, b, "o2", "ETH", trading.Sell, trading.StatusNew)
+		putOrder(t, b, "o3", "BTC", trading.Sell, trading.StatusFilled)
+		putOrder(t, b, "o4", "BTC", trading.Buy, trading.StatusNew)
+		putOrder(t, b, "o2", "ETH", trading.Sell, trading.StatusCanceled)
+		putTrades(t, b, time.Unix(1000, 0).UTC())
+		putTrade(t, b, "t1", "BTC", "o1", "o2", time.Unix(1000, 0).UTC()) // replayed, already stored
+
+		live, err := s.LiveOrders()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, order := range live {
+			ids = append(ids, order.ID)
+		}
+		if !reflect.DeepEqual(ids, []string{"o4", "o1"}) {
+			t.Errorf("live orders %v, want [o4 o1]", ids)
+		}
+		if orders, trades, err := s.Counts(); orders != 4 || trades != 6 || err != nil {
+			t.Errorf("counts %d orders and %d trades, %v; want 4 and 6", orders, trades, err)
+		}
+	})
+}
@@ -0,0 +1,306 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/artorias742/DTP/trading"
+)
+
+// DiskBackend keeps records in a KV on disk. Orders and trades are numbered in
+// the order they are first seen, and every index is a key prefix whose keys end
+// in that number, so a prefix scan lists matches oldest first:
+//
+//	o/<id>                          order, with its number
+//	oi/all/<n>                      order ID, for every order
+//	oi/symbol/<symbol>/<n>          order ID, by symbol
+//	oi/side/<side>/<n>              order ID, by side
+//	oi/status/<status>/<n>          order ID, by current status
+//	t/<n>                           trade
+//	tid/<id>                        trade number, by trade ID
+//	ti/symbol/<symbol>/<n>          trade number, by symbol
+//	ti/order/<id>/<n>               trade number, by either order
+//	a/<owner>                       account
+//	m/order-seq, m/trade-seq        last number handed out
+//
+// A record and its index entries are written in one batch, so they never
+// disagree after a crash.
+type DiskBackend struct {
+	kv       *KV
+	orderSeq uint64
+	tradeSeq uint64
+	mutex    sync.Mutex // serializes writers
+}
+
+// storedOrder is the value of an o/ key.
+type storedOrder struct {
+	Seq   uint64         `json:"seq"`
+	Order *trading.Order `json:"order"`
+}
+
+// OpenDiskBackend opens or creates a disk backend in dir.
+func OpenDiskBackend(dir string) (*DiskBackend, error) {
+	kv, err := OpenKV(dir)
+	if err != nil {
+		return nil, err
+	}
+	d := &DiskBackend{kv: kv}
+	if d.orderSeq, err = d.counter("m/order-seq"); err != nil {
+		kv.Close()
+		return nil, err
+	}
+	if d.tradeSeq, err = d.counter("m/trade-seq"); err != nil {
+		kv.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *DiskBackend) counter(key string) (uint64, error) {
+	value, err := d.kv.Get(key)
+	if err != nil || value == nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(value), 10, 64)
+}
+
+// seqKey formats a record number so that keys sort numerically.
+func seqKey(seq uint64) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
+func (d *DiskBackend) getStoredOrder(id string) (*storedOrder, error) {
+	value, err := d.kv.Get("o/" + id)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var stored storedOrder
+	if err := json.Unmarshal(value, &stored); err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+func (d *DiskBackend) GetOrder(id string) (*trading.Order, error) {
+	stored, err := d.getStoredOrder(id)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+	return stored.Order, nil
+}
+
+func (d *DiskBackend) PutOrder(order *trading.Order) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	stored, err := d.getStoredOrder(order.ID)
+	if err != nil {
+		return err
+	}
+
+	var batch Batch
+	seq := d.orderSeq + 1
+	if stored == nil {
+		n := seqKey(seq)
+		batch.Put("m/order-seq", []byte(strconv.FormatUint(seq, 10)))
+		batch.Put("oi/all/"+n, []byte(order.ID))
+		batch.Put("oi/symbol/"+order.Symbol+"/"+n, []byte(order.ID))
+		batch.Put("oi/side/"+string(order.Type)+"/"+n, []byte(order.ID))
+		batch.Put("oi/status/"+string(order.Status)+"/"+n, []byte(order.ID))
+	} else {
+		seq = stored.Seq
+		if stored.Order.Status != order.Status {
+			n := seqKey(seq)
+			batch.Delete("oi/status/" + string(stored.Order.Status) + "/" + n)
+			batch.Put("oi/status/"+string(order.Status)+"/"+n, []byte(order.ID))
+		}
+	}
+
+	value, err := json.Marshal(storedOrder{Seq: seq, Order: order})
+	if err != nil {
+		return err
+	}
+	batch.Put("o/"+order.ID, value)
+	if err := d.kv.Write(&batch); err != nil {
+		return err
+	}
+	if stored == nil {
+		d.orderSeq = seq
+	}
+	return nil
+}
+
+// ListOrders scans the most selective index the filter allows and checks the
+// rest of the filter against each order.
+func (d *DiskBackend) ListOrders(filter OrderFilter, offset, limit int) ([]*trading.Order, int, error) {
+	prefix := "oi/all/"
+	switch {
+	case filter.Status != "":
+		prefix = "oi/status/" + string(filter.Status) + "/"
+	case filter.Symbol != "":
+		prefix = "oi/symbol/" + filter.Symbol + "/"
+	case filter.Side != "":
+		prefix = "oi/side/" + string(filter.Side) + "/"
+	}
+
+	orders := []*trading.Order{}
+	matched, next := 0, -1
+	var scanErr error
+	err := d.kv.Scan(prefix, func(_ string, id []byte) bool {
+		order, err := d.GetOrder(string(id))
+		if err != nil {
+			scanErr = err
+			return false
+		}
+		if order == nil || !filter.matches(order) {
+			return true
+		}
+		if matched >= offset {
+			if len(orders) == limit {
+				next = matched
+				return false
+			}
+			orders = append(orders, order)
+		}
+		matched++
+		return true
+	})
+	if err == nil {
+		err = scanErr
+	}
+	if err != nil {
+		return nil, -1, err
+	}
+	return orders, next, nil
+}
+
+func (d *DiskBackend) PutTrade(trade *trading.Trade) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if stored, err := d.kv.Get("tid/" + trade.ID); err != nil || stored != nil {
+		return err
+	}
+	value, err := json.Marshal(trade)
+	if err != nil {
+		return err
+	}
+	seq := d.tradeSeq + 1
+	n := seqKey(seq)
+
+	var batch Batch
+	batch.Put("m/trade-seq", []byte(strconv.FormatUint(seq, 10)))
+	batch.Put("t/"+n, value)
+	batch.Put("tid/"+trade.ID, []byte(n))
+	batch.Put("ti/symbol/"+trade.Symbol+"/"+n, []byte(n))
+	batch.Put("ti/order/"+trade.BuyOrderID+"/"+n, []byte(n))
+	batch.Put("ti/order/"+trade.SellOrderID+"/"+n, []byte(n))
+	if err := d.kv.Write(&batch); err != nil {
+		return err
+	}
+	d.tradeSeq = seq
+	return nil
+}
+
+// ListTrades scans the most selective index the filter allows and checks the
+// rest of the filter against each trade. Cursors are trade numbers: a page
+// starts after the one its cursor names.
+func (d *DiskBackend) ListTrades(filter TradeFilter, cursor string, limit int) ([]*trading.Trade, string, error) {
+	after, err := parseCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	prefix := "t/"
+	switch {
+	case filter.OrderID != "":
+		prefix = "ti/order/" + filter.OrderID + "/"
+	case filter.Symbol != "":
+		prefix = "ti/symbol/" + filter.Symbol + "/"
+	}
+
+	trades := []*trading.Trade{}
+	next := ""
+	var scanErr error
+	err = d.kv.ScanFrom(prefix, prefix+seqKey(after+1), func(key string, value []byte) bool {
+		if prefix != "t/" {
+			if value, scanErr = d.kv.Get("t/" + string(value)); scanErr != nil {
+				return false
+			}
+		}
+		var trade trading.Trade
+		if scanErr = json.Unmarshal(value, &trade); scanErr != nil {
+			return false
+		}
+		if !filter.matches(&trade) {
+			return true
+		}
+		if len(trades) == limit {
+			seq, _ := strconv.ParseUint(key[len(prefix):], 10, 64)
+			next = strconv.FormatUint(seq-1, 10)
+			return false
+		}
+		trades = append(trades, &trade)
+		return true
+	})
+	if err == nil {
+		err = scanErr
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return trades, next, nil
+}
+
+func (d *DiskBackend) GetAccount(owner string) (*Account, error) {
+	value, err := d.kv.Get("a/" + owner)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var account Account
+	if err := json.Unmarshal(value, &account); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+func (d *DiskBackend) PutAccount(account *Account) error {
+	value, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+	var batch Batch
+	batch.Put("a/"+account.Owner, value)
+	return d.kv.Write(&batch)
+}
+
+// ListAccounts returns every account sorted by owner.
+func (d *DiskBackend) ListAccounts() ([]*Account, error) {
+	var accounts []*Account
+	var scanErr error
+	err := d.kv.Scan("a/", func(_ string, value []byte) bool {
+		var account Account
+		if scanErr = json.Unmarshal(value, &account); scanErr != nil {
+			return false
+		}
+		accounts = append(accounts, &account)
+		return true
+	})
+	if err == nil {
+		err = scanErr
+	}
+	return accounts, err
+}
+
+func (d *DiskBackend) Counts() (int, int, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return int(d.orderSeq), int(d.tradeSeq), nil
+}
+
+func (d *DiskBackend) Durable() bool { return true }
+func (d *DiskBackend) Sync() error   { return d.kv.Sync() }
+func (d *DiskBackend) Close() error  { return d.kv.Close() }
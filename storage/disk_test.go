@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/artorias742/DTP/trading"
+)
+
+func openDisk(t *testing.T, dir string) *DiskBackend {
+	t.Helper()
+	d, err := OpenDiskBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func putOrder(t *testing.T, b Backend, id, symbol string, side trading.OrderType, status trading.OrderStatus) {
+	t.Helper()
+	order := trading.NewOrder(id, symbol, side, trading.DecimalFromInt(10), trading.DecimalFromInt(1))
+	order.Status = status
+	if err := b.PutOrder(order); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func putTrade(t *testing.T, b Backend, id, symbol, buy, sell string, at time.Time) {
+	t.Helper()
+	trade := &trading.Trade{
+		ID: id, Symbol: symbol, BuyOrderID: buy, SellOrderID: sell, AggressorSide: trading.Buy,
+		Price: trading.DecimalFromInt(10), Quantity: trading.DecimalFromInt(1), Timestamp: at,
+	}
+	if err := b.PutTrade(trade); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// orderIDs lists the IDs of the orders matching filter, a page at a time.
+func orderIDs(t *testing.T, b Backend, filter OrderFilter, offset, limit int) ([]string, int) {
+	t.Helper()
+	orders, next, err := b.ListOrders(filter, offset, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, order := range orders {
+		ids = append(ids, order.ID)
+	}
+	return ids, next
+}
+
+// tradeIDs lists the IDs of the trades matching filter, a page at a time.
+func tradeIDs(t *testing.T, b Backend, filter TradeFilter, cursor string, limit int) ([]string, string) {
+	t.Helper()
+	trades, next, err := b.ListTrades(filter, cursor, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, trade := range trades {
+		ids = append(ids, trade.ID)
+	}
+	return ids, next
+}
+
+// keys returns the keys under prefix.
+func keys(t *testing.T, kv *KV, prefix string) []string {
+	t.Helper()
+	var got []string
+	if err := kv.Scan(prefix, func(key string, _ []byte) bool {
+		got = append(got, key)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestDiskBackendOrderIndexes(t *testing.T) {
+	dir := t.TempDir()
+	d := openDisk(t, dir)
+	putOrder(t, d, "o1", "BTC", trading.Buy, trading.StatusNew)
+	putOrder(t, d, "o2", "ETH", trading.Sell, trading.StatusNew)
+	putOrder(t, d, "o3", "BTC", trading.Sell, trading.StatusNew)
+	putOrder(t, d, "o1", "BTC", trading.Buy, trading.StatusPartiallyFilled)
+	putOrder(t, d, "o1", "BTC", trading.Buy, trading.StatusFilled)
+
+	// A status change moves the order's entry rather than adding one
+	if got := keys(t, d.kv, "oi/status/"); len(got) != 3 {
+		t.Fatalf("status index holds %v, want one entry per order", got)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d = openDisk(t, dir)
+	defer d.Close()
+	putOrder(t, d, "o4", "BTC", trading.Buy, trading.StatusNew)
+	for _, c := range []struct {
+		filter OrderFilter
+		want   []string
+	}{
+		{OrderFilter{}, []string{"o1", "o2", "o3", "o4"}},
+		{OrderFilter{Status: trading.StatusNew}, []string{"o2", "o3", "o4"}},
+		{OrderFilter{Status: trading.StatusFilled}, []string{"o1"}},
+		{OrderFilter{Status: trading.StatusPartiallyFilled}, []string{}},
+		{OrderFilter{Symbol: "BTC"}, []string{"o1", "o3", "o4"}},
+		{OrderFilter{Side: trading.Sell}, []string{"o2", "o3"}},
+		{OrderFilter{Status: trading.StatusNew, Symbol: "BTC", Side: trading.Buy}, []string{"o4"}},
+	} {
+		if got, next := orderIDs(t, d, c.filter, 0, -1); !reflect.DeepEqual(got, c.want) || next != -1 {
+			t.Errorf("orders matching %+v: %v next %d, want %v", c.filter, got, next, c.want)
+		}
+	}
+
+	got, next := orderIDs(t, d, OrderFilter{Symbol: "BTC"}, 0, 2)
+	if !reflect.DeepEqual(got, []string{"o1", "o3"}) || next != 2 {
+		t.Fatalf("first page %v next %d", got, next)
+	}
+	got, next = orderIDs(t, d, OrderFilter{Symbol: "BTC"}, next, 2)
+	if !reflect.DeepEqual(got, []string{"o4"}) || next != -1 {
+		t.Fatalf("second page %v next %d", got, next)
+	}
+}
+
+func TestDiskBackendTradeIndexes(t *testing.T) {
+	dir := t.TempDir()
+	at := time.Unix(1000, 0).UTC()
+	d := openDisk(t, dir)
+	putTrade(t, d, "t1", "BTC", "o1", "o2", at)
+	putTrade(t, d, "t2", "ETH", "o3", "o4", at)
+	putTrade(t, d, "t3", "BTC", "o5", "o1", at)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d = openDisk(t, dir)
+	defer d.Close()
+	putTrade(t, d, "t1", "BTC", "o1", "o2", at) // replayed, already stored
+	putTrade(t, d, "t4", "BTC", "o1", "o6", at)
+	for _, c := range []struct {
+		filter TradeFilter
+		want   []string
+	}{
+		{TradeFilter{}, []string{"t1", "t2", "t3", "t4"}},
+		{TradeFilter{Symbol: "BTC"}, []string{"t1", "t3", "t4"}},
+		{TradeFilter{OrderID: "o1"}, []string{"t1", "t3", "t4"}},
+		{TradeFilter{OrderID: "o1", Symbol: "ETH"}, []string{}},
+		{TradeFilter{OrderID: "o4"}, []string{"t2"}},
+	} {
+		if got, next := tradeIDs(t, d, c.filter, "", -1); !reflect.DeepEqual(got, c.want) || next != "" {
+			t.Errorf("trades matching %+v: %v next %q, want %v", c.filter, got, next, c.want)
+		}
+	}
+
+	var pages [][]string
+	for cursor := ""; ; {
+		page, next := tradeIDs(t, d, TradeFilter{OrderID: "o1"}, cursor, 2)
+		pages = append(pages, page)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if !reflect.DeepEqual(pages, [][]string{{"t1", "t3"}, {"t4"}}) {
+		t.Fatalf("pages %v", pages)
+	}
+}
@@ -0,0 +1,107 @@
+package storage
+
+import "math/rand"
+
+// location says where the current value of a key is stored.
+type location struct {
+	file   uint32
+	offset int64
+	length uint32
+}
+
+// keydirMaxLevel bounds the height of the skip list; 2^24 keys per level-0
+// run is far beyond what a node holds.
+const keydirMaxLevel = 24
+
+type keydirNode struct {
+	key  string
+	loc  location
+	next []*keydirNode
+}
+
+// keydir maps every live key of a KV to the location of its value. It is a
+// skip list, so keys can be walked in order from any point for prefix scans.
+type keydir struct {
+	head  *keydirNode
+	level int
+	len   int
+	rnd   *rand.Rand
+}
+
+func newKeydir() *keydir {
+	return &keydir{
+		head:  &keydirNode{next: make([]*keydirNode, keydirMaxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(1)),
+	}
+}
+
+// seek returns the first node with a key not less than key, filling update
+// with the last node before it on every level when update is not nil.
+func (d *keydir) seek(key string, update []*keydirNode) *keydirNode {
+	node := d.head
+	for i := d.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		if update != nil {
+			update[i] = node
+		}
+	}
+	return node.next[0]
+}
+
+func (d *keydir) get(key string) (location, bool) {
+	node := d.seek(key, nil)
+	if node == nil || node.key != key {
+		return location{}, false
+	}
+	return node.loc, true
+}
+
+// set stores the location of key and returns the one it replaced, if any.
+func (d *keydir) set(key string, loc location) (location, bool) {
+	update := make([]*keydirNode, keydirMaxLevel)
+	node := d.seek(key, update)
+	if node != nil && node.key == key {
+		old := node.loc
+		node.loc = loc
+		return old, true
+	}
+
+	level := 1
+	for level < keydirMaxLevel && d.rnd.Intn(4) == 0 {
+		level++
+	}
+	for i := d.level; i < level; i++ {
+		update[i] = d.head
+	}
+	if level > d.level {
+		d.level = level
+	}
+
+	node = &keydirNode{key: key, loc: loc, next: make([]*keydirNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	d.len++
+	return location{}, false
+}
+
+// delete removes key and returns its location, if it was there.
+func (d *keydir) delete(key string) (location, bool) {
+	update := make([]*keydirNode, keydirMaxLevel)
+	node := d.seek(key, update)
+	if node == nil || node.key != key {
+		return location{}, false
+	}
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+	for d.level > 1 && d.head.next[d.level-1] == nil {
+		d.level--
+	}
+	d.len--
+	return node.loc, true
+}
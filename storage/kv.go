@@ -0,0 +1,445 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// kvFileSize is the size at which the KV starts a new data file.
+const kvFileSize = 64 << 20
+
+// kvCompactMinGarbage is how many bytes of overwritten or deleted values a KV
+// collects before a compaction is considered.
+const kvCompactMinGarbage = 64 << 20
+
+const (
+	opPut    byte = 1
+	opDelete byte = 2
+)
+
+// Batch is a set of writes applied to a KV atomically.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	op    byte
+	key   string
+	value []byte
+}
+
+// Put sets key to value.
+func (b *Batch) Put(key string, value []byte) {
+	b.ops = append(b.ops, batchOp{op: opPut, key: key, value: value})
+}
+
+// Delete removes key.
+func (b *Batch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{op: opDelete, key: key})
+}
+
+// encode lays the batch out as a sequence of
+// [1-byte op][uvarint key length][key][uvarint value length][value].
+func (b *Batch) encode() []byte {
+	var payload []byte
+	for _, op := range b.ops {
+		payload = append(payload, op.op)
+		payload = binary.AppendUvarint(payload, uint64(len(op.key)))
+		payload = append(payload, op.key...)
+		payload = binary.AppendUvarint(payload, uint64(len(op.value)))
+		payload = append(payload, op.value...)
+	}
+	return payload
+}
+
+// KV is an embedded key-value store in the style of Bitcask. Values live in
+// append-only data files and only the keys and the location of their values
+// are held in memory, so the data can be far larger than RAM. Each batch is
+// written as one checksummed frame, so it survives a crash whole or not at
+// all. Overwritten and deleted values are reclaimed by compaction, which
+// rewrites the live values into a new file.
+type KV struct {
+	dir     string
+	files   map[uint32]*os.File // open for reading, by file number
+	active  appendFile          // the newest file, open for appending
+	number  uint32              // number of the active file
+	size    int64               // bytes in the active file
+	keys    *keydir
+	live    int64 // bytes of current values
+	garbage int64 // bytes of overwritten or deleted values
+	mutex   sync.RWMutex
+}
+
+// appendFile is the file a KV appends batches to.
+type appendFile interface {
+	Write(b []byte) (int, error)
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// OpenKV opens the store in dir, creating it if needed. A batch at the tail of
+// the newest file that is incomplete or fails its checksum was torn by a
+// crash and is cut off.
+func OpenKV(dir string) (*KV, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	kv := &KV{dir: dir, files: make(map[uint32]*os.File), keys: newKeydir()}
+
+	numbers, err := kv.listFiles()
+	if err != nil {
+		return nil, err
+	}
+	for i, number := range numbers {
+		path := kv.path(number)
+		valid, err := readFrames(path, func(payload []byte, offset int64) error {
+			return kv.apply(number, offset+recordHeaderSize, payload)
+		})
+		if err != nil {
+			if !errors.Is(err, errTorn) || i != len(numbers)-1 {
+				kv.closeFiles()
+				return nil, fmt.Errorf("%w: %s: %v", ErrCorruptKV, path, err)
+			}
+			if err := os.Truncate(path, valid); err != nil {
+				kv.closeFiles()
+				return nil, err
+			}
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			kv.closeFiles()
+			return nil, err
+		}
+		kv.files[number] = file
+	}
+
+	if len(numbers) == 0 {
+		if err := kv.rotate(); err != nil {
+			return nil, err
+		}
+		return kv, nil
+	}
+	kv.number = numbers[len(numbers)-1]
+	active, err := os.OpenFile(kv.path(kv.number), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		kv.closeFiles()
+		return nil, err
+	}
+	kv.active = active
+	info, err := active.Stat()
+	if err != nil {
+		kv.closeFiles()
+		return nil, err
+	}
+	kv.size = info.Size()
+	return kv, nil
+}
+
+// ErrCorruptKV is returned when a data file other than the newest one fails
+// its checksum.
+var ErrCorruptKV = errors.New("key-value store is corrupt")
+
+// Get returns the value of key, or nil if it is not set.
+func (kv *KV) Get(key string) ([]byte, error) {
+	kv.mutex.RLock()
+	defer kv.mutex.RUnlock()
+
+	loc, ok := kv.keys.get(key)
+	if !ok {
+		return nil, nil
+	}
+	return kv.read(loc)
+}
+
+// Scan calls fn with every key that has the given prefix and its value, in
+// key order, until fn returns false. Keys are read in chunks and fn is called
+// without the store locked, so it may read from the store; writes made during
+// a scan may or may not be seen by it.
+func (kv *KV) Scan(prefix string, fn func(key string, value []byte) bool) error {
+	return kv.ScanFrom(prefix, prefix, fn)
+}
+
+// ScanFrom is Scan starting at the first key not less than from.
+func (kv *KV) ScanFrom(prefix, from string, fn func(key string, value []byte) bool) error {
+	const chunk = 128
+	for {
+		keys := make([]string, 0, chunk)
+		values := make([][]byte, 0, chunk)
+
+		kv.mutex.RLock()
+		for node := kv.keys.seek(from, nil); node != nil && len(keys) < chunk; node = node.next[0] {
+			if !strings.HasPrefix(node.key, prefix) {
+				break
+			}
+			value, err := kv.read(node.loc)
+			if err != nil {
+				kv.mutex.RUnlock()
+				return err
+			}
+			keys = append(keys, node.key)
+			values = append(values, value)
+		}
+		kv.mutex.RUnlock()
+
+		for i, key := range keys {
+			if !fn(key, values[i]) {
+				return nil
+			}
+		}
+		if len(keys) < chunk {
+			return nil
+		}
+		from = keys[len(keys)-1] + "\x00"
+	}
+}
+
+// Write applies a batch. It is not durable until Sync returns.
+func (kv *KV) Write(b *Batch) error {
+	if len(b.ops) == 0 {
+		return nil
+	}
+	payload := b.encode()
+	if len(payload) > maxRecordSize {
+		return fmt.Errorf("key-value batch of %d bytes is too large", len(payload))
+	}
+
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	if kv.size > 0 && kv.size+int64(recordHeaderSize+len(payload)) > kvFileSize {
+		if err := kv.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := kv.active.Write(frame(payload)); err != nil {
+		// Cut off whatever part of the frame made it, or the next batch
+		// would land behind a torn one
+		kv.active.Truncate(kv.size)
+		return err
+	}
+	if err := kv.apply(kv.number, kv.size+recordHeaderSize, payload); err != nil {
+		return err
+	}
+	kv.size += int64(recordHeaderSize + len(payload))
+
+	if kv.garbage > kvCompactMinGarbage && kv.garbage > kv.live {
+		return kv.compact()
+	}
+	return nil
+}
+
+// Sync flushes every write to stable storage.
+func (kv *KV) Sync() error {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	return kv.active.Sync()
+}
+
+// Close syncs and closes the store.
+func (kv *KV) Close() error {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	err := kv.active.Sync()
+	kv.closeFiles()
+	return err
+}
+
+// apply updates the keydir for a batch whose payload starts at offset in the
+// given file. The caller must hold the mutex or own the store exclusively.
+func (kv *KV) apply(number uint32, offset int64, payload []byte) error {
+	pos := 0
+	next := func() ([]byte, bool) {
+		n, size := binary.Uvarint(payload[pos:])
+		if size <= 0 || uint64(len(payload)-pos-size) < n {
+			return nil, false
+		}
+		start := pos + size
+		pos = start + int(n)
+		return payload[start:pos], true
+	}
+
+	for pos < len(payload) {
+		op := payload[pos]
+		pos++
+		key, ok := next()
+		if !ok {
+			return errTorn
+		}
+		value, ok := next()
+		if !ok {
+			return errTorn
+		}
+
+		var old location
+		var replaced bool
+		switch op {
+		case opPut:
+			loc := location{file: number, offset: offset + int64(pos-len(value)), length: uint32(len(value))}
+			old, replaced = kv.keys.set(string(key), loc)
+			kv.live += int64(len(value))
+		case opDelete:
+			old, replaced = kv.keys.delete(string(key))
+		default:
+			return errTorn
+		}
+		if replaced {
+			kv.live -= int64(old.length)
+			kv.garbage += int64(old.length)
+		}
+	}
+	return nil
+}
+
+// read returns the value stored at loc. The caller must hold the mutex.
+func (kv *KV) read(loc location) ([]byte, error) {
+	value := make([]byte, loc.length)
+	if _, err := kv.files[loc.file].ReadAt(value, loc.offset); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// rotate starts a new active file. The caller must hold the mutex.
+func (kv *KV) rotate() error {
+	if kv.active != nil {
+		if err := kv.active.Sync(); err != nil {
+			return err
+		}
+		if err := kv.active.Close(); err != nil {
+			return err
+		}
+	}
+
+	number := kv.number + 1
+	path := kv.path(number)
+	active, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	reader, err := os.Open(path)
+	if err != nil {
+		active.Close()
+		return err
+	}
+	if err := syncDir(kv.dir); err != nil {
+		active.Close()
+		reader.Close()
+		return err
+	}
+	kv.files[number] = reader
+	kv.active, kv.number, kv.size = active, number, 0
+	return nil
+}
+
+// compact copies every live value into a new file and deletes the older
+// files, oldest first. Until they are deleted the new file simply repeats
+// their live values, and whatever a crash leaves behind is a run of the newest
+// old files, so a delete in one of them still follows any value it removed:
+// a crash part way through neither loses a key nor brings one back. The
+// caller must hold the mutex.
+func (kv *KV) compact() error {
+	old := make([]uint32, 0, len(kv.files))
+	for number := range kv.files {
+		old = append(old, number)
+	}
+	sort.Slice(old, func(i, j int) bool { return old[i] < old[j] })
+	if err := kv.rotate(); err != nil {
+		return err
+	}
+
+	// Copy in chunks so no single frame grows past maxRecordSize.
+	var batch Batch
+	var pending int
+	flush := func() error {
+		if len(batch.ops) == 0 {
+			return nil
+		}
+		payload := batch.encode()
+		if _, err := kv.active.Write(frame(payload)); err != nil {
+			kv.active.Truncate(kv.size)
+			return err
+		}
+		kv.size += int64(recordHeaderSize + len(payload))
+		batch, pending = Batch{}, 0
+		return nil
+	}
+
+	compacted := newKeydir()
+	for node := kv.keys.head.next[0]; node != nil; node = node.next[0] {
+		value, err := kv.read(node.loc)
+		if err != nil {
+			return err
+		}
+		if pending+len(value)+len(node.key) > maxRecordSize/2 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		batch.Put(node.key, value)
+		pending += len(node.key) + len(value) + 2*binary.MaxVarintLen64 + 1
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if err := kv.active.Sync(); err != nil {
+		return err
+	}
+
+	// Rebuild the keydir from the new file rather than tracking offsets
+	// while writing, so it is exactly what a restart would load.
+	kv.live, kv.garbage = 0, 0
+	kv.keys = compacted
+	if _, err := readFrames(kv.path(kv.number), func(payload []byte, offset int64) error {
+		return kv.apply(kv.number, offset+recordHeaderSize, payload)
+	}); err != nil {
+		return err
+	}
+
+	for _, number := range old {
+		kv.files[number].Close()
+		delete(kv.files, number)
+		if err := os.Remove(kv.path(number)); err != nil {
+			return err
+		}
+	}
+	return syncDir(kv.dir)
+}
+
+func (kv *KV) path(number uint32) string {
+	return filepath.Join(kv.dir, fmt.Sprintf("kv-%06d.data", number))
+}
+
+// listFiles returns the numbers of the data files in dir, oldest first.
+func (kv *KV) listFiles() ([]uint32, error) {
+	entries, err := os.ReadDir(kv.dir)
+	if err != nil {
+		return nil, err
+	}
+	var numbers []uint32
+	for _, entry := range entries {
+		var number uint32
+		if _, err := fmt.Sscanf(entry.Name(), "kv-%06d.data", &number); err == nil {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	return numbers, nil
+}
+
+func (kv *KV) closeFiles() {
+	for _, file := range kv.files {
+		file.Close()
+	}
+	if kv.active != nil {
+		kv.active.Close()
+	}
+}
@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func openKV(t *testing.T, dir string) *KV {
+	t.Helper()
+	kv, err := OpenKV(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv
+}
+
+// write applies a batch of puts, given as key and value pairs, and deletes,
+// given as a key with no value.
+func write(t *testing.T, kv *KV, ops ...string) {
+	t.Helper()
+	var batch Batch
+	for i := 0; i < len(ops); i += 2 {
+		if i+1 == len(ops) {
+			batch.Delete(ops[i])
+		} else {
+			batch.Put(ops[i], []byte(ops[i+1]))
+		}
+	}
+	if err := kv.Write(&batch); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// contents returns every key of the store and its value.
+func contents(t *testing.T, kv *KV) map[string]string {
+	t.Helper()
+	got := map[string]string{}
+	var last string
+	err := kv.Scan("", func(key string, value []byte) bool {
+		if key <= last && last != "" {
+			t.Fatalf("scan returned %q after %q", key, last)
+		}
+		last = key
+		got[key] = string(value)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+// rotateKV starts a new data file, as filling the active one would.
+func rotateKV(t *testing.T, kv *KV) {
+	t.Helper()
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	if err := kv.rotate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKVReopen(t *testing.T) {
+	dir := t.TempDir()
+	kv := openKV(t, dir)
+	write(t, kv, "a", "1", "b", "1", "c", "1")
+	rotateKV(t, kv)
+	write(t, kv, "b", "2", "a")
+	write(t, kv, "d", "2")
+	want := map[string]string{"b": "2", "c": "1", "d": "2"}
+	if got := contents(t, kv); !reflect.DeepEqual(got, want) {
+		t.Fatalf("store holds %v, want %v", got, want)
+	}
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	kv = openKV(t, dir)
+	defer kv.Close()
+	if got := contents(t, kv); !reflect.DeepEqual(got, want) {
+		t.Fatalf("reopened store holds %v, want %v", got, want)
+	}
+	if value, err := kv.Get("a"); err != nil || value != nil {
+		t.Fatalf("deleted key reads %q, %v", value, err)
+	}
+	if kv.live != 3 || kv.garbage != 2 {
+		t.Fatalf("%d live and %d garbage bytes after reopening, want 3 and 2", kv.live, kv.garbage)
+	}
+
+	var scanned []string
+	kv.ScanFrom("", "c", func(key string, _ []byte) bool {
+		scanned = append(scanned, key)
+		return true
+	})
+	if !reflect.DeepEqual(scanned, []string{"c", "d"}) {
+		t.Fatalf("scan from c gave %v", scanned)
+	}
+}
+
+func TestKVDropsTornBatch(t *testing.T) {
+	dir := t.TempDir()
+	kv := openKV(t, dir)
+	write(t, kv, "a", "1")
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Killed while writing a batch that would have set b and deleted a
+	var batch Batch
+	batch.Put("b", []byte("2"))
+	batch.Delete("a")
+	buf := frame(batch.encode())
+	file, err := os.OpenFile(kv.path(kv.number), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(buf[:len(buf)-1])
+	file.Close()
+
+	kv = openKV(t, dir)
+	defer kv.Close()
+	if got := contents(t, kv); !reflect.DeepEqual(got, map[string]string{"a": "1"}) {
+		t.Fatalf("store holds %v, want none of the torn batch", got)
+	}
+	write(t, kv, "b", "2")
+	if got := contents(t, kv); !reflect.DeepEqual(got, map[string]string{"a": "1", "b": "2"}) {
+		t.Fatalf("store holds %v after writing again", got)
+	}
+}
+
+// shortFile writes half of each batch and fails, as a full disk would.
+type shortFile struct {
+	appendFile
+}
+
+func (f shortFile) Write(b []byte) (int, error) {
+	n, _ := f.appendFile.Write(b[:len(b)/2])
+	return n, errors.New("no space left on device")
+}
+
+func TestKVCutsOffFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	kv := openKV(t, dir)
+	write(t, kv, "a", "1")
+
+	active := kv.active
+	kv.active = shortFile{active}
+	var batch Batch
+	batch.Put("b", []byte("2"))
+	if err := kv.Write(&batch); err == nil {
+		t.Fatal("short write succeeded")
+	}
+	kv.active = active
+
+	write(t, kv, "c", "3")
+	want := map[string]string{"a": "1", "c": "3"}
+	if got := contents(t, kv); !reflect.DeepEqual(got, want) {
+		t.Fatalf("store holds %v, want %v", got, want)
+	}
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The batch after the failed one is not lost behind a torn frame
+	kv = openKV(t, dir)
+	defer kv.Close()
+	if got := contents(t, kv); !reflect.DeepEqual(got, want) {
+		t.Fatalf("reopened store holds %v, want %v", got, want)
+	}
+}
+
+func TestKVCompaction(t *testing.T) {
+	dir := t.TempDir()
+	kv := openKV(t, dir)
+	write(t, kv, "a", "1", "b", "1", "c", "1")
+	rotateKV(t, kv)
+	write(t, kv, "a")
+	write(t, kv, "b", "2")
+	rotateKV(t, kv)
+	write(t, kv, "c")
+	write(t, kv, "d", "3")
+	want := map[string]string{"b": "2", "d": "3"}
+
+	// Keep the files as they were before compacting, and the compacted one
+	// as compact left it
+	saved := t.TempDir()
+	old, err := kv.listFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, number := range old {
+		copyFile(t, kv.path(number), filepath.Join(saved, filepath.Base(kv.path(number))))
+	}
+
+	kv.mutex.Lock()
+	err = kv.compact()
+	kv.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := kv.listFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != kv.number {
+		t.Fatalf("files %v after compacting, want only %d", files, kv.number)
+	}
+	if kv.garbage != 0 {
+		t.Fatalf("%d garbage bytes after compacting", kv.garbage)
+	}
+	if got := contents(t, kv); !reflect.DeepEqual(got, want) {
+		t.Fatalf("store holds %v after compacting, want %v", got, want)
+	}
+	compacted := filepath.Base(kv.path(kv.number))
+	copyFile(t, kv.path(kv.number), filepath.Join(saved, compacted))
+
+	write(t, kv, "e", "4")
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	kv = openKV(t, dir)
+	want["e"] = "4"
+	if got := contents(t, kv); !reflect.DeepEqual(got, want) {
+		t.Fatalf("reopened store holds %v, want %v", got, want)
+	}
+	kv.Close()
+	delete(want, "e")
+
+	// A crash part way through deleting the old files, oldest first, leaves
+	// the newest of them next to the compacted file. Each delete they hold
+	// still follows the value it removed, so no deleted key comes back.
+	for removed := 0; removed <= len(old); removed++ {
+		crashed := t.TempDir()
+		for _, number := range old[removed:] {
+			name := filepath.Base(kv.path(number))
+			copyFile(t, filepath.Join(saved, name), filepath.Join(crashed, name))
+		}
+		copyFile(t, filepath.Join(saved, compacted), filepath.Join(crashed, compacted))
+
+		kv := openKV(t, crashed)
+		if got := contents(t, kv); !reflect.DeepEqual(got, want) {
+			t.Fatalf("with the %d oldest files deleted the store holds %v, want %v", removed, got, want)
+		}
+		kv.Close()
+	}
+}
+
+func copyFile(t *testing.T, from, to string) {
+	t.Helper()
+	data, err := os.ReadFile(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(to, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
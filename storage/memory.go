@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/artorias742/DTP/trading"
+)
+
+// MemoryBackend keeps every record in maps and slices. It holds its own
+// copies, so readers never race with the writers that produced them. Nothing
+// survives a restart; the peer puts its contents into book snapshots instead.
+type MemoryBackend struct {
+	orders   map[string]*trading.Order
+	ids      []string // order IDs in the order they were first seen
+	trades   []*trading.Trade
+	tradeIDs map[string]bool
+	accounts map[string]*Account
+	mutex    sync.RWMutex
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		orders:   make(map[string]*trading.Order),
+		tradeIDs: make(map[string]bool),
+		accounts: make(map[string]*Account),
+	}
+}
+
+func (m *MemoryBackend) GetOrder(id string) (*trading.Order, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	order, ok := m.orders[id]
+	if !ok {
+		return nil, nil
+	}
+	c := *order
+	return &c, nil
+}
+
+func (m *MemoryBackend) PutOrder(order *trading.Order) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.orders[order.ID]; !ok {
+		m.ids = append(m.ids, order.ID)
+	}
+	c := *order
+	m.orders[order.ID] = &c
+	return nil
+}
+
+func (m *MemoryBackend) ListOrders(filter OrderFilter, offset, limit int) ([]*trading.Order, int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	orders := []*trading.Order{}
+	matched := 0
+	for _, id := range m.ids {
+		order := m.orders[id]
+		if !filter.matches(order) {
+			continue
+		}
+		if matched >= offset {
+			if len(orders) == limit {
+				return orders, matched, nil
+			}
+			c := *order
+			orders = append(orders, &c)
+		}
+		matched++
+	}
+	return orders, -1, nil
+}
+
+func (m *MemoryBackend) PutTrade(trade *trading.Trade) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.tradeIDs[trade.ID] {
+		return nil
+	}
+	m.tradeIDs[trade.ID] = true
+	c := *trade
+	m.trades = append(m.trades, &c)
+	return nil
+}
+
+// ListTrades uses positions in the trade history as cursors: a page starts at
+// the trade its cursor names.
+func (m *MemoryBackend) ListTrades(filter TradeFilter, cursor string, limit int) ([]*trading.Trade, string, error) {
+	after, err := parseCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	trades := []*trading.Trade{}
+	for i := int(min(after, uint64(len(m.trades)))); i < len(m.trades); i++ {
+		if !filter.matches(m.trades[i]) {
+			continue
+		}
+		if len(trades) == limit {
+			return trades, strconv.Itoa(i), nil
+		}
+		c := *m.trades[i]
+		trades = append(trades, &c)
+	}
+	return trades, "", nil
+}
+
+func (m *MemoryBackend) GetAccount(owner string) (*Account, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	account, ok := m.accounts[owner]
+	if !ok {
+		return nil, nil
+	}
+	return copyAccount(account), nil
+}
+
+func (m *MemoryBackend) PutAccount(account *Account) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.accounts[account.Owner] = copyAccount(account)
+	return nil
+}
+
+// ListAccounts returns every account sorted by owner.
+func (m *MemoryBackend) ListAccounts() ([]*Account, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	accounts := make([]*Account, 0, len(m.accounts))
+	for _, account := range m.accounts {
+		accounts = append(accounts, copyAccount(account))
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Owner < accounts[j].Owner })
+	return accounts, nil
+}
+
+func (m *MemoryBackend) Counts() (int, int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return len(m.ids), len(m.trades), nil
+}
+
+func (m *MemoryBackend) Durable() bool { return false }
+func (m *MemoryBackend) Sync() error   { return nil }
+func (m *MemoryBackend) Close() error  { return nil }
+
+func copyAccount(account *Account) *Account {
+	c := &Account{Owner: account.Owner, Positions: make(map[string]trading.Decimal, len(account.Positions))}
+	for symbol, position := range account.Positions {
+		c.Positions[symbol] = position
+	}
+	return c
+}
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/artorias742/DTP/trading"
+)
+
+// ErrBadSnapshot is returned for a snapshot file that is truncated, fails its
+// checksum or was written in an unknown format version.
+var ErrBadSnapshot = errors.New("invalid snapshot")
+
+// SnapshotVersion is the format version written by SaveSnapshot.
+const SnapshotVersion = 1
+
+// snapshotMagic starts every snapshot file.
+var snapshotMagic = []byte("DTPS")
+
+// snapshotHeaderSize is the magic, a 1-byte version and the CRC-32C of the
+// payload.
+const snapshotHeaderSize = 4 + 1 + 4
+
+// Snapshot is the state of every book as of the write-ahead log record LSN.
+// Records up to and including LSN are already reflected in it. Stored orders,
+// trades and accounts are included when the store's backend does not keep
+// them itself.
+//
+// A snapshot sent to a Raft follower has no LSN and carries only the orders
+// still live and the accounts, with the number of orders and trades the store
+// held; the follower fetches the rest of the history separately.
+type Snapshot struct {
+	LSN      uint64              `json:"lsn"`
+	Books    []trading.BookState `json:"books"`
+	Orders   []*trading.Order    `json:"orders,omitempty"` // stored order states, oldest first
+	Trades   []*trading.Trade    `json:"trades,omitempty"` // oldest first
+	Accounts []*Account          `json:"accounts,omitempty"`
+
+	OrderCount int `json:"order_count,omitempty"`
+	TradeCount int `json:"trade_count,omitempty"`
+
+	// The last Raft entry applied before the snapshot was taken, and the
+	// cluster's membership as of it
+	RaftIndex uint64   `json:"raft_index,omitempty"`
+	RaftTerm  uint64   `json:"raft_term,omitempty"`
+	Members   []Member `json:"members,omitempty"`
+
+	// The latest cutoff DAY orders were expired at
+	ExpiredAt time.Time `json:"expired_at"`
+}
+
+// SaveSnapshot writes snap to dir atomically and then removes older snapshots.
+// The file is [4-byte magic][1-byte version][4-byte CRC-32C][JSON payload].
+func SaveSnapshot(dir string, snap *Snapshot) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(snapshotMagic)
+	buf.WriteByte(SnapshotVersion)
+	binary.Write(&buf, binary.BigEndian, crc32.Checksum(payload, crcTable))
+	buf.Write(payload)
+
+	// Write to a temporary file and rename it, so a crash never leaves a
+	// half-written file under a snapshot name.
+	path := filepath.Join(dir, fmt.Sprintf("snapshot-%020d.snap", snap.LSN))
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, buf.Bytes()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	older, err := listSnapshots(dir)
+	if err != nil {
+		return err
+	}
+	for _, old := range older {
+		if old != path {
+			os.Remove(old)
+		}
+	}
+	return nil
+}
+
+// LoadSnapshot returns the newest valid snapshot in dir, or nil if there is
+// none. Invalid snapshots are skipped.
+func LoadSnapshot(dir string) (*Snapshot, error) {
+	paths, err := listSnapshots(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := len(paths) - 1; i >= 0; i-- {
+		if snap, err := readSnapshot(paths[i]); err == nil {
+			return snap, nil
+		}
+	}
+	return nil, nil
+}
+
+// readSnapshot reads and verifies one snapshot file.
+func readSnapshot(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < snapshotHeaderSize || !bytes.Equal(data[:4], snapshotMagic) {
+		return nil, ErrBadSnapshot
+	}
+	if data[4] != SnapshotVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrBadSnapshot, data[4])
+	}
+	payload := data[snapshotHeaderSize:]
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(data[5:9]) {
+		return nil, ErrBadSnapshot
+	}
+
+	var snap Snapshot
+	if err := json.Unmarshal(payload, &snap); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+	}
+	return &snap, nil
+}
+
+// listSnapshots returns the snapshot files in dir, oldest first.
+func listSnapshots(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, "snapshot-") && strings.HasSuffix(name, ".snap") {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+	}
+	// The zero-padded LSN in the name makes lexical order LSN order.
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// writeFileSync writes data to a new file and syncs it.
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
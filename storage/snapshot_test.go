@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/artorias742/DTP/trading"
+)
+
+func testSnapshot(lsn uint64) *Snapshot {
+	at := time.Unix(1000, 0).UTC()
+	order := trading.NewOrder("o1", "BTC", trading.Buy, trading.DecimalFromInt(10), trading.DecimalFromInt(2))
+	order.Timestamp = at
+	return &Snapshot{
+		LSN: lsn,
+		Books: []trading.BookState{{
+			Instrument: trading.DefaultInstrument("BTC"),
+			Resting:    []trading.RestingOrder{{Order: order}},
+			Closed:     []trading.ClosedOrder{{ID: "o0", Status: trading.StatusFilled, At: at}},
+			Seq:        lsn,
+			Now:        at,
+		}},
+		Orders:    []*trading.Order{order},
+		Accounts:  []*Account{{Owner: "alice", Positions: map[string]trading.Decimal{"BTC": trading.DecimalFromInt(1)}}},
+		RaftIndex: lsn + 10,
+		RaftTerm:  2,
+		Members:   []Member{{ID: "n1"}},
+		ExpiredAt: at,
+	}
+}
+
+// sameSnapshot compares snapshots by their encoding, which is what is saved.
+func sameSnapshot(t *testing.T, got, want *Snapshot) {
+	t.Helper()
+	a, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(a) != string(b) {
+		t.Fatalf("snapshot\n%s\nwant\n%s", a, b)
+	}
+}
+
+func TestSaveAndLoadSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	if snap, err := LoadSnapshot(filepath.Join(dir, "missing")); snap != nil || err != nil {
+		t.Fatalf("loading from a missing directory gave %v, %v", snap, err)
+	}
+
+	for _, lsn := range []uint64{5, 12} {
+		if err := SaveSnapshot(dir, testSnapshot(lsn)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap, err := LoadSnapshot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameSnapshot(t, snap, testSnapshot(12))
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != fmt.Sprintf("snapshot-%020d.snap", 12) {
+		t.Fatalf("directory holds %v, want only the newest snapshot", entries)
+	}
+}
+
+func TestLoadSnapshotSkipsInvalid(t *testing.T) {
+	for name, damage := range map[string]func(data []byte) []byte{
+		"truncated":       func(data []byte) []byte { return data[:len(data)-10] },
+		"header only":     func(data []byte) []byte { return data[:snapshotHeaderSize-1] },
+		"bad magic":       func(data []byte) []byte { data[0] = 'X'; return data },
+		"unknown version": func(data []byte) []byte { data[4] = SnapshotVersion + 1; return data },
+		"bad checksum":    func(data []byte) []byte { data[len(data)-2] ^= 0xff; return data },
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := SaveSnapshot(dir, testSnapshot(5)); err != nil {
+				t.Fatal(err)
+			}
+			older := filepath.Join(dir, fmt.Sprintf("snapshot-%020d.snap", 5))
+			data, err := os.ReadFile(older)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// A newer snapshot that is damaged is passed over for the older one
+			newer := filepath.Join(dir, fmt.Sprintf("snapshot-%020d.snap", 9))
+			if err := os.WriteFile(newer, damage(append([]byte(nil), data...)), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readSnapshot(newer); err == nil {
+				t.Fatal("damaged snapshot reads back")
+			}
+			snap, err := LoadSnapshot(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sameSnapshot(t, snap, testSnapshot(5))
+
+			// With no valid snapshot left there is none to load
+			if err := os.Remove(older); err != nil {
+				t.Fatal(err)
+			}
+			if snap, err := LoadSnapshot(dir); snap != nil || err != nil {
+				t.Fatalf("loading only a damaged snapshot gave %v, %v", snap, err)
+			}
+		})
+	}
+}
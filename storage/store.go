@@ -6,27 +6,192 @@ import (
 	"github.com/artorias742/DTP/trading"
 )
 
+// Store keeps the latest known state of every order and the positions of
+// every account, folded from execution reports, and the trade history in a
+// Backend.
 type Store struct {
-	orders map[string]*trading.Order
-	mutex  sync.RWMutex
+	backend Backend
+	err     error      // first backend failure seen by ApplyReport
+	mutex   sync.Mutex // serializes ApplyReport's read-modify-write
 }
 
-func NewStore() *Store {
+func NewStore(backend Backend) *Store {
 	return &Store{
-		orders: make(map[string]*trading.Order),
+		backend: backend,
 	}
 }
 
-func (s *Store) SaveOrder(order *trading.Order) {
+func (s *Store) SaveOrder(order *trading.Order) error {
+	return s.backend.PutOrder(order)
+}
+
+func (s *Store) GetOrder(id string) (*trading.Order, error) {
+	return s.backend.GetOrder(id)
+}
+
+// ListOrders returns up to limit orders matching filter, oldest first,
+// starting at offset among the matches. next is the offset of the following
+// page, or -1 when there are no more matches.
+func (s *Store) ListOrders(filter OrderFilter, offset, limit int) (orders []*trading.Order, next int, err error) {
+	return s.backend.ListOrders(filter, offset, limit)
+}
+
+// SaveTrades adds trades to the history. Trades already stored are skipped,
+// so trades produced again by a replay are harmless.
+func (s *Store) SaveTrades(trades []trading.Trade) error {
+	for i := range trades {
+		if err := s.backend.PutTrade(&trades[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListTrades returns up to limit trades matching filter, oldest first,
+// starting at cursor ("" for the first page). next is the cursor of the
+// following page, or "" when there are no more matches. Cursors are opaque
+// and only good for the filter they were handed out with.
+func (s *Store) ListTrades(filter TradeFilter, cursor string, limit int) (trades []*trading.Trade, next string, err error) {
+	return s.backend.ListTrades(filter, cursor, limit)
+}
+
+// GetAccount returns the positions of an owner, or nil if it never traded.
+func (s *Store) GetAccount(owner string) (*Account, error) {
+	return s.backend.GetAccount(owner)
+}
+
+// ApplyReport folds an execution report into the stored state of its order,
+// creating the order the first time it is reported, and moves the owner's
+// position by the quantity filled since the order was last stored. Applying
+// the same report twice changes nothing, so reports replayed after a crash
+// are harmless. It is meant to be registered with trading.BookRegistry.OnReport;
+// since a report handler cannot fail, a backend error is kept for Err.
+func (s *Store) ApplyReport(r trading.ExecutionReport) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	s.orders[order.ID] = order
+	if err := s.applyReport(r); err != nil && s.err == nil {
+		s.err = err
+	}
 }
 
-func (s *Store) GetOrder(id string) *trading.Order {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+func (s *Store) applyReport(r trading.ExecutionReport) error {
+	order, err := s.backend.GetOrder(r.OrderID)
+	if err != nil {
+		return err
+	}
+	if order == nil {
+		order = &trading.Order{
+			ID:          r.OrderID,
+			Symbol:      r.Symbol,
+			Type:        r.Type,
+			Owner:       r.Owner,
+			TimeInForce: r.TimeInForce,
+			Timestamp:   r.Timestamp,
+		}
+	}
+	filled := r.CumQuantity - order.CumQuantity
+
+	order.Kind = r.Kind
+	order.Price = r.Price
+	order.StopPrice = r.StopPrice
+	order.Status = r.Status
+	order.OrigQuantity = r.OrigQuantity
+	order.CumQuantity = r.CumQuantity
+	order.Quantity = r.LeavesQuantity
+	order.AvgPrice = r.AvgPrice
+	if err := s.backend.PutOrder(order); err != nil {
+		return err
+	}
+
+	if r.Owner == "" || filled == 0 {
+		return nil
+	}
+	account, err := s.backend.GetAccount(r.Owner)
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		account = &Account{Owner: r.Owner, Positions: make(map[string]trading.Decimal)}
+	}
+	if r.Type == trading.Sell {
+		filled = -filled
+	}
+	account.Positions[r.Symbol] += filled
+	return s.backend.PutAccount(account)
+}
 
-	return s.orders[id]
+// Err returns the first backend failure ApplyReport ran into, if any.
+func (s *Store) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.err
+}
+
+// Durable reports whether the backend keeps its records across restarts.
+func (s *Store) Durable() bool {
+	return s.backend.Durable()
+}
+
+// Sync makes everything stored so far durable.
+func (s *Store) Sync() error {
+	return s.backend.Sync()
+}
+
+// Orders returns every stored order, oldest first.
+func (s *Store) Orders() ([]*trading.Order, error) {
+	orders, _, err := s.backend.ListOrders(OrderFilter{}, 0, -1)
+	return orders, err
+}
+
+// Trades returns every stored trade, oldest first.
+func (s *Store) Trades() ([]*trading.Trade, error) {
+	trades, _, err := s.backend.ListTrades(TradeFilter{}, "", -1)
+	return trades, err
+}
+
+// LiveOrders returns every stored order that is not in a terminal state,
+// oldest first within each status.
+func (s *Store) LiveOrders() ([]*trading.Order, error) {
+	var live []*trading.Order
+	for _, status := range []trading.OrderStatus{trading.StatusNew, trading.StatusPartiallyFilled} {
+		orders, _, err := s.backend.ListOrders(OrderFilter{Status: status}, 0, -1)
+		if err != nil {
+			return nil, err
+		}
+		live = append(live, orders...)
+	}
+	return live, nil
+}
+
+// Counts returns how many orders and trades are stored.
+func (s *Store) Counts() (orders, trades int, err error) {
+	return s.backend.Counts()
+}
+
+// Accounts returns every account.
+func (s *Store) Accounts() ([]*Account, error) {
+	return s.backend.ListAccounts()
+}
+
+// Restore loads orders and trades, oldest first, and accounts into the
+// backend.
+func (s *Store) Restore(orders []*trading.Order, trades []*trading.Trade, accounts []*Account) error {
+	for _, order := range orders {
+		if err := s.backend.PutOrder(order); err != nil {
+			return err
+		}
+	}
+	for _, trade := range trades {
+		if err := s.backend.PutTrade(trade); err != nil {
+			return err
+		}
+	}
+	for _, account := range accounts {
+		if err := s.backend.PutAccount(account); err != nil {
+			return err
+		}
+	}
+	return nil
 }
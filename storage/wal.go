@@ -0,0 +1,393 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artorias742/DTP/trading"
+)
+
+// ErrCorruptWAL is returned when a record before the tail of the log fails
+// its checksum or is out of sequence. Only the tail can be torn by a crash;
+// damage anywhere else needs an operator.
+var ErrCorruptWAL = errors.New("write-ahead log is corrupt")
+
+// DefaultSegmentSize is the size at which the log starts a new segment file.
+const DefaultSegmentSize = 64 << 20
+
+// maxRecordSize bounds a single record so a garbage length in a torn header
+// is not mistaken for a huge record.
+const maxRecordSize = 16 << 20
+
+// recordHeaderSize is the length and CRC-32C of the payload, both big endian.
+const recordHeaderSize = 8
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// RecordType says what a write-ahead log record holds.
+type RecordType string
+
+const (
+	RecordOrder   RecordType = "ORDER"   // an accepted order
+	RecordCancel  RecordType = "CANCEL"  // a cancel request
+	RecordAmend   RecordType = "AMEND"   // an amend request
+	RecordExpire  RecordType = "EXPIRE"  // DAY orders expired at a cutoff
+	RecordMembers RecordType = "MEMBERS" // the Raft cluster's membership after a change
+	RecordTrade   RecordType = "TRADE"   // a trade produced by the preceding request
+)
+
+// Record is one entry of the write-ahead log. LSN is assigned by Append and
+// increases by one for every record. A request that was committed through
+// Raft carries the index and term of its log entry, and the ID its proposer
+// gave it.
+type Record struct {
+	LSN       uint64             `json:"lsn"`
+	Type      RecordType         `json:"type"`
+	Order     *trading.Order     `json:"order,omitempty"`
+	OrderID   string             `json:"order_id,omitempty"`
+	Amendment *trading.Amendment `json:"amendment,omitempty"`
+	Cutoff    *time.Time         `json:"cutoff,omitempty"`
+	Timestamp *time.Time         `json:"timestamp,omitempty"` // when a cancel was accepted
+	Trade     *trading.Trade     `json:"trade,omitempty"`
+	Members   []Member           `json:"members,omitempty"`
+	Request   string             `json:"request,omitempty"`
+	RaftIndex uint64             `json:"raft_index,omitempty"`
+	RaftTerm  uint64             `json:"raft_term,omitempty"`
+}
+
+// Member is a node of the Raft cluster. An empty Addr means the node's
+// address is configured rather than recorded.
+type Member struct {
+	ID      string `json:"id"`
+	Addr    string `json:"addr,omitempty"`
+	Learner bool   `json:"learner,omitempty"`
+}
+
+// segment is one file of the log, named after the LSN of its first record.
+type segment struct {
+	first uint64
+	path  string
+}
+
+// WAL is an append-only, checksummed log split into segment files. Each
+// record is framed as [4-byte length][4-byte CRC-32C][JSON payload]. Records
+// are durable once Sync returns.
+type WAL struct {
+	dir         string
+	segmentSize int64
+	segments    []segment
+	file        *os.File // the last segment, open for appending
+	size        int64    // bytes in the last segment
+	next        uint64   // LSN of the next record
+	mutex       sync.Mutex
+}
+
+// OpenWAL opens the log in dir, creating it if needed. A record at the tail
+// of the last segment that is incomplete or fails its checksum was torn by a
+// crash and is cut off, along with anything after it.
+func OpenWAL(dir string, segmentSize int64) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	w := &WAL{dir: dir, segmentSize: segmentSize, next: 1}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i, seg := range segments {
+		if i > 0 && seg.first != w.next {
+			return nil, fmt.Errorf("%w: segment %s starts at %d, expected %d", ErrCorruptWAL, seg.path, seg.first, w.next)
+		}
+		w.next = seg.first
+		valid, err := readSegment(seg.path, func(r Record) error {
+			if r.LSN != w.next {
+				return errTorn
+			}
+			w.next++
+			return nil
+		})
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, errTorn) || i != len(segments)-1 {
+			return nil, fmt.Errorf("%w: %s: %v", ErrCorruptWAL, seg.path, err)
+		}
+		if err := os.Truncate(seg.path, valid); err != nil {
+			return nil, err
+		}
+	}
+	w.segments = segments
+
+	if len(w.segments) == 0 {
+		return w, w.rotate()
+	}
+	last := w.segments[len(w.segments)-1]
+	if w.file, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return nil, err
+	}
+	info, err := w.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	w.size = info.Size()
+	return w, nil
+}
+
+// FirstLSN returns the LSN of the oldest record still in the log.
+func (w *WAL) FirstLSN() uint64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.segments[0].first
+}
+
+// NextLSN returns the LSN the next appended record will get.
+func (w *WAL) NextLSN() uint64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.next
+}
+
+// Append assigns the record the next LSN and writes it to the log. The record
+// is not durable until Sync returns. A failed write is cut off again so the
+// record can be retried.
+func (w *WAL) Append(r *Record) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	r.LSN = w.next
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxRecordSize {
+		return fmt.Errorf("write-ahead log record of %d bytes is too large", len(payload))
+	}
+
+	if w.size > 0 && w.size+int64(recordHeaderSize+len(payload)) > w.segmentSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	buf := frame(payload)
+	if _, err := w.file.Write(buf); err != nil {
+		w.file.Truncate(w.size)
+		return err
+	}
+	w.size += int64(len(buf))
+	w.next++
+	return nil
+}
+
+// Sync flushes every appended record to stable storage.
+func (w *WAL) Sync() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.file.Sync()
+}
+
+// Replay calls fn for every record with an LSN of at least from, in order.
+func (w *WAL) Replay(from uint64, fn func(Record) error) error {
+	w.mutex.Lock()
+	segments := append([]segment(nil), w.segments...)
+	w.mutex.Unlock()
+
+	for i, seg := range segments {
+		if i+1 < len(segments) && segments[i+1].first <= from {
+			continue
+		}
+		_, err := readSegment(seg.path, func(r Record) error {
+			if r.LSN < from {
+				return nil
+			}
+			return fn(r)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rotate starts a new segment unless the current one is empty, so every record
+// written so far can later be dropped by TruncateBefore.
+func (w *WAL) Rotate() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.size == 0 {
+		return nil
+	}
+	return w.rotate()
+}
+
+// TruncateBefore deletes the segments that only hold records older than lsn.
+// The segment being appended to is always kept.
+func (w *WAL) TruncateBefore(lsn uint64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	removed := 0
+	for removed+1 < len(w.segments) && w.segments[removed+1].first <= lsn {
+		if err := os.Remove(w.segments[removed].path); err != nil {
+			return err
+		}
+		removed++
+	}
+	if removed == 0 {
+		return nil
+	}
+	w.segments = append([]segment(nil), w.segments[removed:]...)
+	return syncDir(w.dir)
+}
+
+// Close syncs and closes the log.
+func (w *WAL) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+// rotate syncs the current segment and starts a new one at the next LSN. The
+// current segment is closed only once the new one is in place; until then
+// appends go on to it. The caller must hold the mutex.
+func (w *WAL) rotate() error {
+	if w.file != nil {
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	seg := segment{first: w.next, path: filepath.Join(w.dir, fmt.Sprintf("wal-%020d.log", w.next))}
+	file, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("start write-ahead log segment at %d: %w", seg.first, err)
+	}
+	if err := syncDir(w.dir); err != nil {
+		file.Close()
+		os.Remove(seg.path)
+		return fmt.Errorf("start write-ahead log segment at %d: %w", seg.first, err)
+	}
+	old := w.file
+	w.segments = append(w.segments, seg)
+	w.file = file
+	w.size = 0
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+// errTorn marks a record that is cut short or fails its checksum.
+var errTorn = errors.New("torn record")
+
+// readSegment calls fn for each record in a segment file and returns the
+// offset just past the last record it accepted. It stops with errTorn at the
+// first record that is incomplete or fails its checksum.
+func readSegment(path string, fn func(Record) error) (int64, error) {
+	return readFrames(path, func(payload []byte, _ int64) error {
+		var r Record
+		if err := json.Unmarshal(payload, &r); err != nil {
+			return errTorn
+		}
+		return fn(r)
+	})
+}
+
+// readFrames calls fn with the payload and file offset of each checksummed
+// frame in a file and returns the offset just past the last frame it
+// accepted. It stops with errTorn at the first frame that is incomplete or
+// fails its checksum.
+func readFrames(path string, fn func(payload []byte, offset int64) error) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			return offset, errTorn
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		if length == 0 || length > maxRecordSize {
+			return offset, errTorn
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return offset, errTorn
+		}
+		if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+			return offset, errTorn
+		}
+		if err := fn(payload, offset); err != nil {
+			return offset, err
+		}
+		offset += int64(recordHeaderSize) + int64(length)
+	}
+}
+
+// frame prefixes a payload with its length and checksum.
+func frame(payload []byte) []byte {
+	buf := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	copy(buf[recordHeaderSize:], payload)
+	return buf
+}
+
+// listSegments returns the segment files in dir ordered by first LSN.
+func listSegments(dir string) ([]segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []segment
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "wal-") || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		var first uint64
+		if _, err := fmt.Sscanf(name, "wal-%d.log", &first); err != nil {
+			continue
+		}
+		segments = append(segments, segment{first: first, path: filepath.Join(dir, name)})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].first < segments[j].first })
+	return segments, nil
+}
+
+// syncDir makes file creations and removals in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
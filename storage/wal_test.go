@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// appendRecords appends a cancel record for each id and syncs the log.
+func appendRecords(t *testing.T, w *WAL, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		if err := w.Append(&Record{Type: RecordCancel, OrderID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// replayed returns the order IDs of the records with an LSN of at least from.
+func replayed(t *testing.T, w *WAL, from uint64) []string {
+	t.Helper()
+	var ids []string
+	err := w.Replay(from, func(r Record) error {
+		if r.LSN != from+uint64(len(ids)) {
+			t.Fatalf("record %q has LSN %d, want %d", r.OrderID, r.LSN, from+uint64(len(ids)))
+		}
+		ids = append(ids, r.OrderID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+// lastSegment returns the path of the segment being appended to.
+func lastSegment(w *WAL) string {
+	return w.segments[len(w.segments)-1].path
+}
+
+func TestWALReplay(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenWAL(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, w, "a", "b", "c", "d", "e", "f")
+	if len(w.segments) < 3 {
+		t.Fatalf("%d segments, want the records split across several", len(w.segments))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = OpenWAL(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.NextLSN() != 7 {
+		t.Fatalf("next LSN %d after reopening, want 7", w.NextLSN())
+	}
+	if got := replayed(t, w, 1); !reflect.DeepEqual(got, []string{"a", "b", "c", "d", "e", "f"}) {
+		t.Fatalf("replayed %v", got)
+	}
+	if got := replayed(t, w, 4); !reflect.DeepEqual(got, []string{"d", "e", "f"}) {
+		t.Fatalf("replayed %v from 4", got)
+	}
+
+	if err := w.TruncateBefore(4); err != nil {
+		t.Fatal(err)
+	}
+	if first := w.FirstLSN(); first > 4 || first == 1 {
+		t.Fatalf("first LSN %d after truncating before 4", first)
+	}
+	appendRecords(t, w, "g")
+	if got := replayed(t, w, 4); !reflect.DeepEqual(got, []string{"d", "e", "f", "g"}) {
+		t.Fatalf("replayed %v after truncating", got)
+	}
+}
+
+func TestWALDropsTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenWAL(dir, DefaultSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, w, "a", "b", "c")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Killed while appending c
+	info, err := os.Stat(lastSegment(w))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(lastSegment(w), info.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = OpenWAL(dir, DefaultSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if got := replayed(t, w, 1); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("replayed %v, want the torn record dropped", got)
+	}
+	appendRecords(t, w, "c")
+	if got := replayed(t, w, 1); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Fatalf("replayed %v after appending again", got)
+	}
+}
+
+func TestWALChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenWAL(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, w, "a", "b", "c", "d")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	first, last := w.segments[0].path, lastSegment(w)
+	if first == last {
+		t.Fatal("the records fit in one segment")
+	}
+
+	// A damaged byte in the last record is a torn tail and is cut off
+	flip(t, last, -2)
+	w, err = OpenWAL(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := replayed(t, w, 1); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Fatalf("replayed %v, want the damaged last record dropped", got)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Anywhere else it is corruption
+	flip(t, first, recordHeaderSize+2)
+	if _, err := OpenWAL(dir, 100); !errors.Is(err, ErrCorruptWAL) {
+		t.Fatalf("opening a log with a damaged earlier segment gave %v, want ErrCorruptWAL", err)
+	}
+}
+
+// flip inverts a byte of a file, counting from the end if offset is negative.
+func flip(t *testing.T, path string, offset int64) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset < 0 {
+		offset += int64(len(data))
+	}
+	data[offset] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWALKeepsSegmentWhenRotationFails(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenWAL(dir, DefaultSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	appendRecords(t, w, "a", "b")
+
+	// A file already where the next segment would go
+	blocker := filepath.Join(dir, fmt.Sprintf("wal-%020d.log", w.NextLSN()))
+	if err := os.WriteFile(blocker, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Rotate(); err == nil {
+		t.Fatal("rotated onto an existing segment")
+	}
+	appendRecords(t, w, "c")
+
+	if err := os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, w, "d")
+	if got, want := replayed(t, w, 1), []string{"a", "b", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("replayed %v, want %v", got, want)
+	}
+}
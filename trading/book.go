@@ -1,44 +1,197 @@
 package trading
 
 import (
+	"container/list"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/artorias742/DTP/monitoring"
 )
 
+// Trade is one fill between an incoming order and a resting one. IDs are
+// SYMBOL-N with N counting the book's trades from 1, so a replayed book hands
+// out the same IDs again.
 type Trade struct {
-	BuyOrderID  string
-	SellOrderID string
-	Price       float64
-	Quantity    float64
+	ID            string    `json:"id"`
+	Symbol        string    `json:"symbol"`
+	BuyOrderID    string    `json:"buy_order_id"`
+	SellOrderID   string    `json:"sell_order_id"`
+	AggressorSide OrderType `json:"aggressor_side"` // side of the incoming order
+	Price         Decimal   `json:"price"`
+	Quantity      Decimal   `json:"quantity"`
+	Timestamp     time.Time `json:"timestamp"`
 }
 
+// CancelResult tells the caller what happened to a cancel request.
+type CancelResult string
+
+const (
+	Canceled        CancelResult = "CANCELED"
+	AlreadyFilled   CancelResult = "FILLED"
+	AlreadyCanceled CancelResult = "ALREADY_CANCELED"
+	Expired         CancelResult = "EXPIRED"
+	Rejected        CancelResult = "REJECTED"
+	UnknownOrder    CancelResult = "UNKNOWN"
+)
+
+// AmendResult tells the caller what happened to an amend request.
+type AmendResult string
+
+const (
+	Amended         AmendResult = "AMENDED"          // quantity reduced, time priority kept
+	AmendedRequeued AmendResult = "AMENDED_REQUEUED" // price changed or size increased, priority lost
+	AmendRejected   AmendResult = "REJECTED"
+	AmendFilled     AmendResult = "FILLED"
+	AmendCanceled   AmendResult = "CANCELED"
+	AmendUnknown    AmendResult = "UNKNOWN"
+)
+
+// Amendment carries the new price and remaining quantity for a resting order.
+// A zero field leaves that attribute unchanged. Timestamp is when the amend
+// was accepted and becomes the order's new time priority if it is requeued; a
+// zero Timestamp means now.
+type Amendment struct {
+	Price     Decimal   `json:"price"`
+	Quantity  Decimal   `json:"quantity"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// OrderBook keeps resting orders grouped by price level. Each side is a heap
+// of levels and each level is a FIFO queue, so price-time priority falls out
+// of the structure instead of being re-sorted on every match.
 type OrderBook struct {
-	buyOrders  []*Order
-	sellOrders []*Order
+	symbol     string
+	instrument Instrument
+	bids       *bookSide
+	asks       *bookSide
+	index      map[string]*list.Element // resting orders by ID
+	closed     map[string]OrderStatus   // terminal status of orders that left the book
+	retired    []retiredOrder           // the orders in closed, in the order they left
+	incoming   []*Order                 // orders waiting for MatchOrders
+	stops      *StopBook
+	last       Decimal   // price of the most recent trade
+	traded     bool      // whether last is set
+	seq        uint64    // sequence number of the last execution report
+	tradeSeq   uint64    // number of the last trade
+	now        time.Time // time of the operation being applied
+	handlers   []ReportHandler
 	mutex      sync.Mutex
 }
 
-func NewOrderBook() *OrderBook {
+func NewOrderBook(instrument Instrument) *OrderBook {
 	return &OrderBook{
-		buyOrders:  make([]*Order, 0),
-		sellOrders: make([]*Order, 0),
+		symbol:     instrument.Symbol,
+		instrument: instrument,
+		bids:       newBookSide(func(a, b Decimal) bool { return a > b }),
+		asks:       newBookSide(func(a, b Decimal) bool { return a < b }),
+		index:      make(map[string]*list.Element),
+		closed:     make(map[string]OrderStatus),
+		stops:      NewStopBook(),
 	}
 }
 
-func (ob *OrderBook) AddOrder(order *Order) {
+// Symbol returns the instrument traded in this book.
+func (ob *OrderBook) Symbol() string {
+	return ob.symbol
+}
+
+// Instrument returns the tick and lot size of this book.
+func (ob *OrderBook) Instrument() Instrument {
+	return ob.instrument
+}
+
+// AddOrder validates an incoming order against the order rules and the
+// instrument's tick and lot grid, and queues it for the next call to
+// MatchOrders, which decides whether it trades, rests or is dropped. An
+// invalid order is reported as REJECTED and the reason is returned.
+func (ob *OrderBook) AddOrder(order *Order) error {
 	ob.mutex.Lock()
 	defer ob.mutex.Unlock()
 
-	if order.Type == Buy {
-		ob.buyOrders = append(ob.buyOrders, order)
-	} else {
-		ob.sellOrders = append(ob.sellOrders, order)
+	ob.now = order.Timestamp
+	err := order.Validate()
+	if err == nil {
+		err = ob.instrument.Check(order)
+	}
+	if err == nil && ob.known(order.ID) {
+		// Do not touch the state of the order that already owns this ID.
+		return ErrDuplicateOrder
+	}
+	if err != nil {
+		order.OrigQuantity = order.Quantity
+		ob.finish(order, StatusRejected, ExecRejected, err.Error())
+		return err
+	}
+
+	ob.incoming = append(ob.incoming, order)
+	monitoring.OrdersReceived.WithLabelValues(ob.symbol).Inc()
+	return nil
+}
+
+// has reports whether an order with this ID is in the book or left it within
+// closedRetention.
+func (ob *OrderBook) has(id string) bool {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	return ob.known(id)
+}
+
+// known reports whether an order with this ID is in the book or left it
+// within closedRetention. The caller must hold the mutex.
+func (ob *OrderBook) known(id string) bool {
+	if _, ok := ob.index[id]; ok {
+		return true
+	}
+	if _, ok := ob.closed[id]; ok {
+		return true
+	}
+	for _, order := range ob.incoming {
+		if order.ID == id {
+			return true
+		}
+	}
+	return ob.stops.Contains(id)
+}
+
+// LastPrice returns the price of the most recent trade in this book.
+func (ob *OrderBook) LastPrice() (Decimal, bool) {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	return ob.last, ob.traded
+}
+
+// BestBid returns the highest resting buy price.
+func (ob *OrderBook) BestBid() (Decimal, bool) {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	if level := ob.bids.best(); level != nil {
+		return level.price, true
+	}
+	return 0, false
+}
+
+// BestAsk returns the lowest resting sell price.
+func (ob *OrderBook) BestAsk() (Decimal, bool) {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	if level := ob.asks.best(); level != nil {
+		return level.price, true
 	}
+	return 0, false
 }
 
+// MatchOrders runs every queued incoming order against the opposite side of
+// the book in arrival order. Limit orders trade at their price or better,
+// market orders sweep whatever is there. A remainder rests for GTC and DAY
+// limit orders and is dropped for IOC, FOK and market orders; a FOK order
+// that cannot be filled completely does not trade at all. Stop orders wait in
+// the stop book and join the flow once the last trade price triggers them.
 func (ob *OrderBook) MatchOrders() []Trade {
 	ob.mutex.Lock()
 	defer ob.mutex.Unlock()
@@ -49,48 +202,495 @@ func (ob *OrderBook) MatchOrders() []Trade {
 	}()
 
 	var trades []Trade
-	sort.Slice(ob.buyOrders, func(i, j int) bool {
-		return ob.buyOrders[i].Price > ob.buyOrders[j].Price ||
-			(ob.buyOrders[i].Price == ob.buyOrders[j].Price &&
-				ob.buyOrders[i].Timestamp.Before(ob.buyOrders[j].Timestamp))
-	})
-	sort.Slice(ob.sellOrders, func(i, j int) bool {
-		return ob.sellOrders[i].Price < ob.sellOrders[j].Price ||
-			(ob.sellOrders[i].Price == ob.sellOrders[j].Price &&
-				ob.sellOrders[i].Timestamp.Before(ob.sellOrders[j].Timestamp))
-	})
+	for _, order := range ob.incoming {
+		trades = append(trades, ob.submit(order)...)
+	}
+	ob.incoming = ob.incoming[:0]
+	return trades
+}
 
-	for len(ob.buyOrders) > 0 && len(ob.sellOrders) > 0 {
-		buy := ob.buyOrders[0]
-		sell := ob.sellOrders[0]
-		if buy.Price >= sell.Price {
-			quantity := min(buy.Quantity, sell.Quantity)
-			trade := Trade{
-				BuyOrderID:  buy.ID,
-				SellOrderID: sell.ID,
-				Price:       sell.Price,
-				Quantity:    quantity,
-			}
-			trades = append(trades, trade)
+// submit accepts an order, then parks it if it is an untriggered stop or
+// executes it and fires any stops its trades triggered. Everything that
+// happens as a result is stamped with the order's Timestamp rather than the
+// wall clock, so replaying the same orders rebuilds the same queues. The
+// caller must hold the mutex.
+func (ob *OrderBook) submit(order *Order) []Trade {
+	ob.now = order.Timestamp
+	order.OrigQuantity = order.Quantity
+	order.CumQuantity = 0
+	order.AvgPrice = 0
+	order.Status = StatusNew
+	ob.report(order, ExecNew, 0, 0, "")
 
-			buy.Quantity -= quantity
-			sell.Quantity -= quantity
-			if buy.Quantity == 0 {
-				ob.buyOrders = ob.buyOrders[1:]
-			}
-			if sell.Quantity == 0 {
-				ob.sellOrders = ob.sellOrders[1:]
+	if order.isStop() {
+		if !ob.traded || !order.triggered(ob.last) {
+			ob.stops.Add(order)
+			return nil
+		}
+		order.activate(ob.now)
+		ob.report(order, ExecTriggered, 0, 0, "")
+	}
+
+	trades := ob.execute(order)
+	if len(trades) > 0 {
+		trades = append(trades, ob.fireStops()...)
+	}
+	return trades
+}
+
+// fireStops executes triggered stop orders one at a time. Each execution can
+// move the last price and trigger further stops, which are picked up on the
+// next pass, so a cascade always unfolds in the same order.
+func (ob *OrderBook) fireStops() []Trade {
+	var trades []Trade
+	for {
+		order := ob.stops.Next(ob.last)
+		if order == nil {
+			return trades
+		}
+		order.activate(ob.now)
+		ob.report(order, ExecTriggered, 0, 0, "")
+		trades = append(trades, ob.execute(order)...)
+	}
+}
+
+// execute matches an aggressive order against the opposite side and then
+// rests or drops what is left. Trades happen at the resting order's price.
+// Post-only orders never take liquidity and orders of the same owner never
+// trade with each other. The caller must hold the mutex.
+func (ob *OrderBook) execute(order *Order) []Trade {
+	opposite := ob.asks
+	if order.Type == Sell {
+		opposite = ob.bids
+	}
+
+	if order.PostOnly != "" {
+		if level := opposite.best(); level != nil && order.crosses(level.price) {
+			if order.PostOnly == PostOnlyReject || !ob.reprice(order, level.price) {
+				ob.finish(order, StatusRejected, ExecRejected, "post-only order would take liquidity")
+				return nil
 			}
-		} else {
+			ob.report(order, ExecReplaced, 0, 0, "post-only order repriced")
+		}
+	}
+
+	if order.TimeInForce == FOK && !ob.fillable(opposite, order) {
+		ob.finish(order, StatusCanceled, ExecCanceled, "fill-or-kill order cannot be filled")
+		return nil
+	}
+
+	var trades []Trade
+	canceled := false
+	for order.Quantity > 0 && !canceled {
+		level := opposite.best()
+		if level == nil || !order.crosses(level.price) {
 			break
 		}
+
+		elem := level.orders.Front()
+		resting := elem.Value.(*Order)
+		if order.selfTrade(resting) {
+			canceled = ob.preventSelfTrade(order, opposite, level, elem)
+			continue
+		}
+
+		quantity := min(order.Quantity, resting.displayed())
+
+		ob.tradeSeq++
+		trade := Trade{
+			ID:            ob.symbol + "-" + strconv.FormatUint(ob.tradeSeq, 10),
+			Symbol:        ob.symbol,
+			BuyOrderID:    order.ID,
+			SellOrderID:   resting.ID,
+			AggressorSide: order.Type,
+			Price:         level.price,
+			Quantity:      quantity,
+			Timestamp:     ob.now,
+		}
+		if order.Type == Sell {
+			trade.BuyOrderID, trade.SellOrderID = resting.ID, order.ID
+		}
+		trades = append(trades, trade)
+		monitoring.TradesExecuted.WithLabelValues(ob.symbol).Inc()
+		monitoring.TradedVolume.WithLabelValues(ob.symbol).Add(quantity.Float64())
+
+		order.fill(level.price, quantity)
+		resting.fill(level.price, quantity)
+		if resting.DisplayQuantity > 0 {
+			resting.visible -= quantity
+		}
+		ob.last, ob.traded = level.price, true
+		ob.report(resting, ExecTrade, level.price, quantity, "")
+		ob.report(order, ExecTrade, level.price, quantity, "")
+		switch {
+		case resting.Quantity == 0:
+			ob.unlink(opposite, level, elem)
+		case resting.displayed() == 0:
+			// The shown slice of an iceberg is used up: show the next one
+			// from the reserve at the back of the queue.
+			opposite.remove(level, elem)
+			resting.Timestamp = ob.now
+			ob.rest(resting)
+		}
+	}
+
+	switch {
+	case canceled:
+		ob.finish(order, StatusCanceled, ExecCanceled, "self-trade prevention")
+	case order.Quantity == 0:
+		ob.retire(order.ID, StatusFilled)
+	case order.rests():
+		ob.rest(order)
+	default:
+		ob.finish(order, StatusCanceled, ExecCanceled, "unfilled remainder of an immediate order")
 	}
 	return trades
 }
 
-func min(a, b float64) float64 {
-	if a < b {
-		return a
+// reprice moves a post-only order one tick away from the opposite best price
+// so it rests instead of trading. It reports false if no valid price is left.
+func (ob *OrderBook) reprice(order *Order, best Decimal) bool {
+	if order.Type == Buy {
+		order.Price = best - ob.instrument.TickSize
+	} else {
+		order.Price = best + ob.instrument.TickSize
+	}
+	return order.Price > 0
+}
+
+// preventSelfTrade applies the incoming order's self-trade prevention policy
+// against a resting order of the same owner and reports whether the incoming
+// order was canceled. The caller must hold the mutex.
+func (ob *OrderBook) preventSelfTrade(order *Order, side *bookSide, level *priceLevel, elem *list.Element) bool {
+	resting := elem.Value.(*Order)
+	const reason = "self-trade prevention"
+	switch order.SelfTrade {
+	case CancelOldest:
+		ob.unlink(side, level, elem)
+		ob.finish(resting, StatusCanceled, ExecCanceled, reason)
+		return false
+	case CancelBoth:
+		ob.unlink(side, level, elem)
+		ob.finish(resting, StatusCanceled, ExecCanceled, reason)
+		return true
+	case Decrement:
+		quantity := min(order.Quantity, resting.Quantity)
+		order.Quantity -= quantity
+		order.OrigQuantity -= quantity
+		resting.Quantity -= quantity
+		resting.OrigQuantity -= quantity
+		if resting.Quantity == 0 {
+			ob.unlink(side, level, elem)
+			ob.finish(resting, StatusCanceled, ExecCanceled, reason)
+		} else {
+			resting.visible = min(resting.visible, resting.Quantity)
+			ob.report(resting, ExecRestated, 0, 0, reason)
+		}
+		if order.Quantity == 0 {
+			return true
+		}
+		ob.report(order, ExecRestated, 0, 0, reason)
+		return false
+	default:
+		return true
+	}
+}
+
+// rest puts an order into the book, showing only the first slice of an
+// iceberg. The caller must hold the mutex.
+func (ob *OrderBook) rest(order *Order) {
+	order.replenish()
+	ob.index[order.ID] = ob.side(order.Type).insert(order)
+}
+
+// fillable reports whether matching would fill the order completely. It
+// walks the opposite side the way execute does, without changing it: the
+// shown slice of an iceberg trades and the rest of it queues up again at the
+// back of its level, and a resting order of the same owner stops the match
+// under CancelNewest and CancelBoth, drops out under CancelOldest and shrinks
+// the order under Decrement. The caller must hold the mutex.
+func (ob *OrderBook) fillable(side *bookSide, order *Order) bool {
+	needed := order.Quantity
+	blocked := false
+	side.ascend(func(level *priceLevel) bool {
+		if !order.crosses(level.price) {
+			return false
+		}
+
+		// Orders after the last one of the same owner trade in full, and so
+		// do icebergs requeued behind it
+		var last *list.Element
+		for e := level.orders.Back(); e != nil && last == nil; e = e.Prev() {
+			if order.selfTrade(e.Value.(*Order)) {
+				last = e
+			}
+		}
+		passed := last == nil
+		var behind Decimal
+		for e := level.orders.Front(); e != nil && !blocked && needed > 0 && (!passed || behind < needed); e = e.Next() {
+			resting := e.Value.(*Order)
+			switch {
+			case passed:
+				behind += resting.Quantity
+			case order.selfTrade(resting):
+				switch order.SelfTrade {
+				case CancelOldest:
+				case Decrement:
+					needed -= min(needed, resting.Quantity)
+				default:
+					blocked = true
+				}
+			default:
+				shown := min(needed, resting.displayed())
+				needed -= shown
+				behind += resting.Quantity - shown
+			}
+			if e == last {
+				passed = true
+			}
+		}
+		if !blocked {
+			needed -= min(needed, behind)
+		}
+		return needed > 0 && !blocked
+	})
+	return needed == 0 && !blocked
+}
+
+// DepthLevel is the aggregated displayed size at one price.
+type DepthLevel struct {
+	Price    Decimal `json:"price"`
+	Quantity Decimal `json:"quantity"`
+	Orders   int     `json:"orders"`
+}
+
+// Depth is a market-data snapshot of the best price levels of a book.
+type Depth struct {
+	Symbol    string       `json:"symbol"`
+	Bids      []DepthLevel `json:"bids"`
+	Asks      []DepthLevel `json:"asks"`
+	LastPrice Decimal      `json:"last_price"`
+}
+
+// Depth returns up to levels price levels per side, best first. Only the
+// displayed slice of iceberg orders is counted, never their hidden reserve.
+func (ob *OrderBook) Depth(levels int) Depth {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	collect := func(side *bookSide) []DepthLevel {
+		out := []DepthLevel{}
+		side.ascend(func(level *priceLevel) bool {
+			if len(out) == levels {
+				return false
+			}
+			dl := DepthLevel{Price: level.price, Orders: level.orders.Len()}
+			for e := level.orders.Front(); e != nil; e = e.Next() {
+				dl.Quantity += e.Value.(*Order).displayed()
+			}
+			out = append(out, dl)
+			return true
+		})
+		return out
+	}
+
+	return Depth{
+		Symbol:    ob.symbol,
+		Bids:      collect(ob.bids),
+		Asks:      collect(ob.asks),
+		LastPrice: ob.last,
+	}
+}
+
+// ExpireDayOrders cancels every resting or waiting DAY order placed before
+// cutoff and returns the IDs of the orders it removed.
+func (ob *OrderBook) ExpireDayOrders(cutoff time.Time) []string {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	ob.now = cutoff
+	var expired []*Order
+	for _, elem := range ob.index {
+		order := elem.Value.(*Order)
+		if order.TimeInForce != DAY || !order.Timestamp.Before(cutoff) {
+			continue
+		}
+		side := ob.side(order.Type)
+		ob.unlink(side, side.byPrice[order.Price], elem)
+		expired = append(expired, order)
+	}
+	expired = append(expired, ob.stops.ExpireDayOrders(cutoff)...)
+
+	// Report in ID order so the report sequence does not depend on map order.
+	sort.Slice(expired, func(i, j int) bool { return expired[i].ID < expired[j].ID })
+	ids := make([]string, len(expired))
+	for i, order := range expired {
+		ob.finish(order, StatusExpired, ExecExpired, "")
+		ids[i] = order.ID
+	}
+	return ids
+}
+
+// CancelOrder pulls a resting order out of the book in O(1) using the ID
+// index, or drops an order still waiting for MatchOrders. Orders that already
+// left the book report why they did. at is when the cancel was accepted; zero
+// means now.
+func (ob *OrderBook) CancelOrder(id string, at time.Time) CancelResult {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	ob.now = at
+	if ob.now.IsZero() {
+		ob.now = time.Now()
+	}
+	if order, ok := ob.stops.Cancel(id); ok {
+		ob.finish(order, StatusCanceled, ExecCanceled, "")
+		return Canceled
+	}
+
+	for i, order := range ob.incoming {
+		if order.ID == id {
+			// Accepted but not matched yet: it never reached the book
+			ob.incoming = append(ob.incoming[:i], ob.incoming[i+1:]...)
+			order.OrigQuantity = order.Quantity
+			ob.finish(order, StatusCanceled, ExecCanceled, "")
+			return Canceled
+		}
+	}
+
+	elem, ok := ob.index[id]
+	if !ok {
+		switch ob.closed[id] {
+		case StatusFilled:
+			return AlreadyFilled
+		case StatusCanceled:
+			return AlreadyCanceled
+		case StatusExpired:
+			return Expired
+		case StatusRejected:
+			return Rejected
+		}
+		return UnknownOrder
+	}
+
+	order := elem.Value.(*Order)
+	side := ob.side(order.Type)
+	ob.unlink(side, side.byPrice[order.Price], elem)
+	ob.finish(order, StatusCanceled, ExecCanceled, "")
+	return Canceled
+}
+
+// AmendOrder changes the price and/or remaining quantity of a resting order.
+// Reducing quantity keeps the order's place in its queue. A price change or a
+// size increase stamps the order with the amendment's Timestamp and requeues
+// it, so it loses time priority; if the new price crosses the book it is matched
+// immediately and the resulting trades are returned.
+func (ob *OrderBook) AmendOrder(id string, amend Amendment) (AmendResult, []Trade) {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	ob.now = amend.Timestamp
+	if ob.now.IsZero() {
+		ob.now = time.Now()
+	}
+	if ob.stops.Contains(id) {
+		return AmendRejected, nil
+	}
+
+	elem, ok := ob.index[id]
+	if !ok {
+		switch ob.closed[id] {
+		case StatusFilled:
+			return AmendFilled, nil
+		case StatusCanceled, StatusExpired, StatusRejected:
+			return AmendCanceled, nil
+		}
+		return AmendUnknown, nil
+	}
+	if amend.Price < 0 || amend.Quantity < 0 ||
+		!amend.Price.IsMultipleOf(ob.instrument.TickSize) ||
+		!amend.Quantity.IsMultipleOf(ob.instrument.LotSize) {
+		return AmendRejected, nil
+	}
+
+	order := elem.Value.(*Order)
+	price, quantity := order.Price, order.Quantity
+	if amend.Price != 0 {
+		price = amend.Price
+	}
+	if amend.Quantity != 0 {
+		quantity = amend.Quantity
+	}
+
+	if price == order.Price && quantity <= order.Quantity {
+		order.Quantity = quantity
+		order.OrigQuantity = order.CumQuantity + quantity
+		order.visible = min(order.visible, quantity)
+		ob.report(order, ExecReplaced, 0, 0, "")
+		return Amended, nil
+	}
+
+	side := ob.side(order.Type)
+	side.remove(side.byPrice[order.Price], elem)
+	delete(ob.index, order.ID)
+	order.Price = price
+	order.Quantity = quantity
+	order.OrigQuantity = order.CumQuantity + quantity
+	order.Timestamp = ob.now
+	ob.report(order, ExecReplaced, 0, 0, "")
+
+	trades := ob.execute(order)
+	if len(trades) > 0 {
+		trades = append(trades, ob.fireStops()...)
+	}
+	return AmendedRequeued, trades
+}
+
+func (ob *OrderBook) side(orderType OrderType) *bookSide {
+	if orderType == Buy {
+		return ob.bids
+	}
+	return ob.asks
+}
+
+// closedRetention is how long, in the time of the operations applied to it, a
+// book remembers orders that left it. Until then their IDs are refused as
+// duplicates and cancels and amends of them get their final status; after
+// that they are unknown.
+const closedRetention = 24 * time.Hour
+
+// retiredOrder is an order that left the book, and when.
+type retiredOrder struct {
+	id string
+	at time.Time
+}
+
+// retire records the terminal status of an order that left the book and
+// forgets the orders that left it more than closedRetention before the
+// current operation. Every node applies the same operations with the same
+// times, so they all forget the same orders. The caller must hold the mutex.
+func (ob *OrderBook) retire(id string, status OrderStatus) {
+	if _, ok := ob.closed[id]; !ok {
+		ob.retired = append(ob.retired, retiredOrder{id: id, at: ob.now})
+	}
+	ob.closed[id] = status
+
+	cutoff := ob.now.Add(-closedRetention)
+	n := 0
+	for n < len(ob.retired) && ob.retired[n].at.Before(cutoff) {
+		delete(ob.closed, ob.retired[n].id)
+		n++
+	}
+	ob.retired = ob.retired[n:]
+}
+
+// unlink removes a resting order from its level and the ID index. Filled
+// orders are recorded as such; any other exit is recorded by finish.
+func (ob *OrderBook) unlink(side *bookSide, level *priceLevel, elem *list.Element) {
+	order := elem.Value.(*Order)
+	side.remove(level, elem)
+	delete(ob.index, order.ID)
+	if order.Status == StatusFilled {
+		ob.retire(order.ID, StatusFilled)
 	}
-	return b
 }
@@ -0,0 +1,820 @@
+package trading
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// sortedSliceBook is the previous OrderBook implementation, kept here as the
+// baseline for the benchmarks below: it re-sorts both sides on every match.
+type sortedSliceBook struct {
+	buyOrders  []*Order
+	sellOrders []*Order
+}
+
+func (ob *sortedSliceBook) AddOrder(order *Order) error {
+	if order.Type == Buy {
+		ob.buyOrders = append(ob.buyOrders, order)
+	} else {
+		ob.sellOrders = append(ob.sellOrders, order)
+	}
+	return nil
+}
+
+func (ob *sortedSliceBook) MatchOrders() []Trade {
+	var trades []Trade
+	sort.Slice(ob.buyOrders, func(i, j int) bool {
+		return ob.buyOrders[i].Price > ob.buyOrders[j].Price ||
+			(ob.buyOrders[i].Price == ob.buyOrders[j].Price &&
+				ob.buyOrders[i].Timestamp.Before(ob.buyOrders[j].Timestamp))
+	})
+	sort.Slice(ob.sellOrders, func(i, j int) bool {
+		return ob.sellOrders[i].Price < ob.sellOrders[j].Price ||
+			(ob.sellOrders[i].Price == ob.sellOrders[j].Price &&
+				ob.sellOrders[i].Timestamp.Before(ob.sellOrders[j].Timestamp))
+	})
+
+	for len(ob.buyOrders) > 0 && len(ob.sellOrders) > 0 {
+		buy := ob.buyOrders[0]
+		sell := ob.sellOrders[0]
+		if buy.Price < sell.Price {
+			break
+		}
+		quantity := min(buy.Quantity, sell.Quantity)
+		trades = append(trades, Trade{
+			Symbol:      "TEST",
+			BuyOrderID:  buy.ID,
+			SellOrderID: sell.ID,
+			Price:       sell.Price,
+			Quantity:    quantity,
+		})
+		buy.Quantity -= quantity
+		sell.Quantity -= quantity
+		if buy.Quantity == 0 {
+			ob.buyOrders = ob.buyOrders[1:]
+		}
+		if sell.Quantity == 0 {
+			ob.sellOrders = ob.sellOrders[1:]
+		}
+	}
+	return trades
+}
+
+type book interface {
+	AddOrder(order *Order) error
+	MatchOrders() []Trade
+}
+
+// randomOrders returns a deterministic stream of orders around a mid price of
+// 1000 with strictly increasing timestamps.
+func randomOrders(n int, seed int64) []*Order {
+	rng := rand.New(rand.NewSource(seed))
+	base := time.Unix(0, 0)
+	orders := make([]*Order, n)
+	for i := range orders {
+		orderType := Buy
+		if rng.Intn(2) == 0 {
+			orderType = Sell
+		}
+		orders[i] = &Order{
+			ID:          fmt.Sprintf("o%d", i),
+			Type:        orderType,
+			Kind:        Limit,
+			TimeInForce: GTC,
+			Price:       DecimalFromInt(int64(990 + rng.Intn(21))),
+			Quantity:    DecimalFromInt(int64(1 + rng.Intn(10))),
+			Timestamp:   base.Add(time.Duration(i)),
+		}
+	}
+	return orders
+}
+
+func cloneOrders(orders []*Order) []*Order {
+	clones := make([]*Order, len(orders))
+	for i, o := range orders {
+		c := *o
+		clones[i] = &c
+	}
+	return clones
+}
+
+func TestOrderBookMatchesSortedSliceBook(t *testing.T) {
+	orders := randomOrders(5000, 1)
+
+	run := func(b book, orders []*Order) []Trade {
+		var trades []Trade
+		for _, o := range orders {
+			b.AddOrder(o)
+			trades = append(trades, b.MatchOrders()...)
+		}
+		return trades
+	}
+
+	// The sorted-slice book always traded at the sell price, the price-level
+	// book trades at the resting order's price, and only the latter numbers
+	// and stamps its trades, so compare fills only.
+	fills := func(trades []Trade) []Trade {
+		for i, trade := range trades {
+			trades[i] = Trade{
+				Symbol:      trade.Symbol,
+				BuyOrderID:  trade.BuyOrderID,
+				SellOrderID: trade.SellOrderID,
+				Quantity:    trade.Quantity,
+			}
+		}
+		return trades
+	}
+
+	want := fills(run(&sortedSliceBook{}, cloneOrders(orders)))
+	got := fills(run(NewOrderBook(DefaultInstrument("TEST")), cloneOrders(orders)))
+	if len(want) == 0 {
+		t.Fatal("expected the order stream to produce trades")
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("trades differ from the sorted-slice book: got %d trades, want %d", len(got), len(want))
+	}
+}
+
+func TestOrderBookBestPrices(t *testing.T) {
+	ob := NewOrderBook(DefaultInstrument("TEST"))
+	if _, ok := ob.BestBid(); ok {
+		t.Fatal("empty book reported a best bid")
+	}
+
+	ob.AddOrder(NewOrder("b1", "TEST", Buy, DecimalFromInt(99), DecimalFromInt(1)))
+	ob.AddOrder(NewOrder("b2", "TEST", Buy, DecimalFromInt(101), DecimalFromInt(1)))
+	ob.AddOrder(NewOrder("s1", "TEST", Sell, DecimalFromInt(105), DecimalFromInt(1)))
+	ob.AddOrder(NewOrder("s2", "TEST", Sell, DecimalFromInt(103), DecimalFromInt(1)))
+	ob.MatchOrders()
+
+	if bid, _ := ob.BestBid(); bid != DecimalFromInt(101) {
+		t.Fatalf("best bid = %v, want 101", bid)
+	}
+	if ask, _ := ob.BestAsk(); ask != DecimalFromInt(103) {
+		t.Fatalf("best ask = %v, want 103", ask)
+	}
+}
+
+// seedRestingBook fills a book with depth non-crossing orders: bids below 1000
+// and asks above it, spread over many price levels.
+func seedRestingBook(b book, depth int) {
+	base := time.Unix(0, 0)
+	for i := 0; i < depth; i++ {
+		ts := base.Add(time.Duration(i))
+		b.AddOrder(&Order{ID: fmt.Sprintf("b%d", i), Type: Buy, Kind: Limit, TimeInForce: GTC, Price: DecimalFromInt(int64(999 - i%500)), Quantity: DecimalFromInt(5), Timestamp: ts})
+		b.AddOrder(&Order{ID: fmt.Sprintf("s%d", i), Type: Sell, Kind: Limit, TimeInForce: GTC, Price: DecimalFromInt(int64(1001 + i%500)), Quantity: DecimalFromInt(5), Timestamp: ts})
+	}
+	b.MatchOrders()
+}
+
+// benchmarkAddMatch measures one AddOrder+MatchOrders round trip against a
+// book already holding depth resting orders per side. Every other incoming
+// order crosses the spread so both the insert and the match paths are hit.
+func benchmarkAddMatch(b *testing.B, newBook func() book, depth int) {
+	ob := newBook()
+	seedRestingBook(ob, depth)
+	base := time.Unix(1, 0)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		order := &Order{ID: fmt.Sprintf("n%d", i), Kind: Limit, TimeInForce: GTC, Quantity: DecimalFromInt(1), Timestamp: base.Add(time.Duration(i))}
+		switch i % 4 {
+		case 0:
+			order.Type, order.Price = Buy, DecimalFromInt(1001) // takes liquidity from the best ask
+		case 1:
+			order.Type, order.Price = Sell, DecimalFromInt(1001) // replaces it
+		case 2:
+			order.Type, order.Price = Sell, DecimalFromInt(999) // takes liquidity from the best bid
+		case 3:
+			order.Type, order.Price = Buy, DecimalFromInt(999) // replaces it
+		}
+		ob.AddOrder(order)
+		ob.MatchOrders()
+	}
+}
+
+func BenchmarkAddMatch(b *testing.B) {
+	for _, depth := range []int{1000, 10000, 50000} {
+		b.Run(fmt.Sprintf("PriceLevels/depth=%d", depth), func(b *testing.B) {
+			benchmarkAddMatch(b, func() book { return NewOrderBook(DefaultInstrument("TEST")) }, depth)
+		})
+		b.Run(fmt.Sprintf("SortedSlices/depth=%d", depth), func(b *testing.B) {
+			benchmarkAddMatch(b, func() book { return &sortedSliceBook{} }, depth)
+		})
+	}
+}
+
+// testBook is a book on a whole-number grid that stamps each order a second
+// after the last, so queue order is arrival order, and keeps its reports.
+type testBook struct {
+	*OrderBook
+	t       *testing.T
+	now     time.Time
+	reports []ExecutionReport
+}
+
+func newTestBook(t *testing.T) *testBook {
+	b := &testBook{
+		OrderBook: NewOrderBook(Instrument{Symbol: "TEST", TickSize: DecimalFromInt(1), LotSize: DecimalFromInt(1)}),
+		t:         t,
+		now:       time.Unix(1000, 0).UTC(),
+	}
+	b.OnReport(func(r ExecutionReport) { b.reports = append(b.reports, r) })
+	return b
+}
+
+// tick moves the clock on a second and returns the new time.
+func (b *testBook) tick() time.Time {
+	b.now = b.now.Add(time.Second)
+	return b.now
+}
+
+// place submits an order, failing the test if the book refuses it, and
+// returns its trades.
+func (b *testBook) place(order *Order) []Trade {
+	b.t.Helper()
+	order.Timestamp = b.tick()
+	if err := b.AddOrder(order); err != nil {
+		b.t.Fatalf("order %s: %v", order.ID, err)
+	}
+	return b.MatchOrders()
+}
+
+// queue returns the IDs of the resting orders on one side in priority order.
+func (b *testBook) queue(side OrderType) []string {
+	var ids []string
+	for _, resting := range b.State().Resting {
+		if resting.Type == side {
+			ids = append(ids, resting.ID)
+		}
+	}
+	return ids
+}
+
+// status returns the status the last report about an order gave it.
+func (b *testBook) status(id string) OrderStatus {
+	var status OrderStatus
+	for _, r := range b.reports {
+		if r.OrderID == id {
+			status = r.Status
+		}
+	}
+	return status
+}
+
+func limit(id string, side OrderType, price, quantity int64) *Order {
+	return NewOrder(id, "TEST", side, DecimalFromInt(price), DecimalFromInt(quantity))
+}
+
+func owned(order *Order, owner string, policy SelfTradePrevention) *Order {
+	order.Owner, order.SelfTrade = owner, policy
+	return order
+}
+
+// describe lists trades as BUYER/SELLER QUANTITY@PRICE.
+func describe(trades []Trade) []string {
+	var out []string
+	for _, trade := range trades {
+		out = append(out, fmt.Sprintf("%s/%s %v@%v", trade.BuyOrderID, trade.SellOrderID, trade.Quantity, trade.Price))
+	}
+	return out
+}
+
+func TestAmendTimePriority(t *testing.T) {
+	amend := func(b *testBook, id string, price, quantity int64) (AmendResult, []Trade) {
+		return b.AmendOrder(id, Amendment{Price: DecimalFromInt(price), Quantity: DecimalFromInt(quantity), Timestamp: b.tick()})
+	}
+	setup := func(t *testing.T) *testBook {
+		b := newTestBook(t)
+		b.place(limit("a", Buy, 100, 10))
+		b.place(limit("b", Buy, 100, 10))
+		b.place(limit("c", Buy, 99, 10))
+		return b
+	}
+
+	t.Run("reducing quantity keeps priority", func(t *testing.T) {
+		b := setup(t)
+		if res, _ := amend(b, "a", 0, 4); res != Amended {
+			t.Fatalf("result = %v, want %v", res, Amended)
+		}
+		if got := b.queue(Buy); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+			t.Fatalf("bids = %v", got)
+		}
+		got := describe(b.place(limit("s", Sell, 100, 6)))
+		if want := []string{"a/s 4@100", "b/s 2@100"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("trades = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("increasing quantity loses priority", func(t *testing.T) {
+		b := setup(t)
+		if res, _ := amend(b, "a", 0, 20); res != AmendedRequeued {
+			t.Fatalf("result = %v, want %v", res, AmendedRequeued)
+		}
+		if got := b.queue(Buy); !reflect.DeepEqual(got, []string{"b", "a", "c"}) {
+			t.Fatalf("bids = %v", got)
+		}
+	})
+
+	t.Run("changing price loses priority", func(t *testing.T) {
+		b := setup(t)
+		if res, _ := amend(b, "a", 99, 0); res != AmendedRequeued {
+			t.Fatalf("result = %v, want %v", res, AmendedRequeued)
+		}
+		if got := b.queue(Buy); !reflect.DeepEqual(got, []string{"b", "c", "a"}) {
+			t.Fatalf("bids = %v", got)
+		}
+	})
+
+	t.Run("crossing price trades", func(t *testing.T) {
+		b := setup(t)
+		b.place(limit("s", Sell, 102, 5))
+		res, trades := amend(b, "c", 102, 0)
+		if got, want := describe(trades), []string{"c/s 5@102"}; res != AmendedRequeued || !reflect.DeepEqual(got, want) {
+			t.Fatalf("amend = %v %v, want %v %v", res, got, AmendedRequeued, want)
+		}
+	})
+
+	t.Run("rejected and finished orders", func(t *testing.T) {
+		b := setup(t)
+		if res, _ := amend(b, "a", 0, -1); res != AmendRejected {
+			t.Fatalf("negative quantity = %v, want %v", res, AmendRejected)
+		}
+		if res, _ := b.AmendOrder("a", Amendment{Price: MustParseDecimal("100.5")}); res != AmendRejected {
+			t.Fatalf("off-tick price = %v, want %v", res, AmendRejected)
+		}
+		b.place(limit("s", Sell, 100, 10))
+		if res, _ := amend(b, "a", 0, 5); res != AmendFilled {
+			t.Fatalf("filled order = %v, want %v", res, AmendFilled)
+		}
+		b.CancelOrder("b", b.tick())
+		if res, _ := amend(b, "b", 0, 5); res != AmendCanceled {
+			t.Fatalf("canceled order = %v, want %v", res, AmendCanceled)
+		}
+		if res, _ := amend(b, "x", 0, 5); res != AmendUnknown {
+			t.Fatalf("unknown order = %v, want %v", res, AmendUnknown)
+		}
+	})
+}
+
+func stop(id string, side OrderType, stopPrice, quantity int64) *Order {
+	order := NewOrder(id, "TEST", side, 0, DecimalFromInt(quantity))
+	order.Kind, order.TimeInForce, order.StopPrice = Stop, "", DecimalFromInt(stopPrice)
+	return order
+}
+
+func stopLimit(id string, side OrderType, stopPrice, price, quantity int64) *Order {
+	order := limit(id, side, price, quantity)
+	order.Kind, order.StopPrice = StopLimit, DecimalFromInt(stopPrice)
+	return order
+}
+
+// triggered returns the IDs of the orders reported TRIGGERED, in order.
+func (b *testBook) triggered() []string {
+	var ids []string
+	for _, r := range b.reports {
+		if r.ExecType == ExecTriggered {
+			ids = append(ids, r.OrderID)
+		}
+	}
+	return ids
+}
+
+func TestStopOrders(t *testing.T) {
+	t.Run("stop waits for the last trade price", func(t *testing.T) {
+		b := newTestBook(t)
+		b.place(limit("s1", Sell, 100, 1))
+		b.place(limit("s2", Sell, 101, 5))
+		if trades := b.place(stop("stop", Buy, 101, 2)); len(trades) != 0 {
+			t.Fatalf("untriggered stop traded: %v", describe(trades))
+		}
+		if trades := b.place(limit("b1", Buy, 100, 1)); len(trades) != 1 || len(b.triggered()) != 0 {
+			t.Fatalf("trade at 100 triggered a stop at 101: %v", b.triggered())
+		}
+		got := describe(b.place(limit("b2", Buy, 101, 1)))
+		if want := []string{"b2/s2 1@101", "stop/s2 2@101"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("trades = %v, want %v", got, want)
+		}
+		if status := b.status("stop"); status != StatusFilled {
+			t.Fatalf("stop status = %v, want %v", status, StatusFilled)
+		}
+	})
+
+	t.Run("stop limit rests at its limit once triggered", func(t *testing.T) {
+		b := newTestBook(t)
+		b.place(limit("b1", Buy, 99, 1))
+		b.place(limit("b2", Buy, 97, 5))
+		b.place(stopLimit("sl", Sell, 99, 98, 3))
+		got := describe(b.place(limit("s1", Sell, 99, 1)))
+		if want := []string{"b1/s1 1@99"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("trades = %v, want %v", got, want)
+		}
+		if got := b.queue(Sell); !reflect.DeepEqual(got, []string{"sl"}) {
+			t.Fatalf("asks = %v, want the triggered stop limit resting", got)
+		}
+		if ask, _ := b.BestAsk(); ask != DecimalFromInt(98) {
+			t.Fatalf("best ask = %v, want 98", ask)
+		}
+	})
+
+	t.Run("stop already triggered on arrival", func(t *testing.T) {
+		b := newTestBook(t)
+		b.place(limit("s1", Sell, 100, 1))
+		b.place(limit("s2", Sell, 100, 1))
+		b.place(limit("b1", Buy, 100, 1))
+		got := describe(b.place(stop("stop", Buy, 99, 1)))
+		if want := []string{"stop/s2 1@100"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("trades = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("cascade fires in trigger order", func(t *testing.T) {
+		b := newTestBook(t)
+		b.place(limit("s1", Sell, 100, 1))
+		b.place(limit("s2", Sell, 101, 2))
+		b.place(limit("s3", Sell, 102, 2))
+		b.place(limit("s4", Sell, 103, 2))
+		b.place(stop("late", Buy, 102, 2))
+		b.place(stop("early", Buy, 100, 3))
+		got := describe(b.place(limit("b1", Buy, 100, 1)))
+		want := []string{"b1/s1 1@100", "early/s2 2@101", "early/s3 1@102", "late/s3 1@102", "late/s4 1@103"}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("trades = %v, want %v", got, want)
+		}
+		if got := b.triggered(); !reflect.DeepEqual(got, []string{"early", "late"}) {
+			t.Fatalf("triggered = %v, want early then late", got)
+		}
+		if last, _ := b.LastPrice(); last != DecimalFromInt(103) {
+			t.Fatalf("last price = %v, want 103", last)
+		}
+	})
+
+	t.Run("waiting stop can be canceled", func(t *testing.T) {
+		b := newTestBook(t)
+		b.place(stop("stop", Sell, 90, 1))
+		if got := b.CancelOrder("stop", b.tick()); got != Canceled {
+			t.Fatalf("cancel = %v, want %v", got, Canceled)
+		}
+		if res, _ := b.AmendOrder("stop", Amendment{Quantity: DecimalFromInt(2)}); res != AmendCanceled {
+			t.Fatalf("amend after cancel = %v, want %v", res, AmendCanceled)
+		}
+	})
+}
+
+func iceberg(id string, side OrderType, price, quantity, display int64) *Order {
+	order := limit(id, side, price, quantity)
+	order.DisplayQuantity = DecimalFromInt(display)
+	return order
+}
+
+func TestIcebergOrders(t *testing.T) {
+	b := newTestBook(t)
+	b.place(iceberg("i", Sell, 100, 10, 3))
+	b.place(limit("a", Sell, 100, 5))
+	b.place(limit("c", Sell, 101, 1))
+
+	depth := func() []DepthLevel { return b.Depth(1).Asks }
+	if got, want := depth(), []DepthLevel{{Price: DecimalFromInt(100), Quantity: DecimalFromInt(8), Orders: 2}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("depth = %+v, want %+v with the reserve hidden", got, want)
+	}
+
+	// Using up the shown slice sends the iceberg behind a
+	got := describe(b.place(limit("b1", Buy, 100, 3)))
+	if want := []string{"b1/i 3@100"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("trades = %v, want %v", got, want)
+	}
+	if got := b.queue(Sell); !reflect.DeepEqual(got, []string{"a", "i", "c"}) {
+		t.Fatalf("asks = %v, want the replenished iceberg behind a", got)
+	}
+
+	// A partly traded slice keeps its place
+	got = describe(b.place(limit("b2", Buy, 100, 6)))
+	if want := []string{"b2/a 5@100", "b2/i 1@100"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("trades = %v, want %v", got, want)
+	}
+	if got, want := depth(), []DepthLevel{{Price: DecimalFromInt(100), Quantity: DecimalFromInt(2), Orders: 1}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("depth = %+v, want %+v", got, want)
+	}
+
+	// The last slice is what is left of the reserve
+	got = describe(b.place(limit("b3", Buy, 100, 5)))
+	if want := []string{"b3/i 2@100", "b3/i 3@100"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("trades = %v, want %v", got, want)
+	}
+	if got, want := depth(), []DepthLevel{{Price: DecimalFromInt(100), Quantity: DecimalFromInt(1), Orders: 1}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("depth = %+v, want %+v", got, want)
+	}
+	got = describe(b.place(limit("b4", Buy, 101, 2)))
+	if want := []string{"b4/i 1@100", "b4/c 1@101"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("trades = %v, want %v", got, want)
+	}
+	if status := b.status("i"); status != StatusFilled {
+		t.Fatalf("iceberg status = %v, want %v", status, StatusFilled)
+	}
+}
+
+func TestIcebergRules(t *testing.T) {
+	b := newTestBook(t)
+	order := iceberg("m", Buy, 0, 10, 2)
+	order.Kind, order.TimeInForce = Market, IOC
+	if err := b.AddOrder(order); !errors.Is(err, ErrInvalidOrder) {
+		t.Fatalf("market iceberg: %v, want ErrInvalidOrder", err)
+	}
+	order = iceberg("n", Buy, 100, 10, -1)
+	if err := b.AddOrder(order); !errors.Is(err, ErrInvalidOrder) {
+		t.Fatalf("negative display quantity: %v, want ErrInvalidOrder", err)
+	}
+}
+
+func postOnly(order *Order, mode PostOnlyMode) *Order {
+	order.PostOnly = mode
+	return order
+}
+
+func TestPostOnlyOrders(t *testing.T) {
+	b := newTestBook(t)
+	b.place(limit("s", Sell, 100, 5))
+
+	if trades := b.place(postOnly(limit("reject", Buy, 100, 1), PostOnlyReject)); len(trades) != 0 {
+		t.Fatalf("post-only order took liquidity: %v", describe(trades))
+	}
+	if status := b.status("reject"); status != StatusRejected {
+		t.Fatalf("crossing post-only status = %v, want %v", status, StatusRejected)
+	}
+
+	b.place(postOnly(limit("passive", Buy, 99, 1), PostOnlyReject))
+	if trades := b.place(postOnly(limit("reprice", Buy, 101, 1), PostOnlyReprice)); len(trades) != 0 {
+		t.Fatalf("repriced order took liquidity: %v", describe(trades))
+	}
+	if got := b.queue(Buy); !reflect.DeepEqual(got, []string{"passive", "reprice"}) {
+		t.Fatalf("bids = %v, want both post-only orders resting", got)
+	}
+	if bid, _ := b.BestBid(); bid != DecimalFromInt(99) {
+		t.Fatalf("best bid = %v, want the repriced order one tick under the ask", bid)
+	}
+	var replaced []string
+	for _, r := range b.reports {
+		if r.ExecType == ExecReplaced {
+			replaced = append(replaced, fmt.Sprintf("%s@%v", r.OrderID, r.Price))
+		}
+	}
+	if want := []string{"reprice@99"}; !reflect.DeepEqual(replaced, want) {
+		t.Fatalf("replaced reports = %v, want %v", replaced, want)
+	}
+
+	// Nothing is left below an ask at the lowest tick
+	b = newTestBook(t)
+	b.place(limit("floor", Sell, 1, 1))
+	b.place(postOnly(limit("nowhere", Buy, 1, 1), PostOnlyReprice))
+	if status := b.status("nowhere"); status != StatusRejected {
+		t.Fatalf("post-only order with no price left = %v, want %v", status, StatusRejected)
+	}
+
+	order := postOnly(limit("ioc", Buy, 90, 1), PostOnlyReject)
+	order.TimeInForce = IOC
+	if err := b.AddOrder(order); !errors.Is(err, ErrInvalidOrder) {
+		t.Fatalf("post-only IOC: %v, want ErrInvalidOrder", err)
+	}
+}
+
+func TestSelfTradePrevention(t *testing.T) {
+	for _, tc := range []struct {
+		policy   SelfTradePrevention
+		quantity int64
+		trades   []string
+		asks     []string
+		statuses map[string]OrderStatus
+	}{{
+		policy:   "", // defaults to CancelNewest
+		quantity: 8,
+		asks:     []string{"own", "other"},
+		statuses: map[string]OrderStatus{"in": StatusCanceled, "own": StatusNew},
+	}, {
+		policy:   CancelNewest,
+		quantity: 8,
+		asks:     []string{"own", "other"},
+		statuses: map[string]OrderStatus{"in": StatusCanceled, "own": StatusNew},
+	}, {
+		policy:   CancelOldest,
+		quantity: 8,
+		trades:   []string{"in/other 5@100"},
+		statuses: map[string]OrderStatus{"in": StatusPartiallyFilled, "own": StatusCanceled},
+	}, {
+		policy:   CancelBoth,
+		quantity: 8,
+		asks:     []string{"other"},
+		statuses: map[string]OrderStatus{"in": StatusCanceled, "own": StatusCanceled},
+	}, {
+		policy:   Decrement,
+		quantity: 8,
+		trades:   []string{"in/other 3@100"},
+		asks:     []string{"other"},
+		statuses: map[string]OrderStatus{"in": StatusFilled, "own": StatusCanceled},
+	}, {
+		policy:   Decrement,
+		quantity: 3,
+		asks:     []string{"own", "other"},
+		statuses: map[string]OrderStatus{"in": StatusCanceled, "own": StatusNew},
+	}} {
+		t.Run(fmt.Sprintf("%s/%d", tc.policy, tc.quantity), func(t *testing.T) {
+			b := newTestBook(t)
+			b.place(owned(limit("own", Sell, 100, 5), "alice", ""))
+			b.place(owned(limit("other", Sell, 100, 5), "bob", ""))
+			got := describe(b.place(owned(limit("in", Buy, 100, tc.quantity), "alice", tc.policy)))
+			if !reflect.DeepEqual(got, tc.trades) {
+				t.Fatalf("trades = %v, want %v", got, tc.trades)
+			}
+			if got := b.queue(Sell); !reflect.DeepEqual(got, tc.asks) {
+				t.Fatalf("asks = %v, want %v", got, tc.asks)
+			}
+			for id, want := range tc.statuses {
+				if got := b.status(id); got != want {
+					t.Fatalf("%s status = %v, want %v", id, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecrementRestatesBothOrders(t *testing.T) {
+	b := newTestBook(t)
+	b.place(owned(limit("own", Sell, 100, 5), "alice", ""))
+	b.place(owned(limit("in", Buy, 100, 3), "alice", Decrement))
+	var restated []string
+	for _, r := range b.reports {
+		if r.ExecType == ExecRestated {
+			restated = append(restated, fmt.Sprintf("%s %v/%v", r.OrderID, r.LeavesQuantity, r.OrigQuantity))
+		}
+	}
+	if want := []string{"own 2/2"}; !reflect.DeepEqual(restated, want) {
+		t.Fatalf("restated = %v, want %v", restated, want)
+	}
+	if state := b.State(); len(state.Resting) != 1 || state.Resting[0].Quantity != DecimalFromInt(2) {
+		t.Fatalf("resting = %+v, want own with 2 left", state.Resting)
+	}
+}
+
+func TestExecutionReports(t *testing.T) {
+	b := newTestBook(t)
+	b.place(limit("s1", Sell, 100, 4))
+	b.place(limit("s2", Sell, 101, 10))
+	ioc := limit("b", Buy, 101, 20)
+	ioc.TimeInForce = IOC
+	b.place(ioc)
+	b.CancelOrder("s2", b.tick())
+	bad := limit("bad", Buy, 0, 1)
+	bad.Timestamp = b.tick()
+	if err := b.AddOrder(bad); !errors.Is(err, ErrInvalidOrder) {
+		t.Fatalf("order without a price: %v, want ErrInvalidOrder", err)
+	}
+
+	type row struct {
+		order  string
+		exec   ExecType
+		status OrderStatus
+		cum    string
+		leaves string
+		avg    string
+		last   string
+	}
+	want := []row{
+		{"s1", ExecNew, StatusNew, "0", "4", "0", "0"},
+		{"s2", ExecNew, StatusNew, "0", "10", "0", "0"},
+		{"b", ExecNew, StatusNew, "0", "20", "0", "0"},
+		{"s1", ExecTrade, StatusFilled, "4", "0", "100", "4@100"},
+		{"b", ExecTrade, StatusPartiallyFilled, "4", "16", "100", "4@100"},
+		{"s2", ExecTrade, StatusFilled, "10", "0", "101", "10@101"},
+		{"b", ExecTrade, StatusPartiallyFilled, "14", "6", "100.71428571", "10@101"},
+		{"b", ExecCanceled, StatusCanceled, "14", "0", "100.71428571", "0"},
+		{"bad", ExecRejected, StatusRejected, "0", "0", "0", "0"},
+	}
+	var got []row
+	for i, r := range b.reports {
+		if r.Seq != uint64(i+1) {
+			t.Fatalf("report %d has sequence number %d", i, r.Seq)
+		}
+		last := "0"
+		if r.LastQuantity != 0 {
+			last = fmt.Sprintf("%v@%v", r.LastQuantity, r.LastPrice)
+		}
+		got = append(got, row{r.OrderID, r.ExecType, r.Status, r.CumQuantity.String(), r.LeavesQuantity.String(), r.AvgPrice.String(), last})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("reports:\n%v\nwant:\n%v", got, want)
+	}
+
+	// The cancel of s2 came too late, so it reports why
+	if res := b.CancelOrder("s2", b.tick()); res != AlreadyFilled {
+		t.Fatalf("cancel of a filled order = %v, want %v", res, AlreadyFilled)
+	}
+	if n := len(b.reports); n != len(want) {
+		t.Fatalf("%d reports after a cancel that did nothing, want %d", n, len(want))
+	}
+}
+
+func TestReportsCarryTheOperationTime(t *testing.T) {
+	b := newTestBook(t)
+	b.place(limit("s", Sell, 100, 5))
+	at := b.tick()
+	b.CancelOrder("s", at)
+	if r := b.reports[len(b.reports)-1]; r.ExecType != ExecCanceled || !r.Timestamp.Equal(at) {
+		t.Fatalf("cancel report = %+v, want it stamped %v", r, at)
+	}
+	cutoff := b.tick()
+	day := limit("d", Buy, 90, 1)
+	day.TimeInForce = DAY
+	b.place(day)
+	if expired := b.ExpireDayOrders(cutoff); len(expired) != 0 {
+		t.Fatalf("expired %v placed after the cutoff", expired)
+	}
+	if expired := b.ExpireDayOrders(b.tick()); !reflect.DeepEqual(expired, []string{"d"}) {
+		t.Fatalf("expired %v, want d", expired)
+	}
+	if status := b.status("d"); status != StatusExpired {
+		t.Fatalf("DAY order status = %v, want %v", status, StatusExpired)
+	}
+}
+
+func TestFillOrKillWithSelfTradePrevention(t *testing.T) {
+	iceberg := limit("i", Sell, 100, 10)
+	iceberg.DisplayQuantity = DecimalFromInt(2)
+
+	for _, tc := range []struct {
+		name    string
+		resting []*Order
+		fok     *Order
+		want    []string
+	}{{
+		name:    "own order ahead of enough liquidity",
+		resting: []*Order{owned(limit("x", Sell, 100, 5), "x", ""), owned(limit("y", Sell, 100, 5), "y", ""), owned(limit("z", Sell, 101, 5), "z", "")},
+		fok:     owned(limit("f", Buy, 101, 10), "y", CancelNewest),
+	}, {
+		name:    "cancel both",
+		resting: []*Order{owned(limit("x", Sell, 100, 5), "x", ""), owned(limit("y", Sell, 100, 5), "y", ""), owned(limit("z", Sell, 101, 5), "z", "")},
+		fok:     owned(limit("f", Buy, 101, 10), "y", CancelBoth),
+	}, {
+		name:    "iceberg reserve requeued behind own order",
+		resting: []*Order{iceberg, owned(limit("y", Sell, 100, 5), "y", "")},
+		fok:     owned(limit("f", Buy, 100, 5), "y", CancelNewest),
+	}, {
+		name:    "cancel oldest skips own order",
+		resting: []*Order{owned(limit("x", Sell, 100, 5), "x", ""), owned(limit("y", Sell, 100, 5), "y", ""), owned(limit("z", Sell, 101, 5), "z", "")},
+		fok:     owned(limit("f", Buy, 101, 10), "y", CancelOldest),
+		want:    []string{"f/x 5@100", "f/z 5@101"},
+	}, {
+		name:    "decrement shrinks the order to what trades",
+		resting: []*Order{owned(limit("x", Sell, 100, 5), "x", ""), owned(limit("y", Sell, 100, 5), "y", "")},
+		fok:     owned(limit("f", Buy, 100, 8), "y", Decrement),
+		want:    []string{"f/x 5@100"},
+	}, {
+		name:    "decrement leaves too much to fill",
+		resting: []*Order{owned(limit("x", Sell, 100, 5), "x", ""), owned(limit("y", Sell, 100, 5), "y", "")},
+		fok:     owned(limit("f", Buy, 100, 12), "y", Decrement),
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := newTestBook(t)
+			for _, order := range tc.resting {
+				order := *order
+				b.place(&order)
+			}
+			before := b.queue(Sell)
+			tc.fok.TimeInForce = FOK
+			got := describe(b.place(tc.fok))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("trades = %v, want %v", got, tc.want)
+			}
+			if tc.want == nil && !reflect.DeepEqual(b.queue(Sell), before) {
+				t.Fatalf("asks = %v after a killed order, want %v", b.queue(Sell), before)
+			}
+		})
+	}
+}
+
+func TestCancelOrderWaitingToMatch(t *testing.T) {
+	b := newTestBook(t)
+	b.place(limit("s", Sell, 100, 5))
+	order := limit("b", Buy, 100, 5)
+	order.Timestamp = b.tick()
+	if err := b.AddOrder(order); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := b.CancelOrder("b", b.tick()); got != Canceled {
+		t.Fatalf("cancel before matching = %v, want %v", got, Canceled)
+	}
+	if trades := b.MatchOrders(); len(trades) != 0 {
+		t.Fatalf("canceled order traded: %v", describe(trades))
+	}
+	if got := b.CancelOrder("b", b.tick()); got != AlreadyCanceled {
+		t.Fatalf("second cancel = %v, want %v", got, AlreadyCanceled)
+	}
+	if status := b.status("b"); status != StatusCanceled {
+		t.Fatalf("status = %v, want %v", status, StatusCanceled)
+	}
+}
@@ -0,0 +1,140 @@
+package trading
+
+import (
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// DecimalPlaces is the number of fractional digits a Decimal can hold.
+const DecimalPlaces = 8
+
+const decimalScale = 100000000 // 10^DecimalPlaces
+
+var ErrInvalidDecimal = errors.New("invalid decimal")
+
+// Decimal is a fixed-point number with DecimalPlaces fractional digits,
+// stored as an integer count of 10^-8 units. Prices and quantities use it so
+// that matching arithmetic is exact: a fill either empties an order or it
+// does not, with no float residue left behind.
+type Decimal int64
+
+// DecimalFromInt returns n as a Decimal.
+func DecimalFromInt(n int64) Decimal {
+	return Decimal(n * decimalScale)
+}
+
+// ParseDecimal parses a plain decimal literal such as "100", "-0.5" or
+// "12.34567890". Exponents and more than DecimalPlaces fractional digits are
+// rejected rather than rounded.
+func ParseDecimal(s string) (Decimal, error) {
+	negative := false
+	switch {
+	case strings.HasPrefix(s, "-"):
+		negative, s = true, s[1:]
+	case strings.HasPrefix(s, "+"):
+		s = s[1:]
+	}
+
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" && frac == "" || len(frac) > DecimalPlaces || !digitsOnly(whole) || !digitsOnly(frac) {
+		return 0, ErrInvalidDecimal
+	}
+
+	units, err := strconv.ParseInt(whole+frac+strings.Repeat("0", DecimalPlaces-len(frac)), 10, 64)
+	if err != nil {
+		return 0, ErrInvalidDecimal
+	}
+	if negative {
+		units = -units
+	}
+	return Decimal(units), nil
+}
+
+// MustParseDecimal is like ParseDecimal but panics on malformed input. It is
+// meant for constants.
+func MustParseDecimal(s string) Decimal {
+	d, err := ParseDecimal(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func digitsOnly(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the decimal without trailing fractional zeros.
+func (d Decimal) String() string {
+	units := int64(d)
+	sign := ""
+	if units < 0 {
+		sign = "-"
+	}
+
+	// Work on the magnitude as unsigned so the minimum int64 formats too.
+	magnitude := uint64(units)
+	if units < 0 {
+		magnitude = -magnitude
+	}
+	whole := strconv.FormatUint(magnitude/decimalScale, 10)
+	frac := strconv.FormatUint(magnitude%decimalScale+decimalScale, 10)[1:]
+	frac = strings.TrimRight(frac, "0")
+	if frac == "" {
+		return sign + whole
+	}
+	return sign + whole + "." + frac
+}
+
+// Float64 returns the nearest float64, for metrics and logging only.
+func (d Decimal) Float64() float64 {
+	return float64(d) / decimalScale
+}
+
+// IsMultipleOf reports whether d lies on a grid of the given step.
+func (d Decimal) IsMultipleOf(step Decimal) bool {
+	return step > 0 && d%step == 0
+}
+
+// MarshalJSON writes the decimal as an exact JSON number.
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalJSON accepts a JSON number or a quoted decimal string and parses
+// its text exactly, without going through float64.
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	v, err := ParseDecimal(s)
+	if err != nil {
+		return err
+	}
+	*d = v
+	return nil
+}
+
+// weightedAverage folds a fill of quantity at price into an average price
+// over cum previously filled units. The products are taken in big.Int so
+// large notionals cannot overflow; the result is truncated to DecimalPlaces.
+func weightedAverage(avg, cum, price, quantity Decimal) Decimal {
+	total := cum + quantity
+	if total == 0 {
+		return 0
+	}
+	notional := new(big.Int).Mul(big.NewInt(int64(avg)), big.NewInt(int64(cum)))
+	notional.Add(notional, new(big.Int).Mul(big.NewInt(int64(price)), big.NewInt(int64(quantity))))
+	return Decimal(notional.Quo(notional, big.NewInt(int64(total))).Int64())
+}
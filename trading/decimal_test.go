@@ -0,0 +1,103 @@
+package trading
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseDecimal(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Decimal
+	}{
+		{"100", 100 * decimalScale},
+		{"0.5", decimalScale / 2},
+		{"-0.5", -decimalScale / 2},
+		{"+1.25", decimalScale + decimalScale/4},
+		{".5", decimalScale / 2},
+		{"7.", 7 * decimalScale},
+		{"12.34567890", 1234567890},
+		{"0.00000001", 1},
+		{"-92233720368.54775807", -9223372036854775807},
+		{"92233720368.54775807", 9223372036854775807},
+	} {
+		got, err := ParseDecimal(tc.in)
+		if err != nil || got != tc.want {
+			t.Errorf("ParseDecimal(%q) = %d, %v, want %d", tc.in, got, err, tc.want)
+		}
+	}
+
+	for _, in := range []string{
+		"",
+		".",
+		"-",
+		"1.123456789",           // more places than a Decimal holds
+		"0.000000001",           // would round to zero
+		"92233720368.54775808",  // overflows int64
+		"100000000000000000000", // so does this
+		"1e5",
+		"1,5",
+		"--1",
+		" 1",
+		"0x10",
+	} {
+		if got, err := ParseDecimal(in); err != ErrInvalidDecimal {
+			t.Errorf("ParseDecimal(%q) = %v, %v, want ErrInvalidDecimal", in, got, err)
+		}
+	}
+}
+
+func TestDecimalString(t *testing.T) {
+	for _, tc := range []struct {
+		in   Decimal
+		want string
+	}{
+		{0, "0"},
+		{DecimalFromInt(42), "42"},
+		{MustParseDecimal("-0.05"), "-0.05"},
+		{1, "0.00000001"},
+		{-9223372036854775808, "-92233720368.54775808"},
+	} {
+		if got := tc.in.String(); got != tc.want {
+			t.Errorf("%d.String() = %q, want %q", int64(tc.in), got, tc.want)
+		}
+	}
+}
+
+func TestDecimalJSON(t *testing.T) {
+	var v struct {
+		Number Decimal `json:"number"`
+		Quoted Decimal `json:"quoted"`
+	}
+	if err := json.Unmarshal([]byte(`{"number": 0.1, "quoted": "-2.30000000"}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Number != MustParseDecimal("0.1") || v.Quoted != MustParseDecimal("-2.3") {
+		t.Fatalf("decoded %v and %v, want 0.1 and -2.3", v.Number, v.Quoted)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"number":0.1,"quoted":-2.3}` {
+		t.Fatalf("encoded %s", data)
+	}
+	if err := json.Unmarshal([]byte(`{"number": 1e-9}`), &v); err == nil {
+		t.Fatal("decoded a number with too many places")
+	}
+}
+
+func TestWeightedAverage(t *testing.T) {
+	// 1 at 100 and 2 at 101 average 100.66666666, truncated
+	avg := weightedAverage(0, 0, DecimalFromInt(100), DecimalFromInt(1))
+	avg = weightedAverage(avg, DecimalFromInt(1), DecimalFromInt(101), DecimalFromInt(2))
+	if want := MustParseDecimal("100.66666666"); avg != want {
+		t.Fatalf("average = %v, want %v", avg, want)
+	}
+
+	// Notionals beyond int64 do not overflow
+	large := DecimalFromInt(40_000_000_000)
+	if got := weightedAverage(large, large, large, large); got != large {
+		t.Fatalf("average of equal large fills = %v, want %v", got, large)
+	}
+}
@@ -0,0 +1,68 @@
+package trading
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrOffTick = errors.New("price is not a multiple of the tick size")
+	ErrOffLot  = errors.New("quantity is not a multiple of the lot size")
+)
+
+var (
+	// DefaultTickSize is the price increment of instruments that do not set one.
+	DefaultTickSize = MustParseDecimal("0.01")
+	// DefaultLotSize is the quantity increment of instruments that do not set one.
+	DefaultLotSize = MustParseDecimal("0.00000001")
+)
+
+// Instrument describes the price and quantity grid of a tradable symbol.
+type Instrument struct {
+	Symbol   string  `json:"symbol"`
+	TickSize Decimal `json:"tick_size"`
+	LotSize  Decimal `json:"lot_size"`
+}
+
+// DefaultInstrument returns an instrument using the default tick and lot size.
+func DefaultInstrument(symbol string) Instrument {
+	return Instrument{Symbol: symbol, TickSize: DefaultTickSize, LotSize: DefaultLotSize}
+}
+
+// ParseInstrument parses an instrument spec of the form SYMBOL[:TICK[:LOT]],
+// e.g. "BTC-USD:0.5:0.001". Missing sizes use the defaults.
+func ParseInstrument(spec string) (Instrument, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) > 3 || parts[0] == "" {
+		return Instrument{}, errors.New("invalid instrument spec: " + spec)
+	}
+
+	instrument := DefaultInstrument(parts[0])
+	if len(parts) > 1 {
+		tick, err := ParseDecimal(parts[1])
+		if err != nil || tick <= 0 {
+			return Instrument{}, errors.New("invalid tick size in instrument spec: " + spec)
+		}
+		instrument.TickSize = tick
+	}
+	if len(parts) > 2 {
+		lot, err := ParseDecimal(parts[2])
+		if err != nil || lot <= 0 {
+			return Instrument{}, errors.New("invalid lot size in instrument spec: " + spec)
+		}
+		instrument.LotSize = lot
+	}
+	return instrument, nil
+}
+
+// Check rejects orders whose prices are off the tick grid or whose
+// quantities are off the lot grid. Unset (zero) fields are always on grid.
+func (in Instrument) Check(order *Order) error {
+	if !order.Price.IsMultipleOf(in.TickSize) || !order.StopPrice.IsMultipleOf(in.TickSize) {
+		return ErrOffTick
+	}
+	if !order.Quantity.IsMultipleOf(in.LotSize) || !order.DisplayQuantity.IsMultipleOf(in.LotSize) {
+		return ErrOffLot
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package trading
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseInstrument(t *testing.T) {
+	in, err := ParseInstrument("BTC-USD:0.5:0.001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Symbol != "BTC-USD" || in.TickSize != MustParseDecimal("0.5") || in.LotSize != MustParseDecimal("0.001") {
+		t.Fatalf("parsed %+v", in)
+	}
+	if in, err := ParseInstrument("ETH"); err != nil || in != DefaultInstrument("ETH") {
+		t.Fatalf("parsed %+v, %v, want the defaults", in, err)
+	}
+	for _, spec := range []string{"", ":1", "X:0", "X:-1", "X:1:0", "X:a", "X:1:2:3"} {
+		if _, err := ParseInstrument(spec); err == nil {
+			t.Errorf("parsed %q", spec)
+		}
+	}
+}
+
+func TestTickAndLotSize(t *testing.T) {
+	instrument := Instrument{Symbol: "TEST", TickSize: MustParseDecimal("0.5"), LotSize: MustParseDecimal("0.1")}
+	for _, tc := range []struct {
+		price, stop, quantity, display string
+		want                           error
+	}{
+		{"100.5", "0", "1.2", "0", nil},
+		{"100.25", "0", "1", "0", ErrOffTick},
+		{"100", "99.1", "1", "0", ErrOffTick},
+		{"100", "0", "1.25", "0", ErrOffLot},
+		{"100", "0", "1", "0.05", ErrOffLot},
+	} {
+		order := NewOrder("o", "TEST", Buy, MustParseDecimal(tc.price), MustParseDecimal(tc.quantity))
+		order.StopPrice, order.DisplayQuantity = MustParseDecimal(tc.stop), MustParseDecimal(tc.display)
+		if err := instrument.Check(order); err != tc.want {
+			t.Errorf("%+v: %v, want %v", tc, err, tc.want)
+		}
+	}
+
+	// The book rejects off-grid orders and reports them
+	book := NewOrderBook(instrument)
+	var reports []ExecutionReport
+	book.OnReport(func(r ExecutionReport) { reports = append(reports, r) })
+	if err := book.AddOrder(NewOrder("off", "TEST", Sell, MustParseDecimal("100.1"), DecimalFromInt(1))); !errors.Is(err, ErrOffTick) {
+		t.Fatalf("off-tick order: %v, want ErrOffTick", err)
+	}
+	if len(reports) != 1 || reports[0].ExecType != ExecRejected || reports[0].Reason != ErrOffTick.Error() {
+		t.Fatalf("reports = %+v, want one rejection giving the reason", reports)
+	}
+	if res, _ := book.AmendOrder("off", Amendment{Quantity: DecimalFromInt(2)}); res != AmendCanceled {
+		t.Fatalf("amend of a rejected order = %v, want %v", res, AmendCanceled)
+	}
+}
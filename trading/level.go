@@ -0,0 +1,145 @@
+package trading
+
+import (
+	"container/heap"
+	"container/list"
+)
+
+// priceLevel holds every resting order at a single price in arrival order,
+// so the front of the queue always has time priority.
+type priceLevel struct {
+	price  Decimal
+	orders *list.List
+	index  int // position inside the owning levelHeap
+}
+
+// levelHeap is a heap of price levels ordered by the side's notion of a
+// better price (higher for bids, lower for asks).
+type levelHeap struct {
+	levels []*priceLevel
+	better func(a, b Decimal) bool
+}
+
+func (h *levelHeap) Len() int           { return len(h.levels) }
+func (h *levelHeap) Less(i, j int) bool { return h.better(h.levels[i].price, h.levels[j].price) }
+
+func (h *levelHeap) Swap(i, j int) {
+	h.levels[i], h.levels[j] = h.levels[j], h.levels[i]
+	h.levels[i].index = i
+	h.levels[j].index = j
+}
+
+func (h *levelHeap) Push(x any) {
+	level := x.(*priceLevel)
+	level.index = len(h.levels)
+	h.levels = append(h.levels, level)
+}
+
+func (h *levelHeap) Pop() any {
+	n := len(h.levels)
+	level := h.levels[n-1]
+	h.levels[n-1] = nil
+	h.levels = h.levels[:n-1]
+	level.index = -1
+	return level
+}
+
+// bookSide is one side of the order book. Levels are looked up by price in
+// O(1) and kept in a heap so the best level is found in O(1) and a new level
+// is inserted or an empty one removed in O(log n).
+type bookSide struct {
+	levels  levelHeap
+	byPrice map[Decimal]*priceLevel
+}
+
+func newBookSide(better func(a, b Decimal) bool) *bookSide {
+	return &bookSide{
+		levels:  levelHeap{better: better},
+		byPrice: make(map[Decimal]*priceLevel),
+	}
+}
+
+// insert queues the order at its price behind every order with an earlier or
+// equal Timestamp. Orders normally arrive in time order, so the scan from the
+// back stops immediately and the insert is O(1) within the level.
+func (s *bookSide) insert(order *Order) *list.Element {
+	level, ok := s.byPrice[order.Price]
+	if !ok {
+		level = &priceLevel{price: order.Price, orders: list.New()}
+		s.byPrice[order.Price] = level
+		heap.Push(&s.levels, level)
+	}
+	for e := level.orders.Back(); e != nil; e = e.Prev() {
+		if !order.Timestamp.Before(e.Value.(*Order).Timestamp) {
+			return level.orders.InsertAfter(order, e)
+		}
+	}
+	return level.orders.PushFront(order)
+}
+
+// best returns the level with the best price, or nil if the side is empty.
+func (s *bookSide) best() *priceLevel {
+	if len(s.levels.levels) == 0 {
+		return nil
+	}
+	return s.levels.levels[0]
+}
+
+// remove takes an order out of its level and drops the level once it is empty.
+func (s *bookSide) remove(level *priceLevel, elem *list.Element) {
+	level.orders.Remove(elem)
+	if level.orders.Len() == 0 {
+		heap.Remove(&s.levels, level.index)
+		delete(s.byPrice, level.price)
+	}
+}
+
+// len returns the number of price levels on this side.
+func (s *bookSide) len() int {
+	return len(s.levels.levels)
+}
+
+// ascend calls fn for each level from best to worst price until fn returns
+// false. It walks the heap with a frontier of candidate positions, so visiting
+// the k best levels costs O(k log k) and leaves the heap untouched.
+func (s *bookSide) ascend(fn func(level *priceLevel) bool) {
+	if s.len() == 0 {
+		return
+	}
+	frontier := &positionHeap{levels: s.levels.levels, better: s.levels.better}
+	heap.Push(frontier, 0)
+	for frontier.Len() > 0 {
+		i := heap.Pop(frontier).(int)
+		if !fn(s.levels.levels[i]) {
+			return
+		}
+		for _, child := range []int{2*i + 1, 2*i + 2} {
+			if child < s.len() {
+				heap.Push(frontier, child)
+			}
+		}
+	}
+}
+
+// positionHeap orders positions of a levelHeap by the price stored there.
+type positionHeap struct {
+	positions []int
+	levels    []*priceLevel
+	better    func(a, b Decimal) bool
+}
+
+func (h *positionHeap) Len() int { return len(h.positions) }
+func (h *positionHeap) Less(i, j int) bool {
+	return h.better(h.levels[h.positions[i]].price, h.levels[h.positions[j]].price)
+}
+func (h *positionHeap) Swap(i, j int) {
+	h.positions[i], h.positions[j] = h.positions[j], h.positions[i]
+}
+func (h *positionHeap) Push(x any) { h.positions = append(h.positions, x.(int)) }
+
+func (h *positionHeap) Pop() any {
+	n := len(h.positions)
+	i := h.positions[n-1]
+	h.positions = h.positions[:n-1]
+	return i
+}
@@ -1,6 +1,9 @@
 package trading
 
-import "time"
+import (
+	"errors"
+	"time"
+)
 
 type OrderType string
 
@@ -9,20 +12,240 @@ const (
 	Sell OrderType = "SELL"
 )
 
+// OrderKind says how an order is priced.
+type OrderKind string
+
+const (
+	Limit     OrderKind = "LIMIT"      // trades at Price or better
+	Market    OrderKind = "MARKET"     // trades at any price against the opposite side
+	Stop      OrderKind = "STOP"       // becomes a market order once StopPrice trades
+	StopLimit OrderKind = "STOP_LIMIT" // becomes a limit order at Price once StopPrice trades
+)
+
+// TimeInForce says how long an order stays eligible to trade.
+type TimeInForce string
+
+const (
+	GTC TimeInForce = "GTC" // rests until filled or canceled
+	IOC TimeInForce = "IOC" // trades what it can immediately, the rest is dropped
+	FOK TimeInForce = "FOK" // fills completely on arrival or not at all
+	DAY TimeInForce = "DAY" // rests until filled, canceled or the trading day ends
+)
+
+// PostOnlyMode says what happens to a post-only order that would take
+// liquidity on arrival.
+type PostOnlyMode string
+
+const (
+	PostOnlyReject  PostOnlyMode = "REJECT"  // the order is rejected
+	PostOnlyReprice PostOnlyMode = "REPRICE" // the order rests one tick away from the opposite best price
+)
+
+// SelfTradePrevention says what happens when an incoming order would trade
+// against a resting order of the same owner.
+type SelfTradePrevention string
+
+const (
+	CancelNewest SelfTradePrevention = "CANCEL_NEWEST" // cancel the incoming order
+	CancelOldest SelfTradePrevention = "CANCEL_OLDEST" // cancel the resting order and keep matching
+	CancelBoth   SelfTradePrevention = "CANCEL_BOTH"   // cancel both orders
+	Decrement    SelfTradePrevention = "DECREMENT"     // reduce both by the smaller size without trading
+)
+
+// OrderStatus is where an order is in its lifecycle. NEW and
+// PARTIALLY_FILLED orders are open; the others are terminal.
+type OrderStatus string
+
+const (
+	StatusNew             OrderStatus = "NEW"
+	StatusPartiallyFilled OrderStatus = "PARTIALLY_FILLED"
+	StatusFilled          OrderStatus = "FILLED"
+	StatusCanceled        OrderStatus = "CANCELED"
+	StatusRejected        OrderStatus = "REJECTED"
+	StatusExpired         OrderStatus = "EXPIRED"
+)
+
+// Terminal reports whether no further transition can happen.
+func (s OrderStatus) Terminal() bool {
+	return s == StatusFilled || s == StatusCanceled || s == StatusRejected || s == StatusExpired
+}
+
+var (
+	ErrInvalidOrder   = errors.New("invalid order")
+	ErrDuplicateOrder = errors.New("duplicate order ID")
+)
+
 type Order struct {
-	ID        string
-	Type      OrderType
-	Price     float64
-	Quantity  float64
-	Timestamp time.Time
+	ID          string      `json:"id"`
+	Symbol      string      `json:"symbol"`
+	Type        OrderType   `json:"type"`
+	Kind        OrderKind   `json:"kind"`
+	TimeInForce TimeInForce `json:"time_in_force"`
+	Price       Decimal     `json:"price"`
+	StopPrice   Decimal     `json:"stop_price,omitempty"` // trigger for STOP and STOP_LIMIT orders
+	// Quantity is the leaves quantity: what is still open. It shrinks with
+	// every fill, while OrigQuantity and CumQuantity track the order's size
+	// and how much of it has traded at AvgPrice.
+	Quantity     Decimal     `json:"leaves_quantity"`
+	OrigQuantity Decimal     `json:"orig_quantity"`
+	CumQuantity  Decimal     `json:"cum_quantity"`
+	AvgPrice     Decimal     `json:"avg_price"`
+	Status       OrderStatus `json:"status"`
+	// DisplayQuantity makes a resting order an iceberg: only this much is
+	// shown and tradable at a time, the rest is a hidden reserve.
+	DisplayQuantity Decimal `json:"display_quantity,omitempty"`
+	// Owner identifies the account that placed the order. Orders of the same
+	// owner never trade with each other; SelfTrade picks what happens instead.
+	Owner     string              `json:"owner,omitempty"`
+	SelfTrade SelfTradePrevention `json:"self_trade,omitempty"`
+	PostOnly  PostOnlyMode        `json:"post_only,omitempty"`
+	Timestamp time.Time           `json:"timestamp"`
+
+	visible Decimal // shown slice of a resting iceberg order
 }
 
-func NewOrder(id string, orderType OrderType, price, quantity float64) *Order {
+// NewOrder creates a good-till-canceled limit order.
+func NewOrder(id, symbol string, orderType OrderType, price, quantity Decimal) *Order {
 	return &Order{
-		ID:        id,
-		Type:      orderType,
-		Price:     price,
-		Quantity:  quantity,
-		Timestamp: time.Now(),
+		ID:          id,
+		Symbol:      symbol,
+		Type:        orderType,
+		Kind:        Limit,
+		TimeInForce: GTC,
+		Price:       price,
+		Quantity:    quantity,
+		Timestamp:   time.Now(),
+	}
+}
+
+// Validate fills in defaults for an empty Kind or TimeInForce and checks that
+// the combination makes sense. Market and stop orders default to IOC and can
+// never rest in the book once they trade.
+func (o *Order) Validate() error {
+	if o.Kind == "" {
+		o.Kind = Limit
+	}
+	if o.TimeInForce == "" {
+		o.TimeInForce = GTC
+		if o.Kind == Market || o.Kind == Stop {
+			o.TimeInForce = IOC
+		}
+	}
+
+	switch {
+	case o.Type != Buy && o.Type != Sell:
+		return ErrInvalidOrder
+	case o.Quantity <= 0 || o.DisplayQuantity < 0:
+		return ErrInvalidOrder
+	case o.DisplayQuantity > 0 && (o.Kind == Market || o.Kind == Stop):
+		return ErrInvalidOrder
+	case o.PostOnly != "" && o.PostOnly != PostOnlyReject && o.PostOnly != PostOnlyReprice:
+		return ErrInvalidOrder
+	case o.PostOnly != "" && (o.Kind == Market || o.Kind == Stop || o.TimeInForce == IOC || o.TimeInForce == FOK):
+		return ErrInvalidOrder
+	case o.TimeInForce != GTC && o.TimeInForce != IOC && o.TimeInForce != FOK && o.TimeInForce != DAY:
+		return ErrInvalidOrder
+	}
+
+	if o.Owner != "" && o.SelfTrade == "" {
+		o.SelfTrade = CancelNewest
+	}
+	switch o.SelfTrade {
+	case "", CancelNewest, CancelOldest, CancelBoth, Decrement:
+	default:
+		return ErrInvalidOrder
+	}
+
+	switch o.Kind {
+	case Limit:
+		if o.Price <= 0 {
+			return ErrInvalidOrder
+		}
+	case Market:
+		if o.TimeInForce != IOC && o.TimeInForce != FOK {
+			return ErrInvalidOrder
+		}
+	case Stop:
+		if o.StopPrice <= 0 || (o.TimeInForce != IOC && o.TimeInForce != FOK) {
+			return ErrInvalidOrder
+		}
+	case StopLimit:
+		if o.StopPrice <= 0 || o.Price <= 0 {
+			return ErrInvalidOrder
+		}
+	default:
+		return ErrInvalidOrder
+	}
+	return nil
+}
+
+// fill records an execution of quantity at price.
+func (o *Order) fill(price, quantity Decimal) {
+	o.AvgPrice = weightedAverage(o.AvgPrice, o.CumQuantity, price, quantity)
+	o.CumQuantity += quantity
+	o.Quantity -= quantity
+	if o.Quantity == 0 {
+		o.Status = StatusFilled
+	} else {
+		o.Status = StatusPartiallyFilled
+	}
+}
+
+// isStop reports whether the order waits for a trigger before it can trade.
+func (o *Order) isStop() bool {
+	return o.Kind == Stop || o.Kind == StopLimit
+}
+
+// triggered reports whether a trade at lastPrice fires this stop order.
+func (o *Order) triggered(lastPrice Decimal) bool {
+	if o.Type == Buy {
+		return lastPrice >= o.StopPrice
+	}
+	return lastPrice <= o.StopPrice
+}
+
+// activate turns a triggered stop order into the order it stands for.
+func (o *Order) activate(at time.Time) {
+	if o.Kind == Stop {
+		o.Kind = Market
+	} else {
+		o.Kind = Limit
+	}
+	o.Timestamp = at
+}
+
+// selfTrade reports whether the order would trade against its own owner.
+func (o *Order) selfTrade(resting *Order) bool {
+	return o.Owner != "" && o.Owner == resting.Owner
+}
+
+// displayed returns the quantity of a resting order that is visible and can
+// trade before an iceberg has to be replenished.
+func (o *Order) displayed() Decimal {
+	if o.DisplayQuantity > 0 {
+		return o.visible
+	}
+	return o.Quantity
+}
+
+// replenish shows the next slice of an iceberg order from its reserve.
+func (o *Order) replenish() {
+	o.visible = min(o.DisplayQuantity, o.Quantity)
+}
+
+// rests reports whether an unfilled remainder of the order joins the book.
+func (o *Order) rests() bool {
+	return o.Kind == Limit && (o.TimeInForce == GTC || o.TimeInForce == DAY)
+}
+
+// crosses reports whether the order is willing to trade at price.
+func (o *Order) crosses(price Decimal) bool {
+	switch {
+	case o.Kind == Market:
+		return true
+	case o.Type == Buy:
+		return o.Price >= price
+	default:
+		return o.Price <= price
 	}
 }
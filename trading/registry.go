@@ -0,0 +1,193 @@
+package trading
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrUnknownSymbol = errors.New("unknown symbol")
+
+// BookRegistry owns one OrderBook per instrument. When it is created with a
+// fixed list of instruments only those can be traded; otherwise a book with
+// the default tick and lot size is created the first time a symbol is seen.
+type BookRegistry struct {
+	books    map[string]*OrderBook
+	fixed    bool
+	handlers []ReportHandler
+	mutex    sync.RWMutex
+}
+
+func NewBookRegistry(instruments []Instrument) *BookRegistry {
+	r := &BookRegistry{
+		books: make(map[string]*OrderBook),
+		fixed: len(instruments) > 0,
+	}
+	for _, instrument := range instruments {
+		r.books[instrument.Symbol] = NewOrderBook(instrument)
+	}
+	return r
+}
+
+// Book returns the order book for symbol, creating it on demand unless the
+// registry was configured with a fixed set of instruments.
+func (r *BookRegistry) Book(symbol string) (*OrderBook, error) {
+	if symbol == "" {
+		return nil, ErrUnknownSymbol
+	}
+
+	r.mutex.RLock()
+	book, ok := r.books[symbol]
+	r.mutex.RUnlock()
+	if ok {
+		return book, nil
+	}
+	if r.fixed {
+		return nil, ErrUnknownSymbol
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if book, ok := r.books[symbol]; ok {
+		return book, nil
+	}
+	book = NewOrderBook(DefaultInstrument(symbol))
+	for _, handler := range r.handlers {
+		book.OnReport(handler)
+	}
+	r.books[symbol] = book
+	return book, nil
+}
+
+// Lookup returns the order book for symbol if it has one, without creating
+// it, for callers that only read.
+func (r *BookRegistry) Lookup(symbol string) (*OrderBook, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	book, ok := r.books[symbol]
+	if !ok {
+		return nil, ErrUnknownSymbol
+	}
+	return book, nil
+}
+
+// Instrument returns the instrument Book would trade symbol as, without
+// creating a book for it.
+func (r *BookRegistry) Instrument(symbol string) (Instrument, error) {
+	if symbol == "" {
+		return Instrument{}, ErrUnknownSymbol
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if book, ok := r.books[symbol]; ok {
+		return book.Instrument(), nil
+	}
+	if r.fixed {
+		return Instrument{}, ErrUnknownSymbol
+	}
+	return DefaultInstrument(symbol), nil
+}
+
+// OnReport registers a handler for the execution reports of every book,
+// including books created later.
+func (r *BookRegistry) OnReport(handler ReportHandler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.handlers = append(r.handlers, handler)
+	for _, book := range r.books {
+		book.OnReport(handler)
+	}
+}
+
+// Symbols returns the instruments that currently have a book, sorted.
+func (r *BookRegistry) Symbols() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.symbols()
+}
+
+// symbols returns the instruments that have a book, sorted. The caller must
+// hold the mutex.
+func (r *BookRegistry) symbols() []string {
+	symbols := make([]string, 0, len(r.books))
+	for symbol := range r.books {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+// AddOrder queues an order in the book for its symbol, like
+// OrderBook.AddOrder. An order ID is unique across books as long as any book
+// knows it, so cancels and amends, which name only the ID, find one book at
+// most and every replica picks the same one.
+func (r *BookRegistry) AddOrder(order *Order) error {
+	book, err := r.Book(order.Symbol)
+	if err != nil {
+		return err
+	}
+
+	// Held exclusively so no other book takes the ID meanwhile
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, other := range r.books {
+		if other != book && other.has(order.ID) {
+			return ErrDuplicateOrder
+		}
+	}
+	return book.AddOrder(order)
+}
+
+// CancelOrder cancels the order with the given ID in the book that knows it.
+func (r *BookRegistry) CancelOrder(id string, at time.Time) CancelResult {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	book := r.owner(id)
+	if book == nil {
+		return UnknownOrder
+	}
+	return book.CancelOrder(id, at)
+}
+
+// AmendOrder amends the order with the given ID in the book that knows it.
+func (r *BookRegistry) AmendOrder(id string, amend Amendment) (AmendResult, []Trade) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	book := r.owner(id)
+	if book == nil {
+		return AmendUnknown, nil
+	}
+	return book.AmendOrder(id, amend)
+}
+
+// owner returns the book that knows the order with the given ID, or nil.
+// Only that book is handed the request, so the others' clocks stay where
+// their own orders left them. The caller must hold the mutex.
+func (r *BookRegistry) owner(id string) *OrderBook {
+	for _, book := range r.books {
+		if book.has(id) {
+			return book
+		}
+	}
+	return nil
+}
+
+// ExpireDayOrders expires DAY orders placed before cutoff in every book.
+func (r *BookRegistry) ExpireDayOrders(cutoff time.Time) []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var expired []string
+	for _, book := range r.books {
+		expired = append(expired, book.ExpireDayOrders(cutoff)...)
+	}
+	return expired
+}
@@ -0,0 +1,83 @@
+package trading
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOrderIDsAreUniqueAcrossBooks(t *testing.T) {
+	r := NewBookRegistry(nil)
+	first := NewOrder("o1", "AAA", Buy, DecimalFromInt(10), DecimalFromInt(1))
+	if err := r.AddOrder(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddOrder(NewOrder("o1", "BBB", Sell, DecimalFromInt(10), DecimalFromInt(1))); !errors.Is(err, ErrDuplicateOrder) {
+		t.Fatalf("same ID in another book: %v, want ErrDuplicateOrder", err)
+	}
+	if err := r.AddOrder(NewOrder("o1", "AAA", Sell, DecimalFromInt(10), DecimalFromInt(1))); !errors.Is(err, ErrDuplicateOrder) {
+		t.Fatalf("same ID in the same book: %v, want ErrDuplicateOrder", err)
+	}
+	book, _ := r.Book("AAA")
+	book.MatchOrders()
+
+	// The ID still names the first order once it has left the book
+	if got := r.CancelOrder("o1", first.Timestamp); got != Canceled {
+		t.Fatalf("cancel = %v, want %v", got, Canceled)
+	}
+	if err := r.AddOrder(NewOrder("o1", "BBB", Sell, DecimalFromInt(10), DecimalFromInt(1))); !errors.Is(err, ErrDuplicateOrder) {
+		t.Fatalf("ID of a canceled order in another book: %v, want ErrDuplicateOrder", err)
+	}
+	if bid, ok := book.BestBid(); ok {
+		t.Fatalf("AAA still bids %v", bid)
+	}
+}
+
+func TestLookupDoesNotCreateBooks(t *testing.T) {
+	r := NewBookRegistry(nil)
+	if _, err := r.Lookup("AAA"); !errors.Is(err, ErrUnknownSymbol) {
+		t.Fatalf("lookup of a new symbol: %v, want ErrUnknownSymbol", err)
+	}
+	if in, err := r.Instrument("AAA"); err != nil || in != DefaultInstrument("AAA") {
+		t.Fatalf("instrument = %+v, %v, want the default", in, err)
+	}
+	if symbols := r.Symbols(); len(symbols) != 0 {
+		t.Fatalf("reads created books %v", symbols)
+	}
+
+	fixed := NewBookRegistry([]Instrument{{Symbol: "BBB", TickSize: DecimalFromInt(1), LotSize: DecimalFromInt(1)}})
+	if _, err := fixed.Instrument("AAA"); !errors.Is(err, ErrUnknownSymbol) {
+		t.Fatalf("instrument outside a fixed set: %v, want ErrUnknownSymbol", err)
+	}
+	if book, err := fixed.Lookup("BBB"); err != nil || book.Symbol() != "BBB" {
+		t.Fatalf("lookup = %v, %v", book, err)
+	}
+}
+
+func TestCancelAndAmendTouchOnlyTheOwningBook(t *testing.T) {
+	r := NewBookRegistry(nil)
+	mine := NewOrder("o1", "AAA", Buy, DecimalFromInt(10), DecimalFromInt(2))
+	if err := r.AddOrder(mine); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddOrder(NewOrder("o2", "BBB", Buy, DecimalFromInt(10), DecimalFromInt(1))); err != nil {
+		t.Fatal(err)
+	}
+	for _, symbol := range r.Symbols() {
+		book, _ := r.Book(symbol)
+		book.MatchOrders()
+	}
+	other, _ := r.Book("BBB")
+	before := other.State().Now
+
+	later := mine.Timestamp.Add(time.Hour)
+	if got, _ := r.AmendOrder("o1", Amendment{Quantity: DecimalFromInt(1), Timestamp: later}); got != Amended {
+		t.Fatalf("amend = %v, want %v", got, Amended)
+	}
+	if got := r.CancelOrder("o1", later); got != Canceled {
+		t.Fatalf("cancel = %v, want %v", got, Canceled)
+	}
+	if now := other.State().Now; !now.Equal(before) {
+		t.Fatalf("BBB clock moved to %v, want %v", now, before)
+	}
+}
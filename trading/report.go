@@ -0,0 +1,98 @@
+package trading
+
+import "time"
+
+// ExecType says which transition an execution report describes.
+type ExecType string
+
+const (
+	ExecNew       ExecType = "NEW"       // accepted by the book
+	ExecTrade     ExecType = "TRADE"     // (partially) filled
+	ExecCanceled  ExecType = "CANCELED"  // canceled by the owner, or an unfilled IOC/FOK/market remainder
+	ExecReplaced  ExecType = "REPLACED"  // amended, or a post-only order repriced
+	ExecRestated  ExecType = "RESTATED"  // size reduced by self-trade prevention
+	ExecTriggered ExecType = "TRIGGERED" // stop order released into the book
+	ExecRejected  ExecType = "REJECTED"
+	ExecExpired   ExecType = "EXPIRED"
+)
+
+// ExecutionReport describes one lifecycle transition of an order. The book
+// emits one for every transition, so consumers can rebuild the full state of
+// an order from its reports alone.
+type ExecutionReport struct {
+	Seq            uint64      `json:"seq"` // per-book sequence number
+	OrderID        string      `json:"order_id"`
+	Symbol         string      `json:"symbol"`
+	Owner          string      `json:"owner,omitempty"`
+	Type           OrderType   `json:"type"`
+	Kind           OrderKind   `json:"kind"`
+	TimeInForce    TimeInForce `json:"time_in_force"`
+	ExecType       ExecType    `json:"exec_type"`
+	Status         OrderStatus `json:"status"`
+	Price          Decimal     `json:"price"`
+	StopPrice      Decimal     `json:"stop_price,omitempty"`
+	OrigQuantity   Decimal     `json:"orig_quantity"`
+	CumQuantity    Decimal     `json:"cum_quantity"`
+	LeavesQuantity Decimal     `json:"leaves_quantity"`
+	AvgPrice       Decimal     `json:"avg_price"`
+	LastPrice      Decimal     `json:"last_price,omitempty"`
+	LastQuantity   Decimal     `json:"last_quantity,omitempty"`
+	Reason         string      `json:"reason,omitempty"`
+	Timestamp      time.Time   `json:"timestamp"`
+}
+
+// ReportHandler receives execution reports. Handlers run synchronously while
+// the book is locked, in the order the transitions happened, so they must be
+// quick and must not call back into the book.
+type ReportHandler func(ExecutionReport)
+
+// OnReport registers a handler for every execution report of this book.
+func (ob *OrderBook) OnReport(handler ReportHandler) {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	ob.handlers = append(ob.handlers, handler)
+}
+
+// report emits an execution report for the order's current state. The caller
+// must hold the mutex.
+func (ob *OrderBook) report(order *Order, execType ExecType, lastPrice, lastQuantity Decimal, reason string) {
+	ob.seq++
+	leaves := order.Quantity
+	if order.Status.Terminal() {
+		leaves = 0
+	}
+
+	r := ExecutionReport{
+		Seq:            ob.seq,
+		OrderID:        order.ID,
+		Symbol:         ob.symbol,
+		Owner:          order.Owner,
+		Type:           order.Type,
+		Kind:           order.Kind,
+		TimeInForce:    order.TimeInForce,
+		ExecType:       execType,
+		Status:         order.Status,
+		Price:          order.Price,
+		StopPrice:      order.StopPrice,
+		OrigQuantity:   order.OrigQuantity,
+		CumQuantity:    order.CumQuantity,
+		LeavesQuantity: leaves,
+		AvgPrice:       order.AvgPrice,
+		LastPrice:      lastPrice,
+		LastQuantity:   lastQuantity,
+		Reason:         reason,
+		Timestamp:      ob.now,
+	}
+	for _, handler := range ob.handlers {
+		handler(r)
+	}
+}
+
+// finish moves an order into a terminal state and reports it. The caller
+// must hold the mutex.
+func (ob *OrderBook) finish(order *Order, status OrderStatus, execType ExecType, reason string) {
+	order.Status = status
+	ob.retire(order.ID, status)
+	ob.report(order, execType, 0, 0, reason)
+}
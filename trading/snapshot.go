@@ -0,0 +1,160 @@
+package trading
+
+import (
+	"container/list"
+	"time"
+)
+
+// BookState is a copy of everything an OrderBook needs to carry on after a
+// restart. Resting orders are listed bids first, then asks, each side from the
+// best price down and each level in queue order, so restoring them in this
+// order keeps their time priority.
+type BookState struct {
+	Instrument Instrument     `json:"instrument"`
+	Resting    []RestingOrder `json:"resting"`
+	Stops      []*Order       `json:"stops"`  // in arrival order
+	Closed     []ClosedOrder  `json:"closed"` // in the order they left the book
+	LastPrice  Decimal        `json:"last_price"`
+	Traded     bool           `json:"traded"`
+	Seq        uint64         `json:"seq"`
+	TradeSeq   uint64         `json:"trade_seq"`
+	Now        time.Time      `json:"now"`
+}
+
+// ClosedOrder is an order the book still remembers after it left, with its
+// terminal status and the time it left.
+type ClosedOrder struct {
+	ID     string      `json:"id"`
+	Status OrderStatus `json:"status"`
+	At     time.Time   `json:"at"`
+}
+
+// RestingOrder is a resting order together with the part of its displayed
+// slice that is still showing, which differs from DisplayQuantity once an
+// iceberg slice has partly traded.
+type RestingOrder struct {
+	*Order
+	Visible Decimal `json:"visible"`
+}
+
+// State returns a copy of the book's state. The orders in it are copies too,
+// so the state can be encoded while the book keeps trading.
+func (ob *OrderBook) State() BookState {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	state := BookState{
+		Instrument: ob.instrument,
+		Resting:    make([]RestingOrder, 0, len(ob.index)),
+		Closed:     make([]ClosedOrder, 0, len(ob.retired)),
+		LastPrice:  ob.last,
+		Traded:     ob.traded,
+		Seq:        ob.seq,
+		TradeSeq:   ob.tradeSeq,
+		Now:        ob.now,
+	}
+	for _, side := range []*bookSide{ob.bids, ob.asks} {
+		side.ascend(func(level *priceLevel) bool {
+			for e := level.orders.Front(); e != nil; e = e.Next() {
+				order := *e.Value.(*Order)
+				state.Resting = append(state.Resting, RestingOrder{Order: &order, Visible: order.visible})
+			}
+			return true
+		})
+	}
+	for _, stop := range ob.stops.orders() {
+		order := *stop
+		state.Stops = append(state.Stops, &order)
+	}
+	for _, retired := range ob.retired {
+		state.Closed = append(state.Closed, ClosedOrder{ID: retired.id, Status: ob.closed[retired.id], At: retired.at})
+	}
+	return state
+}
+
+// Restore replaces the contents of the book with state. The book keeps its
+// own instrument and report handlers, and no reports are emitted.
+func (ob *OrderBook) Restore(state BookState) {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	ob.bids = newBookSide(ob.bids.levels.better)
+	ob.asks = newBookSide(ob.asks.levels.better)
+	ob.index = make(map[string]*list.Element, len(state.Resting))
+	ob.closed = make(map[string]OrderStatus, len(state.Closed))
+	ob.retired = make([]retiredOrder, 0, len(state.Closed))
+	ob.incoming = nil
+	ob.stops = NewStopBook()
+	ob.last, ob.traded = state.LastPrice, state.Traded
+	ob.seq, ob.tradeSeq, ob.now = state.Seq, state.TradeSeq, state.Now
+
+	for _, resting := range state.Resting {
+		order := *resting.Order
+		order.visible = resting.Visible
+		ob.index[order.ID] = ob.side(order.Type).insert(&order)
+	}
+	for _, stop := range state.Stops {
+		order := *stop
+		ob.stops.Add(&order)
+	}
+	for _, closed := range state.Closed {
+		ob.closed[closed.ID] = closed.Status
+		ob.retired = append(ob.retired, retiredOrder{id: closed.ID, at: closed.At})
+	}
+}
+
+// State returns the state of every book, sorted by symbol.
+func (r *BookRegistry) State() []BookState {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	// The symbols are read under the same lock, so a Restore cannot drop a
+	// book between listing it and saving it
+	symbols := r.symbols()
+	states := make([]BookState, len(symbols))
+	for i, symbol := range symbols {
+		states[i] = r.books[symbol].State()
+	}
+	return states
+}
+
+// Restore replaces every book with the saved states, creating books for
+// symbols that do not have one yet. Books with no state are removed, or
+// emptied if the registry has a fixed set of instruments, which refuses
+// states for any other symbol.
+func (r *BookRegistry) Restore(states []BookState) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	restored := make(map[string]bool, len(states))
+	for _, state := range states {
+		if r.fixed {
+			if _, ok := r.books[state.Instrument.Symbol]; !ok {
+				return ErrUnknownSymbol
+			}
+		}
+		restored[state.Instrument.Symbol] = true
+	}
+	for symbol, book := range r.books {
+		switch {
+		case restored[symbol]:
+		case r.fixed:
+			book.Restore(BookState{Instrument: book.instrument})
+		default:
+			delete(r.books, symbol)
+		}
+	}
+
+	for _, state := range states {
+		book, ok := r.books[state.Instrument.Symbol]
+		if !ok {
+			book = NewOrderBook(state.Instrument)
+			for _, handler := range r.handlers {
+				book.OnReport(handler)
+			}
+			r.books[state.Instrument.Symbol] = book
+		}
+		book.Restore(state)
+	}
+	return nil
+}
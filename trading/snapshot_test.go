@@ -0,0 +1,154 @@
+package trading
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBookStateRoundTrip(t *testing.T) {
+	b := newTestBook(t)
+	b.place(limit("b1", Buy, 98, 5))
+	b.place(limit("b2", Buy, 99, 3))
+	b.place(limit("b3", Buy, 99, 4))
+	b.place(iceberg("s1", Sell, 101, 20, 5))
+	b.place(limit("s2", Sell, 101, 2))
+	b.place(limit("s3", Sell, 103, 7))
+	b.place(limit("x", Buy, 101, 3)) // leaves s1 with 2 of its slice showing
+	b.place(stop("st", Buy, 102, 4))
+	b.place(limit("c", Sell, 110, 1))
+	b.CancelOrder("c", b.tick())
+
+	data, err := json.Marshal(b.State())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state BookState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestBook(t)
+	restored.Restore(state)
+	restored.now = b.now
+
+	again, err := json.Marshal(restored.State())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(data) {
+		t.Fatalf("restored state\n%s\nwant\n%s", again, data)
+	}
+	if want := []ClosedOrder{{ID: "x", Status: StatusFilled, At: b.now.Add(-3 * time.Second)}, {ID: "c", Status: StatusCanceled, At: b.now}}; !reflect.DeepEqual(state.Closed, want) {
+		t.Fatalf("closed orders %+v, want %+v", state.Closed, want)
+	}
+
+	// Both books carry on the same way
+	for _, book := range []*testBook{b, restored} {
+		if err := book.AddOrder(&Order{ID: "x", Symbol: "TEST", Type: Buy, Price: DecimalFromInt(90), Quantity: DecimalFromInt(1), Timestamp: book.tick()}); !errors.Is(err, ErrDuplicateOrder) {
+			t.Fatalf("reusing a closed order's ID gave %v, want ErrDuplicateOrder", err)
+		}
+	}
+	sweep := func(book *testBook) []string {
+		return describe(book.place(limit("sweep", Buy, 103, 30)))
+	}
+	if got, want := sweep(restored), sweep(b); !reflect.DeepEqual(got, want) {
+		t.Fatalf("restored book traded %v, want %v", got, want)
+	}
+	if got, want := restored.triggered(), b.triggered(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("restored book triggered %v, want %v", got, want)
+	}
+	if restored.last != b.last || restored.seq != b.seq || restored.tradeSeq != b.tradeSeq {
+		t.Fatalf("restored book last traded at %v, report %d, trade %d; want %v, %d, %d",
+			restored.last, restored.seq, restored.tradeSeq, b.last, b.seq, b.tradeSeq)
+	}
+}
+
+func TestClosedOrdersAreForgotten(t *testing.T) {
+	b := newTestBook(t)
+	b.place(limit("old", Sell, 100, 1))
+	b.CancelOrder("old", b.tick())
+	b.place(limit("s", Sell, 100, 1))
+	b.place(limit("b", Buy, 100, 1))
+
+	// Within the retention the IDs are remembered
+	b.now = b.now.Add(closedRetention - 10*time.Second)
+	if got := b.CancelOrder("old", b.tick()); got != AlreadyCanceled {
+		t.Fatalf("cancel within the retention = %v, want %v", got, AlreadyCanceled)
+	}
+	if got, _ := b.AmendOrder("s", Amendment{Quantity: DecimalFromInt(2), Timestamp: b.tick()}); got != AmendFilled {
+		t.Fatalf("amend within the retention = %v, want %v", got, AmendFilled)
+	}
+
+	// The next order to leave the book makes it forget those that left long
+	// enough before, but not the ones that left since
+	b.place(limit("later", Sell, 120, 1))
+	b.CancelOrder("later", b.tick())
+	b.now = b.now.Add(10 * time.Second)
+	b.place(limit("new", Sell, 120, 1))
+	b.CancelOrder("new", b.tick())
+	if got := b.CancelOrder("old", b.tick()); got != UnknownOrder {
+		t.Fatalf("cancel after the retention = %v, want %v", got, UnknownOrder)
+	}
+	if got := b.CancelOrder("later", b.tick()); got != AlreadyCanceled {
+		t.Fatalf("cancel of a recent order = %v, want %v", got, AlreadyCanceled)
+	}
+	var ids []string
+	for _, closed := range b.State().Closed {
+		ids = append(ids, closed.ID)
+	}
+	if !reflect.DeepEqual(ids, []string{"later", "new"}) {
+		t.Fatalf("book remembers %v, want [later new]", ids)
+	}
+	b.place(limit("old", Buy, 90, 1))
+	if status := b.status("old"); status != StatusNew {
+		t.Fatalf("reused ID has status %v, want %v", status, StatusNew)
+	}
+}
+
+func TestRegistryRestoreReplacesEveryBook(t *testing.T) {
+	source := NewBookRegistry(nil)
+	if err := source.AddOrder(NewOrder("a1", "AAA", Buy, DecimalFromInt(10), DecimalFromInt(1))); err != nil {
+		t.Fatal(err)
+	}
+	aaa, _ := source.Lookup("AAA")
+	aaa.MatchOrders()
+	state := source.State()
+
+	r := NewBookRegistry(nil)
+	for _, order := range []*Order{
+		NewOrder("a0", "AAA", Sell, DecimalFromInt(20), DecimalFromInt(1)),
+		NewOrder("b0", "BBB", Sell, DecimalFromInt(20), DecimalFromInt(1)),
+	} {
+		if err := r.AddOrder(order); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Restore(state); err != nil {
+		t.Fatal(err)
+	}
+	if symbols := r.Symbols(); !reflect.DeepEqual(symbols, []string{"AAA"}) {
+		t.Fatalf("books %v after restoring, want only the restored one", symbols)
+	}
+	if _, err := r.Lookup("BBB"); !errors.Is(err, ErrUnknownSymbol) {
+		t.Fatalf("lookup of a book missing from the snapshot: %v", err)
+	}
+
+	// A fixed registry keeps its books but empties those with no state
+	fixed := NewBookRegistry([]Instrument{DefaultInstrument("AAA"), DefaultInstrument("BBB")})
+	if err := fixed.AddOrder(NewOrder("b0", "BBB", Sell, DecimalFromInt(20), DecimalFromInt(1))); err != nil {
+		t.Fatal(err)
+	}
+	book, _ := fixed.Lookup("BBB")
+	book.MatchOrders()
+	if err := fixed.Restore(state); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := book.BestAsk(); ok || book.has("b0") {
+		t.Fatal("book missing from the snapshot still holds its orders")
+	}
+	if err := fixed.Restore([]BookState{{Instrument: DefaultInstrument("CCC")}}); !errors.Is(err, ErrUnknownSymbol) {
+		t.Fatalf("restoring an unknown symbol into a fixed registry: %v", err)
+	}
+}
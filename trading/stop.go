@@ -0,0 +1,159 @@
+package trading
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+)
+
+// stopEntry is a stop order waiting for its trigger.
+type stopEntry struct {
+	order *Order
+	seq   uint64 // arrival order, breaks ties between equal stop prices
+	index int    // position inside the owning stopHeap
+}
+
+// stopHeap keeps the stop that triggers first at the root: the lowest stop
+// price for buy stops and the highest for sell stops, earliest arrival first.
+type stopHeap struct {
+	entries []*stopEntry
+	first   func(a, b Decimal) bool
+}
+
+func (h *stopHeap) Len() int { return len(h.entries) }
+
+func (h *stopHeap) Less(i, j int) bool {
+	a, b := h.entries[i], h.entries[j]
+	if a.order.StopPrice != b.order.StopPrice {
+		return h.first(a.order.StopPrice, b.order.StopPrice)
+	}
+	return a.seq < b.seq
+}
+
+func (h *stopHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.entries[i].index = i
+	h.entries[j].index = j
+}
+
+func (h *stopHeap) Push(x any) {
+	entry := x.(*stopEntry)
+	entry.index = len(h.entries)
+	h.entries = append(h.entries, entry)
+}
+
+func (h *stopHeap) Pop() any {
+	n := len(h.entries)
+	entry := h.entries[n-1]
+	h.entries[n-1] = nil
+	h.entries = h.entries[:n-1]
+	entry.index = -1
+	return entry
+}
+
+// StopBook holds STOP and STOP_LIMIT orders until the last trade price
+// reaches their trigger: at or above StopPrice for buys, at or below it for
+// sells. Triggered orders are released one at a time so a cascade of stops
+// always fires in the same order: by stop price, then by arrival.
+type StopBook struct {
+	buys  stopHeap
+	sells stopHeap
+	index map[string]*stopEntry
+	seq   uint64
+}
+
+func NewStopBook() *StopBook {
+	return &StopBook{
+		buys:  stopHeap{first: func(a, b Decimal) bool { return a < b }},
+		sells: stopHeap{first: func(a, b Decimal) bool { return a > b }},
+		index: make(map[string]*stopEntry),
+	}
+}
+
+// Add parks a stop order until it triggers.
+func (sb *StopBook) Add(order *Order) {
+	sb.seq++
+	entry := &stopEntry{order: order, seq: sb.seq}
+	sb.index[order.ID] = entry
+	heap.Push(sb.heap(order.Type), entry)
+}
+
+// Cancel removes a waiting stop order and reports whether it was there.
+func (sb *StopBook) Cancel(id string) (*Order, bool) {
+	entry, ok := sb.index[id]
+	if !ok {
+		return nil, false
+	}
+	heap.Remove(sb.heap(entry.order.Type), entry.index)
+	delete(sb.index, id)
+	return entry.order, true
+}
+
+// Contains reports whether a stop order with this ID is waiting.
+func (sb *StopBook) Contains(id string) bool {
+	_, ok := sb.index[id]
+	return ok
+}
+
+// Len returns the number of waiting stop orders.
+func (sb *StopBook) Len() int {
+	return len(sb.index)
+}
+
+// Next removes and returns the next stop order triggered by lastPrice, or nil
+// if none is. When a buy and a sell stop are both triggered the one that
+// arrived first goes first.
+func (sb *StopBook) Next(lastPrice Decimal) *Order {
+	var buy, sell *stopEntry
+	if len(sb.buys.entries) > 0 && sb.buys.entries[0].order.StopPrice <= lastPrice {
+		buy = sb.buys.entries[0]
+	}
+	if len(sb.sells.entries) > 0 && sb.sells.entries[0].order.StopPrice >= lastPrice {
+		sell = sb.sells.entries[0]
+	}
+
+	var entry *stopEntry
+	switch {
+	case buy != nil && (sell == nil || buy.seq < sell.seq):
+		entry = heap.Pop(&sb.buys).(*stopEntry)
+	case sell != nil:
+		entry = heap.Pop(&sb.sells).(*stopEntry)
+	default:
+		return nil
+	}
+	delete(sb.index, entry.order.ID)
+	return entry.order
+}
+
+// ExpireDayOrders removes and returns DAY stop orders placed before cutoff.
+func (sb *StopBook) ExpireDayOrders(cutoff time.Time) []*Order {
+	var expired []*Order
+	for id, entry := range sb.index {
+		if entry.order.TimeInForce == DAY && entry.order.Timestamp.Before(cutoff) {
+			sb.Cancel(id)
+			expired = append(expired, entry.order)
+		}
+	}
+	return expired
+}
+
+// orders returns the waiting stop orders in arrival order.
+func (sb *StopBook) orders() []*Order {
+	entries := make([]*stopEntry, 0, len(sb.index))
+	for _, entry := range sb.index {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	orders := make([]*Order, len(entries))
+	for i, entry := range entries {
+		orders[i] = entry.order
+	}
+	return orders
+}
+
+func (sb *StopBook) heap(orderType OrderType) *stopHeap {
+	if orderType == Buy {
+		return &sb.buys
+	}
+	return &sb.sells
+}